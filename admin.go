@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// registerAdmin adds the runtime management endpoints. Rule changes apply
+// to the next query but only live in memory; edit the config file as well
+// to keep them across restarts.
+func (a *apiServer) registerAdmin() {
+	a.handle("GET /api/rules", "rules:read", a.listRules)
+	a.handle("POST /api/rules", "rules:write", a.createRule)
+	a.handle("GET /api/rules/{domain}", "rules:read", a.getRule)
+	a.handle("PUT /api/rules/{domain}", "rules:write", a.putRule)
+	a.handle("DELETE /api/rules/{domain}", "rules:write", a.deleteRule)
+	a.handle("POST /api/cache/flush", "cache", a.flushCaches)
+	a.handle("GET /api/stats", "stats", a.stats)
+	a.handle("GET /api/top", "stats", a.topQueries)
+	a.handle("GET /api/bans", "stats", a.listBans)
+	a.handle("DELETE /api/bans", "bans", a.clearBans)
+	a.handle("DELETE /api/bans/{client}", "bans", a.deleteBan)
+	a.handle("GET /api/notices", "stats", a.listNotices)
+	a.handle("GET /api/notices/{token}", "stats", a.getNotice)
+	a.handle("DELETE /api/notices/{token}", "bans", a.deleteNotice)
+	a.handle("GET /api/session", "stats", a.getSession)
+	a.handle("PUT /api/session/{name}", "session", a.putSession)
+	a.handle("DELETE /api/session", "session", a.deleteSession)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func readRule(w http.ResponseWriter, r *http.Request) (*rule, bool) {
+	var rl rule
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rl); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid rule: %v", err)
+		return nil, false
+	}
+	return &rl, true
+}
+
+func (a *apiServer) listRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.dns.rules.list())
+}
+
+func (a *apiServer) getRule(w http.ResponseWriter, r *http.Request) {
+	rl := a.dns.rules.get(r.PathValue("domain"))
+	if rl == nil {
+		writeError(w, http.StatusNotFound, "no rule for %s", r.PathValue("domain"))
+		return
+	}
+	writeJSON(w, http.StatusOK, rl)
+}
+
+func (a *apiServer) createRule(w http.ResponseWriter, r *http.Request) {
+	rl, ok := readRule(w, r)
+	if !ok {
+		return
+	}
+	if a.dns.rules.get(rl.Domain) != nil {
+		writeError(w, http.StatusConflict, "rule for %s already exists", rl.Domain)
+		return
+	}
+	if err := a.dns.rules.add(rl); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	slog.Info("Rule added", "domain", rl.Domain, "ip", rl.IP, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusCreated, rl)
+}
+
+// putRule creates or replaces the rule named in the path.
+func (a *apiServer) putRule(w http.ResponseWriter, r *http.Request) {
+	rl, ok := readRule(w, r)
+	if !ok {
+		return
+	}
+	domain := normalizeName(r.PathValue("domain"))
+	if rl.Domain != "" && normalizeName(rl.Domain) != domain {
+		writeError(w, http.StatusBadRequest, "rule domain %q does not match %q", rl.Domain, domain)
+		return
+	}
+	rl.Domain = domain
+	status := http.StatusOK
+	if a.dns.rules.get(domain) == nil {
+		status = http.StatusCreated
+	}
+	if err := a.dns.rules.add(rl); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	slog.Info("Rule updated", "domain", rl.Domain, "ip", rl.IP, "remote", r.RemoteAddr)
+	writeJSON(w, status, rl)
+}
+
+func (a *apiServer) deleteRule(w http.ResponseWriter, r *http.Request) {
+	domain := r.PathValue("domain")
+	if !a.dns.rules.remove(domain) {
+		writeError(w, http.StatusNotFound, "no rule for %s", domain)
+		return
+	}
+	slog.Info("Rule deleted", "domain", domain, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiServer) flushCaches(w http.ResponseWriter, r *http.Request) {
+	n := a.dns.flushCaches()
+	slog.Info("Caches flushed", "clients", n, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]int{"clients": n})
+}
+
+func (a *apiServer) listBans(w http.ResponseWriter, r *http.Request) {
+	if a.dns.detect.ban == nil {
+		writeError(w, http.StatusNotFound, "banning is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.dns.detect.ban.list())
+}
+
+// deleteBan lifts the ban on the client in the path and forgives its
+// strikes.
+func (a *apiServer) deleteBan(w http.ResponseWriter, r *http.Request) {
+	if a.dns.detect.ban == nil {
+		writeError(w, http.StatusNotFound, "banning is not enabled")
+		return
+	}
+	client := r.PathValue("client")
+	if !a.dns.detect.ban.lift(client) {
+		writeError(w, http.StatusNotFound, "%s is not banned", client)
+		return
+	}
+	slog.Info("Ban lifted", "client", client, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiServer) clearBans(w http.ResponseWriter, r *http.Request) {
+	if a.dns.detect.ban == nil {
+		writeError(w, http.StatusNotFound, "banning is not enabled")
+		return
+	}
+	n := a.dns.detect.ban.liftAll()
+	slog.Info("Bans lifted", "clients", n, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]int{"clients": n})
+}
+
+func (a *apiServer) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.dns.stats())
+}
+
+// flushCaches forgets per-client state, so every client counts as new
+// again for first_seen alerts. It returns the number of clients forgotten.
+func (s *dnsServer) flushCaches() int {
+	n := 0
+	s.seenClients.Range(func(k, _ any) bool {
+		s.seenClients.Delete(k)
+		n++
+		return true
+	})
+	s.answered.Range(func(k, _ any) bool {
+		s.answered.Delete(k)
+		return true
+	})
+	return n
+}
+
+// serverStats is a snapshot of the server's counters.
+type serverStats struct {
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Session       *session           `json:"session,omitempty"` // the active session, if any
+	Rules         int                `json:"rules"`
+	ClientsSeen   int                `json:"clients_seen"`
+	RuleHits      map[string]int64   `json:"rule_hits"`
+	TunnelScores  map[string]float64 `json:"tunnel_scores,omitempty"` // client -> tunneling score, with detection on
+	OverQuota     []quotaStatus      `json:"over_quota,omitempty"`    // clients over their query quota, with quotas on
+	Counters      map[string]int64   `json:"counters"`                // every expvar counter
+
+	Listeners map[string]map[string]int64 `json:"listeners"`           // local address -> counter -> value
+	Upstreams []upstreamStatus            `json:"upstreams,omitempty"` // -forward resolvers, in order of preference
+	Steering  []steerStatus               `json:"steering,omitempty"`  // addresses of rules with several, with steering on
+
+	Connections map[string]int     `json:"connections,omitempty"` // TCP and DoT listener -> connections open
+	Replication *replicationStatus `json:"replication,omitempty"` // with replication configured
+}
+
+func (s *dnsServer) stats() serverStats {
+	st := serverStats{
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		Session:       activeSession.Load(),
+		Rules:         s.rules.len(),
+		RuleHits:      make(map[string]int64),
+		Counters:      make(map[string]int64),
+		Listeners:     make(map[string]map[string]int64),
+		Upstreams:     s.upstream.status(),
+		Steering:      s.steer.status(),
+		Connections:   s.connections(),
+		Replication:   s.repl.status(),
+	}
+	expvar.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			st.Counters[kv.Key] = v.Value()
+		}
+	})
+	listenerStats.Do(func(l expvar.KeyValue) {
+		counters := make(map[string]int64)
+		l.Value.(*expvar.Map).Do(func(kv expvar.KeyValue) {
+			counters[kv.Key] = kv.Value.(*expvar.Int).Value()
+		})
+		st.Listeners[l.Key] = counters
+	})
+	s.seenClients.Range(func(_, _ any) bool {
+		st.ClientsSeen++
+		return true
+	})
+	if s.detect.tunnel != nil {
+		st.TunnelScores = s.detect.tunnel.scores()
+	}
+	if s.detect.quota != nil {
+		st.OverQuota = s.detect.quota.usage()
+	}
+	s.ruleHits.Range(func(k, v any) bool {
+		st.RuleHits[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return st
+}
+
+// logStats writes a snapshot of the server's state to the log as one
+// record, for a quick health check on hosts without the API. It runs on
+// SIGUSR1.
+func (s *dnsServer) logStats() {
+	st := s.stats()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	answered := 0
+	s.answered.Range(func(_, _ any) bool {
+		answered++
+		return true
+	})
+	attrs := []any{
+		"uptime", (time.Duration(st.UptimeSeconds) * time.Second).String(),
+		"goroutines", runtime.NumGoroutine(),
+		"heap_bytes", mem.HeapAlloc,
+		"rules", st.Rules,
+		slog.Group("cache", "clients_seen", st.ClientsSeen, "answered", answered),
+		sortedGroup("counters", st.Counters),
+		sortedGroup("rule_hits", st.RuleHits),
+	}
+	if s.dhcp != nil {
+		s.dhcp.mu.Lock()
+		attrs = append(attrs, "dhcp_leases", len(s.dhcp.leases))
+		s.dhcp.mu.Unlock()
+	}
+	slog.Info("Stats", attrs...)
+}
+
+// sortedGroup turns m into a log group with its keys in order.
+func sortedGroup(name string, m map[string]int64) slog.Attr {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]any, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, slog.Int64(k, m[k]))
+	}
+	return slog.Group(name, attrs...)
+}
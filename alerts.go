@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	alertsRaised    = expvar.NewInt("alerts_raised")
+	alertsDelivered = expvar.NewInt("alerts_delivered")
+	alertsFailed    = expvar.NewInt("alerts_failed")
+	alertsLimited   = expvar.NewInt("alerts_rate_limited")
+)
+
+// alert is a notable event worth telling a human about, such as a canary
+// domain being resolved or a client seen for the first time.
+type alert struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` // e.g. "canary" or "first_seen"
+	Client  string    `json:"client"`
+	QName   string    `json:"qname,omitempty"`
+	QType   string    `json:"qtype,omitempty"`
+	Rule    string    `json:"rule,omitempty"`
+	Source  string    `json:"source,omitempty"` // where a honeytoken was planted, or the feed that listed a domain
+	Message string    `json:"message"`
+	Session string    `json:"session,omitempty"` // the session active when it was raised
+}
+
+// notifier delivers alerts somewhere. Notify is retried by the alerter on
+// error, so implementations should not retry themselves.
+type notifier interface {
+	Notify(ctx context.Context, a *alert) error
+	String() string
+}
+
+// batchingNotifier is a notifier that may queue alerts to send several at
+// once, such as an email digest. While batching, alerts it takes aren't
+// counted as delivered until it has sent them.
+type batchingNotifier interface {
+	notifier
+	batching() bool
+}
+
+// alertsConfig is the "alerts" section of the config file.
+type alertsConfig struct {
+	Webhooks []webhookConfig `yaml:"webhooks"`
+	Slack    []chatConfig    `yaml:"slack"`
+	Discord  []chatConfig    `yaml:"discord"`
+	Email    []emailConfig   `yaml:"email"`
+
+	// Reports are traffic summaries sent on a schedule to the email and
+	// webhook notifiers above.
+	Reports []reportConfig `yaml:"reports"`
+
+	// FirstSeenClients raises a "first_seen" alert the first time each
+	// client address sends a query.
+	FirstSeenClients bool `yaml:"first_seen_clients"`
+}
+
+// notifyOptions are the delivery settings shared by every notifier.
+type notifyOptions struct {
+	Retries   int      `yaml:"retries"`    // extra attempts after a failure, default 3
+	RateLimit int      `yaml:"rate_limit"` // max alerts per minute, default 60
+	Kinds     []string `yaml:"kinds"`      // alert kinds to send, default all
+}
+
+func (o notifyOptions) wants(kind string) bool {
+	if len(o.Kinds) == 0 {
+		return true
+	}
+	for _, k := range o.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (o notifyOptions) withDefaults() notifyOptions {
+	if o.Retries == 0 {
+		o.Retries = 3
+	}
+	if o.RateLimit == 0 {
+		o.RateLimit = 60
+	}
+	return o
+}
+
+// alerter logs alerts and queues them to each notifier. Every notifier has
+// its own queue, rate limit and retry loop so a slow or failing sink does not
+// hold up the others.
+type alerter struct {
+	targets []*alertTarget
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex // held to read while queueing, so close waits
+	closed bool
+}
+
+type alertTarget struct {
+	n       notifier
+	opts    notifyOptions
+	limiter *rateLimiter
+	queue   chan *alert
+}
+
+func newAlerter(cfg alertsConfig) (*alerter, error) {
+	a := &alerter{}
+	for _, wc := range cfg.Webhooks {
+		n, err := newWebhookNotifier(wc)
+		if err != nil {
+			return nil, err
+		}
+		a.add(n, wc.notifyOptions)
+	}
+	for _, cc := range cfg.Slack {
+		n, err := newChatNotifier("slack", cc)
+		if err != nil {
+			return nil, err
+		}
+		a.add(n, cc.notifyOptions)
+	}
+	for _, cc := range cfg.Discord {
+		n, err := newChatNotifier("discord", cc)
+		if err != nil {
+			return nil, err
+		}
+		a.add(n, cc.notifyOptions)
+	}
+	for _, ec := range cfg.Email {
+		n, err := newEmailNotifier(ec)
+		if err != nil {
+			return nil, err
+		}
+		a.add(n, ec.notifyOptions)
+	}
+	return a, nil
+}
+
+func (a *alerter) add(n notifier, opts notifyOptions) {
+	opts = opts.withDefaults()
+	t := &alertTarget{
+		n:       n,
+		opts:    opts,
+		limiter: newRateLimiter(opts.RateLimit, time.Minute),
+		queue:   make(chan *alert, 256),
+	}
+	a.targets = append(a.targets, t)
+	a.wg.Add(1)
+	go a.deliver(t)
+}
+
+// raise logs al and hands it to every notifier. Alerts raised after close
+// are dropped.
+func (a *alerter) raise(al *alert) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	alertsRaised.Add(1)
+	al.Session = sessionName()
+	attrs := []any{"kind", al.Kind, "client", al.Client, "qname", al.QName, "rule", al.Rule, "message", al.Message}
+	if al.Session != "" {
+		attrs = append(attrs, "session", al.Session)
+	}
+	slog.Warn("alert", attrs...)
+	for _, t := range a.targets {
+		if !t.opts.wants(al.Kind) {
+			continue
+		}
+		if !t.limiter.allow() {
+			alertsLimited.Add(1)
+			continue
+		}
+		select {
+		case t.queue <- al:
+		default:
+			alertsFailed.Add(1)
+			slog.Warn("Alert queue full, dropping alert", "notifier", t.n.String())
+		}
+	}
+}
+
+func (a *alerter) deliver(t *alertTarget) {
+	defer a.wg.Done()
+	for al := range t.queue {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := t.n.Notify(ctx, al)
+			cancel()
+			if err == nil {
+				if b, ok := t.n.(batchingNotifier); !ok || !b.batching() {
+					alertsDelivered.Add(1)
+				}
+				break
+			}
+			if attempt >= t.opts.Retries {
+				alertsFailed.Add(1)
+				slog.Error("Alert delivery failed", "notifier", t.n.String(), "attempts", attempt+1, "err", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// close flushes queued alerts and stops the delivery goroutines.
+func (a *alerter) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	for _, t := range a.targets {
+		close(t.queue)
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+	for _, t := range a.targets {
+		if c, ok := t.n.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// rateLimiter is a token bucket allowing n events per period.
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	rate   float64 // tokens per second
+	last   time.Time
+}
+
+func newRateLimiter(n int, per time.Duration) *rateLimiter {
+	return &rateLimiter{tokens: float64(n), max: float64(n), rate: float64(n) / per.Seconds(), last: time.Now()}
+}
+
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.max, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func firstSeenAlert(ev *queryEvent) *alert {
+	return &alert{
+		Time:    ev.Time,
+		Kind:    "first_seen",
+		Client:  ev.Client,
+		QName:   ev.QName,
+		QType:   ev.QType,
+		Message: fmt.Sprintf("new client %s, first query %s", ev.Client, ev.QName),
+	}
+}
+
+func canaryAlert(ev *queryEvent) *alert {
+	al := &alert{
+		Time:    ev.Time,
+		Kind:    "canary",
+		Client:  ev.Client,
+		QName:   ev.QName,
+		QType:   ev.QType,
+		Rule:    ev.Rule,
+		Message: fmt.Sprintf("canary domain %s resolved by %s", ev.QName, ev.Client),
+	}
+	if ev.Feed != "" {
+		al.Source = "feed " + ev.Feed
+		al.Message = fmt.Sprintf("%s resolved %s, listed in feed %s", ev.Client, ev.QName, ev.Feed)
+	}
+	return al
+}
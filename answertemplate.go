@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Answer templates stand in for a rule's ip and are filled in for each
+// query: {client_ip} is the asking client's own address, {client_subnet_gw}
+// the first address of the client's subnet, where its gateway usually is,
+// and {listener_ip} this host's address the query arrived on.
+var answerTemplates = map[string]bool{
+	"{client_ip}":        true,
+	"{client_subnet_gw}": true,
+	"{listener_ip}":      true,
+}
+
+// localNetsTTL is how long the host's interface addresses are cached for.
+const localNetsTTL = 30 * time.Second
+
+// localNets caches the host's interface addresses, which answer templates
+// consult on every query.
+var localNets struct {
+	mu       sync.Mutex
+	prefixes []netip.Prefix
+	loaded   time.Time
+}
+
+// localPrefixes returns the host's interface addresses with their prefix
+// lengths.
+func localPrefixes() []netip.Prefix {
+	localNets.mu.Lock()
+	defer localNets.mu.Unlock()
+	if time.Since(localNets.loaded) < localNetsTTL {
+		return localNets.prefixes
+	}
+	localNets.prefixes, localNets.loaded = nil, time.Now()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok {
+			continue
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip = ip.Unmap()
+		if ip.Is4() && ones > 32 {
+			ones -= 96
+		}
+		localNets.prefixes = append(localNets.prefixes, netip.PrefixFrom(ip, ones))
+	}
+	return localNets.prefixes
+}
+
+// onLinkPrefix returns the host's interface prefix that contains client.
+func onLinkPrefix(client netip.Addr) (netip.Prefix, bool) {
+	for _, p := range localPrefixes() {
+		if p.Contains(client) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// expandAnswer returns the address the answer template t stands for in a
+// query from client that arrived on local, or nil if there is none.
+func expandAnswer(t string, local, client netip.Addr) net.IP {
+	if !client.IsValid() {
+		return nil // no client to reflect, as when hashing a zone
+	}
+	var ip netip.Addr
+	switch t {
+	case "{client_ip}":
+		ip = client
+	case "{client_subnet_gw}":
+		// Off-link clients are assumed to be on a /24 or /64
+		p, ok := onLinkPrefix(client)
+		if !ok {
+			bits := 24
+			if client.Is6() {
+				bits = 64
+			}
+			p = netip.PrefixFrom(client, bits)
+		}
+		ip = p.Masked().Addr().Next()
+	case "{listener_ip}":
+		ip = listenerIP(local, client)
+	}
+	if !ip.IsValid() {
+		return nil
+	}
+	return net.IP(ip.AsSlice())
+}
+
+// listenerIP returns the address a query from client arrived on. Sockets
+// bound to a wildcard or multicast address don't say, so then it is the
+// address of the interface on the client's network, or else the one the
+// host would reply to the client from.
+func listenerIP(local, client netip.Addr) netip.Addr {
+	if local.IsValid() && !local.IsUnspecified() && !local.IsMulticast() {
+		return local.Unmap()
+	}
+	if p, ok := onLinkPrefix(client); ok {
+		return p.Addr()
+	}
+	// Connecting a UDP socket picks a route without sending anything
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(client, 53)))
+	if err != nil {
+		return netip.Addr{}
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// apiServer is the HTTP control surface of a running server.
+type apiServer struct {
+	dns    *dnsServer
+	broker *eventBroker
+	cfg    apiConfig
+	mux    *http.ServeMux
+	srv    *http.Server
+}
+
+func newAPIServer(dns *dnsServer, broker *eventBroker, cfg apiConfig) *apiServer {
+	a := &apiServer{dns: dns, broker: broker, cfg: cfg, mux: http.NewServeMux()}
+	a.handle("GET /api/events", "events", a.streamEvents)
+	a.registerAdmin()
+	a.handle("GET /api/pdns", "pdns", a.passiveDNSRecords)
+	a.registerDashboard()
+	dns.registerHealth(a.mux)
+	return a
+}
+
+// start listens on addr and serves the API in the background, over TLS if
+// a certificate is configured.
+func (a *apiServer) start(addr string) error {
+	if err := a.cfg.validate(); err != nil {
+		return err
+	}
+	var tc *tls.Config
+	if a.cfg.TLSCert != "" {
+		var err error
+		if tc, err = a.cfg.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && !isLoopbackHost(host) && !a.cfg.authRequired() {
+		slog.Warn("API is not bound to localhost and has no authentication configured", "addr", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	scheme := "http"
+	if tc != nil {
+		ln = tls.NewListener(ln, tc)
+		scheme = "https"
+	}
+	slog.Info("API listening", "url", scheme+"://"+ln.Addr().String()+"/api/", "auth", a.cfg.authRequired())
+
+	a.srv = &http.Server{Handler: a.mux}
+	go func() {
+		if err := a.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("API listener stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// shutdown stops accepting connections and waits for open requests to
+// finish, or for ctx to expire. Event streams end when the broker closes.
+func (a *apiServer) shutdown(ctx context.Context) error {
+	return a.srv.Shutdown(ctx)
+}
+
+// streamEvents serves the event stream, turning away WebSocket upgrades
+// from web pages other than the API's own and the configured origins:
+// browsers don't hold WebSockets to the same-origin policy, so any page a
+// user with access visits could otherwise read the stream.
+func (a *apiServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	if isWebSocket(r) && !originAllowed(r, a.cfg.Origins) {
+		writeError(w, http.StatusForbidden, "origin %s is not allowed", r.Header.Get("Origin"))
+		return
+	}
+	a.broker.handleEventStream(w, r)
+}
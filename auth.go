@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// API scopes. Each endpoint requires one; "admin" grants all of them.
+var apiScopes = []string{"events", "rules:read", "rules:write", "cache", "stats", "pdns", "bans", "session", "admin"}
+
+// apiConfig is the "api" section of the config file. With no tokens and no
+// client CA the API is open to anyone who can reach it.
+type apiConfig struct {
+	TLSCert  string `yaml:"tls_cert"`
+	TLSKey   string `yaml:"tls_key"`
+	ClientCA string `yaml:"client_ca"` // require client certificates signed by this CA
+
+	Tokens  []apiToken  `yaml:"tokens"`
+	Clients []apiClient `yaml:"clients"` // scopes for client certificates, by common name
+
+	Origins []string `yaml:"origins"` // web pages elsewhere allowed to open the event stream's WebSocket, e.g. https://soc.example
+}
+
+// apiToken is a bearer token and the scopes it grants.
+type apiToken struct {
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// apiClient grants scopes to a client certificate with the given common
+// name. Without any clients listed, every verified certificate gets admin.
+type apiClient struct {
+	CommonName string   `yaml:"common_name"`
+	Scopes     []string `yaml:"scopes"`
+}
+
+func (c *apiConfig) validate() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("api: tls_cert and tls_key must be set together")
+	}
+	if c.ClientCA != "" && c.TLSCert == "" {
+		return errors.New("api: client_ca needs tls_cert and tls_key")
+	}
+	check := func(scopes []string) error {
+		for _, s := range scopes {
+			if !slices.Contains(apiScopes, s) {
+				return fmt.Errorf("api: unknown scope %q (want one of %s)", s, strings.Join(apiScopes, ", "))
+			}
+		}
+		return nil
+	}
+	for _, t := range c.Tokens {
+		if len(t.Token) < 16 {
+			return errors.New("api: tokens must be at least 16 characters")
+		}
+		if err := check(t.Scopes); err != nil {
+			return err
+		}
+	}
+	for _, cl := range c.Clients {
+		if err := check(cl.Scopes); err != nil {
+			return err
+		}
+	}
+	for _, o := range c.Origins {
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("api: invalid origin %q (want scheme://host[:port])", o)
+		}
+	}
+	return nil
+}
+
+func (c *apiConfig) authRequired() bool {
+	return len(c.Tokens) > 0 || c.ClientCA != ""
+}
+
+// tlsConfig loads the server certificate and, if configured, the CA used to
+// verify client certificates.
+func (c *apiConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading api certificate: %v", err)
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCA)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+		if len(c.Tokens) == 0 {
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tc, nil
+}
+
+// scopes returns what the caller of r is allowed to do.
+func (c *apiConfig) scopes(r *http.Request) []string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		// Browsers can't set headers on EventSource and WebSocket requests
+		token = r.URL.Query().Get("access_token")
+	}
+	return c.grant(token, r.TLS)
+}
+
+// grant returns the union of the scopes of a matching bearer token and of
+// the verified client certificate, if any.
+func (c *apiConfig) grant(token string, cs *tls.ConnectionState) []string {
+	var granted []string
+	if token != "" {
+		for _, t := range c.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				granted = append(granted, t.Scopes...)
+			}
+		}
+	}
+	if c.ClientCA != "" && cs != nil && len(cs.VerifiedChains) > 0 {
+		cn := cs.PeerCertificates[0].Subject.CommonName
+		if len(c.Clients) == 0 {
+			granted = append(granted, "admin")
+		}
+		for _, cl := range c.Clients {
+			if cl.CommonName == cn {
+				granted = append(granted, cl.Scopes...)
+			}
+		}
+	}
+	return granted
+}
+
+// handle registers h for pattern, requiring scope when auth is configured.
+// On the standby of a replication pair only reads are allowed, as the
+// active instance's next update would undo any change.
+func (a *apiServer) handle(pattern, scope string, h http.HandlerFunc) {
+	if next := h; a.dns.repl != nil {
+		h = func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && a.dns.repl.standby() {
+				writeError(w, http.StatusServiceUnavailable, "standing by; make changes on the active instance")
+				return
+			}
+			next(w, r)
+		}
+	}
+	if !a.cfg.authRequired() {
+		a.mux.HandleFunc(pattern, h)
+		return
+	}
+	a.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		granted := a.cfg.scopes(r)
+		if len(granted) == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="DeceptiveDNS"`)
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if !hasScope(granted, scope) {
+			writeError(w, http.StatusForbidden, "missing scope %s", scope)
+			return
+		}
+		h(w, r)
+	})
+}
+
+func hasScope(granted []string, scope string) bool {
+	return slices.Contains(granted, scope) || slices.Contains(granted, "admin")
+}
+
+func isLoopbackHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+)
+
+// negativeTTL is how long resolvers may cache NXDOMAIN and NODATA answers:
+// the SOA minimum, and the TTL of the SOA sent with them (RFC 2308).
+const negativeTTL = 300
+
+// soaRecord returns the SOA record of zone, naming primary as its primary
+// server.
+func soaRecord(zone, primary string, serial, ttl uint32) dnsResourceRecord {
+	rdata, _ := appendName(nil, primary)
+	rdata, _ = appendName(rdata, "hostmaster."+zone)
+	for _, v := range []uint32{serial, 3600, 600, 604800, negativeTTL} { // serial, refresh, retry, expire, minimum
+		rdata = binary.BigEndian.AppendUint32(rdata, v)
+	}
+	return dnsResourceRecord{Name: zone, Type: dnsTypeSOA, Class: dnsClassIN, TTL: ttl, RData: rdata}
+}
+
+// authority returns the most specific zone holding name that the server is
+// authoritative for, or "" if none is. Those are the zones served by AXFR
+// and the zones -update-zones lets clients change: names in them that
+// nothing answers don't exist, rather than being passed through.
+func (s *dnsServer) authority(name string) string {
+	name = normalizeName(name)
+	zones := s.axfr.zoneNames()
+	if s.updates != nil {
+		zones = append(zones, s.updates.zones...)
+	}
+	var zone string
+	for _, z := range zones {
+		if inZone(name, z) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+// nameExists reports whether name, in an authoritative zone, has records,
+// or names below it do: such an empty non-terminal is answered NODATA
+// rather than NXDOMAIN too (RFC 8020).
+func (s *dnsServer) nameExists(name, zone string) bool {
+	name = normalizeName(name)
+	if name == zone {
+		return true
+	}
+	if s.rules.hasBelow(name) {
+		return true
+	}
+	if ss := s.services.Load(); ss != nil {
+		for host := range ss.hosts {
+			if inZone(host, name) {
+				return true
+			}
+		}
+		for owner := range ss.records {
+			if inZone(owner, name) {
+				return true
+			}
+		}
+	}
+	if s.updates != nil {
+		for _, n := range s.updates.names() {
+			if inZone(n, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negativeSOA returns the SOA to put in the authority section of an
+// NXDOMAIN or NODATA answer for name, so resolvers can cache it: that of
+// the authoritative zone holding name, or else of the domain of the rule
+// answering it, as if each rule were a zone of its own.
+func (s *dnsServer) negativeSOA(name string, r *rule) dnsResourceRecord {
+	zone := s.authority(name)
+	if zone != "" && slices.Contains(s.axfr.zoneNames(), zone) {
+		soa := s.axfr.soa(zone)
+		soa.TTL = negativeTTL
+		return soa
+	}
+	if zone == "" {
+		zone = normalizeName(name)
+		if r != nil && inZone(zone, strings.TrimPrefix(r.Domain, "*.")) {
+			zone = strings.TrimPrefix(r.Domain, "*.")
+		}
+	}
+	return soaRecord(zone, "ns1."+zone, uint32(startTime.Unix()), negativeTTL)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	zoneTransfers        = expvar.NewInt("zone_transfers")
+	zoneTransfersRefused = expvar.NewInt("zone_transfers_refused")
+)
+
+const (
+	dnsTypeNS             = 2
+	dnsTypeAXFR           = 252
+	dnsFlagsAuthoritative = 0x8400 // response, authoritative
+	axfrRecordsPerMsg     = 100
+	axfrTTL               = 3600
+)
+
+// axfrConfig is the "axfr" section of the config file: the zones served by
+// zone transfer over TCP, and who may transfer them. With neither allow nor
+// require_tsig anyone may, and every transfer raises an alert.
+type axfrConfig struct {
+	Zones       []string `yaml:"zones"`
+	Allow       []string `yaml:"allow"`        // client addresses or CIDR prefixes
+	RequireTSIG bool     `yaml:"require_tsig"` // transfers must be signed with a key from the tsig section
+
+	// Secondaries sent a NOTIFY when a zone changes, as host or host:port
+	Notify []string `yaml:"notify"`
+
+	// Name servers of the zones, name server -> address ("" for the
+	// default answer), by zone; zones not listed have ns1.<zone>
+	NameServers map[string]map[string]string `yaml:"name_servers"`
+	// Child zones served elsewhere, with their name servers and glue as
+	// in name_servers. Child zones in zones are delegated to implicitly.
+	Delegations map[string]map[string]string `yaml:"delegations"`
+}
+
+// axfrServer answers AXFR requests for its zones with the records the rules,
+// services and dynamic updates under them would answer.
+type axfrServer struct {
+	zones  []string
+	allow  []netip.Prefix
+	notify []string // secondaries, as host:port
+
+	requireTSIG bool
+
+	nameServers map[string][]nameServer // zone -> its name servers
+	delegations map[string][]nameServer // child zone served elsewhere -> its name servers
+
+	mu      sync.Mutex
+	serials map[string]uint32   // zone -> SOA serial, starting at the start time
+	sums    map[string][32]byte // zone -> hash of its records when the serial was set
+
+	stop chan struct{}
+	wg   sync.WaitGroup // zone watcher and NOTIFY senders
+}
+
+// newAXFRServer returns nil if cfg configures no zones.
+func newAXFRServer(cfg axfrConfig) (*axfrServer, error) {
+	if len(cfg.Zones) == 0 {
+		if len(cfg.Allow) > 0 || cfg.RequireTSIG || len(cfg.Notify) > 0 || len(cfg.NameServers) > 0 || len(cfg.Delegations) > 0 {
+			return nil, fmt.Errorf("allow, require_tsig, notify, name_servers and delegations need zones")
+		}
+		return nil, nil
+	}
+	a := &axfrServer{
+		serials: make(map[string]uint32),
+		sums:    make(map[string][32]byte),
+		stop:    make(chan struct{}),
+	}
+	for _, z := range cfg.Zones {
+		zone := normalizeName(z)
+		if _, err := appendName(nil, zone); err != nil || zone == "" {
+			return nil, fmt.Errorf("invalid zone %q", z)
+		}
+		a.zones = append(a.zones, zone)
+		a.serials[zone] = uint32(time.Now().Unix())
+	}
+	var err error
+	if a.allow, err = parsePrefixes(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %v", err)
+	}
+	a.requireTSIG = cfg.RequireTSIG
+	for _, n := range cfg.Notify {
+		addr := withDefaultPort(n, "53")
+		if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+			return nil, fmt.Errorf("invalid notify address %q: %v", n, err)
+		}
+		a.notify = append(a.notify, addr)
+	}
+	if err := a.setDelegations(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parsePrefixes parses a list of addresses and CIDR prefixes.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range list {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid entry %q: want an address or CIDR prefix", s)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// prefixesContain reports whether any of list contains addr.
+func prefixesContain(list []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range list {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneNames returns the zones served, for logging.
+func (a *axfrServer) zoneNames() []string {
+	if a == nil {
+		return nil
+	}
+	return a.zones
+}
+
+// allowed reports whether client passes the allow list.
+func (a *axfrServer) allowed(client netip.Addr) bool {
+	return len(a.allow) == 0 || prefixesContain(a.allow, client)
+}
+
+// isAXFR reports whether msg is a zone transfer request.
+func isAXFR(msg []byte) bool {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[2:4])&0xF800 != 0 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return false
+	}
+	_, off, err := readName(msg, 12)
+	return err == nil && off+2 <= len(msg) && binary.BigEndian.Uint16(msg[off:off+2]) == dnsTypeAXFR
+}
+
+func (a *axfrServer) soa(zone string) dnsResourceRecord {
+	a.mu.Lock()
+	serial := a.serials[zone]
+	a.mu.Unlock()
+	return soaRecord(zone, a.nameServers[zone][0].name, serial, axfrTTL)
+}
+
+// apexRecords answers SOA and NS queries for the zones served, so tools
+// that look those up before asking for a transfer find this server.
+func (a *axfrServer) apexRecords(name string, qtype uint16) ([]dnsResourceRecord, bool) {
+	if a == nil || (qtype != dnsTypeSOA && qtype != dnsTypeNS) {
+		return nil, false
+	}
+	zone := normalizeName(name)
+	if !slices.Contains(a.zones, zone) {
+		return nil, false
+	}
+	if qtype == dnsTypeSOA {
+		return []dnsResourceRecord{a.soa(zone)}, true
+	}
+	return a.nsRecords(zone, axfrTTL), true
+}
+
+// zoneRecords returns the records of zone as a transfer to client, asking
+// on local, should see them, sorted by name and without the SOA and NS
+// records at the apex. Wildcard rules are transferred as wildcard records,
+// and rules scoped by MAC only to the devices they answer. Names in child
+// zones are left to them: the transfer has the NS records delegating to
+// each child instead, with glue for name servers inside it.
+func (s *dnsServer) zoneRecords(zone string, local, client netip.Addr) []dnsResourceRecord {
+	var records []dnsResourceRecord
+	addrs := func(name string, r *rule) {
+		for _, t := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			if ip := s.answerFor(r, t, local, client); ip != nil {
+				records = append(records, dnsResourceRecord{Name: name, Type: t, Class: dnsClassIN, TTL: axfrTTL, Data: ip})
+			}
+		}
+	}
+	owned := func(name string) bool {
+		return inZone(name, zone) && !s.axfr.belowCut(name, zone)
+	}
+	for _, r := range s.rules.list() {
+		if owned(r.Domain) && (!client.IsValid() || s.scoped(&r, client)) {
+			addrs(r.Domain, &r)
+		}
+	}
+	for _, ns := range s.axfr.servers(zone) {
+		if owned(ns.name) && s.rules.match(ns.name) == nil {
+			addrs(ns.name, &rule{Domain: ns.name, addr: ns.addr})
+		}
+	}
+	for _, child := range s.axfr.children(zone) {
+		records = append(records, s.axfr.nsRecords(child, axfrTTL)...)
+		records = append(records, s.glue(child, local, client)...)
+	}
+	if ss := s.services.Load(); ss != nil {
+		var names []string
+		for name := range ss.records {
+			names = append(names, name)
+		}
+		for name := range ss.hosts {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if owned(name) {
+				rrs, _ := s.serviceRecords(name, dnsTypeANY, local, client)
+				records = append(records, rrs...)
+			}
+		}
+	}
+	if s.updates != nil {
+		for _, name := range s.updates.names() {
+			if owned(name) {
+				rrs, _ := s.updates.answers(name, dnsTypeANY)
+				records = append(records, rrs...)
+			}
+		}
+	}
+	slices.SortStableFunc(records, func(x, y dnsResourceRecord) int {
+		if c := strings.Compare(strings.ToLower(x.Name), strings.ToLower(y.Name)); c != 0 {
+			return c
+		}
+		return int(x.Type) - int(y.Type)
+	})
+	return records
+}
+
+// handleAXFR answers a zone transfer request on a TCP connection. Every
+// request is logged; refused ones, and any transfer when the zones are open
+// to everyone, also raise an "axfr" alert, as zone transfers are a classic
+// reconnaissance step.
+func (s *dnsServer) handleAXFR(l *listener, addr netip.AddrPort, req []byte) {
+	start := time.Now()
+	queriesReceived.Add(1)
+	l.stats.Add("received", 1)
+	var msg dnsMsg
+	if err := msg.unpack(req); err != nil {
+		queriesMalformed.Add(1)
+		l.stats.Add("malformed", 1)
+		slog.Warn("Error unpacking zone transfer request", "client", addr.String(), "err", err)
+		return
+	}
+	client := addr.Addr().Unmap()
+	ev := &queryEvent{
+		Time:     start,
+		Client:   client.String(),
+		Port:     int(addr.Port()),
+		Listener: l.addr,
+		QName:    msg.Question.Name,
+		QType:    "AXFR",
+		Opcode:   "QUERY",
+		Action:   "transferred",
+	}
+	if s.keepWire {
+		ev.Query = bytes.Clone(req)
+	}
+	var reason string
+	defer func() {
+		ev.Latency = time.Since(start)
+		l.stats.Add(ev.Action, 1)
+		s.emit(ev)
+		if ev.Action == "refused" || (ev.Action == "transferred" && len(s.axfr.allow) == 0 && !s.axfr.requireTSIG) {
+			s.alerts.raise(axfrAlert(ev, reason))
+		}
+	}()
+	if s.monitor {
+		queriesMonitored.Add(1)
+		ev.Action = "monitored"
+		return
+	}
+
+	zone := normalizeName(msg.Question.Name)
+	tc, err := s.tsig.check(req, start)
+	var rcode uint16
+	switch {
+	case err != nil:
+		rcode, reason, tc = dnsRcodeFormErr, err.Error(), &tsigCheck{}
+	case tc.err != nil:
+		rcode, reason = dnsRcodeNotAuth, tc.err.Error()
+	case s.axfr == nil || !slices.Contains(s.axfr.zones, zone):
+		rcode, reason = dnsRcodeNotAuth, "zone not served"
+	case !s.axfr.allowed(client):
+		rcode, reason = dnsRcodeRefused, "client not allowed"
+	case tc.sig == nil && s.axfr.requireTSIG:
+		rcode, reason = dnsRcodeRefused, "request not signed"
+	}
+	ev.TSIG = tc.verified()
+	if rcode != 0 {
+		zoneTransfersRefused.Add(1)
+		ev.Action = "refused"
+		ev.RCode = rcodeString(rcode)
+		resp := dnsMsg{ID: msg.ID, Flags: dnsFlagsAuthoritative | rcode, Question: msg.Question}
+		respBytes, _ := resp.pack()
+		if err := l.reply(tc.sign(respBytes, time.Now()), addr); err != nil {
+			queryErrors.Add(1)
+			slog.Error("Error sending zone transfer response", "client", addr.String(), "zone", zone, "err", err)
+		}
+		return
+	}
+
+	var signer *tsigSigner
+	if tc.sig != nil {
+		signer = newTSIGSigner(tc.key, tc.sig)
+	}
+	soa := s.axfr.soa(zone)
+	records := append(append([]dnsResourceRecord{soa}, s.axfr.nsRecords(zone, axfrTTL)...), s.zoneRecords(zone, l.local, client)...)
+	records = append(records, soa)
+	for i := 0; i < len(records); i += axfrRecordsPerMsg {
+		resp := dnsMsg{ID: msg.ID, Flags: dnsFlagsAuthoritative, Question: msg.Question}
+		resp.Answers = records[i:min(i+axfrRecordsPerMsg, len(records))]
+		respBytes, err := resp.pack()
+		if err != nil {
+			queryErrors.Add(1)
+			slog.Error("Error packing zone transfer", "client", addr.String(), "zone", zone, "err", err)
+			return
+		}
+		if signer != nil {
+			respBytes = signer.sign(respBytes, time.Now())
+		}
+		if err := l.reply(respBytes, addr); err != nil {
+			queryErrors.Add(1)
+			slog.Error("Error sending zone transfer", "client", addr.String(), "zone", zone, "err", err)
+			return
+		}
+	}
+	zoneTransfers.Add(1)
+	ev.RCode = rcodeString(0)
+	ev.Answer = []string{fmt.Sprintf("%d records", len(records))}
+}
+
+func axfrAlert(ev *queryEvent, reason string) *alert {
+	al := &alert{
+		Time:    ev.Time,
+		Kind:    "axfr",
+		Client:  ev.Client,
+		QName:   ev.QName,
+		QType:   ev.QType,
+		Message: fmt.Sprintf("zone transfer of %s by %s", ev.QName, ev.Client),
+	}
+	if reason != "" {
+		al.Message = fmt.Sprintf("zone transfer of %s by %s refused: %s", ev.QName, ev.Client, reason)
+	}
+	return al
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	clientsBanned = expvar.NewInt("clients_banned")
+	queriesBanned = expvar.NewInt("queries_banned")
+)
+
+const (
+	banDefaultMalformed = 20
+	banDefaultLimited   = 100
+	banDefaultDuration  = time.Minute
+	banDefaultMax       = 24 * time.Hour
+	banDefaultForget    = 24 * time.Hour
+	banMaxClients       = 10000
+)
+
+// banAlertKinds are the detection alerts that can ban the client raising
+// them.
+var banAlertKinds = []string{"dga", "tunneling", "rate_anomaly", "quota"}
+
+// banConfig is the "ban" part of the "detection" section: shutting out
+// abusive clients for a while, longer each time they come back to it.
+type banConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Malformed   int           `yaml:"malformed"`    // malformed messages a client may send in a minute, default 20
+	Limited     int           `yaml:"limited"`      // queries over a tunneling rate limit a client may send in a minute, default 100
+	Alerts      []string      `yaml:"alerts"`       // kinds of alert about a client that ban it, e.g. rate_anomaly or quota
+	Duration    time.Duration `yaml:"duration"`     // first ban, doubled by every ban after it, default 1m
+	MaxDuration time.Duration `yaml:"max_duration"` // longest ban, default 24h
+	Forget      time.Duration `yaml:"forget"`       // time after a ban ends that the next starts over at duration, default 24h
+	Allow       []string      `yaml:"allow"`        // client addresses and prefixes never banned
+
+	allow []netip.Prefix // Allow parsed
+}
+
+// banList bans clients that send floods of malformed messages, keep
+// querying past their rate limit or raise the configured alerts. A banned
+// client's messages are dropped unread until the ban ends. Each ban lasts
+// twice as long as the one before, up to max_duration, until the client
+// stays out of trouble for forget after one ends.
+type banList struct {
+	cfg banConfig
+
+	mu      sync.Mutex
+	clients map[string]*banClient
+	active  int // at least the bans in force, so lookups can skip the map while there are none
+}
+
+type banClient struct {
+	window    time.Time // start of the minute offenses are counted in
+	malformed int
+	limited   int
+
+	strikes int       // bans so far, since the client was last forgiven
+	reason  string    // why it was last banned
+	since   time.Time // when the last ban began
+	until   time.Time // when it ends
+}
+
+// banStatus is a ban, as the admin API lists it and -state keeps it.
+type banStatus struct {
+	Client  string    `json:"client"`
+	Reason  string    `json:"reason"`
+	Strikes int       `json:"strikes"` // bans so far, this one included
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+}
+
+func newBanList(cfg banConfig) (*banList, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Malformed == 0 {
+		cfg.Malformed = banDefaultMalformed
+	}
+	if cfg.Limited == 0 {
+		cfg.Limited = banDefaultLimited
+	}
+	if cfg.Duration == 0 {
+		cfg.Duration = banDefaultDuration
+	}
+	if cfg.MaxDuration == 0 {
+		cfg.MaxDuration = banDefaultMax
+	}
+	if cfg.Forget == 0 {
+		cfg.Forget = banDefaultForget
+	}
+	switch {
+	case cfg.Malformed < 0 || cfg.Limited < 0 || cfg.Duration < 0 || cfg.MaxDuration < 0 || cfg.Forget < 0:
+		return nil, fmt.Errorf("ban: malformed, limited, duration, max_duration and forget must not be negative")
+	case cfg.MaxDuration < cfg.Duration:
+		return nil, fmt.Errorf("ban: max_duration must not be below duration")
+	}
+	for _, kind := range cfg.Alerts {
+		if !slices.Contains(banAlertKinds, kind) {
+			return nil, fmt.Errorf("ban: unknown alert kind %q (want %s)", kind, strings.Join(banAlertKinds, ", "))
+		}
+	}
+	allow, err := parsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("ban: allow: %v", err)
+	}
+	cfg.allow = allow
+	return &banList{cfg: cfg, clients: make(map[string]*banClient)}, nil
+}
+
+// banned reports whether client is banned at now.
+func (b *banList) banned(client string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active == 0 {
+		return false
+	}
+	c, ok := b.clients[client]
+	return ok && now.Before(c.until)
+}
+
+// offense counts a malformed message ("malformed") or a query over a rate
+// limit ("limited") from client against its allowance for the minute, and
+// bans it when that runs out, returning a "ban" alert.
+func (b *banList) offense(client, kind string, now time.Time) *alert {
+	if b.allowed(client) {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.client(client, now)
+	if minute := now.Truncate(time.Minute); !c.window.Equal(minute) {
+		c.window, c.malformed, c.limited = minute, 0, 0
+	}
+	var n, limit int
+	var what string
+	switch kind {
+	case "malformed":
+		c.malformed++
+		n, limit, what = c.malformed, b.cfg.Malformed, "malformed messages"
+	case "limited":
+		c.limited++
+		n, limit, what = c.limited, b.cfg.Limited, "queries over its rate limit"
+	}
+	if n <= limit || now.Before(c.until) {
+		return nil
+	}
+	return b.ban(client, c, fmt.Sprintf("more than %d %s in a minute", limit, what), now)
+}
+
+// alerted bans the client of al if al is of a kind that bans, returning a
+// "ban" alert.
+func (b *banList) alerted(al *alert) *alert {
+	if al.Client == "" || !slices.Contains(b.cfg.Alerts, al.Kind) || b.allowed(al.Client) {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.client(al.Client, al.Time)
+	if al.Time.Before(c.until) {
+		return nil
+	}
+	return b.ban(al.Client, c, al.Kind+" alert", al.Time)
+}
+
+// ban bans client, whose state is c, from now, for twice as long as its
+// last ban unless that is forgotten. b.mu must be held.
+func (b *banList) ban(client string, c *banClient, reason string, now time.Time) *alert {
+	if now.Sub(c.until) > b.cfg.Forget {
+		c.strikes = 0
+	}
+	c.strikes++
+	d := b.cfg.Duration
+	for i := 1; i < c.strikes && d < b.cfg.MaxDuration; i++ {
+		d *= 2
+	}
+	d = min(d, b.cfg.MaxDuration)
+	c.reason, c.since, c.until = reason, now, now.Add(d)
+	c.malformed, c.limited = 0, 0
+	b.active++
+	clientsBanned.Add(1)
+	msg := fmt.Sprintf("%s banned for %s after %s", client, d, reason)
+	if c.strikes > 1 {
+		msg += fmt.Sprintf(" (ban %d)", c.strikes)
+	}
+	return &alert{Time: now, Kind: "ban", Client: client, Message: msg}
+}
+
+// client returns the state of client, adding it if it's new. b.mu must be
+// held.
+func (b *banList) client(client string, now time.Time) *banClient {
+	c, ok := b.clients[client]
+	if !ok {
+		if len(b.clients) >= banMaxClients {
+			b.prune(now)
+		}
+		c = &banClient{}
+		b.clients[client] = c
+	}
+	return c
+}
+
+// prune forgets clients neither banned nor offending in the last minute
+// whose last ban is forgotten, or, if that isn't enough, every client not
+// banned. It recounts the bans still on. b.mu must be held.
+func (b *banList) prune(now time.Time) {
+	b.active = 0
+	for client, c := range b.clients {
+		switch {
+		case now.Before(c.until):
+			b.active++
+		case now.Sub(c.window) > time.Minute && now.Sub(c.until) > b.cfg.Forget:
+			delete(b.clients, client)
+		}
+	}
+	if len(b.clients) >= banMaxClients {
+		for client, c := range b.clients {
+			if !now.Before(c.until) {
+				delete(b.clients, client)
+			}
+		}
+	}
+}
+
+func (b *banList) allowed(client string) bool {
+	addr, err := netip.ParseAddr(client)
+	return err == nil && prefixesContain(b.cfg.allow, addr)
+}
+
+// list returns the bans in force, sorted by client. It recounts them, so
+// a list that finds none lets lookups skip the map again.
+func (b *banList) list() []banStatus {
+	now := time.Now()
+	out := []banStatus{}
+	b.mu.Lock()
+	for client, c := range b.clients {
+		if now.Before(c.until) {
+			out = append(out, banStatus{Client: client, Reason: c.reason, Strikes: c.strikes, Since: c.since, Until: c.until})
+		}
+	}
+	b.active = len(out)
+	b.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Client < out[j].Client })
+	return out
+}
+
+// lift ends client's ban, if it has one, and forgives its past ones. It
+// reports whether the client was banned.
+func (b *banList) lift(client string) bool {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.clients[client]
+	if !ok {
+		return false
+	}
+	delete(b.clients, client)
+	return now.Before(c.until)
+}
+
+// liftAll ends every ban and forgives every client, returning how many
+// were banned.
+func (b *banList) liftAll() int {
+	n := len(b.list())
+	b.mu.Lock()
+	clear(b.clients)
+	b.active = 0
+	b.mu.Unlock()
+	return n
+}
+
+// snapshot returns every client with a ban that isn't forgotten yet, for
+// -state to keep their strikes as well as the bans in force.
+func (b *banList) snapshot() []banStatus {
+	now := time.Now()
+	var out []banStatus
+	b.mu.Lock()
+	for client, c := range b.clients {
+		if c.strikes > 0 && now.Sub(c.until) <= b.cfg.Forget {
+			out = append(out, banStatus{Client: client, Reason: c.reason, Strikes: c.strikes, Since: c.since, Until: c.until})
+		}
+	}
+	b.mu.Unlock()
+	return out
+}
+
+// replace swaps every ban and strike for bans, taken by snapshot from a
+// replication peer.
+func (b *banList) replace(bans []banStatus) {
+	b.mu.Lock()
+	clear(b.clients)
+	b.active = 0
+	b.mu.Unlock()
+	b.restore(bans)
+}
+
+// restore brings back bans saved by snapshot.
+func (b *banList) restore(bans []banStatus) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, st := range bans {
+		b.clients[st.Client] = &banClient{strikes: st.Strikes, reason: st.Reason, since: st.Since, until: st.Until}
+		b.active++
+	}
+	return len(bans)
+}
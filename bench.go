@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchCommand implements "bench", a load generator for measuring how many
+// queries a server keeps up with, e.g.
+//
+//	DeceptiveDNS bench -server 192.168.1.5 -qps 5000 -c 16 -names example.com,corp.lan -types A=9,AAAA=1
+func benchCommand(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	server := fs.String("server", "127.0.0.1:53", "Server to load, host or host:port")
+	qps := fs.Int("qps", 0, "Target queries per second across all workers (0 sends as fast as answers come back)")
+	duration := fs.Duration("duration", 10*time.Second, "How long to run")
+	workers := fs.Int("c", 8, "Number of concurrent workers, each with its own socket and one query in flight")
+	names := fs.String("names", "example.com", "Comma-separated names to query")
+	namesFile := fs.String("names-file", "", "Read names to query from this file, one per line")
+	dist := fs.String("dist", "uniform", "How names are picked: uniform, or zipf to favour the first names like real traffic")
+	randomPrefix := fs.Bool("random-prefix", false, "Prepend a random label to every name so no two queries are alike")
+	types := fs.String("types", "A", "Comma-separated query types with optional weights, e.g. A=3,AAAA=1")
+	timeout := fs.Duration("timeout", time.Second, "How long to wait for each answer")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *workers < 1 || *qps < 0 {
+		fmt.Fprintln(os.Stderr, "-c must be at least 1 and -qps must not be negative")
+		return 2
+	}
+
+	nameList, err := benchNames(*names, *namesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	typeList, err := benchTypes(*types)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *dist != "uniform" && *dist != "zipf" {
+		fmt.Fprintf(os.Stderr, "unknown distribution %q (want uniform or zipf)\n", *dist)
+		return 2
+	}
+	addr := withDefaultPort(*server, "53")
+
+	// With a rate limit a pacer hands out one token per query; workers that
+	// find no token free wait, so the rate is never exceeded
+	var tokens chan struct{}
+	deadline := time.Now().Add(*duration)
+	if *qps > 0 {
+		tokens = make(chan struct{}, *workers)
+		go func() {
+			defer close(tokens)
+			interval := time.Second / time.Duration(*qps)
+			next := time.Now()
+			for next.Before(deadline) {
+				if d := time.Until(next); d > 0 {
+					time.Sleep(d)
+				}
+				tokens <- struct{}{}
+				next = next.Add(interval)
+			}
+		}()
+	}
+
+	rate := "unlimited"
+	if *qps > 0 {
+		rate = strconv.Itoa(*qps) + " qps"
+	}
+	fmt.Fprintf(os.Stderr, "Sending to %s for %v with %d workers, %d names, %s\n", addr, *duration, *workers, len(nameList), rate)
+	results := make([]*benchResult, *workers)
+	var wg sync.WaitGroup
+	seed := time.Now().UnixNano()
+	start := time.Now()
+	for i := range results {
+		results[i] = &benchResult{rcodes: make(map[string]int)}
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer conn.Close()
+		w := &benchWorker{
+			conn:    conn,
+			res:     results[i],
+			rng:     rand.New(rand.NewSource(seed + int64(i))),
+			names:   nameList,
+			types:   typeList,
+			prefix:  *randomPrefix,
+			timeout: *timeout,
+		}
+		if *dist == "zipf" && len(nameList) > 1 {
+			w.zipf = rand.NewZipf(w.rng, 1.1, 1, uint64(len(nameList)-1))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(deadline, tokens)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := &benchResult{rcodes: make(map[string]int)}
+	for _, r := range results {
+		total.sent += r.sent
+		total.timeouts += r.timeouts
+		total.errors += r.errors
+		total.latencies = append(total.latencies, r.latencies...)
+		for rc, n := range r.rcodes {
+			total.rcodes[rc] += n
+		}
+	}
+	total.print(elapsed)
+	return 0
+}
+
+type benchResult struct {
+	sent, timeouts, errors int
+	latencies              []time.Duration
+	rcodes                 map[string]int
+}
+
+func (r *benchResult) print(elapsed time.Duration) {
+	lat := r.latencies
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	fmt.Printf("Sent %d queries in %v (%.0f qps), received %d answers (%.0f qps)\n",
+		r.sent, elapsed.Round(time.Millisecond), float64(r.sent)/elapsed.Seconds(), len(lat), float64(len(lat))/elapsed.Seconds())
+	if r.sent > 0 {
+		fmt.Printf("Timeouts %d (%.2f%%), errors %d\n", r.timeouts, 100*float64(r.timeouts)/float64(r.sent), r.errors)
+	}
+	if len(lat) == 0 {
+		return
+	}
+	pct := func(p float64) time.Duration { return lat[int(p*float64(len(lat)-1))] }
+	fmt.Printf("Latency min %v  p50 %v  p90 %v  p99 %v  p99.9 %v  max %v\n",
+		lat[0], pct(0.5), pct(0.9), pct(0.99), pct(0.999), lat[len(lat)-1])
+	var codes []string
+	for rc, n := range r.rcodes {
+		codes = append(codes, fmt.Sprintf("%s %d", rc, n))
+	}
+	sort.Strings(codes)
+	fmt.Printf("Responses %s\n", strings.Join(codes, ", "))
+}
+
+// benchWorker sends one query at a time on its own socket and waits for the
+// answer, so its socket only ever holds responses to its own queries.
+type benchWorker struct {
+	conn    net.Conn
+	res     *benchResult
+	rng     *rand.Rand
+	zipf    *rand.Zipf
+	names   []string
+	types   []uint16 // repeated by weight
+	prefix  bool
+	timeout time.Duration
+}
+
+func (w *benchWorker) run(deadline time.Time, tokens <-chan struct{}) {
+	buf := make([]byte, 65535)
+	for time.Now().Before(deadline) {
+		if tokens != nil {
+			if _, ok := <-tokens; !ok {
+				return
+			}
+		}
+		name := w.names[0]
+		if w.zipf != nil {
+			name = w.names[w.zipf.Uint64()]
+		} else if len(w.names) > 1 {
+			name = w.names[w.rng.Intn(len(w.names))]
+		}
+		if w.prefix {
+			name = strconv.FormatUint(w.rng.Uint64(), 36) + "." + name
+		}
+		q := dnsMsg{
+			ID:       uint16(w.rng.Uint32()),
+			Flags:    0x0100,
+			Question: dnsQuestion{Name: name, Type: w.types[w.rng.Intn(len(w.types))], Class: dnsClassIN},
+		}
+		req, err := q.pack()
+		if err != nil {
+			w.res.errors++
+			continue
+		}
+
+		sent := time.Now()
+		w.res.sent++
+		if _, err := w.conn.Write(req); err != nil {
+			w.res.errors++
+			continue
+		}
+		w.conn.SetReadDeadline(sent.Add(w.timeout))
+		for {
+			n, err := w.conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					w.res.timeouts++
+				} else {
+					w.res.errors++
+				}
+				break
+			}
+			if n < 12 || binary.BigEndian.Uint16(buf[:2]) != q.ID {
+				continue // late answer to an earlier query
+			}
+			w.res.latencies = append(w.res.latencies, time.Since(sent))
+			w.res.rcodes[rcodeString(binary.BigEndian.Uint16(buf[2:4]))]++
+			break
+		}
+	}
+}
+
+func benchNames(list, file string) ([]string, error) {
+	var names []string
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				names = append(names, strings.TrimSuffix(line, "."))
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, n := range strings.Split(list, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, strings.TrimSuffix(n, "."))
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no names to query")
+	}
+	return names, nil
+}
+
+func benchTypes(spec string) ([]uint16, error) {
+	var types []uint16
+	for _, item := range strings.Split(spec, ",") {
+		name, weight, hasWeight := strings.Cut(strings.TrimSpace(item), "=")
+		t, ok := parseType(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %q", name)
+		}
+		n := 1
+		if hasWeight {
+			var err error
+			if n, err = strconv.Atoi(weight); err != nil || n < 1 || n > 100 {
+				return nil, fmt.Errorf("invalid weight %q for %s (want 1-100)", weight, name)
+			}
+		}
+		for i := 0; i < n; i++ {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+func setBroadcast(fd uintptr) error {
+	return errors.New("broadcast sockets are not supported on " + runtime.GOOS)
+}
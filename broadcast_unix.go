@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// setBroadcast allows sending to broadcast addresses, which DHCP replies to
+// clients without an address need.
+func setBroadcast(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+}
@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// setBroadcast allows sending to broadcast addresses, which DHCP replies to
+// clients without an address need.
+func setBroadcast(fd uintptr) error {
+	return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_BROADCAST, 1)
+}
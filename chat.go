@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+const defaultChatTemplate = `:rotating_light: *{{.Kind}}* alert: {{.Message}} ({{.Time.Format "2006-01-02 15:04:05 MST"}})`
+
+// chatConfig configures a Slack or Discord incoming webhook. Template is a
+// text/template executed with the alert; fields are .Time, .Kind, .Client,
+// .QName, .QType, .Rule, .Source and .Message.
+type chatConfig struct {
+	WebhookURL    string `yaml:"webhook_url"`
+	Template      string `yaml:"template"`
+	Username      string `yaml:"username"` // Discord only
+	notifyOptions `yaml:",inline"`
+}
+
+// chatNotifier posts templated alert messages to a Slack or Discord
+// incoming webhook. The two only differ in the JSON field carrying the text.
+type chatNotifier struct {
+	kind     string // "slack" or "discord"
+	url      string
+	username string
+	tmpl     *template.Template
+	client   *http.Client
+}
+
+func newChatNotifier(kind string, cfg chatConfig) (*chatNotifier, error) {
+	u, err := url.Parse(cfg.WebhookURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s webhook_url %q", kind, cfg.WebhookURL)
+	}
+	text := cfg.Template
+	if text == "" {
+		text = defaultChatTemplate
+	}
+	tmpl, err := template.New(kind).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", kind, err)
+	}
+	username := cfg.Username
+	if username == "" {
+		username = "DeceptiveDNS"
+	}
+	return &chatNotifier{kind: kind, url: cfg.WebhookURL, username: username, tmpl: tmpl, client: &http.Client{}}, nil
+}
+
+func (c *chatNotifier) String() string {
+	return c.kind + " " + c.url
+}
+
+// slackEscaper escapes the characters Slack reads as markup, so names from
+// queries can't mention channels or make links.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (c *chatNotifier) Notify(ctx context.Context, a *alert) error {
+	if c.kind == "slack" {
+		e := *a
+		for _, f := range []*string{&e.Kind, &e.Client, &e.QName, &e.QType, &e.Rule, &e.Source, &e.Message, &e.Session} {
+			*f = slackEscaper.Replace(*f)
+		}
+		a = &e
+	}
+	var msg bytes.Buffer
+	if err := c.tmpl.Execute(&msg, a); err != nil {
+		return err
+	}
+
+	var payload any
+	switch c.kind {
+	case "slack":
+		payload = map[string]string{"text": msg.String()}
+	case "discord":
+		// Nothing in an alert may ping anyone, such as a query for
+		// @everyone.example
+		payload = map[string]any{"content": msg.String(), "username": c.username, "allowed_mentions": map[string][]string{"parse": {}}}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, c.client, c.url, nil, body)
+}
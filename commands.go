@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	// Assigned in init because helpCommand refers back to the table
+	commands = []command{
+		{"serve", "Run the DNS server (the default when only flags are given)", serveCommand},
+		{"validate", "Check a config file without starting the server", validateCommand},
+		{"query", "Send a DNS question and print the answer", queryCommand},
+		{"bench", "Load a DNS server and report latency percentiles", benchCommand},
+		{"rules", "Explain which rule would answer a name", rulesCommand},
+		{"import", "Convert a hosts file or domain list into config rules", importCommand},
+		{"querylog", "Search the SQLite query log", querylogCommand},
+		{"export", "Bundle a session's queries, alerts, capture and config into an archive", exportCommand},
+		{"pdns", "Look up names and addresses in the passive DNS database", pdnsCommand},
+		{"honeytoken", "Generate, list and revoke honeytoken names", honeytokenCommand},
+		{"stats", "Show a running server's busiest rules, names and clients", statsCommand},
+		{"ctl", "Send a command to a running server's control socket", ctlCommand},
+		{"service", "Install or control the Windows service", serviceCommand},
+		{"version", "Print version information", versionCommand},
+		{"help", "Show this list", helpCommand},
+	}
+}
+
+// runCommand dispatches args to a subcommand. Flags without a subcommand,
+// or no arguments at all, mean "serve", so existing command lines and
+// service definitions keep working.
+func runCommand(args []string) int {
+	help := len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help")
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && !help) {
+		return serveCommand(args)
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	if !help {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	}
+	helpCommand(nil)
+	return 2
+}
+
+func helpCommand([]string) int {
+	fmt.Fprintln(os.Stderr, "Usage: DeceptiveDNS <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `Run "DeceptiveDNS <command> -h" for the flags of a command.`)
+	return 0
+}
+
+func versionCommand([]string) int {
+	fmt.Printf("DeceptiveDNS %s (%s, %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" || s.Key == "vcs.time" || s.Key == "vcs.modified" {
+				fmt.Printf("  %s %s\n", s.Key, s.Value)
+			}
+		}
+	}
+	return 0
+}
+
+// importCommand implements "import", which turns a hosts file (as used by
+// ad-block lists), a plain list of domains, or a CSV file of
+// domain,ip,canary into YAML rules for the config file.
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "auto", "Input format: hosts, list, csv or auto")
+	ip := fs.String("ip", "", "Answer for imported rules, overriding addresses in the input")
+	canary := fs.Bool("canary", false, "Mark every imported rule as a canary")
+	out := fs.String("o", "", "Write the rules to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *ip != "" && net.ParseIP(*ip) == nil && !answerTemplates[*ip] {
+		fmt.Fprintf(os.Stderr, "invalid IP address or answer template %q\n", *ip)
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	rules, err := parseRuleImport(in, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	seen := make(map[string]bool)
+	var kept []*rule
+	for _, r := range rules {
+		if *ip != "" {
+			r.IP = *ip
+		}
+		r.Canary = r.Canary || *canary
+		r.Domain = normalizeName(r.Domain)
+		if seen[r.Domain] {
+			continue
+		}
+		if err := r.validate(); err != nil {
+			fmt.Fprintln(os.Stderr, "skipping:", err)
+			continue
+		}
+		seen[r.Domain] = true
+		kept = append(kept, r)
+	}
+
+	data, err := yaml.Marshal(map[string][]*rule{"rules": kept})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(data)
+	} else if err := os.WriteFile(*out, data, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "imported %d rules\n", len(kept))
+	return 0
+}
+
+// hostsSkip lists names found in stock hosts files that should never
+// become rules.
+var hostsSkip = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+func parseRuleImport(r io.Reader, format string) ([]*rule, error) {
+	br := bufio.NewReader(r)
+	if format == "auto" {
+		head, _ := br.Peek(4096)
+		format = detectImportFormat(string(head))
+	}
+	switch format {
+	case "csv":
+		cr := csv.NewReader(br)
+		cr.Comment = '#'
+		cr.FieldsPerRecord = -1
+		var rules []*rule
+		for {
+			rec, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return rules, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			rl := &rule{Domain: strings.TrimSpace(rec[0])}
+			if rl.Domain == "" || rl.Domain == "domain" {
+				continue // blank line or header
+			}
+			if len(rec) > 1 {
+				rl.IP = strings.TrimSpace(rec[1])
+			}
+			if len(rec) > 2 {
+				rl.Canary, _ = strconv.ParseBool(strings.TrimSpace(rec[2]))
+			}
+			rules = append(rules, rl)
+		}
+	case "hosts", "list":
+		var rules []*rule
+		sc := bufio.NewScanner(br)
+		for sc.Scan() {
+			line, _, _ := strings.Cut(sc.Text(), "#")
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if format == "list" {
+				rl := &rule{Domain: fields[0]}
+				if len(fields) > 1 {
+					rl.IP = fields[1]
+				}
+				rules = append(rules, rl)
+				continue
+			}
+			// "0.0.0.0" and loopback sinkhole addresses in block lists mean
+			// "this name", not an answer worth keeping
+			addr := net.ParseIP(fields[0])
+			if addr == nil {
+				continue
+			}
+			for _, name := range fields[1:] {
+				if hostsSkip[strings.ToLower(name)] {
+					continue
+				}
+				rl := &rule{Domain: name}
+				if !addr.IsUnspecified() && !addr.IsLoopback() {
+					rl.IP = fields[0]
+				}
+				rules = append(rules, rl)
+			}
+		}
+		return rules, sc.Err()
+	default:
+		return nil, fmt.Errorf("unknown import format %q (want hosts, list, csv or auto)", format)
+	}
+}
+
+func detectImportFormat(head string) string {
+	for _, line := range strings.Split(head, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.Contains(fields[0], ",") {
+			return "csv"
+		}
+		if net.ParseIP(fields[0]) != nil {
+			return "hosts"
+		}
+		return "list"
+	}
+	return "list"
+}
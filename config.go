@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the optional YAML configuration file given with -config. Flags
+// cover the simple single-domain case; the file adds multiple rules and
+// notification sinks.
+type config struct {
+	Rules       []*rule           `yaml:"rules"`
+	Services    []*serviceConfig  `yaml:"services"`
+	Alerts      alertsConfig      `yaml:"alerts"`
+	Detection   detectionConfig   `yaml:"detection"`
+	Events      eventsConfig      `yaml:"events"`
+	API         apiConfig         `yaml:"api"`
+	AXFR        axfrConfig        `yaml:"axfr"`
+	TSIG        tsigConfig        `yaml:"tsig"`
+	Steering    steeringConfig    `yaml:"steering"`
+	Connections connectionsConfig `yaml:"connections"`
+	Replication replicationConfig `yaml:"replication"`
+	QTypes      map[string]string `yaml:"qtypes"` // action by query type for the rules that answer (see qtypePolicy)
+	Notice      noticeConfig      `yaml:"notice"`
+	Listen      string            `yaml:"listen"` // used unless -listen is given
+
+	// Named scenarios selected with -profile, each overriding the
+	// top-level settings it sets
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+	profile  string               // the one applied, if any
+
+	// Threat intelligence feeds whose domains become rules
+	Feeds []feedConfig `yaml:"feeds"`
+
+	// Client software signatures for -fingerprint, tried before the
+	// built-in ones
+	Fingerprints []fingerprintSignature `yaml:"fingerprints"`
+}
+
+// loadConfig reads and strictly decodes path; unknown keys are errors so
+// typos don't silently disable a rule or sink. A non-empty profile is then
+// applied on top.
+func loadConfig(path, profile string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if profile != "" {
+		if err := cfg.applyProfile(data, profile); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		cfg.profile = profile
+	}
+	return &cfg, nil
+}
+
+// applyProfile decodes the named profile over cfg. Keys the profile sets
+// replace the top-level ones: lists such as rules are replaced whole, while
+// sections such as alerts are merged key by key. data is the whole file.
+func (cfg *config) applyProfile(data []byte, name string) error {
+	node, ok := cfg.Profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile %q (profiles: %s)", name, strings.Join(cfg.profileNames(), ", "))
+	}
+	if node.Kind == 0 || node.ShortTag() == "!!null" { // an empty profile
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: profile %s is not a mapping", node.Line, name)
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == "profiles" {
+			return fmt.Errorf("line %d: profile %s: profiles can't be nested", node.Content[i].Line, name)
+		}
+	}
+
+	// Node.Decode can't reject unknown keys, so the profile's own lines go
+	// through a strict decoder, at their place in the file so that errors
+	// name the right line
+	src := profileSource(data, name)
+	if src == nil {
+		if src, _ = yaml.Marshal(&node); src == nil {
+			return fmt.Errorf("profile %s could not be read", name)
+		}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(src))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("profile %s: %v", name, err)
+	}
+	return nil
+}
+
+// profileSource returns the block of data holding the named profile's
+// settings, preceded by blank lines standing in for the lines above it, or
+// nil if the profile isn't a block mapping on lines of its own.
+func profileSource(data []byte, name string) []byte {
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	root := doc.Content[0].Content
+	for i := 0; i+1 < len(root); i += 2 {
+		if root[i].Value != "profiles" || root[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+		end := 0 // the line after the profile, 0 for the end of the file
+		if i+2 < len(root) {
+			end = root[i+2].Line
+		}
+		profiles := root[i+1].Content
+		for j := 0; j+1 < len(profiles); j += 2 {
+			if profiles[j].Value != name {
+				continue
+			}
+			value := profiles[j+1]
+			if value.Style&yaml.FlowStyle != 0 || value.Line == profiles[j].Line {
+				return nil
+			}
+			if j+2 < len(profiles) {
+				end = profiles[j+2].Line
+			}
+			lines := strings.SplitAfter(string(data), "\n")
+			if end == 0 || end > len(lines) {
+				end = len(lines) + 1
+			}
+			return []byte(strings.Repeat("\n", value.Line-1) + strings.Join(lines[value.Line-1:end-1], ""))
+		}
+	}
+	return nil
+}
+
+// profileNames returns the names of the profiles in cfg, sorted.
+func (cfg *config) profileNames() []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// flagPassed reports whether the flag name was set on fs's command line,
+// rather than left at its default, so the config file's value can apply.
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
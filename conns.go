@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	connDefaultMax          = 128              // connections served at once by a listener
+	connDefaultMaxPerClient = 16               // of those, from one client address
+	connDefaultIdleTimeout  = 10 * time.Second // between messages on one connection
+)
+
+var (
+	tcpConnsRefused       = expvar.NewInt("tcp_conns_refused")
+	tcpConnsRefusedClient = expvar.NewInt("tcp_conns_refused_client")
+)
+
+// connectionsConfig is the "connections" section of the config file:
+// limits on the connections of the TCP and DNS over TLS listeners, which
+// each listener applies on its own.
+type connectionsConfig struct {
+	TCP connLimits `yaml:"tcp"`
+	DoT connLimits `yaml:"dot"`
+}
+
+// connLimits bounds a listener's connections, so that a client opening
+// them without end, or holding them open, can't use up the server's file
+// descriptors or crowd out other clients.
+type connLimits struct {
+	MaxConns     int           `yaml:"max_conns"`      // served at once, default 128; more are closed on accept
+	MaxPerClient int           `yaml:"max_per_client"` // served at once for one client address, default 16
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`   // a connection may wait for its next message, default 10s
+}
+
+// validate fills in the defaults of the limits not set.
+func (c *connectionsConfig) validate() error {
+	for _, l := range []struct {
+		name   string
+		limits *connLimits
+	}{{"tcp", &c.TCP}, {"dot", &c.DoT}} {
+		if err := l.limits.validate(); err != nil {
+			return fmt.Errorf("connections: %s: %v", l.name, err)
+		}
+	}
+	return nil
+}
+
+func (l *connLimits) validate() error {
+	if l.MaxConns < 0 || l.MaxPerClient < 0 || l.IdleTimeout < 0 {
+		return errors.New("max_conns, max_per_client and idle_timeout must not be negative")
+	}
+	if l.MaxConns == 0 {
+		l.MaxConns = connDefaultMax
+	}
+	if l.MaxPerClient == 0 {
+		l.MaxPerClient = min(connDefaultMaxPerClient, l.MaxConns)
+	}
+	if l.IdleTimeout == 0 {
+		l.IdleTimeout = connDefaultIdleTimeout
+	}
+	if l.MaxPerClient > l.MaxConns {
+		return fmt.Errorf("max_per_client %d is above max_conns %d", l.MaxPerClient, l.MaxConns)
+	}
+	return nil
+}
+
+// connLimiter holds a listener to its connLimits, counting the connections
+// it accepts, refuses and closes in its stats:
+//
+//	conns_accepted        connections served
+//	conns_closed          served connections since closed, for any reason
+//	conns_idle            of those, closed for idling past idle_timeout
+//	conns_refused         closed on accept, the listener being at max_conns
+//	conns_refused_client  closed on accept, their client being at max_per_client
+//
+// The connections open are conns_accepted less conns_closed, and are also
+// in the stats API under connections.
+type connLimiter struct {
+	limits connLimits
+	stats  *expvar.Map
+
+	mu      sync.Mutex
+	open    int
+	clients map[netip.Addr]int // connections open, by client
+}
+
+func newConnLimiter(limits connLimits, stats *expvar.Map) *connLimiter {
+	return &connLimiter{limits: limits, stats: stats, clients: make(map[netip.Addr]int)}
+}
+
+// acquire reports whether a connection from client may be served, counting
+// it as open if so. Those that may are released when they close.
+func (cl *connLimiter) acquire(client netip.Addr) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	switch {
+	case cl.open >= cl.limits.MaxConns:
+		tcpConnsRefused.Add(1)
+		cl.stats.Add("conns_refused", 1)
+		return false
+	case cl.clients[client] >= cl.limits.MaxPerClient:
+		tcpConnsRefusedClient.Add(1)
+		cl.stats.Add("conns_refused_client", 1)
+		return false
+	}
+	cl.open++
+	cl.clients[client]++
+	cl.stats.Add("conns_accepted", 1)
+	return true
+}
+
+// release counts a connection from client as closed, idle if it idled
+// past the timeout.
+func (cl *connLimiter) release(client netip.Addr, idle bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.open--
+	if cl.clients[client]--; cl.clients[client] <= 0 {
+		delete(cl.clients, client)
+	}
+	cl.stats.Add("conns_closed", 1)
+	if idle {
+		cl.stats.Add("conns_idle", 1)
+	}
+}
+
+// connections returns how many connections are open.
+func (cl *connLimiter) connections() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.open
+}
+
+// connections returns the connections open on each TCP and DoT listener,
+// by the name of its stats.
+func (s *dnsServer) connections() map[string]int {
+	out := make(map[string]int)
+	s.connLimiters.Range(func(k, v any) bool {
+		out[k.(string)] = v.(*connLimiter).connections()
+		return true
+	})
+	return out
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// controlServer accepts dnsmasq-style line commands on a unix socket, for
+// scripts on the same host. Access is limited by the socket's file mode.
+// Each command gets one or more lines of output ending with "OK" or
+// "ERR <message>".
+type controlServer struct {
+	dns    *dnsServer
+	reload func() error
+	ln     net.Listener
+	path   string
+}
+
+const controlHelp = `add <domain> [ip] [canary]   add or replace a rule
+del <domain>                 delete a rule
+list                         list rules
+stats                        show counters
+top [window] [n]             busiest rules, names and clients, default 1h 10
+reload                       reload rules from the config file
+flush-cache                  forget seen clients
+session [start <name>|end]   show, start or end the session
+help                         show this help`
+
+func startControlServer(path string, dns *dnsServer, reload func() error) (*controlServer, error) {
+	// A socket left behind by a previous run would make Listen fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	// Bind in a directory only we can enter and restrict the socket there
+	// before moving it into place, so no one can connect in between
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	c := &controlServer{dns: dns, reload: reload, ln: ln, path: path}
+	slog.Info("Control socket listening", "path", path)
+	go c.serve()
+	return c, nil
+}
+
+func (c *controlServer) Close() error {
+	err := c.ln.Close()
+	os.Remove(c.path)
+	return err
+}
+
+func (c *controlServer) serve() {
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Control socket stopped", "err", err)
+			}
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		if !sc.Scan() {
+			return
+		}
+		args := strings.Fields(sc.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "exit" {
+			return
+		}
+		out, err := c.run(args)
+		if out != "" {
+			io.WriteString(conn, strings.TrimSuffix(out, "\n")+"\n")
+		}
+		if err != nil {
+			fmt.Fprintf(conn, "ERR %v\n", err)
+		} else {
+			io.WriteString(conn, "OK\n")
+		}
+	}
+}
+
+func (c *controlServer) run(args []string) (string, error) {
+	switch cmd := args[0]; cmd {
+	case "add":
+		if len(args) < 2 || len(args) > 4 {
+			return "", errors.New("usage: add <domain> [ip] [canary]")
+		}
+		r := &rule{Domain: args[1]}
+		for _, a := range args[2:] {
+			if a == "canary" {
+				r.Canary = true
+			} else {
+				r.IP = a
+			}
+		}
+		if err := c.dns.rules.add(r); err != nil {
+			return "", err
+		}
+		slog.Info("Rule added", "domain", r.Domain, "ip", r.IP, "via", "control")
+		return "", nil
+	case "del":
+		if len(args) != 2 {
+			return "", errors.New("usage: del <domain>")
+		}
+		if !c.dns.rules.remove(args[1]) {
+			return "", fmt.Errorf("no rule for %s", args[1])
+		}
+		slog.Info("Rule deleted", "domain", args[1], "via", "control")
+		return "", nil
+	case "list":
+		var b strings.Builder
+		for _, r := range c.dns.rules.list() {
+			ip := r.IP
+			if len(r.IPs) > 0 {
+				ip = strings.Join(r.IPs, ",")
+			}
+			if ip == "" {
+				ip = "-"
+			}
+			fmt.Fprintf(&b, "%s %s", r.Domain, ip)
+			if r.Canary {
+				b.WriteString(" canary")
+			}
+			b.WriteByte('\n')
+		}
+		return b.String(), nil
+	case "stats":
+		st := c.dns.stats()
+		var b strings.Builder
+		fmt.Fprintf(&b, "uptime_seconds %d\nrules %d\nclients_seen %d\n", st.UptimeSeconds, st.Rules, st.ClientsSeen)
+		names := make([]string, 0, len(st.Counters))
+		for k := range st.Counters {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			fmt.Fprintf(&b, "%s %d\n", k, st.Counters[k])
+		}
+		addrs := make([]string, 0, len(st.Listeners))
+		for addr := range st.Listeners {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			keys := make([]string, 0, len(st.Listeners[addr]))
+			for k := range st.Listeners[addr] {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(&b, "listener %s %s %d\n", addr, k, st.Listeners[addr][k])
+			}
+		}
+		return b.String(), nil
+	case "top":
+		if len(args) > 3 {
+			return "", errors.New("usage: top [window] [n]")
+		}
+		window, n, err := parseTopArgs(argAt(args, 1), argAt(args, 2))
+		if err != nil {
+			return "", err
+		}
+		rep, err := c.dns.top.report(window, n, time.Now())
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "window %s\nsince %s\nqueries %d\n", rep.Window, rep.Since.Format(time.RFC3339), rep.Queries)
+		for _, t := range []struct {
+			kind    string
+			entries []topEntry
+		}{{"rule", rep.Rules}, {"name", rep.Names}, {"client", rep.Clients}} {
+			for _, e := range t.entries {
+				fmt.Fprintf(&b, "%s %s %d\n", t.kind, e.Key, e.Count)
+			}
+		}
+		return b.String(), nil
+	case "reload":
+		if c.reload == nil {
+			return "", errors.New("no config file to reload")
+		}
+		if err := c.reload(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("rules %d", c.dns.rules.len()), nil
+	case "flush-cache":
+		n := c.dns.flushCaches()
+		slog.Info("Caches flushed", "clients", n, "via", "control")
+		return fmt.Sprintf("clients %d", n), nil
+	case "session":
+		switch {
+		case len(args) == 1:
+			s := activeSession.Load()
+			if s == nil {
+				return "", errors.New("no session is active")
+			}
+			return fmt.Sprintf("session %s\nstarted %s", s.Name, s.Started.Format(time.RFC3339)), nil
+		case len(args) == 3 && args[1] == "start":
+			return "", startSession(args[2], "control")
+		case len(args) == 2 && args[1] == "end":
+			if endSession("control") == nil {
+				return "", errors.New("no session is active")
+			}
+			return "", nil
+		}
+		return "", errors.New("usage: session [start <name>|end]")
+	case "help":
+		return controlHelp, nil
+	default:
+		return "", fmt.Errorf("unknown command %q (try help)", cmd)
+	}
+}
+
+// argAt returns args[i], or "" if there are fewer arguments.
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// ctlCommand implements "ctl", which sends one command to the control
+// socket and prints the reply, e.g.
+//
+//	DeceptiveDNS ctl add '*.corp.local' 10.0.0.9
+func ctlCommand(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	socket := fs.String("socket", "/run/deceptivedns.sock", "Control socket of the running server")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: DeceptiveDNS ctl [-socket path] <command> [args...]")
+		fmt.Fprintln(os.Stderr, controlHelp)
+		return 2
+	}
+	lines, err := controlRequest(*socket, strings.Join(fs.Args(), " "))
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// controlRequest sends one command to the control socket at path and
+// returns the lines of its reply, without the final OK. A reply ending in
+// ERR is returned as an error, along with the lines before it.
+func controlRequest(path, command string) ([]string, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, command)
+
+	var lines []string
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "OK":
+			return lines, nil
+		case strings.HasPrefix(line, "ERR "):
+			return lines, errors.New(strings.TrimPrefix(line, "ERR "))
+		}
+		lines = append(lines, line)
+	}
+	return lines, errors.New("connection closed without a reply")
+}
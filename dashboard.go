@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// registerDashboard serves the single-page dashboard under /ui/. The page
+// itself is static and public; it calls the API with the token the user
+// enters, so the API scopes still apply.
+func (a *apiServer) registerDashboard() {
+	sub, _ := fs.Sub(dashboardFiles, "dashboard")
+	a.mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServerFS(sub)))
+	a.mux.Handle("GET /{$}", http.RedirectHandler("/ui/", http.StatusFound))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// startDebugServer exposes net/http/pprof and expvar counters on addr. It is
+// meant to be bound to localhost; anything else gets a warning since the
+// profiling endpoints are unauthenticated.
+func startDebugServer(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid debug address %q: %v", addr, err)
+	}
+	if !isLoopbackHost(host) {
+		slog.Warn("Debug endpoint is not bound to localhost", "addr", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("Debug endpoint listening", "url", "http://"+ln.Addr().String()+"/debug/pprof/")
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("Debug endpoint stopped", "err", err)
+		}
+	}()
+	return nil
+}
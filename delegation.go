@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// nameServer is a zone's name server, with the address its glue records
+// and A or AAAA queries for it answer with, or nil for the default answer.
+type nameServer struct {
+	name string
+	addr net.IP
+}
+
+// parseNameServers parses a name server -> address map from the config
+// file, sorted by name. An empty address is the default answer.
+func parseNameServers(m map[string]string) ([]nameServer, error) {
+	var out []nameServer
+	for name, addr := range m {
+		ns := nameServer{name: normalizeName(name)}
+		if _, err := appendName(nil, ns.name); err != nil || ns.name == "" {
+			return nil, fmt.Errorf("invalid name server %q", name)
+		}
+		if addr != "" {
+			if ns.addr = net.ParseIP(addr); ns.addr == nil {
+				return nil, fmt.Errorf("invalid address %q for name server %s", addr, ns.name)
+			}
+		}
+		out = append(out, ns)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+// setDelegations sets up the name servers of the zones served and the
+// delegations to child zones served elsewhere from cfg. Zones without
+// name servers of their own get ns1.<zone>.
+func (a *axfrServer) setDelegations(cfg axfrConfig) error {
+	a.nameServers = make(map[string][]nameServer)
+	a.delegations = make(map[string][]nameServer)
+	for zone, m := range cfg.NameServers {
+		zone = normalizeName(zone)
+		if !a.serves(zone) {
+			return fmt.Errorf("name_servers: %s is not in zones", zone)
+		}
+		servers, err := parseNameServers(m)
+		if err != nil {
+			return fmt.Errorf("name_servers: %s: %v", zone, err)
+		}
+		if len(servers) > 0 {
+			a.nameServers[zone] = servers
+		}
+	}
+	for _, zone := range a.zones {
+		if a.nameServers[zone] == nil {
+			a.nameServers[zone] = []nameServer{{name: "ns1." + zone}}
+		}
+	}
+	for child, m := range cfg.Delegations {
+		child = normalizeName(child)
+		switch {
+		case a.serves(child):
+			return fmt.Errorf("delegations: %s is in zones, so it is delegated to its name_servers", child)
+		case a.parent(child) == "":
+			return fmt.Errorf("delegations: %s is not below any of zones", child)
+		}
+		servers, err := parseNameServers(m)
+		if err != nil {
+			return fmt.Errorf("delegations: %s: %v", child, err)
+		}
+		if len(servers) == 0 {
+			return fmt.Errorf("delegations: %s has no name servers", child)
+		}
+		for _, ns := range servers {
+			if ns.addr == nil && inZone(ns.name, child) {
+				return fmt.Errorf("delegations: %s: name server %s is inside the zone, so it needs a glue address", child, ns.name)
+			}
+		}
+		a.delegations[child] = servers
+	}
+	return nil
+}
+
+// serves reports whether zone is one of the zones served.
+func (a *axfrServer) serves(zone string) bool {
+	return slices.Contains(a.zones, zone)
+}
+
+// parent returns the most specific zone served strictly above name, or "".
+func (a *axfrServer) parent(name string) string {
+	var parent string
+	for _, z := range a.zones {
+		if z != name && inZone(name, z) && len(z) > len(parent) {
+			parent = z
+		}
+	}
+	return parent
+}
+
+// children returns the zones zone delegates to, sorted: the zones served
+// whose closest parent it is, and the delegations below it to zones served
+// elsewhere.
+func (a *axfrServer) children(zone string) []string {
+	var out []string
+	for _, z := range a.zones {
+		if a.parent(z) == zone {
+			out = append(out, z)
+		}
+	}
+	for child := range a.delegations {
+		if a.parent(child) == zone {
+			out = append(out, child)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// servers returns the name servers of zone, served here or delegated to.
+func (a *axfrServer) servers(zone string) []nameServer {
+	if ns, ok := a.nameServers[zone]; ok {
+		return ns
+	}
+	return a.delegations[zone]
+}
+
+// delegation returns the zone served elsewhere that name is at or below,
+// for a referral to its name servers, or "" if there is none.
+func (a *axfrServer) delegation(name string) string {
+	if a == nil {
+		return ""
+	}
+	name = normalizeName(name)
+	var cut string
+	for child := range a.delegations {
+		if inZone(name, child) && len(child) > len(cut) {
+			cut = child
+		}
+	}
+	// A zone served below the cut takes it back
+	if cut != "" && len(a.parent(name)) > len(cut) {
+		return ""
+	}
+	return cut
+}
+
+// belowCut reports whether name, in zone, is in a zone zone delegates to,
+// so a transfer of zone leaves it out.
+func (a *axfrServer) belowCut(name, zone string) bool {
+	for _, child := range a.children(zone) {
+		if inZone(name, child) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameServerRule returns a rule answering A and AAAA queries for name if
+// it's the name server of a zone served or delegated to, with its address
+// or the default answer, or nil if it isn't one.
+func (a *axfrServer) nameServerRule(name string) *rule {
+	if a == nil {
+		return nil
+	}
+	name = normalizeName(name)
+	for _, servers := range []map[string][]nameServer{a.nameServers, a.delegations} {
+		for _, list := range servers {
+			for _, ns := range list {
+				if ns.name == name && (ns.addr != nil || a.authoritative(name)) {
+					return &rule{Domain: ns.name, addr: ns.addr}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// authoritative reports whether name is at or below a zone served here.
+func (a *axfrServer) authoritative(name string) bool {
+	return a.parent(name) != "" || a.serves(name)
+}
+
+// nsRecords returns the NS records of zone, owned by zone, with ttl.
+func (a *axfrServer) nsRecords(zone string, ttl uint32) []dnsResourceRecord {
+	var out []dnsResourceRecord
+	for _, ns := range a.servers(zone) {
+		rdata, _ := appendName(nil, ns.name)
+		out = append(out, dnsResourceRecord{Name: zone, Type: dnsTypeNS, Class: dnsClassIN, TTL: ttl, RData: rdata})
+	}
+	return out
+}
+
+// glue returns the address records of the name servers of child that are
+// inside it, which resolvers couldn't find otherwise, as a client asking
+// on local would get them.
+func (s *dnsServer) glue(child string, local, client netip.Addr) []dnsResourceRecord {
+	var out []dnsResourceRecord
+	for _, ns := range s.axfr.servers(child) {
+		if !inZone(ns.name, child) {
+			continue
+		}
+		r := &rule{Domain: ns.name, addr: ns.addr}
+		for _, t := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			if ip := s.answerFor(r, t, local, client); ip != nil {
+				out = append(out, dnsResourceRecord{Name: ns.name, Type: t, Class: dnsClassIN, TTL: axfrTTL, Data: ip})
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package main
+
+import "time"
+
+// detectionConfig is the "detection" section of the config file:
+// heuristics that look for malware in the names clients query, and raise
+// alerts when they find it.
+type detectionConfig struct {
+	DGA       dgaConfig    `yaml:"dga"`
+	Tunneling tunnelConfig `yaml:"tunneling"`
+	Rate      rateConfig   `yaml:"rate"`
+	Quota     quotaConfig  `yaml:"quota"`
+	Ban       banConfig    `yaml:"ban"`
+}
+
+// detectors are the detection heuristics enabled in a detectionConfig.
+type detectors struct {
+	dga    *dgaDetector
+	tunnel *tunnelDetector
+	rate   *rateDetector
+	quota  *quotaDetector
+	ban    *banList
+}
+
+func newDetectors(cfg detectionConfig) (*detectors, error) {
+	dga, err := newDGADetector(cfg.DGA)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := newTunnelDetector(cfg.Tunneling)
+	if err != nil {
+		return nil, err
+	}
+	rate, err := newRateDetector(cfg.Rate)
+	if err != nil {
+		return nil, err
+	}
+	quota, err := newQuotaDetector(cfg.Quota)
+	if err != nil {
+		return nil, err
+	}
+	ban, err := newBanList(cfg.Ban)
+	if err != nil {
+		return nil, err
+	}
+	return &detectors{dga: dga, tunnel: tunnel, rate: rate, quota: quota, ban: ban}, nil
+}
+
+// check runs ev past every detector, raising the alerts they return.
+func (d *detectors) check(ev *queryEvent, alerts *alerter) {
+	if d.dga != nil {
+		d.raise(d.dga.check(ev), alerts)
+	}
+	if d.tunnel != nil {
+		d.raise(d.tunnel.check(ev), alerts)
+	}
+	if d.rate != nil {
+		d.raise(d.rate.check(ev), alerts)
+	}
+	if d.quota != nil {
+		d.raise(d.quota.check(ev), alerts)
+	}
+}
+
+// raise raises al, if there is one, and bans its client if that kind of
+// alert does.
+func (d *detectors) raise(al *alert, alerts *alerter) {
+	if al == nil {
+		return
+	}
+	alerts.raise(al)
+	if d.ban != nil {
+		if b := d.ban.alerted(al); b != nil {
+			alerts.raise(b)
+		}
+	}
+}
+
+// offense counts a malformed message or a query over a rate limit, as
+// kind says, against client, raising an alert if that bans it.
+func (d *detectors) offense(client, kind string, now time.Time, alerts *alerter) {
+	if d.ban == nil {
+		return
+	}
+	if al := d.ban.offense(client, kind, now); al != nil {
+		alerts.raise(al)
+	}
+}
+
+// banned reports whether client is banned.
+func (d *detectors) banned(client string, now time.Time) bool {
+	return d.ban != nil && d.ban.banned(client, now)
+}
+
+// enforce returns what to do with a query from client: "drop" it, answer
+// it from the tunneling "sinkhole" or the "quota" sinkhole, or "" to
+// handle it as usual.
+func (d *detectors) enforce(client string, now time.Time) string {
+	if d.tunnel != nil {
+		if action := d.tunnel.enforce(client, now); action != "" {
+			return action
+		}
+	}
+	if d.quota != nil && d.quota.sinkholed(client, now) {
+		return "quota"
+	}
+	return ""
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dgaDetections = expvar.NewInt("dga_detections")
+
+const (
+	dgaDefaultThreshold = 0.4
+	dgaDefaultMinLength = 8
+	dgaModelBigrams     = 200 // how many of a model's most common bigrams count as common
+	dgaRealertAfter     = time.Hour
+	dgaMaxTracked       = 10000
+)
+
+// englishBigrams are the most common letter pairs in English text and in
+// popular domain names, used to score names when no model is configured.
+const englishBigrams = "th he in er an re on at en nd ti es or te of ed is it al ar st to nt ng " +
+	"se ha as ou io le ve co me de hi ri ro ic ne ea ra ce li ch ll be ma si om ur ca el ta la ns " +
+	"di fo ho pe ec pr no ct us ac ot il tr ly nc et ut ss so rs un lo wa ge ie wh ee wi em ad ol " +
+	"rt po we na ul ni ts mo ow pa im mi ai sh ir su id os iv ia am fi ci vi pl ig tu ev ld ry mp " +
+	"fe bl ab gh ty op wo sa ay ex ke fr oo av ag ap gr od bo sp rd do uc bu ei ov by rm ep tt oc " +
+	"fa ef cu rn sc gi da yo cr cl du ga qu ue ff ba ey ls va um pp ua up lu go ht ru ug ds lt pi " +
+	"rc rr eg au ck ew mu br bi pt ak pu ui rg ib tl ny ki rk ys ob mm fu ph og ms ye ud mb ip ub " +
+	"oi rl gu dr hr cc tw ft wn nu af hu nn eo vo rv nf gn sm fl ok nl my gl aw oa sy sl ps jo ks"
+
+// dgaConfig is the "dga" part of the "detection" section: flagging names
+// that look algorithmically generated, as malware using a domain generation
+// algorithm queries many of them to find its command server.
+type dgaConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	Threshold float64  `yaml:"threshold"`  // score from 0 to 1 at which a name is flagged, default 0.4
+	MinLength int      `yaml:"min_length"` // shorter names are never flagged, default 8
+	Model     string   `yaml:"model"`      // file of known-good domains, one per line, to learn common bigrams from
+	Allow     []string `yaml:"allow"`      // domains never flagged, along with their subdomains
+}
+
+// dgaDetector scores the registrable label of each queried name (the part
+// a domain generation algorithm makes up) on its length, character entropy,
+// digits, consonant runs and, above all, how many of its letter pairs are
+// common in real names. It alerts once an hour per client and domain.
+type dgaDetector struct {
+	threshold float64
+	minLength int
+	common    map[string]bool
+	allow     []string
+
+	mu      sync.Mutex
+	alerted map[string]time.Time // client and domain -> last alert
+}
+
+func newDGADetector(cfg dgaConfig) (*dgaDetector, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	d := &dgaDetector{
+		threshold: cfg.Threshold,
+		minLength: cfg.MinLength,
+		common:    make(map[string]bool),
+		alerted:   make(map[string]time.Time),
+	}
+	if d.threshold == 0 {
+		d.threshold = dgaDefaultThreshold
+	}
+	if d.threshold < 0 || d.threshold > 1 {
+		return nil, fmt.Errorf("dga: threshold %v is not between 0 and 1", cfg.Threshold)
+	}
+	if d.minLength == 0 {
+		d.minLength = dgaDefaultMinLength
+	}
+	for _, a := range cfg.Allow {
+		d.allow = append(d.allow, normalizeName(strings.TrimPrefix(a, "*.")))
+	}
+	if cfg.Model == "" {
+		for _, bg := range strings.Fields(englishBigrams) {
+			d.common[bg] = true
+		}
+		return d, nil
+	}
+	if err := d.loadModel(cfg.Model); err != nil {
+		return nil, fmt.Errorf("dga: model %s: %v", cfg.Model, err)
+	}
+	return d, nil
+}
+
+// loadModel learns the common bigrams from a list of known-good domains,
+// such as a top sites list. "rank,domain" CSV lines are accepted too.
+func (d *dgaDetector) loadModel(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	counts := make(map[string]int)
+	names := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.LastIndexByte(line, ','); i >= 0 {
+			line = line[i+1:]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		label := registrableLabel(normalizeName(line))
+		for i := 0; i+1 < len(label); i++ {
+			if isLetter(label[i]) && isLetter(label[i+1]) {
+				counts[label[i:i+2]]++
+			}
+		}
+		names++
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if names < 100 {
+		return errors.New("need at least 100 domains to learn from")
+	}
+	bigrams := make([]string, 0, len(counts))
+	for bg := range counts {
+		bigrams = append(bigrams, bg)
+	}
+	sort.Slice(bigrams, func(i, j int) bool { return counts[bigrams[i]] > counts[bigrams[j]] })
+	for _, bg := range bigrams[:min(len(bigrams), dgaModelBigrams)] {
+		d.common[bg] = true
+	}
+	return nil
+}
+
+// check returns an alert if ev's name looks generated and its client
+// hasn't been alerted about that domain recently. Internationalised names
+// are skipped, as their punycode always looks random.
+func (d *dgaDetector) check(ev *queryEvent) *alert {
+	name := normalizeName(ev.QName)
+	label := registrableLabel(name)
+	if len(label) < d.minLength || strings.HasPrefix(label, "xn--") || d.allowed(name) {
+		return nil
+	}
+	score := d.score(label)
+	if score < d.threshold {
+		return nil
+	}
+	dgaDetections.Add(1)
+
+	key := ev.Client + " " + label
+	d.mu.Lock()
+	last, ok := d.alerted[key]
+	if ok && ev.Time.Sub(last) < dgaRealertAfter {
+		d.mu.Unlock()
+		return nil
+	}
+	if len(d.alerted) >= dgaMaxTracked {
+		clear(d.alerted)
+	}
+	d.alerted[key] = ev.Time
+	d.mu.Unlock()
+
+	return &alert{
+		Time:    ev.Time,
+		Kind:    "dga",
+		Client:  ev.Client,
+		QName:   ev.QName,
+		QType:   ev.QType,
+		Rule:    ev.Rule,
+		Message: fmt.Sprintf("%s looked up %s, which looks algorithmically generated (score %.2f)", ev.Client, ev.QName, score),
+	}
+}
+
+func (d *dgaDetector) allowed(name string) bool {
+	for _, a := range d.allow {
+		if name == a || strings.HasSuffix(name, "."+a) {
+			return true
+		}
+	}
+	return false
+}
+
+// score rates label from 0 (looks like a word) to 1 (looks random).
+func (d *dgaDetector) score(label string) float64 {
+	var digits, pairs, commonPairs, run, maxRun int
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+		if isLetter(c) && !strings.ContainsRune("aeiouy", rune(c)) {
+			run++
+			maxRun = max(maxRun, run)
+		} else {
+			run = 0
+		}
+		if i+1 < len(label) && isLetter(c) && isLetter(label[i+1]) {
+			pairs++
+			if d.common[label[i:i+2]] {
+				commonPairs++
+			}
+		}
+	}
+	rarity := 1.0 // a label with no letter pairs is all digits and hyphens
+	if pairs > 0 {
+		rarity = clamp01(1 - float64(commonPairs)/float64(pairs)/0.6)
+	}
+	return 0.45*rarity +
+		0.15*clamp01(float64(len(label)-8)/12) +
+		0.15*clamp01((charEntropy(label)-2.5)/1.5) +
+		0.1*clamp01(float64(digits)/float64(len(label))*3) +
+		0.15*clamp01(float64(maxRun-3)/3)
+}
+
+// registrableLabel returns the label a domain owner chose: the one left of
+// the top-level domain, or of a two-letter country code's second-level
+// domain such as co.uk. Names with a single label have none.
+func registrableLabel(name string) string {
+	labels := strings.Split(name, ".")
+	if i := registrableIndex(labels); i >= 0 {
+		return labels[i]
+	}
+	return ""
+}
+
+// registrableIndex returns the index of the registrable label in labels,
+// or -1 if there is none.
+func registrableIndex(labels []string) int {
+	n := len(labels)
+	if n < 2 {
+		return -1
+	}
+	if n >= 3 && len(labels[n-1]) == 2 && len(labels[n-2]) <= 3 {
+		switch labels[n-2] {
+		case "co", "com", "net", "org", "gov", "ac", "edu", "ne", "or", "go":
+			return n - 3
+		}
+	}
+	return n - 2
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' }
+
+func clamp01(x float64) float64 { return max(0, min(1, x)) }
+
+// charEntropy is the Shannon entropy of s in bits per character.
+func charEntropy(s string) float64 {
+	var freq [256]int
+	for i := 0; i < len(s); i++ {
+		freq[s[i]]++
+	}
+	var h float64
+	for _, n := range freq {
+		if n > 0 {
+			p := float64(n) / float64(len(s))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
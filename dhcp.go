@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	dhcpOffers = expvar.NewInt("dhcp_offers")
+	dhcpAcks   = expvar.NewInt("dhcp_acks")
+	dhcpNaks   = expvar.NewInt("dhcp_naks")
+)
+
+// DHCP message types and options (RFC 2131, RFC 2132).
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+	dhcpInform   = 8
+
+	dhcpOptPad         = 0
+	dhcpOptSubnetMask  = 1
+	dhcpOptRouter      = 3
+	dhcpOptDNS         = 6
+	dhcpOptHostname    = 12
+	dhcpOptDomainName  = 15
+	dhcpOptRequestedIP = 50
+	dhcpOptLeaseTime   = 51
+	dhcpOptMessageType = 53
+	dhcpOptServerID    = 54
+	dhcpOptRenewalTime = 58
+	dhcpOptRebindTime  = 59
+	dhcpOptVendorClass = 60
+	dhcpOptWPAD        = 252
+	dhcpOptEnd         = 255
+
+	dhcpHeaderLen = 240 // fixed BOOTP fields and the magic cookie
+	dhcpMagic     = 0x63825363
+	dhcpOfferHold = time.Minute // how long an offered address is held for the request
+)
+
+var dhcpMessageNames = map[byte]string{
+	dhcpDiscover: "DISCOVER", dhcpOffer: "OFFER", dhcpRequest: "REQUEST", dhcpDecline: "DECLINE",
+	dhcpAck: "ACK", dhcpNak: "NAK", dhcpRelease: "RELEASE", dhcpInform: "INFORM",
+}
+
+// dhcpConfig is what the DHCP server hands out. DNS is always this server.
+type dhcpConfig struct {
+	first, last netip.Addr // address pool, inclusive
+	netmask     net.IP
+	router      net.IP // optional
+	domain      string // optional
+	wpadURL     string // optional
+	lease       time.Duration
+}
+
+// parseDHCPRange parses "192.168.1.100-192.168.1.200".
+func parseDHCPRange(s string) (first, last netip.Addr, err error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return first, last, fmt.Errorf("invalid DHCP range %q, want first-last", s)
+	}
+	if first, err = netip.ParseAddr(strings.TrimSpace(a)); err == nil {
+		last, err = netip.ParseAddr(strings.TrimSpace(b))
+	}
+	if err != nil || !first.Is4() || !last.Is4() || last.Less(first) {
+		return first, last, fmt.Errorf("invalid DHCP range %q, want two IPv4 addresses, lowest first", s)
+	}
+	return first, last, nil
+}
+
+type dhcpLease struct {
+	addr    netip.Addr
+	expires time.Time
+	bound   bool // acknowledged rather than just offered
+}
+
+// dhcpServer is a minimal DHCP server, enough to lease addresses to
+// clients on the local segment and hand them this host as their resolver.
+type dhcpServer struct {
+	cfg      dhcpConfig
+	serverID net.IP // our address, which clients send requests back to
+	dns      net.IP
+
+	mu     sync.Mutex
+	leases map[string]*dhcpLease // by client hardware address
+	owners map[netip.Addr]string // address -> hardware address
+}
+
+func newDHCPServer(cfg dhcpConfig, serverID net.IP) *dhcpServer {
+	return &dhcpServer{
+		cfg:      cfg,
+		serverID: serverID.To4(),
+		dns:      serverID.To4(),
+		leases:   make(map[string]*dhcpLease),
+		owners:   make(map[netip.Addr]string),
+	}
+}
+
+// listenDHCP opens UDP port 67, where clients broadcast, and adds a listener
+// for it.
+func (s *dnsServer) listenDHCP() error {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) { err = setBroadcast(fd) })
+		if cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return err
+		}
+		return s.socketOptions(network, address, c)
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", "0.0.0.0:67")
+	if err != nil {
+		return err
+	}
+	conn := pc.(*net.UDPConn)
+	l := &listener{conn: conn, addr: conn.LocalAddr().String(), stats: new(expvar.Map), proto: "dhcp"}
+	listenerStats.Set(l.addr, l.stats)
+	s.listeners = append(s.listeners, l)
+	return nil
+}
+
+// handleDHCP answers one DHCP message from a client.
+func (s *dnsServer) handleDHCP(l *listener, addr netip.AddrPort, req []byte) {
+	handlersInFlight.Add(1)
+	defer handlersInFlight.Add(-1)
+	defer func() {
+		if r := recover(); r != nil {
+			queryErrors.Add(1)
+			slog.Error("Recovered in handleDHCP", "client", addr.String(), "panic", r)
+		}
+	}()
+	l.stats.Add("received", 1)
+	if len(req) < dhcpHeaderLen || req[0] != 1 || req[1] != 1 || req[2] != 6 || binary.BigEndian.Uint32(req[236:240]) != dhcpMagic {
+		l.stats.Add("malformed", 1)
+		return // not an Ethernet BOOTREQUEST
+	}
+	opts := parseDHCPOptions(req[dhcpHeaderLen:])
+	msgType := byte(0)
+	if v := opts[dhcpOptMessageType]; len(v) == 1 {
+		msgType = v[0]
+	}
+	mac := net.HardwareAddr(req[28:34]).String()
+	attrs := []any{"mac", mac, "type", dhcpMessageNames[msgType]}
+	if v := opts[dhcpOptHostname]; v != nil {
+		attrs = append(attrs, "hostname", string(trimNUL(v)))
+	}
+	if v := opts[dhcpOptVendorClass]; v != nil {
+		attrs = append(attrs, "vendor", string(trimNUL(v)))
+	}
+
+	if s.monitor {
+		slog.Info("DHCP request", append(attrs, "action", "monitored")...)
+		return
+	}
+	d := s.dhcp
+	var reply byte
+	var yiaddr netip.Addr
+	switch msgType {
+	case dhcpDiscover:
+		var ok bool
+		if yiaddr, ok = d.offer(mac, ipOption(opts[dhcpOptRequestedIP])); !ok {
+			slog.Warn("DHCP pool exhausted", attrs...)
+			return
+		}
+		reply = dhcpOffer
+	case dhcpRequest:
+		if id := opts[dhcpOptServerID]; id != nil && !net.IP(id).Equal(d.serverID) {
+			d.release(mac) // the client chose another server's offer
+			slog.Info("DHCP client chose another server", append(attrs, "server", net.IP(id).String())...)
+			return
+		}
+		want := ipOption(opts[dhcpOptRequestedIP])
+		if !want.IsValid() {
+			want, _ = netip.AddrFromSlice(req[12:16]) // ciaddr, when renewing
+		}
+		var ok bool
+		if yiaddr, ok = d.bind(mac, want); ok {
+			reply = dhcpAck
+		} else {
+			reply = dhcpNak
+		}
+	case dhcpInform:
+		reply = dhcpAck // options only; the client has its address
+	case dhcpRelease, dhcpDecline:
+		d.release(mac)
+		slog.Info("DHCP lease released", attrs...)
+		return
+	default:
+		return
+	}
+
+	resp := d.reply(req, reply, yiaddr)
+	to := netip.AddrPortFrom(netip.AddrFrom4([4]byte{255, 255, 255, 255}), 68)
+	if giaddr, _ := netip.AddrFromSlice(req[24:28]); !giaddr.IsUnspecified() {
+		to = netip.AddrPortFrom(giaddr, 67) // through a relay
+	} else if ciaddr, _ := netip.AddrFromSlice(req[12:16]); !ciaddr.IsUnspecified() && reply != dhcpNak {
+		to = netip.AddrPortFrom(ciaddr, 68)
+	}
+	if _, err := l.conn.WriteToUDPAddrPort(resp, to); err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending DHCP reply", append(attrs, "to", to.String(), "err", err)...)
+		return
+	}
+	l.stats.Add(strings.ToLower(dhcpMessageNames[reply]), 1)
+	switch reply {
+	case dhcpOffer:
+		dhcpOffers.Add(1)
+	case dhcpAck:
+		dhcpAcks.Add(1)
+	case dhcpNak:
+		dhcpNaks.Add(1)
+	}
+	if yiaddr.IsValid() {
+		attrs = append(attrs, "ip", yiaddr.String())
+	}
+	slog.Info("DHCP "+strings.ToLower(dhcpMessageNames[reply]), attrs...)
+}
+
+// offer picks an address for mac: its current one, the one it asks for if
+// that's free, or the first free one. The address is held briefly for the
+// client's request.
+func (d *dhcpServer) offer(mac string, want netip.Addr) (netip.Addr, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if l, ok := d.leases[mac]; ok {
+		return l.addr, true
+	}
+	addr := netip.Addr{}
+	if d.inPool(want) && d.freeAt(want, mac, now) {
+		addr = want
+	} else {
+		for a := d.cfg.first; a.IsValid() && !d.cfg.last.Less(a); a = a.Next() {
+			if d.freeAt(a, mac, now) {
+				addr = a
+				break
+			}
+		}
+	}
+	if !addr.IsValid() {
+		return addr, false
+	}
+	d.set(mac, &dhcpLease{addr: addr, expires: now.Add(dhcpOfferHold)})
+	return addr, true
+}
+
+// bind confirms mac's lease on addr, if addr is ours to give it.
+func (d *dhcpServer) bind(mac string, addr netip.Addr) (netip.Addr, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if !d.inPool(addr) || !d.freeAt(addr, mac, now) {
+		return netip.Addr{}, false
+	}
+	d.set(mac, &dhcpLease{addr: addr, expires: now.Add(d.cfg.lease), bound: true})
+	return addr, true
+}
+
+func (d *dhcpServer) release(mac string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if l, ok := d.leases[mac]; ok {
+		delete(d.owners, l.addr)
+		delete(d.leases, mac)
+	}
+}
+
+func (d *dhcpServer) set(mac string, l *dhcpLease) {
+	if old, ok := d.leases[mac]; ok {
+		delete(d.owners, old.addr)
+	}
+	if prev, ok := d.owners[l.addr]; ok {
+		delete(d.leases, prev) // expired, and now someone else's
+	}
+	d.leases[mac] = l
+	d.owners[l.addr] = mac
+}
+
+// owner returns the hardware address a current lease of a belongs to, if
+// any. It is safe on a nil server.
+func (d *dhcpServer) owner(a netip.Addr) net.HardwareAddr {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	mac, ok := d.owners[a]
+	if !ok || time.Now().After(d.leases[mac].expires) {
+		return nil
+	}
+	hw, _ := net.ParseMAC(mac)
+	return hw
+}
+
+func (d *dhcpServer) inPool(a netip.Addr) bool {
+	return a.IsValid() && !a.Less(d.cfg.first) && !d.cfg.last.Less(a)
+}
+
+// freeAt reports whether a is unleased, leased to mac already, or held by a
+// lease that has expired.
+func (d *dhcpServer) freeAt(a netip.Addr, mac string, now time.Time) bool {
+	owner, ok := d.owners[a]
+	return !ok || owner == mac || now.After(d.leases[owner].expires)
+}
+
+// reply builds a BOOTREPLY to req of the given message type.
+func (d *dhcpServer) reply(req []byte, msgType byte, yiaddr netip.Addr) []byte {
+	resp := make([]byte, dhcpHeaderLen, 512)
+	resp[0], resp[1], resp[2] = 2, req[1], req[2]
+	copy(resp[4:8], req[4:8])     // xid
+	copy(resp[10:12], req[10:12]) // flags
+	if msgType != dhcpNak {
+		copy(resp[12:16], req[12:16]) // ciaddr
+	}
+	if yiaddr.IsValid() && msgType != dhcpNak {
+		a := yiaddr.As4()
+		copy(resp[16:20], a[:])
+	}
+	copy(resp[24:28], req[24:28]) // giaddr
+	copy(resp[28:44], req[28:44]) // chaddr
+	binary.BigEndian.PutUint32(resp[236:240], dhcpMagic)
+
+	opt := func(code byte, v []byte) {
+		resp = append(append(resp, code, byte(len(v))), v...)
+	}
+	u32 := func(d time.Duration) []byte { return binary.BigEndian.AppendUint32(nil, uint32(d/time.Second)) }
+	opt(dhcpOptMessageType, []byte{msgType})
+	opt(dhcpOptServerID, d.serverID)
+	if msgType != dhcpNak {
+		if msgType != dhcpAck || yiaddr.IsValid() { // no lease times for INFORM
+			opt(dhcpOptLeaseTime, u32(d.cfg.lease))
+			opt(dhcpOptRenewalTime, u32(d.cfg.lease/2))
+			opt(dhcpOptRebindTime, u32(d.cfg.lease*7/8))
+		}
+		opt(dhcpOptSubnetMask, d.cfg.netmask)
+		if d.cfg.router != nil {
+			opt(dhcpOptRouter, d.cfg.router)
+		}
+		opt(dhcpOptDNS, d.dns)
+		if d.cfg.domain != "" {
+			opt(dhcpOptDomainName, []byte(d.cfg.domain))
+		}
+		if d.cfg.wpadURL != "" {
+			opt(dhcpOptWPAD, []byte(d.cfg.wpadURL))
+		}
+	}
+	return append(resp, dhcpOptEnd)
+}
+
+// parseDHCPOptions returns the options in data by code. Malformed trailing
+// options are ignored.
+func parseDHCPOptions(data []byte) map[byte][]byte {
+	opts := make(map[byte][]byte)
+	for len(data) > 0 {
+		code := data[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			data = data[1:]
+			continue
+		}
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			break
+		}
+		opts[code] = append(opts[code], data[2:2+int(data[1])]...) // long options span several (RFC 3396)
+		data = data[2+int(data[1]):]
+	}
+	return opts
+}
+
+func ipOption(v []byte) netip.Addr {
+	a, ok := netip.AddrFromSlice(v)
+	if !ok || !a.Is4() {
+		return netip.Addr{}
+	}
+	return a
+}
+
+// trimNUL drops the NUL padding some clients leave on string options.
+func trimNUL(b []byte) []byte { return bytes.TrimRight(b, "\x00") }
+
+// leaseList returns the bound leases that haven't expired, for -state. It
+// is safe on a nil server.
+func (d *dhcpServer) leaseList() []stateLease {
+	if d == nil {
+		return nil
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []stateLease
+	for mac, l := range d.leases {
+		if l.bound && now.Before(l.expires) {
+			out = append(out, stateLease{MAC: mac, Addr: l.addr, Expires: l.expires})
+		}
+	}
+	return out
+}
+
+// restore brings back leases saved by leaseList that are still current and
+// in the pool, and returns how many it restored. It is safe on a nil
+// server.
+func (d *dhcpServer) restore(leases []stateLease) int {
+	if d == nil {
+		return 0
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, l := range leases {
+		if now.Before(l.Expires) && d.inPool(l.Addr) && d.freeAt(l.Addr, l.MAC, now) {
+			d.set(l.MAC, &dhcpLease{addr: l.Addr, expires: l.Expires, bound: true})
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type dnsMsg struct {
+	ID         uint16
+	Flags      uint16
+	Question   dnsQuestion
+	Answers    []dnsResourceRecord
+	Authority  []dnsResourceRecord // packed only, for the SOA of negative answers and referrals' NS records
+	Additional []dnsResourceRecord // packed only, for referrals' glue and OPT records
+}
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type dnsResourceRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  net.IP
+	RData []byte // wire-format data of types other than A and AAAA
+}
+
+// Questions other than exactly one are well-formed DNS, but not something
+// any real resolver sends; unpack reports them with these errors after
+// filling in the header and the first question, if any.
+var (
+	errNoQuestion        = errors.New("invalid DNS message: no question")
+	errMultipleQuestions = errors.New("invalid DNS message: more than one question")
+)
+
+func (msg *dnsMsg) unpack(data []byte) error {
+	// Ensure data is at least 12 bytes long (DNS header)
+	if len(data) < 12 {
+		return fmt.Errorf("invalid DNS message: message too short")
+	}
+
+	// Unpack DNS header
+	msg.ID = binary.BigEndian.Uint16(data[:2])
+	msg.Flags = binary.BigEndian.Uint16(data[2:4])
+	qdcount := int(binary.BigEndian.Uint16(data[4:6]))
+	if qdcount == 0 {
+		return errNoQuestion
+	}
+
+	// Unpack DNS question section, keeping the first question but walking
+	// them all so the answers are found where they really start
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readName(data, off)
+		if err != nil {
+			return err
+		}
+		if next+4 > len(data) {
+			return fmt.Errorf("invalid DNS message: malformed question section")
+		}
+		if i == 0 {
+			msg.Question.Name = name
+			msg.Question.Type = binary.BigEndian.Uint16(data[next : next+2])
+			msg.Question.Class = binary.BigEndian.Uint16(data[next+2 : next+4])
+		}
+		off = next + 4
+	}
+	var result error
+	if qdcount > 1 {
+		result = errMultipleQuestions
+	}
+
+	// Answers are only decoded in responses; the authority and additional
+	// sections are not supported
+	if msg.Flags&0x8000 == 0 {
+		return result
+	}
+	msg.Answers = nil
+	for i := 0; i < int(binary.BigEndian.Uint16(data[6:8])); i++ {
+		var rr dnsResourceRecord
+		var err error
+		if rr.Name, off, err = readName(data, off); err != nil {
+			return err
+		}
+		if off+10 > len(data) {
+			return fmt.Errorf("invalid DNS message: truncated resource record")
+		}
+		rr.Type = binary.BigEndian.Uint16(data[off : off+2])
+		rr.Class = binary.BigEndian.Uint16(data[off+2 : off+4])
+		rr.TTL = binary.BigEndian.Uint32(data[off+4 : off+8])
+		rdlen := int(binary.BigEndian.Uint16(data[off+8 : off+10]))
+		off += 10
+		if off+rdlen > len(data) {
+			return fmt.Errorf("invalid DNS message: record data runs past end of message")
+		}
+		rdata := data[off : off+rdlen]
+		off += rdlen
+		switch {
+		case rr.Type == dnsTypeA && rdlen == 4, rr.Type == dnsTypeAAAA && rdlen == 16:
+			rr.Data = net.IP(append([]byte(nil), rdata...))
+		default:
+			continue
+		}
+		msg.Answers = append(msg.Answers, rr)
+	}
+	return result
+}
+
+// formErr returns a FORMERR response to the query in req, without a
+// question section, for queries that can't be answered as parsed.
+func formErr(req []byte) []byte {
+	return headerResponse(req, dnsRcodeFormErr)
+}
+
+// headerResponse returns a response to req with only a header, carrying
+// rcode.
+func headerResponse(req []byte, rcode uint16) []byte {
+	flags := binary.BigEndian.Uint16(req[2:4])&0x7900 | 0x8000 | rcode // keep the opcode and RD
+	resp := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(req[:2]))
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	return append(resp, make([]byte, 8)...)
+}
+
+// respondAs returns a copy of resp, a response to a query for the same
+// question as req, with req's ID and spelling of the name.
+func respondAs(resp, req []byte) []byte {
+	resp = append([]byte(nil), resp...)
+	copy(resp[:2], req[:2])
+	if _, end, err := readName(req, 12); err == nil && end <= len(resp) {
+		copy(resp[12:end], req[12:end])
+	}
+	return resp
+}
+
+func (msg *dnsMsg) pack() ([]byte, error) {
+	return msg.appendPack(make([]byte, 0, 512))
+}
+
+// appendPack appends the wire form of msg to buf, with its names
+// compressed. With a buffer large enough for the message it does not
+// allocate.
+func (msg *dnsMsg) appendPack(buf []byte) ([]byte, error) {
+	c := nameCompressor{base: len(buf)}
+
+	// Pack DNS header
+	buf = binary.BigEndian.AppendUint16(buf, msg.ID)
+	buf = binary.BigEndian.AppendUint16(buf, msg.Flags)
+	buf = binary.BigEndian.AppendUint16(buf, 1)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.Answers)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.Authority)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.Additional)))
+
+	// Pack DNS question section
+	buf, err := c.appendName(buf, msg.Question.Name)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, msg.Question.Type)
+	buf = binary.BigEndian.AppendUint16(buf, msg.Question.Class)
+
+	// Pack DNS answer, authority and additional sections
+	for _, section := range [][]dnsResourceRecord{msg.Answers, msg.Authority, msg.Additional} {
+		for i := range section {
+			if buf, err = c.appendRR(buf, &section[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return buf, nil
+}
+
+// dnsFlagTruncated is the TC bit, set on responses cut short to fit in a UDP
+// message, which clients repeat over TCP.
+const dnsFlagTruncated = 0x0200
+
+// maxUDPResponse returns how large a response to req over UDP may be: 512
+// octets, or with EDNS the size the client asked for, but no more than the
+// server advertises (RFC 6891 section 6.2.5).
+func maxUDPResponse(req []byte) int {
+	opt, ok := findOPT(req)
+	if !ok {
+		return 512
+	}
+	return min(max(int(opt.size), 512), ednsUDPSize)
+}
+
+// appendPackLimit is appendPack for a message of at most limit octets. If
+// msg doesn't fit, its records are left out from the last until it does,
+// keeping any OPT record, and the message is marked truncated.
+func (msg *dnsMsg) appendPackLimit(buf []byte, limit int) ([]byte, error) {
+	out, err := msg.appendPack(buf)
+	if err != nil || len(out)-len(buf) <= limit {
+		return out, err
+	}
+	var records, opts []dnsResourceRecord
+	records = append(records, msg.Answers...)
+	records = append(records, msg.Authority...)
+	for _, rr := range msg.Additional {
+		if rr.Type == dnsTypeOPT {
+			opts = append(opts, rr)
+		} else {
+			records = append(records, rr)
+		}
+	}
+	t := dnsMsg{ID: msg.ID, Flags: msg.Flags | dnsFlagTruncated, Question: msg.Question}
+	for n := len(records) - 1; ; n-- {
+		kept := records[:n]
+		na := min(len(kept), len(msg.Answers))
+		nb := min(len(kept)-na, len(msg.Authority))
+		t.Answers, t.Authority = kept[:na], kept[na:na+nb]
+		t.Additional = append(slices.Clip(kept[na+nb:]), opts...)
+		if out, err = t.appendPack(buf); err != nil || len(out)-len(buf) <= limit || n == 0 {
+			return out, err
+		}
+	}
+}
+
+// truncateResponse cuts a packed response longer than limit down to its
+// header and question, marked truncated, or returns it as it is if it fits
+// or can't be parsed.
+func truncateResponse(b []byte, limit int) []byte {
+	if len(b) <= limit || len(b) < 12 || binary.BigEndian.Uint16(b[4:6]) != 1 {
+		return b
+	}
+	_, end, err := readName(b, 12)
+	if err != nil || end+4 > len(b) {
+		return b
+	}
+	out := slices.Clone(b[:end+4])
+	binary.BigEndian.PutUint16(out[2:4], binary.BigEndian.Uint16(b[2:4])|dnsFlagTruncated)
+	clear(out[6:12])
+	return out
+}
+
+// appendRR appends a resource record, taking A and AAAA data from rr.Data
+// and anything else from rr.RData, without compressing its names.
+func appendRR(buf []byte, rr *dnsResourceRecord) ([]byte, error) {
+	return (*nameCompressor)(nil).appendRR(buf, rr)
+}
+
+// nameCompressor remembers where names were written in a message, so that
+// later names ending the same way can point back at them (RFC 1035 section
+// 4.1.4). It keeps a fixed number of suffixes, so packing doesn't allocate;
+// a nil compressor writes every name in full.
+type nameCompressor struct {
+	base  int // where the message starts in the buffer
+	n     int
+	names [32]struct {
+		name string
+		off  int
+	}
+}
+
+func (c *nameCompressor) appendName(buf []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	for rest := name; rest != ""; {
+		if c != nil {
+			for i := range c.names[:c.n] {
+				if strings.EqualFold(c.names[i].name, rest) {
+					return binary.BigEndian.AppendUint16(buf, 0xC000|uint16(c.names[i].off)), nil
+				}
+			}
+		}
+		label, tail, _ := strings.Cut(rest, ".")
+		if len(label) == 0 || len(label) > 63 || (tail == "" && strings.HasSuffix(rest, ".")) {
+			// Cloned so the error doesn't force callers' messages onto the heap
+			return nil, fmt.Errorf("invalid label %q in name %q", strings.Clone(label), strings.Clone(name))
+		}
+		if c != nil && c.n < len(c.names) && len(buf)-c.base < 0x4000 {
+			c.names[c.n].name, c.names[c.n].off = rest, len(buf)-c.base
+			c.n++
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+		rest = tail
+	}
+	return append(buf, 0), nil // Null-terminate domain name
+}
+
+func (c *nameCompressor) appendRR(buf []byte, rr *dnsResourceRecord) ([]byte, error) {
+	data := rr.RData
+	switch rr.Type {
+	case dnsTypeA:
+		data = rr.Data.To4()
+	case dnsTypeAAAA:
+		data = rr.Data.To16()
+	}
+	if data == nil {
+		return nil, fmt.Errorf("invalid address %s for %s record", rr.Data.String(), typeString(rr.Type))
+	}
+	buf, err := c.appendName(buf, rr.Name)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, rr.Type)
+	buf = binary.BigEndian.AppendUint16(buf, rr.Class)
+	buf = binary.BigEndian.AppendUint32(buf, rr.TTL)
+	if c != nil {
+		if out, ok := c.appendRData(buf, rr.Type, data); ok {
+			return out, nil
+		}
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+	return append(buf, data...), nil
+}
+
+// appendRData appends the length and data of a record of type t whose data
+// holds names that may be compressed: those of the RFC 1035 types. Others,
+// such as SRV targets (RFC 2782), are left as they are, as is data that
+// doesn't parse.
+func (c *nameCompressor) appendRData(buf []byte, t uint16, data []byte) ([]byte, bool) {
+	var prefix, suffix int // bytes before and after the names
+	names := 1
+	switch t {
+	case dnsTypeNS, dnsTypeCNAME, dnsTypePTR:
+	case dnsTypeMX:
+		prefix = 2
+	case dnsTypeSOA:
+		names, suffix = 2, 20
+	default:
+		return nil, false
+	}
+	if len(data) < prefix+suffix {
+		return nil, false
+	}
+	start := len(buf)
+	buf = append(buf, 0, 0) // length, filled in below
+	buf = append(buf, data[:prefix]...)
+	off := prefix
+	for i := 0; i < names; i++ {
+		name, next, err := readName(data, off)
+		if err != nil || name == "" {
+			return nil, false
+		}
+		if buf, err = c.appendName(buf, name); err != nil {
+			return nil, false
+		}
+		off = next
+	}
+	if len(data)-off != suffix {
+		return nil, false
+	}
+	buf = append(buf, data[off:]...)
+	binary.BigEndian.PutUint16(buf[start:], uint16(len(buf)-start-2))
+	return buf, true
+}
+
+// dataString formats the record's data for events, like dig does.
+func (rr *dnsResourceRecord) dataString() string {
+	if rr.Type == dnsTypeA || rr.Type == dnsTypeAAAA {
+		return rr.Data.String()
+	}
+	return rdataString(rr.RData, 0, len(rr.RData), rr.Type)
+}
+
+// readName decodes the (possibly compressed) domain name starting at off and
+// returns it without the trailing dot, along with the offset just past it.
+// The name is assembled in a stack buffer, so the returned string is the only
+// allocation.
+func readName(data []byte, off int) (string, int, error) {
+	var scratch [255]byte
+	name := scratch[:0]
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(data) {
+			return "", 0, fmt.Errorf("invalid DNS message: name runs past end of message")
+		}
+		l := int(data[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return string(name), end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(data) {
+				return "", 0, fmt.Errorf("invalid DNS message: truncated compression pointer")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, fmt.Errorf("invalid DNS message: compression loop")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(data[off:off+2]) & 0x3FFF)
+		case l > 63:
+			return "", 0, fmt.Errorf("invalid DNS message: bad label length %d", l)
+		default:
+			if off+1+l > len(data) {
+				return "", 0, fmt.Errorf("invalid DNS message: label runs past end of message")
+			}
+			if len(name)+1+l > len(scratch) {
+				return "", 0, fmt.Errorf("invalid DNS message: name longer than 255 bytes")
+			}
+			if len(name) > 0 {
+				name = append(name, '.')
+			}
+			name = append(name, data[off+1:off+1+l]...)
+			off += 1 + l
+		}
+	}
+}
+
+// appendName encodes name as a sequence of length-prefixed labels.
+func appendName(buf []byte, name string) ([]byte, error) {
+	return (*nameCompressor)(nil).appendName(buf, name)
+}
+
+const (
+	dnsTypeA         = 1
+	dnsTypeCNAME     = 5
+	dnsTypeSOA       = 6
+	dnsTypePTR       = 12
+	dnsTypeMX        = 15
+	dnsTypeTXT       = 16
+	dnsTypeAAAA      = 28
+	dnsTypeOPT       = 41
+	dnsTypeSRV       = 33
+	dnsTypeANY       = 255
+	dnsClassIN       = 1
+	dnsClassANY      = 255
+	dnsFlagsResponse = 0x8180 // Response flag
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+	dnsOpcodeQuery   = 0
+	dnsOpcodeIQuery  = 1 // obsolete inverse query (RFC 3425)
+	dnsOpcodeStatus  = 2
+)
+
+var dnsTypeNames = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 10: "NULL", 12: "PTR", 15: "MX",
+	16: "TXT", 28: "AAAA", 33: "SRV", 39: "DNAME", 41: "OPT", 43: "DS", 46: "RRSIG",
+	47: "NSEC", 48: "DNSKEY", 64: "SVCB", 65: "HTTPS", 252: "AXFR", 255: "ANY", 257: "CAA",
+}
+
+func typeString(t uint16) string {
+	if name, ok := dnsTypeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+var dnsRcodeNames = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED", "YXDOMAIN", "YXRRSET", "NXRRSET", "NOTAUTH", "NOTZONE"}
+
+var dnsOpcodeNames = []string{"QUERY", "IQUERY", "STATUS", "", "NOTIFY", "UPDATE"}
+
+func opcodeString(flags uint16) string {
+	if op := int(flags >> 11 & 0xF); op < len(dnsOpcodeNames) && dnsOpcodeNames[op] != "" {
+		return dnsOpcodeNames[op]
+	}
+	return "OPCODE" + strconv.Itoa(int(flags>>11&0xF))
+}
+
+func rcodeString(flags uint16) string {
+	if rc := int(flags & 0xF); rc < len(dnsRcodeNames) {
+		return dnsRcodeNames[rc]
+	}
+	return "RCODE" + strconv.Itoa(int(flags&0xF))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+var dns64Synthesized = expvar.NewInt("dns64_synthesized")
+
+// parseDNS64Prefix parses a NAT64 prefix for -dns64, which must have one of
+// the lengths RFC 6052 defines and leave bits 64 to 71 zero.
+func parseDNS64Prefix(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	p = p.Masked()
+	if !p.Addr().Is6() || p.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("%s is not an IPv6 prefix", s)
+	}
+	switch p.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return netip.Prefix{}, fmt.Errorf("NAT64 prefix %s must be /32, /40, /48, /56, /64 or /96", s)
+	}
+	if p.Addr().As16()[8] != 0 {
+		return netip.Prefix{}, fmt.Errorf("NAT64 prefix %s must have bits 64 to 71 zero", s)
+	}
+	return p, nil
+}
+
+// synthesizeAAAA embeds the IPv4 address v4 in prefix as RFC 6052 lays it
+// out: right after the prefix, skipping over bits 64 to 71.
+func synthesizeAAAA(prefix netip.Prefix, v4 net.IP) net.IP {
+	b := prefix.Addr().As16()
+	pos := prefix.Bits() / 8
+	for _, octet := range v4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		b[pos] = octet
+		pos++
+	}
+	return net.IP(b[:])
+}
+
+// dns64Answer returns the response to a forwarded AAAA query whose upstream
+// response is upstream: if that holds no AAAA records for an existing name,
+// the name's A records are asked for and rewritten into AAAA records under
+// the NAT64 prefix, giving up at deadline. It returns nil when there is
+// nothing to synthesize, and upstream's response stands.
+func (s *dnsServer) dns64Answer(msg *dnsMsg, req, upstream []byte, deadline time.Time) []byte {
+	var resp dnsMsg
+	if resp.unpack(upstream) != nil || resp.Flags&0xF != 0 {
+		return nil
+	}
+	for _, rr := range resp.Answers {
+		if rr.Type == dnsTypeAAAA {
+			return nil
+		}
+	}
+
+	_, off, err := readName(req, 12)
+	if err != nil {
+		return nil
+	}
+	aReq := slices.Clone(req)
+	binary.BigEndian.PutUint16(aReq[off:off+2], dnsTypeA)
+	aRespBytes, err := s.forward(aReq, deadline)
+	if err != nil {
+		return nil
+	}
+	var aResp dnsMsg
+	if aResp.unpack(aRespBytes) != nil || aResp.Flags&0xF != 0 {
+		return nil
+	}
+
+	// Any CNAMEs the A records came through are flattened, every record
+	// being owned by the queried name, and the answer isn't authoritative
+	out := dnsMsg{ID: msg.ID, Flags: resp.Flags &^ 0x0600, Question: msg.Question}
+	for _, rr := range aResp.Answers {
+		if rr.Type != dnsTypeA {
+			continue
+		}
+		out.Answers = append(out.Answers, dnsResourceRecord{
+			Name:  msg.Question.Name,
+			Type:  dnsTypeAAAA,
+			Class: dnsClassIN,
+			TTL:   rr.TTL,
+			Data:  synthesizeAAAA(s.dns64, rr.Data),
+		})
+	}
+	if len(out.Answers) == 0 {
+		return nil
+	}
+	b, err := out.pack()
+	if err != nil {
+		return nil
+	}
+	dns64Synthesized.Add(1)
+	return b
+}
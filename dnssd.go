@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// TTLs from RFC 6762 section 10: records naming a host get a short one, as
+// the host's address may change
+const (
+	dnssdTTL = 4500
+	hostTTL  = 120
+)
+
+// serviceConfig is one entry of the "services" section of the config file: a
+// DNS-SD service instance (RFC 6763) to advertise, such as a fake printer.
+type serviceConfig struct {
+	Instance string   `yaml:"instance"` // e.g. "Office Printer"
+	Type     string   `yaml:"type"`     // e.g. _ipp._tcp
+	Domain   string   `yaml:"domain"`   // default local
+	Host     string   `yaml:"host"`     // default derived from the instance name
+	Port     int      `yaml:"port"`
+	TXT      []string `yaml:"txt"` // key=value pairs
+	IP       string   `yaml:"ip"`  // host address, defaults to the server's -ip
+}
+
+var (
+	serviceTypeRE = regexp.MustCompile(`^_[a-z0-9-]{1,15}\._(tcp|udp)$`)
+	notHostnameRE = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// serviceSet holds the records advertising every configured service, keyed
+// by lower-cased owner name, and the hosts they point at.
+type serviceSet struct {
+	records map[string][]dnsResourceRecord
+	hosts   map[string]*rule
+}
+
+func newServiceSet(services []*serviceConfig) (*serviceSet, error) {
+	ss := &serviceSet{records: make(map[string][]dnsResourceRecord), hosts: make(map[string]*rule)}
+	for _, svc := range services {
+		if err := ss.add(svc); err != nil {
+			return nil, err
+		}
+	}
+	return ss, nil
+}
+
+func (ss *serviceSet) add(svc *serviceConfig) error {
+	domain := normalizeName(svc.Domain)
+	if domain == "" {
+		domain = "local"
+	}
+	typ := strings.ToLower(svc.Type)
+	switch {
+	case svc.Instance == "" || len(svc.Instance) > 63 || strings.Contains(svc.Instance, "."):
+		return fmt.Errorf("service %q: instance name must be 1-63 bytes without dots", svc.Instance)
+	case !serviceTypeRE.MatchString(typ):
+		return fmt.Errorf("service %q: invalid type %q, want e.g. _http._tcp", svc.Instance, svc.Type)
+	case svc.Port < 1 || svc.Port > 65535:
+		return fmt.Errorf("service %q: invalid port %d", svc.Instance, svc.Port)
+	}
+	host := normalizeName(svc.Host)
+	if host == "" {
+		host = strings.Trim(notHostnameRE.ReplaceAllString(strings.ToLower(svc.Instance), "-"), "-") + "." + domain
+	}
+	hostRule := &rule{Domain: host, IP: svc.IP}
+	if err := hostRule.validate(); err != nil {
+		return fmt.Errorf("service %q: %v", svc.Instance, err)
+	}
+	hostRule.addr = net.ParseIP(svc.IP)
+
+	serviceType := typ + "." + domain
+	instance := svc.Instance + "." + serviceType
+	key := strings.ToLower(instance)
+	if _, ok := ss.records[key]; ok {
+		return fmt.Errorf("service %q is defined twice", instance)
+	}
+
+	// _services._dns-sd._udp lists every type once, for browsers that ask
+	// what's on offer before asking for instances
+	meta := "_services._dns-sd._udp." + domain
+	if len(ss.records[serviceType]) == 0 {
+		ss.records[meta] = append(ss.records[meta], ptrRecord(meta, serviceType))
+	}
+	ss.records[serviceType] = append(ss.records[serviceType], ptrRecord(serviceType, instance))
+
+	srv := binary.BigEndian.AppendUint16(nil, 0) // priority
+	srv = binary.BigEndian.AppendUint16(srv, 0)  // weight
+	srv = binary.BigEndian.AppendUint16(srv, uint16(svc.Port))
+	srv, err := appendName(srv, host)
+	if err != nil {
+		return fmt.Errorf("service %q: %v", svc.Instance, err)
+	}
+	// A TXT record can't be empty, so no pairs is one empty string
+	var txt []byte
+	for _, kv := range svc.TXT {
+		if len(kv) > 255 {
+			return fmt.Errorf("service %q: TXT entry longer than 255 bytes", svc.Instance)
+		}
+		txt = append(append(txt, byte(len(kv))), kv...)
+	}
+	if txt == nil {
+		txt = []byte{0}
+	}
+	ss.records[key] = []dnsResourceRecord{
+		{Name: instance, Type: dnsTypeSRV, Class: dnsClassIN, TTL: hostTTL, RData: srv},
+		{Name: instance, Type: dnsTypeTXT, Class: dnsClassIN, TTL: dnssdTTL, RData: txt},
+	}
+	ss.hosts[host] = hostRule
+	return nil
+}
+
+func ptrRecord(name, target string) dnsResourceRecord {
+	rdata, _ := appendName(nil, target)
+	return dnsResourceRecord{Name: name, Type: dnsTypePTR, Class: dnsClassIN, TTL: dnssdTTL, RData: rdata}
+}
+
+// serviceRecords returns the DNS-SD records of type qtype (or every type,
+// for ANY) owned by name, and whether name belongs to an advertised service
+// at all. Answers for service hosts use the server defaults unless the
+// service gives its own IP or answer template, filled in for a query from
+// client arriving on local.
+func (s *dnsServer) serviceRecords(name string, qtype uint16, local, client netip.Addr) ([]dnsResourceRecord, bool) {
+	ss := s.services.Load()
+	if ss == nil {
+		return nil, false
+	}
+	name = normalizeName(name)
+	var out []dnsResourceRecord
+	if r, ok := ss.hosts[name]; ok {
+		for _, t := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			if qtype != t && qtype != dnsTypeANY {
+				continue
+			}
+			if ip := s.answerFor(r, t, local, client); ip != nil {
+				out = append(out, dnsResourceRecord{Name: name, Type: t, Class: dnsClassIN, TTL: hostTTL, Data: ip})
+			}
+		}
+		return out, true
+	}
+	records, ok := ss.records[name]
+	for _, rr := range records {
+		if qtype == rr.Type || qtype == dnsTypeANY {
+			out = append(out, rr)
+		}
+	}
+	return out, ok
+}
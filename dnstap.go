@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var dnstapDropped = expvar.NewInt("dnstap_dropped")
+
+// dnstap message types and enums, from dnstap.proto.
+const (
+	dnstapTypeMessage       = 1
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapSocketFamilyINET  = 1
+	dnstapSocketFamilyINET6 = 2
+	dnstapSocketProtoUDP    = 1
+)
+
+// Frame Streams control frames.
+const (
+	fstrmControlAccept = 1
+	fstrmControlStart  = 2
+	fstrmControlStop   = 3
+	fstrmControlReady  = 4
+	fstrmControlFinish = 5
+
+	fstrmFieldContentType = 1
+	dnstapContentType     = "protobuf:dnstap.Dnstap"
+)
+
+// dnstapSink streams CLIENT_QUERY/CLIENT_RESPONSE messages to a dnstap
+// collector (fstrm_capture, dnstap-read, passive DNS sensors) over a unix
+// or TCP socket using the bidirectional Frame Streams protocol. It
+// reconnects in the background if the collector goes away.
+type dnstapSink struct {
+	network  string
+	addr     string
+	identity []byte
+	frames   chan []byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newDnstapSink parses a target like unix:///var/run/dnstap.sock or
+// tcp://127.0.0.1:6000.
+func newDnstapSink(target, identity string) (*dnstapSink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dnstap target %q: %v", target, err)
+	}
+	s := &dnstapSink{
+		identity: []byte(identity),
+		frames:   make(chan []byte, 4096),
+		done:     make(chan struct{}),
+	}
+	switch u.Scheme {
+	case "unix":
+		s.network, s.addr = "unix", u.Path
+	case "tcp":
+		s.network, s.addr = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("unsupported dnstap scheme %q (want unix or tcp)", u.Scheme)
+	}
+	if len(s.identity) == 0 {
+		host, _ := os.Hostname()
+		s.identity = []byte(host)
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *dnstapSink) Write(ev *queryEvent) {
+	if ev.Query != nil {
+		s.enqueue(s.encode(ev, dnstapClientQuery))
+	}
+	if ev.Response != nil {
+		s.enqueue(s.encode(ev, dnstapClientResponse))
+	}
+}
+
+func (s *dnstapSink) enqueue(frame []byte) {
+	select {
+	case s.frames <- frame:
+	default:
+		dnstapDropped.Add(1)
+	}
+}
+
+// Close stops the writer after sending what is already queued.
+func (s *dnstapSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *dnstapSink) run() {
+	defer s.wg.Done()
+	backoff := time.Second
+	for {
+		conn, err := s.connect()
+		if err != nil {
+			slog.Warn("dnstap collector unavailable", "addr", s.addr, "err", err)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		stopped := s.stream(conn)
+		conn.Close()
+		if stopped {
+			return
+		}
+	}
+}
+
+// connect dials the collector and performs the READY/ACCEPT/START handshake.
+func (s *dnstapSink) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeControlFrame(conn, fstrmControlReady, dnstapContentType); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, err := readControlFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ != fstrmControlAccept {
+		conn.Close()
+		return nil, fmt.Errorf("collector sent control frame %d instead of ACCEPT", typ)
+	}
+	if err := writeControlFrame(conn, fstrmControlStart, dnstapContentType); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("dnstap connected", "addr", s.addr)
+	return conn, nil
+}
+
+// stream writes data frames until the connection fails (returns false) or
+// the sink is closed (returns true).
+func (s *dnstapSink) stream(conn net.Conn) bool {
+	write := func(frame []byte) error {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(frame)))
+		if _, err := conn.Write(hdr[:]); err != nil {
+			return err
+		}
+		_, err := conn.Write(frame)
+		return err
+	}
+	for {
+		select {
+		case frame := <-s.frames:
+			if err := write(frame); err != nil {
+				dnstapDropped.Add(1)
+				slog.Warn("dnstap write failed", "addr", s.addr, "err", err)
+				return false
+			}
+		case <-s.done:
+			// Drain what is queued, then STOP and wait for FINISH
+			for drained := false; !drained; {
+				select {
+				case frame := <-s.frames:
+					if write(frame) != nil {
+						return true
+					}
+				default:
+					drained = true
+				}
+			}
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if writeControlFrame(conn, fstrmControlStop, "") == nil {
+				readControlFrame(conn)
+			}
+			return true
+		}
+	}
+}
+
+func writeControlFrame(w io.Writer, typ uint32, contentType string) error {
+	payload := binary.BigEndian.AppendUint32(nil, typ)
+	if contentType != "" {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmFieldContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(contentType)))
+		payload = append(payload, contentType...)
+	}
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(payload))) // first 4 bytes: escape
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+func readControlFrame(r io.Reader) (uint32, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return 0, fmt.Errorf("expected control frame")
+	}
+	n := binary.BigEndian.Uint32(hdr[4:])
+	if n < 4 || n > 512 {
+		return 0, fmt.Errorf("bad control frame length %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload[:4]), nil
+}
+
+// encode builds a Dnstap protobuf message for ev.
+func (s *dnstapSink) encode(ev *queryEvent, msgType uint64) []byte {
+	var m []byte
+	m = pbAppendVarint(m, 1, msgType)
+
+	ip := net.ParseIP(ev.Client)
+	if ip4 := ip.To4(); ip4 != nil {
+		m = pbAppendVarint(m, 2, dnstapSocketFamilyINET)
+		ip = ip4
+	} else {
+		m = pbAppendVarint(m, 2, dnstapSocketFamilyINET6)
+	}
+	m = pbAppendVarint(m, 3, dnstapSocketProtoUDP)
+	m = pbAppendBytes(m, 4, ip)
+	m = pbAppendVarint(m, 6, uint64(ev.Port))
+
+	m = pbAppendVarint(m, 8, uint64(ev.Time.Unix()))
+	m = pbAppendFixed32(m, 9, uint32(ev.Time.Nanosecond()))
+	if msgType == dnstapClientQuery {
+		m = pbAppendBytes(m, 10, ev.Query)
+	} else {
+		done := ev.Time.Add(ev.Latency)
+		m = pbAppendVarint(m, 12, uint64(done.Unix()))
+		m = pbAppendFixed32(m, 13, uint32(done.Nanosecond()))
+		m = pbAppendBytes(m, 14, ev.Response)
+	}
+
+	var d []byte
+	d = pbAppendBytes(d, 1, s.identity)
+	d = pbAppendBytes(d, 2, []byte("DeceptiveDNS"))
+	d = pbAppendBytes(d, 14, m)
+	d = pbAppendVarint(d, 15, dnstapTypeMessage)
+	return d
+}
+
+// Minimal protobuf wire-format encoding, enough for dnstap.
+
+func pbAppendKey(b []byte, field, wireType uint64) []byte {
+	return binary.AppendUvarint(b, field<<3|wireType)
+}
+
+func pbAppendVarint(b []byte, field, v uint64) []byte {
+	return binary.AppendUvarint(pbAppendKey(b, field, 0), v)
+}
+
+func pbAppendFixed32(b []byte, field uint64, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(pbAppendKey(b, field, 5), v)
+}
+
+func pbAppendBytes(b []byte, field uint64, v []byte) []byte {
+	b = binary.AppendUvarint(pbAppendKey(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
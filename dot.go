@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"slices"
+)
+
+const (
+	ednsOptionPadding = 12   // EDNS Padding option (RFC 7830)
+	paddingBlock      = 468  // response block size recommended by RFC 8467
+	ednsUDPSize       = 1232 // advertised in the OPT records the server adds to responses
+)
+
+// dotListener is a TCP listener for DNS over TLS (RFC 7858). Its
+// connections are served like plain TCP ones, but counted apart and with
+// their responses padded.
+type dotListener struct {
+	net.Listener
+}
+
+// listenDoT opens a DNS over TLS socket on addr, presenting the configured
+// certificate, or one minted by certs for the name each client sends in
+// SNI. Like listenTCP, an address without a host gets separate IPv4 and
+// IPv6 sockets.
+func (s *dnsServer) listenDoT(addr string, tc *tls.Config) error {
+	n := len(s.tcpListeners)
+	if err := s.listenTCP(addr); err != nil {
+		return err
+	}
+	for i := n; i < len(s.tcpListeners); i++ {
+		s.tcpListeners[i] = dotListener{tls.NewListener(s.tcpListeners[i], tc)}
+	}
+	return nil
+}
+
+// dotTLSConfig returns the TLS configuration of the DoT listeners: the
+// certificate in certFile and keyFile if given, or else certificates from
+// certs, for the name each client asks for or the address it connected to.
+func dotTLSConfig(certFile, keyFile string, certs *certMinter) (*tls.Config, error) {
+	if certFile != "" {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}, nil
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name, _, _ = net.SplitHostPort(hello.Conn.LocalAddr().String())
+			}
+			slog.Debug("DoT client hello", "client", hello.Conn.RemoteAddr().String(), "sni", hello.ServerName)
+			return certs.certificate(name)
+		},
+	}, nil
+}
+
+// wantsPadding reports whether a query carries the EDNS Padding option,
+// asking for its response to be padded.
+func wantsPadding(req []byte) bool {
+	opt, ok := findOPT(req)
+	return ok && slices.Contains(opt.codes, ednsOptionPadding)
+}
+
+// padMessage pads a response to a multiple of paddingBlock octets with the
+// EDNS Padding option, so its size doesn't give away which name was asked
+// about. The option goes in the response's OPT record, replacing any
+// padding an upstream added, or in a new one. Responses that can't be
+// parsed, are signed with TSIG, which must come last and covers the whole
+// message, or hold an OPT record before other records are returned as they
+// are.
+func padMessage(b []byte) []byte {
+	if len(b) < 12 || binary.BigEndian.Uint16(b[4:6]) > 1 {
+		return b
+	}
+	off := 12
+	if binary.BigEndian.Uint16(b[4:6]) == 1 {
+		_, end, err := readName(b, off)
+		if err != nil {
+			return b
+		}
+		off = end + 4
+	}
+	opt := -1 // where the OPT record starts
+	records := int(binary.BigEndian.Uint16(b[6:8])) + int(binary.BigEndian.Uint16(b[8:10])) + int(binary.BigEndian.Uint16(b[10:12]))
+	for i := 0; i < records; i++ {
+		if opt >= 0 {
+			return b
+		}
+		_, end, err := readName(b, off)
+		if err != nil || end+10 > len(b) {
+			return b
+		}
+		switch binary.BigEndian.Uint16(b[end : end+2]) {
+		case dnsTypeTSIG:
+			return b
+		case dnsTypeOPT:
+			if end != off+1 { // not the root name
+				return b
+			}
+			opt = off
+		}
+		off = end + 10 + int(binary.BigEndian.Uint16(b[end+8:end+10]))
+	}
+	if off != len(b) || len(b) > 65535-paddingBlock-15 {
+		return b
+	}
+
+	// Copy the message up to the OPT record's rdata, adding the record if
+	// there's none, then put back its options other than padding and pad
+	out := make([]byte, 0, len(b)+paddingBlock+15)
+	var opts []byte
+	if opt < 0 {
+		out = append(out, b...)
+		binary.BigEndian.PutUint16(out[10:12], binary.BigEndian.Uint16(b[10:12])+1)
+		out = append(out, 0) // root
+		out = binary.BigEndian.AppendUint16(out, dnsTypeOPT)
+		out = binary.BigEndian.AppendUint16(out, ednsUDPSize)
+		out = binary.BigEndian.AppendUint32(out, 0)
+	} else {
+		out = append(out, b[:opt+9]...)
+		for rd := b[opt+11:]; len(rd) > 0; {
+			if len(rd) < 4 {
+				return b
+			}
+			n := 4 + int(binary.BigEndian.Uint16(rd[2:4]))
+			if n > len(rd) {
+				return b
+			}
+			if binary.BigEndian.Uint16(rd[:2]) != ednsOptionPadding {
+				opts = append(opts, rd[:n]...)
+			}
+			rd = rd[n:]
+		}
+	}
+	pad := (paddingBlock - (len(out)+2+len(opts)+4)%paddingBlock) % paddingBlock
+	out = binary.BigEndian.AppendUint16(out, uint16(len(opts)+4+pad))
+	out = append(out, opts...)
+	out = binary.BigEndian.AppendUint16(out, ednsOptionPadding)
+	out = binary.BigEndian.AppendUint16(out, uint16(pad))
+	return append(out, make([]byte, pad)...)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	ednsOptionEDE = 15 // Extended DNS Error option (RFC 8914)
+
+	edeNoReachableAuthority = 22
+)
+
+// edeCodeNames are the Extended DNS Error info codes registered with IANA,
+// by code, as rules name them.
+var edeCodeNames = []string{
+	"other", "unsupported-dnskey-algorithm", "unsupported-ds-digest-type",
+	"stale-answer", "forged-answer", "dnssec-indeterminate", "dnssec-bogus",
+	"signature-expired", "signature-not-yet-valid", "dnskey-missing",
+	"rrsigs-missing", "no-zone-key-bit-set", "nsec-missing", "cached-error",
+	"not-ready", "blocked", "censored", "filtered", "prohibited",
+	"stale-nxdomain-answer", "not-authoritative", "not-supported",
+	"no-reachable-authority", "network-error", "invalid-data",
+}
+
+// parseEDECode parses an Extended DNS Error info code: one of edeCodeNames,
+// case and the choice of dashes, underscores or spaces aside, or a number,
+// which lets labs try codes resolvers don't know, such as those for
+// private use from 49152.
+func parseEDECode(s string) (uint16, error) {
+	name := strings.NewReplacer("_", "-", " ", "-").Replace(strings.ToLower(strings.TrimSpace(s)))
+	for code, n := range edeCodeNames {
+		if n == name {
+			return uint16(code), nil
+		}
+	}
+	if code, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return uint16(code), nil
+	}
+	return 0, fmt.Errorf("unknown extended error %q (want a code from 0 to 65535, or a name such as blocked, filtered, prohibited or forged-answer)", s)
+}
+
+// edeString formats an info code for events, such as "15 (blocked)".
+func edeString(code uint16) string {
+	if int(code) < len(edeCodeNames) {
+		return fmt.Sprintf("%d (%s)", code, edeCodeNames[code])
+	}
+	return strconv.Itoa(int(code))
+}
+
+// checkEDE checks the extended error a rule or hook answer attaches.
+func checkEDE(code, text string) error {
+	if code == "" {
+		if text != "" {
+			return fmt.Errorf("ede_text needs ede")
+		}
+		return nil
+	}
+	if _, err := parseEDECode(code); err != nil {
+		return err
+	}
+	if !utf8.ValidString(text) || len(text) > 512 {
+		return fmt.Errorf("ede_text must be UTF-8 of at most 512 bytes")
+	}
+	return nil
+}
+
+// ednsOPTRecord returns the OPT record of a response carrying an Extended
+// DNS Error with code and text, for the additional section. Responses only
+// carry one if their query had an OPT record itself (RFC 6891).
+func ednsOPTRecord(code uint16, text string) dnsResourceRecord {
+	rdata := binary.BigEndian.AppendUint16(nil, ednsOptionEDE)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(2+len(text)))
+	rdata = binary.BigEndian.AppendUint16(rdata, code)
+	rdata = append(rdata, text...)
+	return dnsResourceRecord{Type: dnsTypeOPT, Class: ednsUDPSize, RData: rdata}
+}
+
+// edeOptionString formats the Extended DNS Error in the data of an OPT
+// record, such as `15 (blocked): "listed by urlhaus"`, or returns "" if it
+// has none.
+func edeOptionString(rd []byte) string {
+	for len(rd) >= 4 {
+		n := 4 + int(binary.BigEndian.Uint16(rd[2:4]))
+		if n > len(rd) {
+			break
+		}
+		if binary.BigEndian.Uint16(rd[:2]) == ednsOptionEDE && n >= 6 {
+			s := edeString(binary.BigEndian.Uint16(rd[4:6]))
+			if n > 6 {
+				s += ": " + quoteCharString(rd[6:n])
+			}
+			return s
+		}
+		rd = rd[n:]
+	}
+	return ""
+}
+
+// edeRecord returns the OPT record with the extended error r attaches, if
+// it has one and req carries an OPT record, and the error as events
+// show it.
+func (r *rule) edeRecord(req []byte) (*dnsResourceRecord, string) {
+	if r == nil || r.EDE == "" {
+		return nil, ""
+	}
+	if _, ok := findOPT(req); !ok {
+		return nil, ""
+	}
+	code, err := parseEDECode(r.EDE)
+	if err != nil {
+		return nil, ""
+	}
+	opt := ednsOPTRecord(code, r.EDEText)
+	return &opt, edeString(code)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var elasticDropped = expvar.NewInt("elastic_dropped")
+
+// elasticConfig configures bulk indexing of query events into Elasticsearch
+// or OpenSearch.
+type elasticConfig struct {
+	URL      string `yaml:"url"`   // e.g. https://es.example.com:9200
+	Index    string `yaml:"index"` // default "deceptivedns"
+	Daily    bool   `yaml:"daily"` // append -YYYY.MM.DD to the index name
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	APIKey   string `yaml:"api_key"`
+
+	// Template installs an index template with field mappings at startup,
+	// so client is an ip field and the rest are keywords.
+	Template bool `yaml:"template"`
+}
+
+const (
+	elasticBatchSize     = 1000
+	elasticFlushInterval = 2 * time.Second
+	elasticRetries       = 4
+)
+
+// elasticMappings types the fields of a JSON-encoded queryEvent.
+const elasticMappings = `{
+	"properties": {
+		"time":       {"type": "date"},
+		"client":     {"type": "ip"},
+		"port":       {"type": "integer"},
+		"listener":   {"type": "keyword"},
+		"qname":      {"type": "keyword"},
+		"qtype":      {"type": "keyword"},
+		"action":     {"type": "keyword"},
+		"answer":     {"type": "keyword"},
+		"rule":       {"type": "keyword"},
+		"rcode":      {"type": "keyword"},
+		"ede":        {"type": "keyword"},
+		"latency_ns": {"type": "long"}
+	}
+}`
+
+// elasticSink buffers query events and sends them to the _bulk API in
+// batches. A failed request is retried with backoff; events that still
+// can't be indexed are dropped and counted.
+type elasticSink struct {
+	cfg    elasticConfig
+	base   string
+	client *http.Client
+	events chan *queryEvent
+	wg     sync.WaitGroup
+}
+
+func newElasticSink(cfg elasticConfig) (*elasticSink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid elasticsearch url %q", cfg.URL)
+	}
+	if cfg.Index == "" {
+		cfg.Index = "deceptivedns"
+	}
+	s := &elasticSink{
+		cfg:    cfg,
+		base:   strings.TrimSuffix(cfg.URL, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+		events: make(chan *queryEvent, 8192),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *elasticSink) Write(ev *queryEvent) {
+	select {
+	case s.events <- ev:
+	default:
+		elasticDropped.Add(1)
+	}
+}
+
+// Close flushes queued events.
+func (s *elasticSink) Close() error {
+	close(s.events)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *elasticSink) run() {
+	defer s.wg.Done()
+	if s.cfg.Template {
+		if err := s.putTemplate(); err != nil {
+			slog.Warn("Failed to install Elasticsearch index template", "url", s.cfg.URL, "err", err)
+		}
+	}
+
+	ticker := time.NewTicker(elasticFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*queryEvent, 0, elasticBatchSize)
+	for {
+		select {
+		case ev, ok := <-s.events:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			if batch = append(batch, ev); len(batch) >= elasticBatchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *elasticSink) index(t time.Time) string {
+	if s.cfg.Daily {
+		return s.cfg.Index + "-" + t.UTC().Format("2006.01.02")
+	}
+	return s.cfg.Index
+}
+
+func (s *elasticSink) flush(batch []*queryEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, ev := range batch {
+		enc.Encode(map[string]any{"create": map[string]string{"_index": s.index(ev.Time)}})
+		enc.Encode(ev)
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		failed, err := s.bulk(body.Bytes())
+		if err == nil {
+			if failed > 0 {
+				elasticDropped.Add(int64(failed))
+			}
+			return
+		}
+		if attempt >= elasticRetries {
+			elasticDropped.Add(int64(len(batch)))
+			slog.Error("Failed to index query events", "url", s.cfg.URL, "events", len(batch), "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// bulk sends one _bulk request. An error means the whole request should be
+// retried; otherwise it returns how many documents were rejected.
+func (s *elasticSink) bulk(body []byte) (int, error) {
+	resp, err := s.do(http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return 0, fmt.Errorf("bulk request returned %s", resp.Status)
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || !result.Errors {
+		return 0, nil
+	}
+	failed := 0
+	for _, item := range result.Items {
+		for _, r := range item {
+			if r.Status/100 != 2 {
+				if failed == 0 {
+					slog.Warn("Elasticsearch rejected query events", "type", r.Error.Type, "reason", r.Error.Reason)
+				}
+				failed++
+			}
+		}
+	}
+	return failed, nil
+}
+
+func (s *elasticSink) putTemplate() error {
+	pattern := s.cfg.Index
+	if s.cfg.Daily {
+		pattern += "-*"
+	}
+	tmpl, err := json.Marshal(map[string]any{
+		"index_patterns": []string{pattern},
+		"template":       map[string]any{"mappings": json.RawMessage(elasticMappings)},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPut, "/_index_template/"+s.cfg.Index, "application/json", tmpl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("index template request returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *elasticSink) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(context.Background(), method, s.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "DeceptiveDNS")
+	switch {
+	case s.cfg.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.cfg.APIKey)
+	case s.cfg.Username != "":
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	return s.client.Do(req)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultEmailSubject = `[DeceptiveDNS] {{len .Alerts}} alert{{if gt (len .Alerts) 1}}s{{end}}{{with index .Alerts 0}}: {{.Kind}} {{.QName}}{{end}}`
+	defaultEmailBody    = `{{range .Alerts}}{{.Time.Format "2006-01-02 15:04:05 MST"}}  {{.Kind}}  {{.Message}}
+  client={{.Client}}{{with .QName}} qname={{.}}{{end}}{{with .QType}} qtype={{.}}{{end}}{{with .Rule}} rule={{.}}{{end}}{{with .Source}} source={{.}}{{end}}
+{{end}}`
+)
+
+// emailConfig configures an SMTP notifier. Subject and Template are
+// text/templates executed with {Alerts: []*alert}. When Digest is set,
+// alerts are collected and sent as a single message per interval instead of
+// one message each.
+type emailConfig struct {
+	Server        string        `yaml:"server"` // host:port
+	TLS           string        `yaml:"tls"`    // starttls (default), tls or none
+	Username      string        `yaml:"username"`
+	Password      string        `yaml:"password"`
+	From          string        `yaml:"from"`
+	To            []string      `yaml:"to"`
+	Subject       string        `yaml:"subject"`
+	Template      string        `yaml:"template"`
+	Digest        time.Duration `yaml:"digest"`
+	notifyOptions `yaml:",inline"`
+}
+
+type emailNotifier struct {
+	cfg     emailConfig
+	host    string
+	subject *template.Template
+	body    *template.Template
+
+	// digest mode
+	mu      sync.Mutex
+	pending []*alert
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newEmailNotifier(cfg emailConfig) (*emailNotifier, error) {
+	host, _, err := net.SplitHostPort(cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email server %q: %v", cfg.Server, err)
+	}
+	switch cfg.TLS {
+	case "":
+		cfg.TLS = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("invalid email tls mode %q (want starttls, tls or none)", cfg.TLS)
+	}
+	if cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("email notifier for %s needs from and to addresses", cfg.Server)
+	}
+	if cfg.Subject == "" {
+		cfg.Subject = defaultEmailSubject
+	}
+	if cfg.Template == "" {
+		cfg.Template = defaultEmailBody
+	}
+	subject, err := template.New("subject").Parse(cfg.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email subject template: %v", err)
+	}
+	body, err := template.New("body").Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email body template: %v", err)
+	}
+
+	e := &emailNotifier{cfg: cfg, host: host, subject: subject, body: body}
+	if cfg.Digest > 0 {
+		e.done = make(chan struct{})
+		e.wg.Add(1)
+		go e.digestLoop()
+	}
+	return e, nil
+}
+
+func (e *emailNotifier) String() string {
+	return "email " + e.cfg.Server
+}
+
+// batching reports whether alerts are collected into digests.
+func (e *emailNotifier) batching() bool {
+	return e.cfg.Digest > 0
+}
+
+func (e *emailNotifier) Notify(ctx context.Context, a *alert) error {
+	if e.cfg.Digest > 0 {
+		e.mu.Lock()
+		e.pending = append(e.pending, a)
+		e.mu.Unlock()
+		return nil
+	}
+	return e.send(ctx, []*alert{a})
+}
+
+func (e *emailNotifier) digestLoop() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.cfg.Digest)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-e.done:
+			e.flush()
+			return
+		}
+	}
+}
+
+// flush sends the pending digest, retrying a few times before giving up.
+func (e *emailNotifier) flush() {
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	var err error
+	for attempt := 0; attempt <= e.cfg.withDefaults().Retries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = e.send(ctx, batch)
+		cancel()
+		if err == nil {
+			alertsDelivered.Add(int64(len(batch)))
+			return
+		}
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	alertsFailed.Add(int64(len(batch)))
+	slog.Error("Email digest delivery failed", "server", e.cfg.Server, "alerts", len(batch), "err", err)
+}
+
+// Close sends any pending digest.
+func (e *emailNotifier) Close() error {
+	if e.done != nil {
+		close(e.done)
+		e.wg.Wait()
+	}
+	return nil
+}
+
+func (e *emailNotifier) send(ctx context.Context, alerts []*alert) error {
+	data := struct{ Alerts []*alert }{alerts}
+	var subject, body bytes.Buffer
+	if err := e.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := e.body.Execute(&body, data); err != nil {
+		return err
+	}
+	return e.deliver(ctx, e.compose(strings.Join(strings.Fields(subject.String()), " "), body.String(), "text/plain"))
+}
+
+// SendReport mails r, as HTML or as plain text for Markdown reports.
+func (e *emailNotifier) SendReport(ctx context.Context, r *report) error {
+	contentType := "text/plain"
+	if r.Format == "html" {
+		contentType = "text/html"
+	}
+	return e.deliver(ctx, e.compose("[DeceptiveDNS] "+r.Title, r.Content, contentType))
+}
+
+// deliver sends one composed message.
+func (e *emailNotifier) deliver(ctx context.Context, msg []byte) error {
+	d := net.Dialer{}
+	var conn net.Conn
+	var err error
+	if e.cfg.TLS == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: e.host}}).DialContext(ctx, "tcp", e.cfg.Server)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", e.cfg.Server)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if e.cfg.TLS == "starttls" {
+		if err := c.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+			return err
+		}
+	}
+	if e.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range e.cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (e *emailNotifier) compose(subject, body, contentType string) []byte {
+	id := make([]byte, 12)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.cfg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), hostname)
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\nContent-Type: %s; charset=utf-8\r\n\r\n", contentType)
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// queryEvent describes one handled query. Every query produces exactly one
+// event, which is logged and handed to each configured event sink.
+type queryEvent struct {
+	Time     time.Time     `json:"time"`
+	Client   string        `json:"client"` // client IP address, without port
+	Port     int           `json:"port"`
+	Listener string        `json:"listener,omitempty"` // local address the query arrived on
+	QName    string        `json:"qname"`
+	QType    string        `json:"qtype"`
+	Opcode   string        `json:"opcode,omitempty"` // "QUERY", "NOTIFY", "UPDATE" or, answered NOTIMP, any other
+	Action   string        `json:"action"`           // "answered", "monitored", "forwarded", "replayed", "limited", "update", "notify", "transferred", "unsupported", "refused" or "ignored"
+	Answer   []string      `json:"answer,omitempty"`
+	Rule     string        `json:"rule,omitempty"`
+	Feed     string        `json:"feed,omitempty"` // threat feed that listed the rule's domain
+	RCode    string        `json:"rcode,omitempty"`
+	EDE      string        `json:"ede,omitempty"`  // Extended DNS Error the response carried, such as "15 (blocked)"
+	TSIG     string        `json:"tsig,omitempty"` // key a signed request verified with
+	MAC      string        `json:"mac,omitempty"`  // client's link-layer address, when a rule scoped by MAC looked it up
+	Session  string        `json:"session,omitempty"`
+	Latency  time.Duration `json:"latency_ns"`
+
+	// With -ground-truth, what -forward answered a query a rule answered
+	// with: its records and response code, or "error" if it didn't answer
+	TrueAnswer []string `json:"true_answer,omitempty"`
+	TrueRCode  string   `json:"true_rcode,omitempty"`
+
+	// With -fingerprint, what the query says about the client software,
+	// and a guess at what it is
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Software    string `json:"client_software,omitempty"`
+
+	// Raw wire-format messages, for sinks such as dnstap that carry them
+	Query    []byte `json:"-"`
+	Response []byte `json:"-"`
+}
+
+// eventSink receives query events. Write must not block the query path;
+// sinks that do I/O buffer internally and drop events when they fall behind.
+type eventSink interface {
+	Write(ev *queryEvent)
+	Close() error
+}
+
+// eventsConfig is the "events" section of the config file, listing event
+// sinks that need more settings than a flag can carry.
+type eventsConfig struct {
+	MQTT          []mqttConfig    `yaml:"mqtt"`
+	Kafka         []kafkaConfig   `yaml:"kafka"`
+	Elasticsearch []elasticConfig `yaml:"elasticsearch"`
+	SIEM          []siemConfig    `yaml:"siem"`
+}
+
+// newConfiguredSinks starts the sinks listed in cfg. Sinks that also carry
+// alerts, such as SIEM outputs, are registered with alerts.
+func newConfiguredSinks(cfg eventsConfig, alerts *alerter) ([]eventSink, error) {
+	var sinks []eventSink
+	for _, mc := range cfg.MQTT {
+		s, err := newMQTTSink(mc)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	for _, kc := range cfg.Kafka {
+		s, err := newKafkaSink(kc)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	for _, ec := range cfg.Elasticsearch {
+		s, err := newElasticSink(ec)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	for _, sc := range cfg.SIEM {
+		s, err := newSIEMSink(sc)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+		alerts.add(siemAlerts{s}, sc.notifyOptions)
+	}
+	return sinks, nil
+}
+
+// logEvent writes ev to the process log. Ignored and forwarded queries are
+// logged at debug level so the default output only shows queries that matched
+// a rule.
+func logEvent(ev *queryEvent) {
+	level := slog.LevelInfo
+	if ev.Action == "ignored" || ev.Action == "forwarded" || ev.Action == "limited" {
+		level = slog.LevelDebug
+	}
+	attrs := []any{
+		"client", ev.Client,
+		"qname", ev.QName,
+		"qtype", ev.QType,
+		"action", ev.Action,
+		"rcode", ev.RCode,
+		"rule", ev.Rule,
+		"answer", strings.Join(ev.Answer, ","),
+		"latency", ev.Latency,
+	}
+	if ev.Opcode != "" && ev.Opcode != "QUERY" {
+		attrs = append(attrs, "opcode", ev.Opcode)
+	}
+	if ev.Feed != "" {
+		attrs = append(attrs, "feed", ev.Feed)
+	}
+	if ev.EDE != "" {
+		attrs = append(attrs, "ede", ev.EDE)
+	}
+	if ev.TrueRCode != "" {
+		attrs = append(attrs, "true_rcode", ev.TrueRCode, "true_answer", strings.Join(ev.TrueAnswer, ","), "differs", ev.differs())
+	}
+	if ev.TSIG != "" {
+		attrs = append(attrs, "tsig", ev.TSIG)
+	}
+	if ev.MAC != "" {
+		attrs = append(attrs, "mac", ev.MAC)
+	}
+	if ev.Fingerprint != "" {
+		attrs = append(attrs, "fingerprint", ev.Fingerprint, "client_software", ev.Software)
+	}
+	if ev.Session != "" {
+		attrs = append(attrs, "session", ev.Session)
+	}
+	slog.Log(context.Background(), level, "query", attrs...)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportCommand implements "export", which bundles what a session left
+// behind into one gzipped tar archive for reporting on the engagement, e.g.
+//
+//	DeceptiveDNS export -session acme-q3 -db queries.db -pcap dns.pcap -config config.yaml
+//
+// The archive holds a directory named after the session with its queries
+// and alerts from the query log as JSON lines, the packets captured while
+// it ran, a copy of the config file and a manifest summarizing them.
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	name := fs.String("session", "", "Session to export")
+	dbPath := fs.String("db", "queries.db", "Query log database the server wrote with -querylog")
+	pcapPath := fs.String("pcap", "", "Capture the server wrote with -pcap, whose packets from the session's time to include (optional)")
+	configPath := fs.String("config", "", "Config file to include (optional)")
+	out := fs.String("o", "", "Archive to write (default <session>.tar.gz)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *name == "" || fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: DeceptiveDNS export -session name [-db queries.db] [-pcap file] [-config file] [-o file.tar.gz]")
+		return 2
+	}
+	if err := validSessionName(*name); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *out == "" {
+		*out = *name + ".tar.gz"
+	}
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot open query log:", err)
+		return 1
+	}
+	tmp, err := os.MkdirTemp("", "deceptivedns-export")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(tmp)
+
+	m, err := exportQueryLog(*dbPath, *name, tmp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Reading the query log failed:", err)
+		return 1
+	}
+	if m.Queries == 0 && m.Alerts == 0 {
+		fmt.Fprintf(os.Stderr, "%s has no queries or alerts from session %s\n", *dbPath, *name)
+		return 1
+	}
+	files := map[string]string{"queries.jsonl": filepath.Join(tmp, "queries.jsonl"), "alerts.jsonl": filepath.Join(tmp, "alerts.jsonl")}
+	if *pcapPath != "" {
+		if m.Queries == 0 {
+			fmt.Fprintln(os.Stderr, "The session has no queries to take the capture's time span from; leaving out the capture")
+		} else {
+			path := filepath.Join(tmp, "capture.pcap")
+			if m.Packets, err = exportPCAP(*pcapPath, path, *m.First, m.last); err != nil {
+				fmt.Fprintln(os.Stderr, "Reading the capture failed:", err)
+				return 1
+			}
+			files["capture.pcap"] = path
+		}
+	}
+	if *configPath != "" {
+		if _, err := os.Stat(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		files[filepath.Base(*configPath)] = *configPath
+	}
+	for f := range files {
+		m.Files = append(m.Files, f)
+	}
+	sort.Strings(m.Files)
+
+	if err := writeExport(*out, m, files); err != nil {
+		os.Remove(*out)
+		fmt.Fprintln(os.Stderr, "Writing the archive failed:", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d queries, %d alerts and %d packets from session %s to %s\n", m.Queries, m.Alerts, m.Packets, *name, *out)
+	return 0
+}
+
+// exportManifest describes an exported session, as manifest.json in the
+// archive.
+type exportManifest struct {
+	Session  string     `json:"session"`
+	Exported time.Time  `json:"exported"`
+	Version  string     `json:"version"`
+	First    *time.Time `json:"first,omitempty"` // first query
+	Last     *time.Time `json:"last,omitempty"`  // last query
+	Files    []string   `json:"files"`
+
+	Queries    int              `json:"queries"`
+	Alerts     int              `json:"alerts"`
+	Packets    int              `json:"packets,omitempty"` // in capture.pcap
+	Differs    int              `json:"differs,omitempty"` // spoofed queries whose -ground-truth answer was different
+	Clients    int              `json:"clients"`
+	Actions    map[string]int64 `json:"actions"`     // queries by action
+	AlertKinds map[string]int64 `json:"alert_kinds"` // alerts by kind
+	TopNames   []topEntry       `json:"top_names"`
+	TopClients []topEntry       `json:"top_clients"`
+
+	last time.Time // when the last response was sent, which ends the capture
+}
+
+// exportQueryLog writes the session's queries and alerts from the query log
+// at dbPath to queries.jsonl and alerts.jsonl in dir, oldest first, and
+// returns a manifest counting them.
+func exportQueryLog(dbPath, name, dir string) (*exportManifest, error) {
+	db, err := openQueryLogReadOnly(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	from, err := queryLogFrom(db)
+	if err != nil {
+		return nil, err
+	}
+	// Query logs from before sessions have no alerts table
+	var hasAlerts bool
+	if err := db.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'alerts'`).Scan(&hasAlerts); err != nil {
+		return nil, err
+	}
+
+	m := &exportManifest{Session: name, Exported: time.Now().UTC(), Version: version,
+		Actions: make(map[string]int64), AlertKinds: make(map[string]int64)}
+	names := make(map[string]int64)
+	clients := make(map[string]int64)
+	err = writeJSONLines(filepath.Join(dir, "queries.jsonl"), func(enc *json.Encoder) error {
+		rows, err := db.Query(queryLogSelect+from+` WHERE session = ? ORDER BY ts, id`, name)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			ev, err := scanQueryLog(rows)
+			if err != nil {
+				return err
+			}
+			if m.First == nil {
+				m.First = &ev.Time
+			}
+			m.Last = &ev.Time
+			// Times in the query log are to the millisecond, the capture's to
+			// the microsecond
+			if end := ev.Time.Add(ev.Latency + time.Millisecond); end.After(m.last) {
+				m.last = end
+			}
+			m.Queries++
+			m.Actions[ev.Action]++
+			if ev.differs() {
+				m.Differs++
+			}
+			names[ev.QName]++
+			clients[ev.Client]++
+			if err := enc.Encode(&ev); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = writeJSONLines(filepath.Join(dir, "alerts.jsonl"), func(enc *json.Encoder) error {
+		if !hasAlerts {
+			return nil
+		}
+		rows, err := db.Query(`SELECT ts, kind, client, qname, qtype, rule, source, message, session
+			FROM alerts WHERE session = ? ORDER BY ts, id`, name)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var al alert
+			var ts int64
+			if err := rows.Scan(&ts, &al.Kind, &al.Client, &al.QName, &al.QType, &al.Rule, &al.Source, &al.Message, &al.Session); err != nil {
+				return err
+			}
+			al.Time = time.UnixMilli(ts)
+			m.Alerts++
+			m.AlertKinds[al.Kind]++
+			if err := enc.Encode(&al); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.Clients = len(clients)
+	m.TopNames = topEntries(names, 10)
+	m.TopClients = topEntries(clients, 10)
+	return m, nil
+}
+
+// writeJSONLines creates path and has write encode its lines.
+func writeJSONLines(path string, write func(enc *json.Encoder) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := write(json.NewEncoder(w)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportPCAP copies the packets from first to last in the capture at path,
+// and the files it was rotated to, into a single capture at out, returning
+// how many there were.
+func exportPCAP(path, out string, first, last time.Time) (int, error) {
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return 0, err
+	}
+	var inputs []string
+	for _, r := range rotated {
+		if !strings.HasSuffix(r, ".tmp") {
+			inputs = append(inputs, r)
+		}
+	}
+	// The live file is newest
+	sortRotated(path, inputs)
+	inputs = append(inputs, path)
+
+	f, err := os.Create(out)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	n, header := 0, true
+	for _, in := range inputs {
+		c, err := copyPCAP(w, in, header, first, last)
+		if errors.Is(err, os.ErrNotExist) && in != path {
+			continue // pruned since it was listed
+		}
+		if err != nil {
+			return n, fmt.Errorf("%s: %v", in, err)
+		}
+		n, header = n+c, false
+	}
+	if err := w.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// copyPCAP copies the records from first to last of the pcap file at path
+// to w, preceded by the file header if header is set.
+func copyPCAP(w io.Writer, path string, header bool, first, last time.Time) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		r = zr
+	}
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, errors.New("not a pcap file")
+	}
+	if binary.LittleEndian.Uint32(hdr) != 0xa1b2c3d4 {
+		return 0, errors.New("not a pcap file written by -pcap")
+	}
+	if header {
+		if _, err := w.Write(hdr); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	rec := make([]byte, 16, 16+65535)
+	for {
+		// Stop at the end of the file, or at a record cut short because the
+		// server is still writing it
+		if _, err := io.ReadFull(r, rec[:16]); err != nil {
+			return n, nil
+		}
+		size := binary.LittleEndian.Uint32(rec[8:12])
+		if size > 65535 {
+			return n, errors.New("corrupt record")
+		}
+		rec = rec[:16+size]
+		if _, err := io.ReadFull(r, rec[16:]); err != nil {
+			return n, nil
+		}
+		ts := time.Unix(int64(binary.LittleEndian.Uint32(rec[0:4])), int64(binary.LittleEndian.Uint32(rec[4:8]))*1000)
+		if ts.Before(first) || ts.After(last) {
+			continue
+		}
+		if _, err := w.Write(rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// writeExport writes the archive at path: the manifest and then files,
+// name -> path on disk, in a directory named after the session.
+func writeExport(path string, m *exportManifest, files map[string]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifest = append(manifest, '\n')
+	if err := tw.WriteHeader(&tar.Header{Name: m.Session + "/manifest.json", Mode: 0o644, Size: int64(len(manifest)), ModTime: m.Exported}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	for _, name := range m.Files {
+		if err := addToTar(tw, m.Session+"/"+name, files[name], m.Exported); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addToTar(tw *tar.Writer, name, path string, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: fi.Size(), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
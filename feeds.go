@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var feedErrors = expvar.NewInt("feed_errors")
+
+const (
+	feedDefaultRefresh = time.Hour
+	feedMinRefresh     = time.Minute
+	feedMaxSize        = 64 << 20
+	feedFetchTimeout   = time.Minute
+)
+
+// feedConfig is one entry of the "feeds" section: a list of malicious
+// domains, fetched on a schedule, whose names become rules.
+type feedConfig struct {
+	Name     string            `yaml:"name"`     // recorded in every event and alert the feed's rules cause
+	URL      string            `yaml:"url"`      // http(s) URL or local file
+	Format   string            `yaml:"format"`   // list (default), hosts, csv or misp
+	Column   int               `yaml:"column"`   // csv column with the domain or URL, counting from 1
+	Refresh  time.Duration     `yaml:"refresh"`  // how often to fetch it, default 1h
+	Action   string            `yaml:"action"`   // sinkhole (default) answers listed names, alert also raises a canary alert
+	IP       string            `yaml:"ip"`       // sinkhole address, default the server's
+	Wildcard bool              `yaml:"wildcard"` // also match every name below a listed domain
+	Headers  map[string]string `yaml:"headers"`  // e.g. a MISP Authorization key
+}
+
+// feeds keeps the rules of each configured feed up to date. A feed that
+// can't be fetched keeps the rules from its last good copy.
+type feeds struct {
+	rules  *ruleSet
+	client *http.Client
+	list   []*feed
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type feed struct {
+	cfg          feedConfig
+	etag         string
+	lastModified string
+}
+
+func newFeeds(cfgs []feedConfig, rules *ruleSet) (*feeds, error) {
+	f := &feeds{rules: rules, client: &http.Client{Timeout: feedFetchTimeout}, stop: make(chan struct{})}
+	names := make(map[string]bool)
+	for i, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("feed %d needs a name", i+1)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("feed %s is defined twice", cfg.Name)
+		}
+		names[cfg.Name] = true
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("feed %s needs a url", cfg.Name)
+		}
+		switch cfg.Format {
+		case "":
+			cfg.Format = "list"
+		case "list", "hosts", "csv", "misp":
+		default:
+			return nil, fmt.Errorf("feed %s: unknown format %q (want list, hosts, csv or misp)", cfg.Name, cfg.Format)
+		}
+		if cfg.Column < 0 {
+			return nil, fmt.Errorf("feed %s: column must be positive", cfg.Name)
+		}
+		if cfg.Column == 0 {
+			cfg.Column = 1
+		}
+		switch cfg.Action {
+		case "":
+			cfg.Action = "sinkhole"
+		case "sinkhole", "alert":
+		default:
+			return nil, fmt.Errorf("feed %s: unknown action %q (want sinkhole or alert)", cfg.Name, cfg.Action)
+		}
+		if cfg.IP != "" && net.ParseIP(cfg.IP) == nil && !answerTemplates[cfg.IP] {
+			return nil, fmt.Errorf("feed %s: invalid IP address or answer template %q", cfg.Name, cfg.IP)
+		}
+		if cfg.Refresh == 0 {
+			cfg.Refresh = feedDefaultRefresh
+		}
+		if cfg.Refresh < feedMinRefresh {
+			return nil, fmt.Errorf("feed %s: refresh %s is shorter than %s", cfg.Name, cfg.Refresh, feedMinRefresh)
+		}
+		f.list = append(f.list, &feed{cfg: cfg})
+	}
+	return f, nil
+}
+
+// start fetches every feed now and then on its schedule.
+func (f *feeds) start() {
+	for _, fd := range f.list {
+		f.wg.Add(1)
+		go f.run(fd)
+	}
+}
+
+func (f *feeds) close() {
+	close(f.stop)
+	f.wg.Wait()
+}
+
+func (f *feeds) run(fd *feed) {
+	defer f.wg.Done()
+	ticker := time.NewTicker(fd.cfg.Refresh)
+	defer ticker.Stop()
+	for {
+		f.update(fd)
+		select {
+		case <-ticker.C:
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// update fetches fd and swaps in its rules.
+func (f *feeds) update(fd *feed) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-f.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	data, err := f.fetch(ctx, fd)
+	if err != nil {
+		feedErrors.Add(1)
+		slog.Error("Failed to fetch feed", "feed", fd.cfg.Name, "url", fd.cfg.URL, "err", err)
+		return
+	}
+	if data == nil {
+		slog.Debug("Feed unchanged", "feed", fd.cfg.Name)
+		return
+	}
+	domains, err := parseFeed(data, fd.cfg.Format, fd.cfg.Column)
+	if err != nil {
+		feedErrors.Add(1)
+		slog.Error("Failed to parse feed", "feed", fd.cfg.Name, "err", err)
+		return
+	}
+	var rules []*rule
+	for _, d := range domains {
+		rules = append(rules, fd.rule(d))
+		if fd.cfg.Wildcard {
+			rules = append(rules, fd.rule("*."+d))
+		}
+	}
+	added, shadowed := f.rules.replaceFeed(fd.cfg.Name, rules)
+	slog.Info("Feed loaded", "feed", fd.cfg.Name, "domains", len(domains), "rules", added, "shadowed", shadowed)
+}
+
+func (fd *feed) rule(domain string) *rule {
+	return &rule{Domain: domain, IP: fd.cfg.IP, Canary: fd.cfg.Action == "alert", Feed: fd.cfg.Name}
+}
+
+// fetch returns the feed's contents, or nil if a web server says they
+// haven't changed since the last fetch.
+func (f *feeds) fetch(ctx context.Context, fd *feed) ([]byte, error) {
+	u, err := url.Parse(fd.cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return os.ReadFile(strings.TrimPrefix(fd.cfg.URL, "file://"))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fd.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "DeceptiveDNS")
+	for k, v := range fd.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if fd.etag != "" {
+		req.Header.Set("If-None-Match", fd.etag)
+	}
+	if fd.lastModified != "" {
+		req.Header.Set("If-Modified-Since", fd.lastModified)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s returned %s", fd.cfg.URL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, feedMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > feedMaxSize {
+		return nil, fmt.Errorf("feed is larger than %d MB", feedMaxSize>>20)
+	}
+	fd.etag, fd.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return data, nil
+}
+
+// parseFeed returns the valid, distinct domains listed in data.
+func parseFeed(data []byte, format string, column int) ([]string, error) {
+	var values []string
+	switch format {
+	case "list", "hosts":
+		rules, err := parseRuleImport(bytes.NewReader(data), format)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			values = append(values, r.Domain)
+		}
+	case "csv":
+		cr := csv.NewReader(bytes.NewReader(data))
+		cr.Comment = '#'
+		cr.FieldsPerRecord = -1
+		cr.LazyQuotes = true
+		for {
+			rec, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if column <= len(rec) {
+				values = append(values, rec[column-1])
+			}
+		}
+	case "misp":
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		values = mispDomains(v, values)
+	}
+
+	seen := make(map[string]bool)
+	var domains []string
+	for _, v := range values {
+		d := feedDomain(v)
+		if d == "" || seen[d] {
+			continue
+		}
+		seen[d] = true
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// mispDomains collects the values of domain, hostname and url attributes
+// anywhere in a MISP event export or attribute search result.
+func mispDomains(v any, out []string) []string {
+	switch v := v.(type) {
+	case map[string]any:
+		if typ, ok := v["type"].(string); ok {
+			if value, ok := v["value"].(string); ok {
+				switch typ {
+				case "domain", "hostname", "url":
+					out = append(out, value)
+				case "domain|ip":
+					d, _, _ := strings.Cut(value, "|")
+					out = append(out, d)
+				}
+			}
+		}
+		for _, child := range v {
+			out = mispDomains(child, out)
+		}
+	case []any:
+		for _, child := range v {
+			out = mispDomains(child, out)
+		}
+	}
+	return out
+}
+
+// feedDomain turns a feed entry, a domain or a URL, into a domain a rule
+// can match, or "" if it has none. Defanged entries such as
+// evil[.]example are accepted.
+func feedDomain(s string) string {
+	s = strings.TrimSpace(strings.ReplaceAll(s, "[.]", "."))
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return ""
+		}
+		s = u.Hostname()
+	}
+	s = normalizeName(strings.TrimPrefix(s, "*."))
+	if s == "" || net.ParseIP(s) != nil || !strings.Contains(s, ".") {
+		return ""
+	}
+	if r := (&rule{Domain: s}); r.kind() != ruleExact || r.validate() != nil || strings.ContainsAny(s, " /:") {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fingerprintMaxClients = 10000
+	fingerprintPairWindow = time.Second      // A and AAAA queries this close together are one lookup
+	fingerprintRetryLimit = 10 * time.Second // longer gaps between identical queries aren't retransmissions
+)
+
+// fingerprintSignature names the client software whose queries carry every
+// token in Match. Tokens prefixed with ! must be absent.
+type fingerprintSignature struct {
+	Name  string `yaml:"name"`
+	Match string `yaml:"match"` // e.g. "rd ad edns=1232 opts=10"
+}
+
+// builtinSignatures are checked after any from the config file, in order.
+// Several programs share a fingerprint, so the guesses name all of them.
+var builtinSignatures = []fingerprintSignature{
+	{"scanner (server version query)", "class=CH"},
+	{"dig or another BIND tool", "rd ad edns cookie"},
+	{"recursive resolver (BIND, Unbound, Knot)", "!rd edns do"},
+	{"forwarding resolver with client subnet", "rd edns ecs"},
+	{"resolver using 0x20 case randomisation", "0x20"},
+	{"Go resolver or dnsmasq", "rd !ad !do edns=1232 !opts"},
+	{"glibc or musl stub resolver", "rd noedns pair same-port"},
+	{"Windows DNS client", "rd noedns retry=1s"},
+	{"stub resolver without EDNS", "rd noedns"},
+}
+
+// fingerprinter describes each query by what its client software leaves in
+// it, such as header flags, EDNS settings, option order, case randomisation
+// and, from the client's previous query, whether A and AAAA are asked
+// together and how soon an unanswered query is repeated. It then guesses
+// the software from the first signature the description matches.
+type fingerprinter struct {
+	signatures []fingerprintSignature
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*fingerprintClient
+}
+
+// fingerprintClient is what's remembered of a client's last query.
+type fingerprintClient struct {
+	name  string
+	qtype uint16
+	id    uint16
+	port  uint16
+	time  time.Time
+	pair  bool // A and AAAA queries seen together
+	same  bool // ... from the same port
+	retry time.Duration
+}
+
+func newFingerprinter(custom []fingerprintSignature) (*fingerprinter, error) {
+	for _, sig := range custom {
+		if sig.Name == "" || strings.TrimSpace(sig.Match) == "" {
+			return nil, fmt.Errorf("fingerprint signature %q needs a name and match tokens", sig.Name)
+		}
+	}
+	return &fingerprinter{
+		signatures: append(append([]fingerprintSignature(nil), custom...), builtinSignatures...),
+		clients:    make(map[netip.Addr]*fingerprintClient),
+	}, nil
+}
+
+// observe returns the fingerprint of req, from addr, and the guessed
+// client software, or "" if no signature matches.
+func (f *fingerprinter) observe(addr netip.AddrPort, msg *dnsMsg, req []byte, now time.Time) (string, string) {
+	tokens := queryTokens(msg, req)
+	tokens = append(tokens, f.history(addr, msg, now)...)
+	for _, sig := range f.signatures {
+		if matchesSignature(tokens, sig.Match) {
+			return strings.Join(tokens, " "), sig.Name
+		}
+	}
+	return strings.Join(tokens, " "), ""
+}
+
+// queryTokens describes one query: its header flags, EDNS settings and
+// options, and the case and class of its question.
+func queryTokens(msg *dnsMsg, req []byte) []string {
+	var tokens []string
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{{0x0100, "rd"}, {0x0020, "ad"}, {0x0010, "cd"}} {
+		if msg.Flags&f.bit != 0 {
+			tokens = append(tokens, f.name)
+		}
+	}
+	if msg.Question.Class != dnsClassIN {
+		tokens = append(tokens, "class="+classString(msg.Question.Class))
+	}
+	if hasMixedCase(msg.Question.Name) {
+		tokens = append(tokens, "0x20")
+	}
+
+	opt, ok := findOPT(req)
+	if !ok {
+		return append(tokens, "noedns")
+	}
+	tokens = append(tokens, "edns", "edns="+strconv.Itoa(int(opt.size)))
+	if opt.version != 0 {
+		tokens = append(tokens, "ednsv="+strconv.Itoa(int(opt.version)))
+	}
+	if opt.do {
+		tokens = append(tokens, "do")
+	}
+	if len(opt.codes) > 0 {
+		codes := make([]string, len(opt.codes))
+		for i, c := range opt.codes {
+			codes[i] = strconv.Itoa(int(c))
+			switch c {
+			case 8:
+				tokens = append(tokens, "ecs")
+			case 10:
+				tokens = append(tokens, "cookie")
+			case 12:
+				tokens = append(tokens, "padding")
+			}
+		}
+		tokens = append(tokens, "opts", "opts="+strings.Join(codes, ","))
+	}
+	return tokens
+}
+
+// history compares the query with the client's previous one and returns
+// what that says about the client: whether it looks up A and AAAA together,
+// from the same port, and how long it waits before retransmitting.
+func (f *fingerprinter) history(addr netip.AddrPort, msg *dnsMsg, now time.Time) []string {
+	client := addr.Addr().Unmap()
+	name := normalizeName(msg.Question.Name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.clients[client]
+	if !ok {
+		if len(f.clients) >= fingerprintMaxClients {
+			clear(f.clients)
+		}
+		c = &fingerprintClient{}
+		f.clients[client] = c
+	}
+	gap := now.Sub(c.time)
+	if c.name == name {
+		otherFamily := (c.qtype == dnsTypeA && msg.Question.Type == dnsTypeAAAA) || (c.qtype == dnsTypeAAAA && msg.Question.Type == dnsTypeA)
+		switch {
+		case otherFamily && gap < fingerprintPairWindow:
+			c.pair, c.same = true, c.port == addr.Port()
+		case c.qtype == msg.Question.Type && c.id == msg.ID && gap < fingerprintRetryLimit:
+			c.retry = gap
+		}
+	}
+	c.name, c.qtype, c.id, c.port, c.time = name, msg.Question.Type, msg.ID, addr.Port(), now
+
+	var tokens []string
+	if c.pair {
+		tokens = append(tokens, "pair")
+		if c.same {
+			tokens = append(tokens, "same-port")
+		}
+	}
+	if c.retry > 0 {
+		tokens = append(tokens, "retry="+c.retry.Round(time.Second).String())
+	}
+	return tokens
+}
+
+func matchesSignature(tokens []string, match string) bool {
+	for _, want := range strings.Fields(match) {
+		neg := strings.HasPrefix(want, "!")
+		found := false
+		for _, t := range tokens {
+			if t == strings.TrimPrefix(want, "!") {
+				found = true
+				break
+			}
+		}
+		if found == neg {
+			return false
+		}
+	}
+	return true
+}
+
+func hasMixedCase(name string) bool {
+	var upper, lower bool
+	for i := 0; i < len(name); i++ {
+		upper = upper || (name[i] >= 'A' && name[i] <= 'Z')
+		lower = lower || (name[i] >= 'a' && name[i] <= 'z')
+	}
+	return upper && lower
+}
+
+type ednsOPT struct {
+	size    uint16
+	version uint8
+	do      bool
+	codes   []uint16 // option codes, in the order sent
+}
+
+// findOPT returns the EDNS OPT record (RFC 6891) of a query, if it has one.
+func findOPT(req []byte) (ednsOPT, bool) {
+	var opt ednsOPT
+	if len(req) < 12 {
+		return opt, false
+	}
+	_, off, err := readName(req, 12)
+	if err != nil {
+		return opt, false
+	}
+	off += 4
+	records := int(binary.BigEndian.Uint16(req[6:8])) + int(binary.BigEndian.Uint16(req[8:10])) + int(binary.BigEndian.Uint16(req[10:12]))
+	for i := 0; i < records; i++ {
+		var name string
+		if name, off, err = readName(req, off); err != nil || off+10 > len(req) {
+			return opt, false
+		}
+		typ := binary.BigEndian.Uint16(req[off : off+2])
+		rdlen := int(binary.BigEndian.Uint16(req[off+8 : off+10]))
+		if off+10+rdlen > len(req) {
+			return opt, false
+		}
+		if typ == 41 && name == "" {
+			opt.size = binary.BigEndian.Uint16(req[off+2 : off+4])
+			opt.version = req[off+5]
+			opt.do = req[off+6]&0x80 != 0
+			rd := req[off+10 : off+10+rdlen]
+			for len(rd) >= 4 {
+				opt.codes = append(opt.codes, binary.BigEndian.Uint16(rd[:2]))
+				n := 4 + int(binary.BigEndian.Uint16(rd[2:4]))
+				if n > len(rd) {
+					break
+				}
+				rd = rd[n:]
+			}
+			return opt, true
+		}
+		off += 10 + rdlen
+	}
+	return opt, false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"strings"
+)
+
+var cnamesFlattened = expvar.NewInt("cnames_flattened")
+
+// parseFlattenMode checks a -flatten-cnames value: "" for none, "apex" for
+// registrable domains such as example.com, or "all".
+func parseFlattenMode(s string) (string, error) {
+	switch s {
+	case "", "apex", "all":
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid -flatten-cnames %q (want apex or all)", s)
+}
+
+// flattenAnswer returns the response to a forwarded A or AAAA query whose
+// upstream response is upstream, with any CNAME chain flattened the way
+// authoritative providers answer for a zone's apex: the addresses the
+// chain ends at are owned by the queried name, with the lowest TTL along
+// the chain, and the CNAMEs are left out. It returns nil when upstream has
+// no CNAMEs to flatten, the chain ends without addresses, or the name is
+// outside the mode's names, and upstream's response stands.
+func (s *dnsServer) flattenAnswer(msg *dnsMsg, upstream []byte) []byte {
+	q := msg.Question
+	if s.flatten == "" || (q.Type != dnsTypeA && q.Type != dnsTypeAAAA) {
+		return nil
+	}
+	if s.flatten == "apex" && registrableIndex(strings.Split(normalizeName(q.Name), ".")) != 0 {
+		return nil
+	}
+	ttl, ok := cnameTTL(upstream)
+	if !ok {
+		return nil
+	}
+	var resp dnsMsg
+	if resp.unpack(upstream) != nil || resp.Flags&0xF != 0 {
+		return nil
+	}
+
+	// Like DNS64 answers, the result isn't authoritative
+	out := dnsMsg{ID: msg.ID, Flags: resp.Flags &^ 0x0600, Question: q}
+	for _, rr := range resp.Answers {
+		if rr.Type != q.Type {
+			continue
+		}
+		out.Answers = append(out.Answers, dnsResourceRecord{
+			Name:  q.Name,
+			Type:  rr.Type,
+			Class: dnsClassIN,
+			TTL:   min(rr.TTL, ttl),
+			Data:  rr.Data,
+		})
+	}
+	if len(out.Answers) == 0 {
+		return nil
+	}
+	b, err := out.pack()
+	if err != nil {
+		return nil
+	}
+	cnamesFlattened.Add(1)
+	return b
+}
+
+// cnameTTL returns the lowest TTL of the CNAME records in a response's
+// answer section, and whether it has any.
+func cnameTTL(resp []byte) (uint32, bool) {
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp[4:6]) != 1 {
+		return 0, false
+	}
+	_, off, err := readName(resp, 12)
+	if err != nil {
+		return 0, false
+	}
+	off += 4
+	ttl, found := uint32(0), false
+	for i := 0; i < int(binary.BigEndian.Uint16(resp[6:8])); i++ {
+		if _, off, err = readName(resp, off); err != nil || off+10 > len(resp) {
+			return 0, false
+		}
+		if binary.BigEndian.Uint16(resp[off:off+2]) == dnsTypeCNAME {
+			if t := binary.BigEndian.Uint32(resp[off+4 : off+8]); !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+		off += 10 + int(binary.BigEndian.Uint16(resp[off+8:off+10]))
+	}
+	return ttl, found
+}
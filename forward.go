@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	forwardsCoalesced = expvar.NewInt("forwards_coalesced")
+	forwardTimeouts   = expvar.NewInt("forward_timeouts") // upstream attempts unanswered in time
+	forwardRetries    = expvar.NewInt("forward_retries")
+	queriesDeadline   = expvar.NewInt("queries_deadline_exceeded")
+	forwardSpoofed    = expvar.NewInt("forward_spoofed") // datagrams that weren't the response to a forwarded query
+)
+
+// errQueryDeadline is returned by forward when the query's deadline passes
+// before upstream answers.
+var errQueryDeadline = errors.New("query deadline exceeded")
+
+// forwardLimits bound how long a forwarded query may take: each upstream
+// attempt gets timeout, an unanswered one is sent again up to retries
+// times, and the whole query must be done within deadline of being taken
+// up, or it is answered SERVFAIL.
+type forwardLimits struct {
+	timeout  time.Duration
+	retries  int
+	deadline time.Duration
+}
+
+// withDefaultPort appends port to addr unless it already has one.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, port)
+	}
+	return addr
+}
+
+// forwardCall is an upstream lookup in flight.
+type forwardCall struct {
+	done chan struct{} // closed once resp and err are set
+	resp []byte
+	err  error
+}
+
+// forwardGroup tracks the upstream lookups in flight, by question.
+type forwardGroup struct {
+	mu    sync.Mutex
+	calls map[string]*forwardCall
+}
+
+// forward relays a raw query to the upstream resolver and returns its raw
+// response, giving up with errQueryDeadline at deadline. Queries identical
+// to one already waiting on upstream but for their ID and the case of the
+// name, as from many clients asking at once or one client retrying, share
+// its lookup rather than sending their own; each gets the response with its
+// own ID and spelling of the name.
+func (s *dnsServer) forward(req []byte, deadline time.Time) ([]byte, error) {
+	key, ok := forwardKey(req)
+	if !ok {
+		return s.exchange(req, deadline)
+	}
+	g := &s.forwards
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		forwardsCoalesced.Add(1)
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		select {
+		case <-c.done:
+		case <-t.C:
+			return nil, errQueryDeadline
+		}
+		if c.err != nil {
+			return nil, c.err
+		}
+		return respondAs(c.resp, req), nil
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*forwardCall)
+	}
+	c := &forwardCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.resp, c.err = s.exchange(req, deadline)
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+	return c.resp, c.err
+}
+
+// forwardKey returns what identifies the lookup req asks for: everything
+// after its ID, with the question name in lower case, so options such as
+// EDNS buffer sizes and the RD and CD bits are only shared between queries
+// that agree on them.
+func forwardKey(req []byte) (string, bool) {
+	_, end, err := readName(req, 12)
+	if err != nil || binary.BigEndian.Uint16(req[4:6]) != 1 {
+		return "", false
+	}
+	key := append([]byte(nil), req[2:]...)
+	for i := 10; i < end-2; i++ {
+		if c := key[i]; 'A' <= c && c <= 'Z' {
+			key[i] = c + 'a' - 'A'
+		}
+	}
+	return string(key), true
+}
+
+// exchange sends a raw query to an upstream resolver and returns its raw
+// response, sending it again from a new port when an attempt times out,
+// within the retries and the deadline the limits allow. Each attempt goes
+// to the healthy upstream the pool picks for it, so retries fail over, and
+// with several upstreams any failed attempt is retried.
+func (s *dnsServer) exchange(req []byte, deadline time.Time) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			forwardRetries.Add(1)
+		}
+		until, cut := time.Now().Add(s.limits.timeout), false
+		if !until.Before(deadline) {
+			until, cut = deadline, true
+		}
+		u, start := s.upstream.pick(attempt), time.Now()
+		resp, err := s.attempt(u, req, until)
+		var nerr net.Error
+		timeout := errors.As(err, &nerr) && nerr.Timeout()
+		if timeout {
+			forwardTimeouts.Add(1)
+			if cut {
+				// Not u's fault: it may have had less than the timeout.
+				return nil, fmt.Errorf("upstream %s: %w", u.addr, errQueryDeadline)
+			}
+		}
+		u.report(err, time.Since(start))
+		// Other errors, such as a refused port, are only worth retrying
+		// on another upstream.
+		if err == nil || attempt == s.limits.retries || (!timeout && len(s.upstream.list) == 1) {
+			return resp, err
+		}
+	}
+}
+
+// attempt sends a raw query to u once and waits until deadline for its
+// response, returned with req's ID and spelling of the name.
+//
+// So that an off-path attacker can't easily slip a forged answer in, each
+// attempt is sent from a socket of its own, on a port the kernel picks at
+// random, with a random ID and, with -forward-0x20, the name in random
+// case (draft-vixie-dnsext-dns0x20). Datagrams that don't echo the ID and
+// the question exactly are discarded, and reported as spoofing attempts.
+func (s *dnsServer) attempt(u *upstream, req []byte, deadline time.Time) ([]byte, error) {
+	conn, err := net.Dial("udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	sent := upstreamQuery(req, s.mixCase)
+	if _, err := conn.Write(sent); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.addr, err)
+		}
+		if why := responseMismatch(sent, buf[:n]); why != "" {
+			s.spoofed(u, sent, why)
+			continue
+		}
+		return respondAs(buf[:n], req), nil
+	}
+}
+
+// upstreamQuery returns a copy of req to send upstream, with a random ID
+// and, with mixCase, the letters of the question name in random case.
+// Names with compression pointers, which no sane client sends in a
+// question, keep their case.
+func upstreamQuery(req []byte, mixCase bool) []byte {
+	out := bytes.Clone(req)
+	var r [2 + 255]byte
+	rand.Read(r[:])
+	copy(out[:2], r[:2])
+	if !mixCase || binary.BigEndian.Uint16(req[4:6]) != 1 {
+		return out
+	}
+	for off := 12; off < len(out) && out[off] != 0; off += 1 + int(out[off]) {
+		if out[off]&0xC0 != 0 || off+1+int(out[off]) > len(out) {
+			return out
+		}
+		for i := off + 1; i <= off+int(out[off]); i++ {
+			if c := out[i] | 0x20; 'a' <= c && c <= 'z' {
+				out[i] = c &^ (r[2+(i-12)%255] & 1 << 5)
+			}
+		}
+	}
+	return out
+}
+
+// responseMismatch returns why resp can't be the response to sent, an
+// upstream query, or "" if it can: it must carry sent's ID, be a response,
+// and repeat its question byte for byte, the name's case included.
+func responseMismatch(sent, resp []byte) string {
+	if len(resp) < 12 {
+		return "short message"
+	}
+	if binary.BigEndian.Uint16(resp[:2]) != binary.BigEndian.Uint16(sent[:2]) {
+		return "wrong ID"
+	}
+	if resp[2]&0x80 == 0 {
+		return "not a response"
+	}
+	_, end, err := readName(sent, 12)
+	if err != nil || binary.BigEndian.Uint16(sent[4:6]) != 1 || end+4 > len(sent) {
+		return "" // no question to compare
+	}
+	end += 4
+	switch {
+	case binary.BigEndian.Uint16(resp[4:6]) != 1 || end > len(resp):
+		return "no question"
+	case bytes.Equal(resp[12:end], sent[12:end]):
+		return ""
+	case bytes.EqualFold(resp[12:end-4], sent[12:end-4]) && bytes.Equal(resp[end-4:end], sent[end-4:end]):
+		return "name in the wrong case"
+	}
+	return "wrong question"
+}
+
+// spoofed counts a datagram that arrived for a query sent to u but isn't
+// its response, and raises a "spoofing" alert about it, at most once a
+// minute per upstream, since a poisoning attempt sends a flood of them.
+func (s *dnsServer) spoofed(u *upstream, sent []byte, why string) {
+	forwardSpoofed.Add(1)
+	u.spoofed.Add(1)
+	now := time.Now()
+	u.mu.Lock()
+	quiet := now.Sub(u.spoofAlerted) < time.Minute
+	if !quiet {
+		u.spoofAlerted = now
+	}
+	u.mu.Unlock()
+	if quiet {
+		return
+	}
+	al := &alert{
+		Time:    now,
+		Kind:    "spoofing",
+		Client:  u.addr,
+		Message: fmt.Sprintf("a response to a query forwarded to %s didn't match it (%s): possible cache poisoning attempt", u.addr, why),
+	}
+	if name, _, err := readName(sent, 12); err == nil {
+		al.QName = name
+	}
+	s.alerts.raise(al)
+}
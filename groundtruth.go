@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+var (
+	groundTruthLookups = expvar.NewInt("ground_truth_lookups")
+	groundTruthErrors  = expvar.NewInt("ground_truth_errors")
+	groundTruthSkipped = expvar.NewInt("ground_truth_skipped") // with too many lookups in flight already
+	groundTruthDiffers = expvar.NewInt("ground_truth_differs")
+)
+
+// groundTruthMaxLookups bounds the ground truth lookups in flight, so a
+// flood of spoofed queries can't pile up goroutines waiting on upstream.
+const groundTruthMaxLookups = 256
+
+// emitWithGroundTruth emits ev, the event of a query req a rule answered,
+// once the -forward resolvers have said what they would have answered it
+// with, recorded in ev as its true answer. The lookup happens after the
+// spoofed response has gone out, so it never delays it; the event waits
+// for it instead, up to the query deadline. Without a free lookup slot the
+// event is emitted as it is. The caller must be done with ev, which the
+// lookup's goroutine fills in, and events whose lookup outlasts shutdown are
+// dropped.
+func (s *dnsServer) emitWithGroundTruth(ev *queryEvent, req []byte) {
+	select {
+	case s.truthSlots <- struct{}{}:
+	default:
+		groundTruthSkipped.Add(1)
+		s.emit(ev)
+		return
+	}
+	req = bytes.Clone(req) // the caller's buffer is reused once it returns
+	s.truths.Add(1)
+	go func() {
+		defer s.truths.Done()
+		defer func() { <-s.truthSlots }()
+		defer func() {
+			if r := recover(); r != nil {
+				queryErrors.Add(1)
+				slog.Error("Recovered in ground truth lookup", "qname", ev.QName, "panic", r)
+			}
+		}()
+		groundTruthLookups.Add(1)
+		resp, err := s.forward(req, time.Now().Add(s.limits.deadline))
+		var msg dnsMsg
+		if err == nil {
+			err = msg.unpack(resp)
+		}
+		if err != nil {
+			groundTruthErrors.Add(1)
+			slog.Debug("Ground truth lookup failed", "qname", ev.QName, "qtype", ev.QType, "err", err)
+			ev.TrueRCode = "error"
+			s.emitTruth(ev)
+			return
+		}
+		ev.TrueRCode = rcodeString(msg.Flags)
+		ev.TrueAnswer = []string{}
+		for i := range msg.Answers {
+			ev.TrueAnswer = append(ev.TrueAnswer, msg.Answers[i].dataString())
+		}
+		if ev.differs() {
+			groundTruthDiffers.Add(1)
+		}
+		s.emitTruth(ev)
+	}()
+}
+
+// emitTruth emits ev, filled in by a ground truth lookup, unless shutdown
+// has stopped waiting for the lookups and closed the sinks.
+func (s *dnsServer) emitTruth(ev *queryEvent) {
+	s.truthMu.RLock()
+	defer s.truthMu.RUnlock()
+	if !s.truthsDone {
+		s.emit(ev)
+	}
+}
+
+// differs reports whether ev's answer differs from its true answer, in its
+// response code or its records, whatever their order, if it has one.
+func (ev *queryEvent) differs() bool {
+	if ev.TrueRCode == "" || ev.TrueRCode == "error" {
+		return false
+	}
+	if ev.RCode != ev.TrueRCode {
+		return true
+	}
+	a, b := slices.Clone(ev.Answer), slices.Clone(ev.TrueAnswer)
+	slices.Sort(a)
+	slices.Sort(b)
+	return !slices.Equal(a, b)
+}
@@ -0,0 +1,292 @@
+package main
+
+//go:generate buf generate
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"DeceptiveDNS/controlpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcScopes maps each Control method to the API scope it requires.
+var grpcScopes = map[string]string{
+	"ListRules":    "rules:read",
+	"GetRule":      "rules:read",
+	"CreateRule":   "rules:write",
+	"PutRule":      "rules:write",
+	"DeleteRule":   "rules:write",
+	"FlushCaches":  "cache",
+	"GetStats":     "stats",
+	"StreamEvents": "events",
+}
+
+// grpcServer implements the Control service from proto/control.proto. It
+// shares TLS, tokens and scopes with the HTTP API.
+type grpcServer struct {
+	controlpb.UnimplementedControlServer
+	dns    *dnsServer
+	broker *eventBroker
+	cfg    apiConfig
+}
+
+// startGRPCServer listens on addr and serves the Control service in the
+// background.
+func startGRPCServer(addr string, dns *dnsServer, broker *eventBroker, cfg apiConfig) (*grpc.Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	g := &grpcServer{dns: dns, broker: broker, cfg: cfg}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(g.authorizeUnary),
+		grpc.StreamInterceptor(g.authorizeStream),
+	}
+	if cfg.TLSCert != "" {
+		tc, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tc)))
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && !isLoopbackHost(host) && !cfg.authRequired() {
+		slog.Warn("gRPC API is not bound to localhost and has no authentication configured", "addr", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := grpc.NewServer(opts...)
+	controlpb.RegisterControlServer(srv, g)
+	slog.Info("gRPC API listening", "addr", ln.Addr().String(), "tls", cfg.TLSCert != "", "auth", cfg.authRequired())
+
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			slog.Error("gRPC listener stopped", "err", err)
+		}
+	}()
+	return srv, nil
+}
+
+// stopGRPC lets running calls finish until ctx expires, then closes the
+// rest.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
+
+// authorize checks the bearer token in the "authorization" metadata and the
+// client certificate against the scope fullMethod needs.
+func (g *grpcServer) authorize(ctx context.Context, fullMethod string) error {
+	if !g.cfg.authRequired() {
+		return nil
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			token, _ = strings.CutPrefix(v[0], "Bearer ")
+		}
+	}
+	var cs *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if ti, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			cs = &ti.State
+		}
+	}
+	granted := g.cfg.grant(token, cs)
+	if len(granted) == 0 {
+		return status.Error(codes.Unauthenticated, "authentication required")
+	}
+	scope := grpcScopes[fullMethod[strings.LastIndexByte(fullMethod, '/')+1:]]
+	if scope == "" || !hasScope(granted, scope) {
+		return status.Errorf(codes.PermissionDenied, "missing scope %s", scope)
+	}
+	return nil
+}
+
+func (g *grpcServer) authorizeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := g.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *grpcServer) authorizeStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (g *grpcServer) ruleProto(r *rule) *controlpb.Rule {
+	pr := &controlpb.Rule{
+		Domain:   r.Domain,
+		Ip:       r.IP,
+		Canary:   r.Canary,
+		Action:   r.Action,
+		Ips:      r.IPs,
+		Ede:      r.EDE,
+		EdeText:  r.EDEText,
+		Priority: int32(r.Priority),
+		Typos:    r.Typos,
+		Mac:      r.MAC,
+		Qtypes:   r.QTypes,
+		Feed:     r.Feed,
+	}
+	if n, ok := g.dns.ruleHits.Load(r.Domain); ok {
+		pr.Hits = n.(*atomic.Int64).Load()
+	}
+	return pr
+}
+
+func ruleFromProto(pr *controlpb.Rule) (*rule, error) {
+	if pr == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing rule")
+	}
+	return &rule{
+		Domain:   pr.Domain,
+		IP:       pr.Ip,
+		Canary:   pr.Canary,
+		Action:   pr.Action,
+		IPs:      pr.Ips,
+		EDE:      pr.Ede,
+		EDEText:  pr.EdeText,
+		Priority: int(pr.Priority),
+		Typos:    pr.Typos,
+		MAC:      pr.Mac,
+		QTypes:   pr.Qtypes,
+	}, nil
+}
+
+func (g *grpcServer) ListRules(ctx context.Context, req *controlpb.ListRulesRequest) (*controlpb.ListRulesResponse, error) {
+	resp := &controlpb.ListRulesResponse{}
+	for _, r := range g.dns.rules.list() {
+		resp.Rules = append(resp.Rules, g.ruleProto(&r))
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) GetRule(ctx context.Context, req *controlpb.GetRuleRequest) (*controlpb.Rule, error) {
+	r := g.dns.rules.get(req.Domain)
+	if r == nil {
+		return nil, status.Errorf(codes.NotFound, "no rule for %s", req.Domain)
+	}
+	return g.ruleProto(r), nil
+}
+
+func (g *grpcServer) CreateRule(ctx context.Context, req *controlpb.CreateRuleRequest) (*controlpb.Rule, error) {
+	r, err := ruleFromProto(req.Rule)
+	if err != nil {
+		return nil, err
+	}
+	if g.dns.rules.get(r.Domain) != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "rule for %s already exists", r.Domain)
+	}
+	if err := g.dns.rules.add(r); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	slog.Info("Rule added", "domain", r.Domain, "ip", r.IP, "via", "grpc")
+	return g.ruleProto(r), nil
+}
+
+func (g *grpcServer) PutRule(ctx context.Context, req *controlpb.PutRuleRequest) (*controlpb.PutRuleResponse, error) {
+	r, err := ruleFromProto(req.Rule)
+	if err != nil {
+		return nil, err
+	}
+	created := g.dns.rules.get(r.Domain) == nil
+	if err := g.dns.rules.add(r); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	slog.Info("Rule updated", "domain", r.Domain, "ip", r.IP, "via", "grpc")
+	return &controlpb.PutRuleResponse{Rule: g.ruleProto(r), Created: created}, nil
+}
+
+func (g *grpcServer) DeleteRule(ctx context.Context, req *controlpb.DeleteRuleRequest) (*controlpb.DeleteRuleResponse, error) {
+	if !g.dns.rules.remove(req.Domain) {
+		return nil, status.Errorf(codes.NotFound, "no rule for %s", req.Domain)
+	}
+	slog.Info("Rule deleted", "domain", req.Domain, "via", "grpc")
+	return &controlpb.DeleteRuleResponse{}, nil
+}
+
+func (g *grpcServer) FlushCaches(ctx context.Context, req *controlpb.FlushCachesRequest) (*controlpb.FlushCachesResponse, error) {
+	n := g.dns.flushCaches()
+	slog.Info("Caches flushed", "clients", n, "via", "grpc")
+	return &controlpb.FlushCachesResponse{Clients: int64(n)}, nil
+}
+
+func (g *grpcServer) GetStats(ctx context.Context, req *controlpb.GetStatsRequest) (*controlpb.Stats, error) {
+	st := g.dns.stats()
+	listeners := make(map[string]*controlpb.ListenerStats, len(st.Listeners))
+	for addr, counters := range st.Listeners {
+		listeners[addr] = &controlpb.ListenerStats{Counters: counters}
+	}
+	return &controlpb.Stats{
+		UptimeSeconds: st.UptimeSeconds,
+		Rules:         int64(st.Rules),
+		ClientsSeen:   int64(st.ClientsSeen),
+		RuleHits:      st.RuleHits,
+		Counters:      st.Counters,
+		Listeners:     listeners,
+	}, nil
+}
+
+func (g *grpcServer) StreamEvents(req *controlpb.StreamEventsRequest, stream controlpb.Control_StreamEventsServer) error {
+	f := eventFilter{client: req.Client, qname: strings.ToLower(req.Qname), action: req.Action}
+	ch := g.broker.subscribe()
+	defer g.broker.unsubscribe(ch)
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return status.Error(codes.Unavailable, "server shutting down")
+			}
+			if !f.match(ev) {
+				continue
+			}
+			if err := stream.Send(eventProto(ev)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func eventProto(ev *queryEvent) *controlpb.QueryEvent {
+	return &controlpb.QueryEvent{
+		Time:     timestamppb.New(ev.Time),
+		Client:   ev.Client,
+		Port:     int32(ev.Port),
+		Listener: ev.Listener,
+		Qname:    ev.QName,
+		Qtype:    ev.QType,
+		Action:   ev.Action,
+		Answer:   ev.Answer,
+		Rule:     ev.Rule,
+		Rcode:    ev.RCode,
+		Latency:  durationpb.New(ev.Latency),
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// healthReport is what /healthz and /readyz answer with: whether the
+// server is up, or ready for queries, and if not why not, with the state
+// of its listeners and upstreams.
+type healthReport struct {
+	Status        string           `json:"status"` // "ok" or "unavailable"
+	Problems      []string         `json:"problems,omitempty"`
+	UptimeSeconds int64            `json:"uptime_seconds"`
+	Rules         int              `json:"rules"`
+	Listeners     []listenerHealth `json:"listeners"`
+	Upstreams     []upstreamStatus `json:"upstreams,omitempty"`
+}
+
+// listenerHealth is a listener as the health endpoints show it.
+type listenerHealth struct {
+	Address  string     `json:"address"`
+	Protocol string     `json:"protocol"`                // "udp", "tcp", "dot", or the protocol of a multicast or DHCP listener
+	Error    string     `json:"error,omitempty"`         // of the last read or accept, if it failed
+	Since    *time.Time `json:"failing_since,omitempty"` // when reads or accepts started failing
+}
+
+// listenError is a listener's failing read or accept, kept in
+// dnsServer.listenErrors, by *listener or net.Listener, until one succeeds.
+type listenError struct {
+	time time.Time
+	err  error
+}
+
+// health reports on the server for /healthz, or with ready for /readyz.
+// The server is healthy while every listener can take queries; it is ready
+// once it has started, until it starts shutting down, while healthy, while
+// it is the active instance of its replication pair, if any, and while it
+// has an upstream to forward to, if any are configured.
+func (s *dnsServer) health(ready bool) healthReport {
+	rep := healthReport{
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		Rules:         s.rules.len(),
+		Listeners:     []listenerHealth{},
+		Upstreams:     s.upstream.status(),
+	}
+	byAddr := make(map[string]*listenerHealth)
+	add := func(key any, addr, proto string) {
+		lh, ok := byAddr[proto+" "+addr]
+		if !ok {
+			lh = &listenerHealth{Address: addr, Protocol: proto}
+			byAddr[proto+" "+addr] = lh
+		}
+		// Sockets sharing an address with SO_REUSEPORT count as one,
+		// failing if any of them is
+		if v, ok := s.listenErrors.Load(key); ok && lh.Since == nil {
+			le := v.(listenError)
+			lh.Error, lh.Since = le.err.Error(), &le.time
+		}
+	}
+	for _, l := range s.listeners {
+		proto := l.proto
+		if proto == "" {
+			proto = "udp"
+		}
+		add(l, l.addr, proto)
+	}
+	for _, ln := range s.tcpListeners {
+		proto := "tcp"
+		if _, ok := ln.(dotListener); ok {
+			proto = "dot"
+		}
+		add(ln, ln.Addr().String(), proto)
+	}
+	for _, lh := range byAddr {
+		rep.Listeners = append(rep.Listeners, *lh)
+		if lh.Since != nil {
+			rep.Problems = append(rep.Problems, fmt.Sprintf("%s listener %s failing: %s", lh.Protocol, lh.Address, lh.Error))
+		}
+	}
+	sort.Slice(rep.Listeners, func(i, j int) bool {
+		a, b := rep.Listeners[i], rep.Listeners[j]
+		return a.Address < b.Address || a.Address == b.Address && a.Protocol < b.Protocol
+	})
+	sort.Strings(rep.Problems)
+
+	if ready {
+		switch {
+		case s.stopping.Load():
+			rep.Problems = append(rep.Problems, "shutting down")
+		case !s.ready.Load():
+			rep.Problems = append(rep.Problems, "starting")
+		case s.repl.standby():
+			rep.Problems = append(rep.Problems, "standing by for the active instance of the pair")
+		}
+		if len(rep.Upstreams) > 0 && !s.upstream.anyHealthy() {
+			rep.Problems = append(rep.Problems, "every -forward resolver is down")
+		}
+	}
+	rep.Status = "ok"
+	if len(rep.Problems) > 0 {
+		rep.Status = "unavailable"
+	}
+	return rep
+}
+
+// listenFailed records that the listener key's read or accept failed with
+// err, leaving the time it started failing if it already was.
+func (s *dnsServer) listenFailed(key any, err error) {
+	s.listenErrors.LoadOrStore(key, listenError{time: time.Now(), err: err})
+}
+
+// writeHealth answers a health check with rep, 503 if it has problems.
+func writeHealth(w http.ResponseWriter, rep healthReport) {
+	status := http.StatusOK
+	if len(rep.Problems) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, rep)
+}
+
+// registerHealth adds /healthz and /readyz to mux. They need no
+// credentials, as probes from orchestrators and load balancers have none.
+func (s *dnsServer) registerHealth(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.health(false))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.health(true))
+	})
+}
+
+// healthServer serves the health endpoints on a listener of their own, for
+// when the API is off or needs credentials or client certificates probes
+// don't have.
+type healthServer struct {
+	srv *http.Server
+}
+
+func startHealthServer(addr string, s *dnsServer) (*healthServer, error) {
+	mux := http.NewServeMux()
+	s.registerHealth(mux)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Health checks listening", "url", "http://"+ln.Addr().String()+"/readyz")
+	h := &healthServer{srv: &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}}
+	go func() {
+		if err := h.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Health check listener stopped", "err", err)
+		}
+	}()
+	return h, nil
+}
+
+// shutdown stops the listener. It is safe on a nil server.
+func (h *healthServer) shutdown(ctx context.Context) error {
+	if h == nil {
+		return nil
+	}
+	return h.srv.Shutdown(ctx)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var honeytokenHits = expvar.NewInt("honeytoken_hits")
+
+const (
+	honeytokenLength       = 10 // characters of [a-z0-9], enough that tokens are never guessed
+	honeytokenAlphabet     = "abcdefghijklmnopqrstuvwxyz0123456789"
+	honeytokenPollInterval = 30 * time.Second
+)
+
+// honeytoken is a unique name planted somewhere, such as in a document, a
+// config file or a host's browser history, so that whoever resolves it
+// gives away where they found it.
+type honeytoken struct {
+	Token   string    `json:"token"`  // random label
+	Domain  string    `json:"domain"` // zone the token is a label of
+	Source  string    `json:"source"` // where it was planted
+	Created time.Time `json:"created"`
+}
+
+// Name is the full name to plant.
+func (t *honeytoken) Name() string {
+	return t.Token + "." + t.Domain
+}
+
+type honeytokenFile struct {
+	Tokens []*honeytoken `json:"tokens"`
+}
+
+// honeytokenSet holds the tokens of a file written by the honeytoken
+// command, reloading it when it changes so tokens generated while the
+// server runs take effect.
+type honeytokenSet struct {
+	path string
+
+	mu       sync.RWMutex
+	tokens   map[string]*honeytoken
+	modified time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// readHoneytokens returns the tokens in path, or none if it doesn't exist.
+func readHoneytokens(path string) ([]*honeytoken, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f honeytokenFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return f.Tokens, nil
+}
+
+func writeHoneytokens(path string, tokens []*honeytoken) error {
+	slices.SortFunc(tokens, func(a, b *honeytoken) int { return a.Created.Compare(b.Created) })
+	data, err := json.MarshalIndent(honeytokenFile{Tokens: tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// newHoneytoken returns a token under domain that isn't in tokens yet.
+func newHoneytoken(domain, source string, tokens []*honeytoken) *honeytoken {
+	for {
+		b := make([]byte, honeytokenLength)
+		rand.Read(b)
+		for i := range b {
+			b[i] = honeytokenAlphabet[int(b[i])%len(honeytokenAlphabet)]
+		}
+		// Start with a letter, as some software rejects labels that don't
+		b[0] = honeytokenAlphabet[int(b[0])%26]
+		token := string(b)
+		if !slices.ContainsFunc(tokens, func(t *honeytoken) bool { return t.Token == token }) {
+			return &honeytoken{Token: token, Domain: normalizeName(domain), Source: source, Created: time.Now().UTC()}
+		}
+	}
+}
+
+func loadHoneytokens(path string) (*honeytokenSet, error) {
+	s := &honeytokenSet{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	go s.watch()
+	return s, nil
+}
+
+func (s *honeytokenSet) reload() error {
+	var modified time.Time
+	if fi, err := os.Stat(s.path); err == nil {
+		modified = fi.ModTime()
+	}
+	list, err := readHoneytokens(s.path)
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]*honeytoken, len(list))
+	for _, t := range list {
+		tokens[strings.ToLower(t.Token)] = t
+	}
+	s.mu.Lock()
+	s.tokens, s.modified = tokens, modified
+	s.mu.Unlock()
+	return nil
+}
+
+// watch reloads the file whenever its modification time changes.
+func (s *honeytokenSet) watch() {
+	defer close(s.done)
+	ticker := time.NewTicker(honeytokenPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var modified time.Time
+			if fi, err := os.Stat(s.path); err == nil {
+				modified = fi.ModTime()
+			}
+			s.mu.RLock()
+			changed := !modified.Equal(s.modified)
+			s.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := s.reload(); err != nil {
+				slog.Error("Failed to reload honeytokens", "path", s.path, "err", err)
+				continue
+			}
+			slog.Info("Honeytokens reloaded", "path", s.path, "tokens", s.len())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *honeytokenSet) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// list returns the tokens, oldest first.
+func (s *honeytokenSet) list() []*honeytoken {
+	s.mu.RLock()
+	out := make([]*honeytoken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		out = append(out, t)
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(out, func(a, b *honeytoken) int {
+		if c := a.Created.Compare(b.Created); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Token, b.Token)
+	})
+	return out
+}
+
+// replace writes tokens, from a replication peer, to the file and loads
+// them.
+func (s *honeytokenSet) replace(tokens []*honeytoken) error {
+	if err := writeHoneytokens(s.path, tokens); err != nil {
+		return err
+	}
+	return s.reload()
+}
+
+func (s *honeytokenSet) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.tokens)
+}
+
+// lookup returns the token in name, which may have more labels in front
+// of it, or nil.
+func (s *honeytokenSet) lookup(name string) *honeytoken {
+	labels := strings.Split(normalizeName(name), ".")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, label := range labels {
+		if t, ok := s.tokens[label]; ok && strings.Join(labels[i+1:], ".") == t.Domain {
+			return t
+		}
+	}
+	return nil
+}
+
+// check returns an alert naming where the token was planted if ev's name
+// contains one.
+func (s *honeytokenSet) check(ev *queryEvent) *alert {
+	t := s.lookup(ev.QName)
+	if t == nil {
+		return nil
+	}
+	honeytokenHits.Add(1)
+	return &alert{
+		Time:    ev.Time,
+		Kind:    "honeytoken",
+		Client:  ev.Client,
+		QName:   ev.QName,
+		QType:   ev.QType,
+		Rule:    ev.Rule,
+		Source:  t.Source,
+		Message: fmt.Sprintf("honeytoken %s resolved by %s; it was planted in %s on %s", t.Name(), ev.Client, t.Source, t.Created.Format("2006-01-02")),
+	}
+}
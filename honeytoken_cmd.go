@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// honeytokenCommand implements "honeytoken", which generates, lists and
+// revokes the planted names a server started with -honeytokens alerts on,
+// e.g.
+//
+//	DeceptiveDNS honeytoken -domain files.corp.local -source 'payroll.xlsx on \\fs01\hr'
+//	DeceptiveDNS honeytoken -list
+func honeytokenCommand(args []string) int {
+	fs := flag.NewFlagSet("honeytoken", flag.ContinueOnError)
+	path := fs.String("file", "honeytokens.json", "Honeytoken file, shared with the server's -honeytokens")
+	domain := fs.String("domain", "", "Zone to generate tokens under; the server must be authoritative for it, or forwarded its queries")
+	source := fs.String("source", "", "Where the tokens will be planted, e.g. a document and host, named in the alert when one is resolved")
+	count := fs.Int("count", 1, "Number of tokens to generate")
+	list := fs.Bool("list", false, "List the tokens instead of generating one")
+	revoke := fs.String("revoke", "", "Remove this token (or full name) from the file")
+	format := fs.String("format", "table", "Output format for -list: table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	tokens, err := readHoneytokens(*path)
+	if err != nil {
+		fmt.Println("Cannot read honeytokens:", err)
+		return 1
+	}
+
+	switch {
+	case *list:
+		switch *format {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if tokens == nil {
+				tokens = []*honeytoken{}
+			}
+			enc.Encode(tokens)
+		case "table":
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tCREATED\tSOURCE")
+			for _, t := range tokens {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", t.Name(), t.Created.Local().Format("2006-01-02 15:04"), t.Source)
+			}
+			tw.Flush()
+		default:
+			fmt.Println("Unknown output format:", *format)
+			return 2
+		}
+		return 0
+
+	case *revoke != "":
+		token, _, _ := strings.Cut(strings.ToLower(*revoke), ".")
+		i := slices.IndexFunc(tokens, func(t *honeytoken) bool { return t.Token == token })
+		if i < 0 {
+			fmt.Println("No such token:", *revoke)
+			return 1
+		}
+		name := tokens[i].Name()
+		if err := writeHoneytokens(*path, slices.Delete(tokens, i, i+1)); err != nil {
+			fmt.Println("Cannot write honeytokens:", err)
+			return 1
+		}
+		fmt.Println("Revoked", name)
+		return 0
+	}
+
+	if *domain == "" || *source == "" {
+		fmt.Fprintln(os.Stderr, "usage: DeceptiveDNS honeytoken [-file path] -domain zone -source 'where it is planted' [-count n]")
+		fmt.Fprintln(os.Stderr, "       DeceptiveDNS honeytoken [-file path] -list | -revoke token")
+		return 2
+	}
+	if err := (&rule{Domain: *domain}).validate(); err != nil || strings.HasPrefix(*domain, "*.") {
+		fmt.Println("Invalid domain:", *domain)
+		return 2
+	}
+	if *count < 1 {
+		fmt.Println("Invalid count:", *count)
+		return 2
+	}
+	var added []*honeytoken
+	for i := 0; i < *count; i++ {
+		t := newHoneytoken(*domain, *source, tokens)
+		tokens = append(tokens, t)
+		added = append(added, t)
+	}
+	if err := writeHoneytokens(*path, tokens); err != nil {
+		fmt.Println("Cannot write honeytokens:", err)
+		return 1
+	}
+	for _, t := range added {
+		fmt.Println(t.Name())
+	}
+	return 0
+}
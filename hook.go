@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	hookCalls    = expvar.NewInt("hook_calls")
+	hookErrors   = expvar.NewInt("hook_errors")
+	hookRestarts = expvar.NewInt("hook_restarts")
+)
+
+const (
+	hookRestartDelay = 5 * time.Second // between starts of a hook that keeps exiting
+	hookStopTimeout  = 5 * time.Second // for a hook to exit once its stdin is closed
+)
+
+// queryDecider is asked about each unicast query before the rules answer
+// it, by -script and -hook. decide returns nil to leave the query to the
+// rules (or the next decider); matched is the rule that would answer it.
+type queryDecider interface {
+	decide(ev *queryEvent, matched *rule) *queryVerdict
+	close()
+}
+
+// queryVerdict is what a decider chose for a query.
+type queryVerdict struct {
+	rule  *rule  // what to answer with, or nil to pass the query through
+	rcode uint16 // NXDOMAIN or REFUSED instead of an answer
+	drop  bool   // send nothing
+	ttl   uint32 // overrides the answer's TTL if set
+}
+
+// hookRequest is the JSON line a hook process is sent for each query. The
+// fields are part of the hook protocol, so only ever add to them.
+type hookRequest struct {
+	ID          uint64    `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Client      string    `json:"client"`
+	Port        int       `json:"port"`
+	Listener    string    `json:"listener"`
+	Time        time.Time `json:"time"`
+	Rule        string    `json:"rule,omitempty"` // domain of the rule that would answer
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Software    string    `json:"software,omitempty"`
+}
+
+// hookAnswer is a decision about a query: the JSON line a hook process
+// replies with, carrying the request's ID, and the table a -script returns.
+type hookAnswer struct {
+	ID     uint64 `json:"id"`
+	Action string `json:"action"`           // answer, nxdomain, refused, drop, pass or default (the default)
+	IP     string `json:"ip,omitempty"`     // address or answer template, for answer
+	TTL    uint32 `json:"ttl,omitempty"`    // seconds
+	Canary *bool  `json:"canary,omitempty"` // raise a canary alert
+	Rule   string `json:"rule,omitempty"`   // recorded in events
+
+	EDE     string `json:"ede,omitempty"`      // Extended DNS Error to attach, by name or code
+	EDEText string `json:"ede_text,omitempty"` // its extra text
+}
+
+// verdict checks a and turns it into a verdict for a query that matched
+// would answer otherwise. Fields a leaves out keep matched's values, or
+// for names without a rule, the server's address and the rule name
+// "script".
+func (a *hookAnswer) verdict(matched *rule) (*queryVerdict, error) {
+	r := &rule{Domain: "script"}
+	if matched != nil {
+		c := *matched
+		r = &c
+	}
+	v := &queryVerdict{rule: r}
+	switch a.Action {
+	case "", "default":
+		return nil, nil
+	case "answer":
+	case "nxdomain":
+		v.rcode = dnsRcodeNXDomain
+	case "refused":
+		v.rcode = dnsRcodeRefused
+	case "drop":
+		v.drop = true
+	case "pass":
+		v.rule = nil
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unknown action %q (want answer, nxdomain, refused, drop, pass or default)", a.Action)
+	}
+	if a.Rule != "" {
+		r.Domain = a.Rule
+	}
+	if a.IP != "" {
+		r.IP, r.addr = a.IP, net.ParseIP(a.IP)
+		if r.addr == nil && !answerTemplates[r.IP] {
+			return nil, fmt.Errorf("invalid IP address or answer template %q", r.IP)
+		}
+	}
+	if a.Canary != nil {
+		r.Canary = *a.Canary
+	}
+	if a.EDE != "" {
+		if err := checkEDE(a.EDE, a.EDEText); err != nil {
+			return nil, err
+		}
+		r.EDE, r.EDEText = a.EDE, a.EDEText
+	}
+	if a.TTL > 1<<31-1 {
+		return nil, fmt.Errorf("invalid ttl %d", a.TTL)
+	}
+	v.ttl = a.TTL
+	return v, nil
+}
+
+// hookProcess is an external program consulted about every query, such as
+// one that checks a CMDB or ticketing system. It reads one hookRequest per
+// line on stdin and writes one hookAnswer per line on stdout, in any
+// order; stderr is logged. A hook that exits is restarted on a later
+// query.
+type hookProcess struct {
+	argv    []string
+	timeout time.Duration // per query
+
+	// mu guards the fields below; wmu serialises writes to stdin, which
+	// may block while the process catches up
+	mu      sync.Mutex
+	wmu     sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	enc     *json.Encoder
+	done    chan struct{} // closed when the running process has exited
+	started time.Time
+	nextID  uint64
+	pending map[uint64]chan *hookAnswer
+	closed  bool
+}
+
+// startHook runs command, split on spaces.
+func startHook(command string, timeout time.Duration) (*hookProcess, error) {
+	argv := strings.Fields(command)
+	if len(argv) == 0 {
+		return nil, errors.New("empty hook command")
+	}
+	h := &hookProcess{argv: argv, timeout: timeout, pending: make(map[uint64]chan *hookAnswer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.start(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// start runs the program. The caller holds h.mu.
+func (h *hookProcess) start() error {
+	h.started = time.Now()
+	cmd := exec.Command(h.argv[0], h.argv[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	h.cmd, h.stdin, h.enc, h.done = cmd, stdin, json.NewEncoder(stdin), make(chan struct{})
+	go h.logStderr(stderr)
+	go h.readAnswers(cmd, stdout, h.done)
+	slog.Info("Hook started", "command", strings.Join(h.argv, " "), "pid", cmd.Process.Pid)
+	return nil
+}
+
+func (h *hookProcess) logStderr(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		slog.Warn("Hook stderr", "command", h.argv[0], "line", sc.Text())
+	}
+}
+
+// readAnswers hands each answer to the query waiting for it until the
+// process exits, then fails the queries still waiting.
+func (h *hookProcess) readAnswers(cmd *exec.Cmd, stdout io.Reader, done chan struct{}) {
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var a hookAnswer
+		if err := json.Unmarshal(sc.Bytes(), &a); err != nil {
+			hookErrors.Add(1)
+			slog.Warn("Invalid hook answer", "command", h.argv[0], "err", err)
+			continue
+		}
+		h.mu.Lock()
+		ch, ok := h.pending[a.ID]
+		delete(h.pending, a.ID)
+		h.mu.Unlock()
+		if ok {
+			ch <- &a
+		}
+	}
+	err := cmd.Wait()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		slog.Error("Hook exited", "command", h.argv[0], "err", err)
+	}
+	for id, ch := range h.pending {
+		close(ch)
+		delete(h.pending, id)
+	}
+	h.stdin, h.enc = nil, nil
+	close(done)
+}
+
+// send writes req to the process, restarting it if it has exited, and
+// returns the channel its answer will arrive on.
+func (h *hookProcess) send(req *hookRequest) (chan *hookAnswer, error) {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, errors.New("hook closed")
+	}
+	if h.enc == nil {
+		if time.Since(h.started) < hookRestartDelay {
+			h.mu.Unlock()
+			return nil, errors.New("hook not running")
+		}
+		hookRestarts.Add(1)
+		if err := h.start(); err != nil {
+			h.mu.Unlock()
+			return nil, err
+		}
+	}
+	h.nextID++
+	req.ID = h.nextID
+	ch := make(chan *hookAnswer, 1)
+	h.pending[req.ID] = ch
+	enc := h.enc
+	h.mu.Unlock()
+
+	h.wmu.Lock()
+	err := enc.Encode(req)
+	h.wmu.Unlock()
+	if err != nil {
+		h.forget(req.ID)
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (h *hookProcess) forget(id uint64) {
+	h.mu.Lock()
+	delete(h.pending, id)
+	h.mu.Unlock()
+}
+
+func (h *hookProcess) decide(ev *queryEvent, matched *rule) *queryVerdict {
+	hookCalls.Add(1)
+	v, err := h.ask(ev, matched)
+	if err != nil {
+		hookErrors.Add(1)
+		slog.Warn("Hook failed", "command", h.argv[0], "client", ev.Client, "qname", ev.QName, "err", err)
+		return nil
+	}
+	return v
+}
+
+func (h *hookProcess) ask(ev *queryEvent, matched *rule) (*queryVerdict, error) {
+	req := &hookRequest{
+		Name:        normalizeName(ev.QName),
+		Type:        ev.QType,
+		Client:      ev.Client,
+		Port:        ev.Port,
+		Listener:    ev.Listener,
+		Time:        ev.Time,
+		Fingerprint: ev.Fingerprint,
+		Software:    ev.Software,
+	}
+	if matched != nil {
+		req.Rule = matched.Domain
+	}
+	ch, err := h.send(req)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case a, ok := <-ch:
+		if !ok {
+			return nil, errors.New("hook exited before answering")
+		}
+		return a.verdict(matched)
+	case <-timer.C:
+		h.forget(req.ID)
+		return nil, fmt.Errorf("no answer within %s", h.timeout)
+	}
+}
+
+// close ends the process by closing its stdin, killing it if it doesn't
+// exit in time.
+func (h *hookProcess) close() {
+	h.mu.Lock()
+	h.closed = true
+	cmd, stdin, done := h.cmd, h.stdin, h.done
+	h.mu.Unlock()
+	if stdin == nil {
+		return
+	}
+	stdin.Close()
+	select {
+	case <-done:
+	case <-time.After(hookStopTimeout):
+		slog.Warn("Hook did not exit; killing it", "command", h.argv[0])
+		cmd.Process.Kill()
+		<-done
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net"
+	"time"
+)
+
+var addrChanges = expvar.NewInt("answer_address_changes")
+
+// answerAddrs are the addresses rules without their own IP answer with.
+type answerAddrs struct {
+	ip  net.IP // for A queries, or AAAA if it's IPv6
+	ip6 net.IP // for AAAA queries, if set
+}
+
+// addrTracker keeps the default answers pointing at this host when they
+// were taken from its addresses rather than given, as DHCP renews them or
+// the host moves between networks. It polls the host's addresses (of
+// -iface, if set) every interval, and when an address answered with is no
+// longer among them, switches to one that is. While the host has none, as
+// between Wi-Fi networks, the last one stays.
+type addrTracker struct {
+	dns      *dnsServer
+	iface    string
+	v4, v6   bool // which of the default answers to track
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startAddrTracker tracks the IPv4 default answer if v4 and the IPv6 one
+// if v6, until close.
+func (s *dnsServer) startAddrTracker(iface string, v4, v6 bool, interval time.Duration) *addrTracker {
+	t := &addrTracker{dns: s, iface: iface, v4: v4, v6: v6, interval: interval, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				t.check()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// close stops tracking. It is safe on a nil tracker.
+func (t *addrTracker) close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+// check switches the tracked default answers that are no longer the
+// host's to ones that are.
+func (t *addrTracker) check() {
+	cur := t.dns.addrs.Load()
+	next := *cur
+	if t.v4 {
+		next.ip = pickHostAddr(hostAddrs(t.iface, false), cur.ip)
+	}
+	if t.v6 {
+		next.ip6 = pickHostAddr(hostAddrs(t.iface, true), cur.ip6)
+	}
+	if next.ip.Equal(cur.ip) && next.ip6.Equal(cur.ip6) {
+		return
+	}
+	t.dns.addrs.Store(&next)
+	addrChanges.Add(1)
+	slog.Info("Host address changed, answering with the new one", "ip", next.ip, "ip6", next.ip6, "was_ip", cur.ip, "was_ip6", cur.ip6)
+}
+
+// pickHostAddr returns cur if it's among addrs, or else the first of
+// them, or cur if there are none.
+func pickHostAddr(addrs []net.IP, cur net.IP) net.IP {
+	for _, a := range addrs {
+		if a.Equal(cur) {
+			return cur
+		}
+	}
+	if len(addrs) == 0 {
+		return cur
+	}
+	return addrs[0]
+}
+
+// hostAddrs returns the host's addresses, or iface's if given, that can
+// be answered with: IPv4 ones other than loopback, or with v6 global IPv6
+// ones. Errors, as for an interface that has gone away, return none.
+func hostAddrs(iface string, v6 bool) []net.IP {
+	var addrs []net.Addr
+	var err error
+	if iface != "" {
+		var ifi *net.Interface
+		if ifi, err = net.InterfaceByName(iface); err == nil {
+			addrs, err = ifi.Addrs()
+		}
+	} else {
+		addrs, err = net.InterfaceAddrs()
+	}
+	if err != nil {
+		return nil
+	}
+	var out []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if v6 && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() || !v6 && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+			out = append(out, ipnet.IP)
+		}
+	}
+	return out
+}
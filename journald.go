@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// underJournal reports whether stderr is connected to the journal, which
+// systemd signals by setting JOURNAL_STREAM for the service.
+func underJournal() bool {
+	if os.Getenv("JOURNAL_STREAM") == "" {
+		return false
+	}
+	_, err := os.Stat(journalSocket)
+	return err == nil
+}
+
+// journalHandler writes records to journald using its native protocol, so
+// every attribute becomes a field that journalctl can filter on, e.g.
+// journalctl QNAME=example.com.
+type journalHandler struct {
+	level  slog.Leveler
+	conn   *journalConn
+	attrs  []slog.Attr
+	groups []string
+}
+
+type journalConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newJournalHandler(level slog.Leveler) (*journalHandler, error) {
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{level: level, conn: &journalConn{conn: conn}}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	appendJournalField(&buf, "MESSAGE", r.Message)
+	appendJournalField(&buf, "PRIORITY", fmt.Sprint(syslogSeverity(r.Level)))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", "DeceptiveDNS")
+	for _, a := range h.attrs {
+		appendJournalAttr(&buf, nil, a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		appendJournalAttr(&buf, h.groups, a)
+		return true
+	})
+
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	_, err := h.conn.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		if len(h.groups) > 0 {
+			a = slog.Attr{Key: strings.Join(h.groups, "_") + "_" + a.Key, Value: a.Value}
+		}
+		n.attrs = append(n.attrs, a)
+	}
+	return &n
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	n := *h
+	n.groups = append(append([]string(nil), h.groups...), name)
+	return &n
+}
+
+func (h *journalHandler) Close() error {
+	return h.conn.conn.Close()
+}
+
+func appendJournalAttr(buf *bytes.Buffer, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		g := append(append([]string(nil), groups...), a.Key)
+		for _, ga := range a.Value.Group() {
+			appendJournalAttr(buf, g, ga)
+		}
+		return
+	}
+	key := a.Key
+	if len(groups) > 0 {
+		key = strings.Join(groups, "_") + "_" + key
+	}
+	appendJournalField(buf, journalFieldName(key), a.Value.String())
+}
+
+// journalFieldName converts an attribute key into a valid journal field
+// name: uppercase ASCII letters, digits and underscores, not starting with
+// an underscore (those are reserved for trusted fields).
+func journalFieldName(key string) string {
+	b := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			b = append(b, c-'a'+'A')
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b = append(b, c)
+		default:
+			b = append(b, '_')
+		}
+	}
+	name := strings.TrimLeft(string(b), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "F_" + name
+	}
+	return name
+}
+
+// appendJournalField encodes one field. Values containing newlines use the
+// binary form: name, newline, little-endian 64-bit length, value, newline.
+func appendJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// listenerStats holds per-listener counters, keyed by local address, each a
+// map of received, malformed and per-action counts.
+var listenerStats = expvar.NewMap("listeners")
+
+// listener is one socket queries arrive on. Every listener feeds the same
+// handler and rules.
+type listener struct {
+	conn  *net.UDPConn
+	addr  string     // local address, as reported in events
+	local netip.Addr // local IP, unset for multicast listeners
+	stats *expvar.Map
+	proto string   // name service answered other than unicast DNS, e.g. "mdns"
+	tcp   net.Conn // the connection, for a TCP client's listener
+	tls   bool     // tcp is DNS over TLS, whose responses are padded
+	pad   bool     // the message being answered asked for padding
+}
+
+// splitListenAddrs parses the comma-separated -listen value, defaulting each
+// port to 53.
+func splitListenAddrs(s string) []string {
+	var addrs []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, withDefaultPort(a, "53"))
+		}
+	}
+	return addrs
+}
+
+// defaultSockets is one socket per CPU where SO_REUSEPORT can spread the load,
+// and a single socket elsewhere.
+func defaultSockets() int {
+	if reusePortSupported {
+		return runtime.GOMAXPROCS(0)
+	}
+	return 1
+}
+
+// isAnswerableIP reports whether host is a specific, non-loopback address
+// that clients could be sent to.
+func isAnswerableIP(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsUnspecified() && !ip.IsLoopback()
+}
+
+// answerableListenHost returns the first listen address that could serve as
+// the default answer, or "" if there is none.
+func answerableListenHost(addrs []string) string {
+	for _, a := range addrs {
+		if host, _, err := net.SplitHostPort(a); err == nil && isAnswerableIP(host) {
+			return host
+		}
+	}
+	return ""
+}
+
+// listen opens UDP sockets for queries on addr and adds them to s.listeners.
+// An address without a host gets separate IPv4 and IPv6 sockets, so
+// dual-stack works whatever the system's bindv6only setting; IPv6 is skipped
+// with a warning if the host has none. 0.0.0.0 and [::] listen on one family
+// only.
+func (s *dnsServer) listen(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		if err := s.listenUDP("udp4", net.JoinHostPort("0.0.0.0", port)); err != nil {
+			return err
+		}
+		if err := s.listenUDP("udp6", net.JoinHostPort("::", port)); err != nil {
+			slog.Warn("Not listening on IPv6", "port", port, "err", err)
+		}
+		return nil
+	}
+	network := "udp"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		network = "udp4"
+	} else if ip != nil {
+		network = "udp6"
+	}
+	return s.listenUDP(network, addr)
+}
+
+// listenUDP opens s.sockets sockets on addr, or one if SO_REUSEPORT isn't in
+// use. Sockets sharing an address share its stats.
+func (s *dnsServer) listenUDP(network, addr string) error {
+	lc := net.ListenConfig{Control: s.socketOptions}
+	var stats *expvar.Map
+	for i := 0; i < max(s.sockets, 1); i++ {
+		pc, err := lc.ListenPacket(context.Background(), network, addr)
+		if err != nil {
+			return err
+		}
+		conn := pc.(*net.UDPConn)
+		local := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+		l := &listener{conn: conn, addr: conn.LocalAddr().String(), local: local}
+		if stats == nil {
+			stats = new(expvar.Map)
+			listenerStats.Set(l.addr, stats)
+		}
+		l.stats = stats
+		s.listeners = append(s.listeners, l)
+		// Bind further sockets to the port the first one got, in case it
+		// was 0
+		addr = l.addr
+	}
+	return nil
+}
+
+// listenMulticast joins group on s.iface, or the system's default multicast
+// interface, and adds a listener for it whose queries go to the handler for
+// proto.
+func (s *dnsServer) listenMulticast(group netip.AddrPort, proto string) (*listener, error) {
+	var ifi *net.Interface
+	if s.iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(s.iface); err != nil {
+			return nil, err
+		}
+	}
+	network := "udp4"
+	if group.Addr().Is6() {
+		network = "udp6"
+	}
+	conn, err := net.ListenMulticastUDP(network, ifi, net.UDPAddrFromAddrPort(group))
+	if err != nil {
+		return nil, err
+	}
+	// Go turns multicast loopback off, which would hide multicast responses
+	// from clients on this host
+	if group.Addr().Is4() {
+		pc := ipv4.NewPacketConn(conn)
+		err = pc.SetMulticastLoopback(true)
+		if err == nil && ifi != nil {
+			err = pc.SetMulticastInterface(ifi)
+		}
+	} else {
+		pc := ipv6.NewPacketConn(conn)
+		err = pc.SetMulticastLoopback(true)
+		if err == nil && ifi != nil {
+			err = pc.SetMulticastInterface(ifi)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l := &listener{conn: conn, addr: group.String(), stats: new(expvar.Map), proto: proto}
+	listenerStats.Set(l.addr, l.stats)
+	s.listeners = append(s.listeners, l)
+	return l, nil
+}
+
+// socketOptions is the ListenConfig control hook that applies -iface and
+// SO_REUSEPORT to each socket before it is bound.
+func (s *dnsServer) socketOptions(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if s.sockets > 1 {
+			if err = setReusePort(fd); err != nil {
+				return
+			}
+		}
+		if s.iface != "" {
+			if err = bindToInterface(fd, network, s.iface); err != nil {
+				err = fmt.Errorf("binding to interface %s: %w", s.iface, err)
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// maxQuerySize is the largest query read; it covers the EDNS payload sizes
+// clients advertise in practice.
+const maxQuerySize = 4096
+
+// queryBufs recycles receive buffers, which go back to the pool once their
+// query has been handled.
+var queryBufs = sync.Pool{New: func() any { return new([maxQuerySize]byte) }}
+
+// packet is one received query waiting for a worker.
+type packet struct {
+	l    *listener
+	addr netip.AddrPort
+	buf  *[maxQuerySize]byte
+	n    int
+}
+
+// startWorkers starts n goroutines that handle queries from a queue of
+// queueLen packets. Readers drop packets when the queue is full rather than
+// letting the backlog, and the memory it holds, grow without bound.
+func (s *dnsServer) startWorkers(n, queueLen int) {
+	s.queue = make(chan packet, queueLen)
+	s.inflight.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer s.inflight.Done()
+			for p := range s.queue {
+				switch p.l.proto {
+				case "mdns":
+					s.handleMDNS(p.l, p.addr, p.buf[:p.n])
+				case "llmnr":
+					s.handleLLMNR(p.l, p.addr, p.buf[:p.n])
+				case "nbns":
+					s.handleNBNS(p.l, p.addr, p.buf[:p.n])
+				case "dhcp":
+					s.handleDHCP(p.l, p.addr, p.buf[:p.n])
+				default:
+					s.handleRequest(p.l, p.addr, p.buf[:p.n])
+				}
+				queryBufs.Put(p.buf)
+			}
+		}()
+	}
+}
+
+// serve reads queries from l into the worker queue until shutdown. The
+// caller adds to s.readers first.
+func (s *dnsServer) serve(l *listener) {
+	defer s.readers.Done()
+	slog.Info("DNS server listening", "addr", l.addr, "iface", s.iface, "rules", s.rules.len(), "ip", s.addrs.Load().ip)
+
+	failing := false
+	for {
+		buf := queryBufs.Get().(*[maxQuerySize]byte)
+		n, addr, err := l.conn.ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			queryBufs.Put(buf)
+			if s.stopping.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Error reading from UDP connection", "listener", l.addr, "err", err)
+			s.listenFailed(l, err)
+			failing = true
+			continue
+		}
+		if failing {
+			s.listenErrors.Delete(l)
+			failing = false
+		}
+		if s.repl.standby() {
+			queriesStandby.Add(1)
+			l.stats.Add("standby", 1)
+			queryBufs.Put(buf)
+			continue
+		}
+
+		select {
+		case s.queue <- packet{l, addr, buf, n}:
+		default:
+			queriesDropped.Add(1)
+			l.stats.Add("dropped", 1)
+			queryBufs.Put(buf)
+		}
+	}
+}
+
+// shutdown stops reading queries and waits until the ones already read have
+// been answered, or ctx expires, before closing the listeners. The sockets
+// stay open while draining so the last answers can still be sent.
+func (s *dnsServer) shutdown(ctx context.Context) error {
+	s.stopping.Store(true)
+	for _, l := range s.listeners {
+		l.conn.SetReadDeadline(time.Now()) // wakes the blocked read
+	}
+	for _, ln := range s.tcpListeners {
+		ln.Close()
+	}
+	s.tcpOpen.Range(func(conn, _ any) bool {
+		conn.(net.Conn).SetReadDeadline(time.Now()) // connections finish the message they're on
+		return true
+	})
+	s.readers.Wait()
+	close(s.queue)
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		s.tcpConns.Wait()
+		s.truths.Wait()
+		close(done)
+	}()
+	defer func() {
+		for _, l := range s.listeners {
+			l.conn.Close()
+		}
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// The sinks are closed next, so lookups finishing late mustn't
+		// emit their events
+		s.truthMu.Lock()
+		s.truthsDone = true
+		s.truthMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// interfaceIPv4 returns the first IPv4 address of the named interface.
+func interfaceIPv4(name string) (string, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("interface %s has no IPv4 address", name)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
+// LLMNR groups and port (RFC 4795). Windows falls back to LLMNR when DNS
+// can't resolve a name, typically a single-label one such as "fileserver".
+var (
+	llmnrGroup4 = netip.MustParseAddrPort("224.0.0.252:5355")
+	llmnrGroup6 = netip.MustParseAddrPort("[ff02::1:3]:5355")
+)
+
+const (
+	llmnrFlagsResponse = 0x8000
+	llmnrTTL           = 30 // RFC 4795 section 2.8
+)
+
+// listenLLMNR joins the IPv4 LLMNR group, and the IPv6 one if the host has
+// IPv6, adding a listener for each.
+func (s *dnsServer) listenLLMNR() error {
+	if _, err := s.listenMulticast(llmnrGroup4, "llmnr"); err != nil {
+		return err
+	}
+	if _, err := s.listenMulticast(llmnrGroup6, "llmnr"); err != nil {
+		slog.Warn("Not answering LLMNR over IPv6", "err", err)
+	}
+	return nil
+}
+
+// handleLLMNR answers an LLMNR query for a name matching a rule, or any name
+// with s.llmnrAll. Responses always go straight back to the sender; names we
+// don't answer get no response, leaving them to other hosts.
+func (s *dnsServer) handleLLMNR(l *listener, addr netip.AddrPort, req []byte) {
+	start := time.Now()
+	handlersInFlight.Add(1)
+	defer handlersInFlight.Add(-1)
+	defer func() {
+		if r := recover(); r != nil {
+			queryErrors.Add(1)
+			slog.Error("Recovered in handleLLMNR", "client", addr.String(), "panic", r)
+		}
+	}()
+
+	var msg dnsMsg
+	if err := msg.unpack(req); err != nil {
+		queriesReceived.Add(1)
+		l.stats.Add("received", 1)
+		queriesMalformed.Add(1)
+		l.stats.Add("malformed", 1)
+		slog.Debug("Error unpacking LLMNR message", "client", addr.String(), "err", err)
+		return
+	}
+	// Responses, opcodes other than QUERY, and queries with records in the
+	// answer or authority sections are all to be ignored silently
+	if msg.Flags&0xF800 != 0 || binary.BigEndian.Uint32(req[6:10]) != 0 {
+		return
+	}
+	queriesReceived.Add(1)
+	l.stats.Add("received", 1)
+
+	q := msg.Question
+	ev := &queryEvent{
+		Time:     start,
+		Client:   addr.Addr().Unmap().String(),
+		Port:     int(addr.Port()),
+		Listener: l.addr,
+		QName:    q.Name,
+		QType:    typeString(q.Type),
+		Opcode:   "QUERY",
+		Action:   "ignored",
+	}
+	if s.keepWire {
+		ev.Query = bytes.Clone(req)
+	}
+	var canary bool
+	defer func() {
+		ev.Latency = time.Since(start)
+		l.stats.Add(ev.Action, 1)
+		s.emit(ev)
+		if canary {
+			s.alerts.raise(canaryAlert(ev))
+		}
+	}()
+
+	r := s.matchClient(q.Name, addr.Addr(), ev)
+	if r == nil && s.llmnrAll {
+		r = &rule{} // server defaults
+	}
+	if r == nil || (q.Class != dnsClassIN && q.Class != dnsClassANY) {
+		queriesIgnored.Add(1)
+		return
+	}
+	ev.Rule = r.Domain
+	if s.monitor {
+		queriesMonitored.Add(1)
+		ev.Action = "monitored"
+		return
+	}
+
+	resp := dnsMsg{ID: msg.ID, Flags: llmnrFlagsResponse, Question: q}
+	for _, t := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		if q.Type != t && q.Type != dnsTypeANY {
+			continue
+		}
+		if ip := s.answerFor(r, t, l.local, addr.Addr().Unmap()); ip != nil {
+			resp.Answers = append(resp.Answers, dnsResourceRecord{Name: q.Name, Type: t, Class: dnsClassIN, TTL: llmnrTTL, Data: ip})
+			ev.Answer = append(ev.Answer, ip.String())
+		}
+	}
+	if len(resp.Answers) == 0 {
+		queriesIgnored.Add(1)
+		return
+	}
+
+	respBytes, err := resp.pack()
+	if err == nil {
+		_, err = l.conn.WriteToUDPAddrPort(respBytes, addr)
+	}
+	if err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending LLMNR response", "client", addr.String(), "qname", q.Name, "err", err)
+		ev.Answer = nil
+		return
+	}
+	queriesAnswered.Add(1)
+	ev.Action = "answered"
+	ev.RCode = rcodeString(resp.Flags)
+	if s.keepWire {
+		ev.Response = respBytes
+	}
+	canary = r.Canary
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an io.Writer that appends to a log file and rotates it once
+// it grows beyond maxSize bytes or has been open longer than maxAge. Rotated
+// files get a timestamp suffix, are optionally gzipped, and only the newest
+// keep of them are retained. Compression and pruning happen in the
+// background, one rotated file at a time.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	keep     int
+	compress bool
+	header   []byte // written at the start of every new file, e.g. a pcap header
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	rotated chan string // rotated files waiting for tidy
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int, compress bool) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep, compress: compress}
+	if err := f.start(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// start opens the file and starts tidying up after rotations.
+func (f *rotatingFile) start() error {
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.rotated = make(chan string, 16)
+	go f.tidy()
+	return nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	size := info.Size()
+	if size == 0 && len(f.header) > 0 {
+		if _, err := file.Write(f.header); err != nil {
+			file.Close()
+			return err
+		}
+		size = int64(len(f.header))
+	}
+	f.file, f.size, f.openedAt = file, size, time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > int64(len(f.header)) && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.maxAge > 0 && time.Since(f.openedAt) > f.maxAge)) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines
+			fmt.Fprintln(os.Stderr, "Log rotation failed:", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate must be called with mu held.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotated := rotatedName(f.path, time.Now())
+	if err := os.Rename(f.path, rotated); err != nil {
+		f.open()
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	// Don't hold up logging if tidy is behind; pruning catches up with
+	// the file on a later rotation, but it stays uncompressed
+	select {
+	case f.rotated <- rotated:
+	default:
+		fmt.Fprintln(os.Stderr, "Log tidying is behind, leaving", rotated, "uncompressed")
+	}
+	return nil
+}
+
+// rotatedName returns a name for path rotated at t that no file has, with
+// the time to the millisecond and a sequence number if that's taken too, so
+// rotations in quick succession don't overwrite each other.
+func rotatedName(path string, t time.Time) string {
+	base := path + "." + t.Format("20060102-150405.000")
+	name := base
+	for n := 1; ; n++ {
+		_, err := os.Lstat(name)
+		_, gzErr := os.Lstat(name + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzErr) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// tidy compresses the rotated files, if asked to, and prunes the old ones,
+// until the file is closed.
+func (f *rotatingFile) tidy() {
+	for rotated := range f.rotated {
+		// A file pruned while it waited is gone already
+		if f.compress {
+			if err := gzipFile(rotated); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintln(os.Stderr, "Compressing rotated log failed:", err)
+			}
+		}
+		if len(f.rotated) == 0 {
+			f.prune()
+		}
+	}
+}
+
+// prune deletes rotated files beyond the newest keep.
+func (f *rotatingFile) prune() {
+	if f.keep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".tmp") {
+			rotated = append(rotated, m)
+		}
+	}
+	sortRotated(f.path, rotated)
+	for len(rotated) > f.keep {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+// sortRotated sorts the names of files rotated from path oldest first, by
+// their timestamp suffix and then the sequence number after it, if any.
+func sortRotated(path string, names []string) {
+	key := func(name string) (string, int) {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(name, path+"."), ".gz")
+		// The timestamp has one "-" of its own
+		if strings.Count(suffix, "-") < 2 {
+			return suffix, 0
+		}
+		i := strings.LastIndexByte(suffix, '-')
+		n, _ := strconv.Atoi(suffix[i+1:])
+		return suffix[:i], n
+	}
+	sort.Slice(names, func(i, j int) bool {
+		si, ni := key(names[i])
+		sj, nj := key(names[j])
+		if si != sj {
+			return si < sj
+		}
+		return ni < nj
+	})
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.rotated)
+	}
+	return f.file.Close()
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// newFileLogHandler opens path for rotating log output in the given format.
+func newFileLogHandler(path, format string, level slog.Leveler, maxSizeMB int, maxAge time.Duration, keep int, compress bool) (slog.Handler, io.Closer, error) {
+	f, err := newRotatingFile(path, int64(maxSizeMB)<<20, maxAge, keep, compress)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := newLogHandler(f, format, level)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return h, f, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// logOptions collects the flags controlling where logs go.
+type logOptions struct {
+	format         string
+	level          string
+	syslog         string
+	syslogFacility string
+	journald       string
+	file           string
+	fileMaxSize    int
+	fileMaxAge     time.Duration
+	fileKeep       int
+	fileCompress   bool
+}
+
+func (o *logOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.format, "log-format", "text", "Log output format: text or json")
+	fs.StringVar(&o.level, "log-level", "info", "Minimum log level: trace, debug, info, warn or error")
+	fs.StringVar(&o.syslog, "syslog", "", "Also log to syslog, e.g. udp://host:514, tcp://host:601 or unix:///dev/log (optional)")
+	fs.StringVar(&o.syslogFacility, "syslog-facility", "daemon", "Syslog facility, e.g. daemon or local0")
+	fs.StringVar(&o.journald, "journald", "auto", "Log to the systemd journal instead of stderr: auto, on or off")
+	fs.StringVar(&o.file, "logfile", "", "Write logs to this file instead of stderr, with rotation (optional)")
+	fs.IntVar(&o.fileMaxSize, "logfile-max-size", 100, "Rotate the log file after it reaches this many megabytes (0 disables)")
+	fs.DurationVar(&o.fileMaxAge, "logfile-max-age", 24*time.Hour, "Rotate the log file after it has been open this long (0 disables)")
+	fs.IntVar(&o.fileKeep, "logfile-keep", 7, "Number of rotated log files to keep (0 keeps all)")
+	fs.BoolVar(&o.fileCompress, "logfile-compress", true, "Gzip rotated log files")
+}
+
+// setupLogging installs the default slog logger described by o. The
+// returned function closes any files or sockets opened for logging.
+func setupLogging(o *logOptions) (func(), error) {
+	var closers []io.Closer
+	cleanup := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	level, err := parseLogLevel(o.level)
+	if err != nil {
+		return cleanup, err
+	}
+
+	// Primary output: log file, journal or stderr
+	var handler slog.Handler
+	if o.file != "" {
+		fh, closer, err := newFileLogHandler(o.file, o.format, level, o.fileMaxSize, o.fileMaxAge, o.fileKeep, o.fileCompress)
+		if err != nil {
+			return cleanup, fmt.Errorf("opening log file: %v", err)
+		}
+		closers = append(closers, closer)
+		handler = fh
+	}
+	switch o.journald {
+	case "on", "auto":
+		if handler == nil && (o.journald == "on" || underJournal()) {
+			jh, err := newJournalHandler(level)
+			if err != nil {
+				return cleanup, fmt.Errorf("connecting to the journal: %v", err)
+			}
+			closers = append(closers, jh)
+			handler = jh
+		}
+	case "off":
+	default:
+		return cleanup, fmt.Errorf("invalid -journald value %q (want auto, on or off)", o.journald)
+	}
+	if handler == nil {
+		if handler, err = newLogHandler(os.Stderr, o.format, level); err != nil {
+			return cleanup, err
+		}
+	}
+
+	// Additional sinks
+	handlers := multiHandler{handler}
+	if o.syslog != "" {
+		w, err := newSyslogWriter(o.syslog, o.syslogFacility)
+		if err != nil {
+			return cleanup, fmt.Errorf("connecting to syslog: %v", err)
+		}
+		closers = append(closers, w)
+		handlers = append(handlers, newSyslogHandler(w, o.format, level))
+	}
+	if isWindowsService() {
+		eh, err := newEventLogHandler(level)
+		if err != nil {
+			return cleanup, fmt.Errorf("opening the event log: %v", err)
+		}
+		closers = append(closers, eh)
+		handlers = append(handlers, eh)
+	}
+
+	slog.SetDefault(slog.New(handlers))
+	return cleanup, nil
+}
+
+// parseLogLevel accepts one of trace, debug, info, warn or error.
+func parseLogLevel(level string) (slog.Level, error) {
+	if strings.EqualFold(level, "trace") {
+		return levelTrace, nil
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", level)
+	}
+	return lvl, nil
+}
+
+// newLogHandler builds a handler writing to w. format is "text" or "json".
+func newLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: nameTraceLevel}
+
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+}
+
+// nameTraceLevel prints levelTrace as TRACE rather than DEBUG-4.
+func nameTraceLevel(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.LevelKey && a.Value.Any() == levelTrace {
+		a.Value = slog.StringValue("TRACE")
+	}
+	return a
+}
+
+// multiHandler fans each record out to several handlers, e.g. stderr and
+// syslog at the same time.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
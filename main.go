@@ -1,33 +1,270 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
 func main() {
-	// Parse command line arguments
-	domainPtr := flag.String("domain", "", "Domain name to respond to")
-	ipPtr := flag.String("ip", "", "IP address to respond with (optional)")
-	flag.Parse()
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// serveCommand implements "serve", the DNS server itself. It is also what
+// runs when the binary is started with flags and no subcommand.
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	domainPtr := fs.String("domain", "", "Domain name to respond to")
+	configPtr := fs.String("config", "", "YAML config file with rules and alert sinks (optional)")
+	profilePtr := fs.String("profile", "", "Apply this named profile from the -config file's profiles section (optional)")
+	ipPtr := fs.String("ip", "", "IP address to respond with (optional)")
+	userPtr := fs.String("user", "", "Switch to this user once the listeners are bound, e.g. nobody (optional)")
+	chrootPtr := fs.String("chroot", "", "Chroot to this directory once the listeners are bound (optional)")
+	shutdownTimeoutPtr := fs.Duration("shutdown-timeout", 10*time.Second, "How long to wait for queries and API requests in flight when stopping")
+	workersPtr := fs.Int("workers", 512, "Number of queries handled at once; forwarded queries hold a worker until the upstream answers")
+	queuePtr := fs.Int("queue", 4096, "Queries that may wait for a worker before new ones are dropped")
+	socketsPtr := fs.Int("sockets", defaultSockets(), "UDP sockets per listen address, each with its own reader, balanced by the kernel with SO_REUSEPORT (Linux only)")
+	ifacePtr := fs.String("iface", "", "Only receive queries arriving on this network interface, e.g. wlan1 (optional)")
+	ipRefreshPtr := fs.Duration("ip-refresh", 5*time.Second, "How often to check this host's addresses for changes when the answer address is taken from them, without -ip or with -ip6 auto (0 keeps the first)")
+	ip6Ptr := fs.String("ip6", "", "IPv6 address for AAAA answers to rules without their own IP, or auto to use this host's (optional)")
+	listenPtr := fs.String("listen", ":53", "Comma-separated addresses and ports to receive queries on, e.g. 192.168.1.5:53,127.0.0.1:5353 (overrides the config file's listen)")
+	debugAddrPtr := fs.String("debug-addr", "", "Serve pprof and expvar on this address, e.g. localhost:6060 (optional)")
+	healthAddrPtr := fs.String("health-addr", "", "Serve the /healthz and /readyz health checks, without authentication, on this address, e.g. :8080 (optional)")
+	apiAddrPtr := fs.String("api-addr", "", "Serve the HTTP API (live query stream) on this address, e.g. 127.0.0.1:8053 (optional)")
+	controlPtr := fs.String("control", "", "Accept control commands on this unix socket, e.g. /run/deceptivedns.sock (optional)")
+	grpcAddrPtr := fs.String("grpc-addr", "", "Serve the gRPC control API on this address, e.g. 127.0.0.1:8054 (optional)")
+	queryLogPtr := fs.String("querylog", "", "Record every query in this SQLite database (optional)")
+	pdnsPtr := fs.String("pdns", "", "Keep a passive DNS database of the records in forwarded answers in this SQLite file (optional)")
+	dnstapPtr := fs.String("dnstap", "", "Stream dnstap messages to unix:///path or tcp://host:port (optional)")
+	dnstapIdentityPtr := fs.String("dnstap-identity", "", "dnstap identity to send (defaults to the hostname)")
+	pcapPtr := fs.String("pcap", "", "Write received queries and sent responses to this pcap file (optional)")
+	pcapMaxSizePtr := fs.Int("pcap-max-size", 100, "Rotate the pcap file after it reaches this many megabytes (0 disables)")
+	pcapKeepPtr := fs.Int("pcap-keep", 10, "Number of rotated pcap files to keep (0 keeps all)")
+	mirrorPtr := fs.String("mirror", "", "Copy every query and its response to a collector at this UDP host:port, e.g. 10.0.0.9:5300 (optional)")
+	mirrorFormatPtr := fs.String("mirror-format", "raw", "How -mirror sends queries: raw, the DNS messages as they were, or json, with the query's event")
+	sessionPtr := fs.String("session", "", "Tag queries, alerts and logs with this session name, e.g. an engagement, for the export command (optional)")
+	statePtr := fs.String("state", "", "Keep counters, clients seen and caches in this file across restarts, saving it every minute (optional)")
+	selfTestPtr := fs.Bool("self-test", false, "After binding, query every rule over loopback and exit if the answers are wrong")
+	honeytokensPtr := fs.String("honeytokens", "", "Alert with where each token was planted when a name from this honeytoken file is resolved (optional)")
+	scriptPtr := fs.String("script", "", "Lua script whose query function may choose the answer to each query (optional)")
+	scriptTimeoutPtr := fs.Duration("script-timeout", 100*time.Millisecond, "How long -script may take over one query before the rules answer it instead")
+	hookPtr := fs.String("hook", "", "Program to ask about each query over JSON lines on stdin and stdout, which may veto or synthesize the answer (optional)")
+	hookTimeoutPtr := fs.Duration("hook-timeout", 500*time.Millisecond, "How long -hook may take to answer one query before the rules answer it instead")
+	updatesPtr := fs.String("updates", "refuse", "How to handle DNS UPDATE messages: refuse (log them and answer REFUSED) or accept (apply them to an in-memory lab zone)")
+	tcpPtr := fs.Bool("tcp", false, "Also accept queries over TCP on every -listen address (implied by axfr zones in the config)")
+	dotPtr := fs.String("dot", "", "Also accept DNS over TLS queries on these comma-separated addresses, e.g. :853 (optional)")
+	dotCertPtr := fs.String("dot-cert", "", "Certificate (PEM) for -dot (default: one minted for each name asked for, signed by the -https-ca-cert CA)")
+	dotKeyPtr := fs.String("dot-key", "", "Private key (PEM) of -dot-cert")
+	updateTSIGPtr := fs.Bool("update-tsig", false, "Only accept updates signed with a key from the tsig section of the config file")
+	updateZonesPtr := fs.String("update-zones", "", "Comma-separated zones -updates accept lets clients change (default: any)")
+	fingerprintPtr := fs.Bool("fingerprint", false, "Describe each client's DNS software from its queries and tag events with a guess at what it is")
+	monitorPtr := fs.Bool("monitor", false, "Log which rule each query matches but never send spoofed answers")
+	mdnsPtr := fs.Bool("mdns", false, "Also answer multicast DNS queries for .local rules on 224.0.0.251:5353")
+	llmnrPtr := fs.Bool("llmnr", false, "Also answer LLMNR queries for names matching rules on 224.0.0.252:5355 and [ff02::1:3]:5355")
+	llmnrAllPtr := fs.Bool("llmnr-all", false, "Answer every LLMNR name with the default addresses, not just those matching rules (implies -llmnr)")
+	nbnsPtr := fs.Bool("nbns", false, "Also answer NetBIOS name queries for names matching rules on UDP port 137")
+	nbnsAllPtr := fs.Bool("nbns-all", false, "Answer every NetBIOS name with the default address, not just those matching rules (implies -nbns)")
+	dhcpRangePtr := fs.String("dhcp-range", "", "Run a DHCP server handing out addresses in this range, e.g. 192.168.1.100-192.168.1.200, with this host as the DNS server (optional)")
+	dhcpNetmaskPtr := fs.String("dhcp-netmask", "255.255.255.0", "Subnet mask to hand out with -dhcp-range")
+	dhcpRouterPtr := fs.String("dhcp-router", "", "Default gateway to hand out with -dhcp-range (optional)")
+	dhcpDomainPtr := fs.String("dhcp-domain", "", "DNS search domain to hand out with -dhcp-range (optional)")
+	dhcpLeasePtr := fs.Duration("dhcp-lease", time.Hour, "Lease time for -dhcp-range addresses")
+	wpadPtr := fs.Bool("wpad", false, "Answer wpad.<suffix> lookups and serve a proxy auto-config file to the browsers that follow them")
+	wpadAddrPtr := fs.String("wpad-addr", ":80", "Serve the WPAD PAC file on this address")
+	wpadPACPtr := fs.String("wpad-pac", "", "PAC file to serve as wpad.dat (default: one pointing at -wpad-proxy)")
+	wpadProxyPtr := fs.String("wpad-proxy", "", "Proxy for the default PAC file, host:port (default: the answer IP on port 3128)")
+	httpAddrPtr := fs.String("http-addr", "", "Serve a landing page to every HTTP request on this address, e.g. :80, and log each hit (optional)")
+	httpPagePtr := fs.String("http-page", "", "HTML file to serve from -http-addr (default: a plain \"site unavailable\" page)")
+	httpsAddrPtr := fs.String("https-addr", "", "Also serve the landing page over HTTPS on this address, e.g. :443, with a certificate minted for each name asked for (optional)")
+	httpsCACertPtr := fs.String("https-ca-cert", "", "CA certificate (PEM) to sign the HTTPS certificates with (default: a new CA for each run)")
+	httpsCAKeyPtr := fs.String("https-ca-key", "", "Private key (PEM) of -https-ca-cert")
+	recordPtr := fs.String("record", "", "Record the upstream answers to forwarded queries in this snapshot file (optional)")
+	replayPtr := fs.String("replay", "", "Answer queries no rule answers from this snapshot file, without asking upstream (optional)")
+	forwardPtr := fs.String("forward", "", "Forward queries no rule answers to this resolver, or comma-separated resolvers in order of preference, e.g. 9.9.9.9:53,1.1.1.1 (optional)")
+	forwardTimeoutPtr := fs.Duration("forward-timeout", 2*time.Second, "How long to wait for the -forward resolver to answer before sending the query again")
+	forwardRetriesPtr := fs.Int("forward-retries", 1, "How many times to send a forwarded query again if the resolver doesn't answer")
+	queryDeadlinePtr := fs.Duration("query-deadline", 5*time.Second, "Answer SERVFAIL to a forwarded query not resolved within this long, retries included")
+	forward0x20Ptr := fs.Bool("forward-0x20", true, "Send forwarded queries with the name in random case and discard responses that don't repeat it; turn off for resolvers that don't preserve case")
+	forwardProbePtr := fs.Duration("forward-probe", 10*time.Second, "How often to check the -forward resolvers are answering, 0 to only judge them by forwarded queries")
+	flattenPtr := fs.String("flatten-cnames", "", "Flatten CNAME chains in forwarded A and AAAA answers into records of the name asked for: apex for registrable domains such as example.com, or all (optional)")
+	groundTruthPtr := fs.Bool("ground-truth", false, "For queries a rule answers, also ask the -forward resolvers in the background and record their real answer alongside the spoofed one")
+	dns64Ptr := fs.String("dns64", "", "Synthesize AAAA answers from IPv4 ones under this NAT64 prefix, e.g. 64:ff9b::/96, for IPv6-only clients behind NAT64 (optional)")
+	mastersPtr := fs.String("masters", "", "Comma-separated addresses or prefixes NOTIFY is accepted from with -forward or -replay (default: the -forward resolvers)")
+	var logOpts logOptions
+	logOpts.registerFlags(fs)
+	fs.Parse(args)
+
+	// Set up logging
+	closeLogs, err := setupLogging(&logOpts)
+	if err != nil {
+		fmt.Println("Invalid logging options:", err)
+		os.Exit(1)
+	}
+	defer closeLogs()
+
+	// Load the config file and collect rules
+	cfg := &config{}
+	if *configPtr != "" {
+		if cfg, err = loadConfig(*configPtr, *profilePtr); err != nil {
+			fmt.Println("Failed to load config:", err)
+			os.Exit(1)
+		}
+		data, _ := os.ReadFile(*configPtr)
+		problems := checkConfig(data, cfg)
+		for _, p := range problems {
+			fmt.Println(p.format(*configPtr))
+		}
+		if hasErrors(problems) {
+			fmt.Println("Config has errors; run the validate command for details")
+			os.Exit(1)
+		}
+		if *profilePtr != "" {
+			slog.Info("Using config profile", "profile", *profilePtr)
+		}
+	} else if *profilePtr != "" {
+		fmt.Println("-profile needs a -config file to take the profile from")
+		os.Exit(1)
+	}
+	if *domainPtr != "" {
+		cfg.Rules = append(cfg.Rules, &rule{Domain: *domainPtr})
+	}
 
 	// Validate command line arguments
-	if *domainPtr == "" {
-		fmt.Println("Please provide a domain name using the -domain flag")
+	listen := *listenPtr
+	if cfg.Listen != "" && !flagPassed(fs, "listen") {
+		listen = cfg.Listen
+	}
+	listenAddrs := splitListenAddrs(listen)
+	if len(listenAddrs) == 0 {
+		fmt.Println("Please provide at least one -listen address")
+		os.Exit(1)
+	}
+	if *workersPtr < 1 || *queuePtr < 0 {
+		fmt.Println("-workers must be at least 1 and -queue must not be negative")
+		os.Exit(1)
+	}
+	if *socketsPtr < 1 || (*socketsPtr > 1 && !reusePortSupported) {
+		fmt.Println("-sockets must be at least 1, and more than 1 is only supported on Linux")
+		os.Exit(1)
+	}
+	if *recordPtr != "" && *forwardPtr == "" {
+		fmt.Println("-record needs a -forward resolver to record answers from")
+		os.Exit(1)
+	}
+	if *groundTruthPtr && *forwardPtr == "" {
+		fmt.Println("-ground-truth needs a -forward resolver to ask for the real answers")
+		os.Exit(1)
+	}
+	if *sessionPtr != "" {
+		if err := startSession(*sessionPtr, "flag"); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if len(cfg.Rules) == 0 && len(cfg.Services) == 0 && len(cfg.Feeds) == 0 && !*wpadPtr && *replayPtr == "" && *honeytokensPtr == "" && *scriptPtr == "" && *hookPtr == "" {
+		fmt.Println("Please provide a domain name using the -domain flag or rules in a -config file")
+		os.Exit(1)
+	}
+	rules, err := newRuleSet(cfg.Rules)
+	if err != nil {
+		fmt.Println("Invalid rule:", err)
+		os.Exit(1)
+	}
+	feeds, err := newFeeds(cfg.Feeds, rules)
+	if err != nil {
+		fmt.Println("Invalid feed configuration:", err)
+		os.Exit(1)
+	}
+	services, err := newServiceSet(cfg.Services)
+	if err != nil {
+		fmt.Println("Invalid service:", err)
+		os.Exit(1)
+	}
+	alerts, err := newAlerter(cfg.Alerts)
+	if err != nil {
+		fmt.Println("Invalid alert configuration:", err)
+		os.Exit(1)
+	}
+	detect, err := newDetectors(cfg.Detection)
+	if err != nil {
+		fmt.Println("Invalid detection configuration:", err)
+		os.Exit(1)
+	}
+	axfr, err := newAXFRServer(cfg.AXFR)
+	if err != nil {
+		fmt.Println("Invalid axfr configuration:", err)
+		os.Exit(1)
+	}
+	steer, err := newSteerer(cfg.Steering)
+	if err != nil {
+		fmt.Println("Invalid steering configuration:", err)
+		os.Exit(1)
+	}
+	if err := cfg.Connections.validate(); err != nil {
+		fmt.Println("Invalid connections configuration:", err)
+		os.Exit(1)
+	}
+	if err := cfg.Replication.validate(); err != nil {
+		fmt.Println("Invalid replication configuration:", err)
+		os.Exit(1)
+	}
+	qtypes, err := parseQTypePolicy(cfg.QTypes)
+	if err != nil {
+		fmt.Println("Invalid qtypes configuration:", err)
+		os.Exit(1)
+	}
+	notice, err := newNoticeBoard(cfg.Notice, cfg.Detection)
+	if err != nil {
+		fmt.Println("Invalid notice configuration:", err)
+		os.Exit(1)
+	}
+	if notice != nil && *httpAddrPtr == "" && *httpsAddrPtr == "" {
+		fmt.Println("The notice section needs -http-addr or -https-addr to serve its page from")
+		os.Exit(1)
+	}
+	keyring, err := newTSIGKeyring(cfg.TSIG)
+	if err != nil {
+		fmt.Println("Invalid tsig configuration:", err)
+		os.Exit(1)
+	}
+	if err := checkTSIGUse(cfg); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
 	var ip string
+	var trackIP bool // ip is taken from the host's addresses
 	if *ipPtr != "" {
+		if net.ParseIP(*ipPtr) == nil {
+			fmt.Println("Invalid IP address:", *ipPtr)
+			os.Exit(1)
+		}
 		ip = *ipPtr
+	} else if host := answerableListenHost(listenAddrs); host != "" {
+		// Answer with the address we're bound to
+		ip = host
+	} else if *ifacePtr != "" {
+		if ip, err = interfaceIPv4(*ifacePtr); err != nil {
+			fmt.Println("Failed to get interface address:", err)
+			os.Exit(1)
+		}
+		trackIP = true
 	} else {
 		// Get local IP address
 		localIP, err := getLocalIP()
@@ -36,191 +273,1203 @@ func main() {
 			os.Exit(1)
 		}
 		ip = localIP
+		trackIP = true
+	}
+
+	var ip6 string
+	switch *ip6Ptr {
+	case "":
+	case "auto":
+		if ip6, err = getLocalIP6(); err != nil {
+			fmt.Println("Failed to get local IPv6 address:", err)
+			os.Exit(1)
+		}
+	default:
+		if addr := net.ParseIP(*ip6Ptr); addr == nil || addr.To4() != nil {
+			fmt.Println("Invalid IPv6 address:", *ip6Ptr)
+			os.Exit(1)
+		}
+		ip6 = *ip6Ptr
+	}
+
+	// Start the debug endpoint if requested
+	if *debugAddrPtr != "" {
+		if err := startDebugServer(*debugAddrPtr); err != nil {
+			fmt.Println("Failed to start debug endpoint:", err)
+			os.Exit(1)
+		}
 	}
 
 	// Set up DNS server
 	server := &dnsServer{
-		domain: *domainPtr,
-		ip:     ip,
+		rules:     rules,
+		iface:     *ifacePtr,
+		sockets:   *socketsPtr,
+		alerts:    alerts,
+		detect:    detect,
+		axfr:      axfr,
+		steer:     steer,
+		conns:     cfg.Connections,
+		qtypes:    qtypes,
+		notice:    notice,
+		tsig:      keyring,
+		top:       newTopStats(),
+		firstSeen: cfg.Alerts.FirstSeenClients,
+		monitor:   *monitorPtr,
+	}
+	server.repl = newReplicator(cfg.Replication, server)
+	server.services.Store(services)
+	server.addrs.Store(&answerAddrs{ip: net.ParseIP(ip), ip6: net.ParseIP(ip6)})
+	if *fingerprintPtr {
+		if server.fingerprints, err = newFingerprinter(cfg.Fingerprints); err != nil {
+			fmt.Println("Invalid fingerprint signature:", err)
+			os.Exit(1)
+		}
+	}
+	if *scriptPtr != "" {
+		qs, err := loadQueryScript(*scriptPtr, *scriptTimeoutPtr, *workersPtr)
+		if err != nil {
+			fmt.Println("Failed to load script:", err)
+			os.Exit(1)
+		}
+		server.deciders = append(server.deciders, qs)
+		slog.Info("Query script loaded", "path", *scriptPtr)
+	}
+	if *hookPtr != "" {
+		h, err := startHook(*hookPtr, *hookTimeoutPtr)
+		if err != nil {
+			fmt.Println("Failed to start hook:", err)
+			os.Exit(1)
+		}
+		server.deciders = append(server.deciders, h)
+	}
+	switch *updatesPtr {
+	case "refuse":
+		if *updateZonesPtr != "" || *updateTSIGPtr {
+			fmt.Println("-update-zones and -update-tsig need -updates accept")
+			os.Exit(1)
+		}
+	case "accept":
+		if *updateTSIGPtr && keyring == nil {
+			fmt.Println("-update-tsig needs keys in the tsig section of the config file")
+			os.Exit(1)
+		}
+		server.updateTSIG = *updateTSIGPtr
+		var zones []string
+		for _, z := range strings.Split(*updateZonesPtr, ",") {
+			if z = strings.TrimSpace(z); z != "" {
+				zones = append(zones, z)
+			}
+		}
+		server.updates = newLabZone(zones)
+		slog.Info("Accepting dynamic updates", "zones", *updateZonesPtr)
+	default:
+		fmt.Println("-updates must be refuse or accept")
+		os.Exit(1)
+	}
+	if *forwardPtr != "" {
+		var addrs []string
+		for _, f := range strings.Split(*forwardPtr, ",") {
+			if f = strings.TrimSpace(f); f == "" {
+				continue
+			}
+			f = withDefaultPort(f, "53")
+			upstream, err := net.ResolveUDPAddr("udp", f)
+			if err != nil {
+				fmt.Println("Invalid forward address:", err)
+				os.Exit(1)
+			}
+			addr := upstream.AddrPort().Addr().Unmap()
+			server.masters = append(server.masters, netip.PrefixFrom(addr, addr.BitLen()))
+			addrs = append(addrs, f)
+		}
+		if len(addrs) == 0 {
+			fmt.Println("Invalid forward address: none given")
+			os.Exit(1)
+		}
+		if *forwardProbePtr < 0 {
+			fmt.Println("-forward-probe must not be negative")
+			os.Exit(1)
+		}
+		server.upstream = newUpstreamPool(addrs, *forwardProbePtr)
+	}
+	if *forwardTimeoutPtr <= 0 || *forwardRetriesPtr < 0 || *queryDeadlinePtr <= 0 {
+		fmt.Println("-forward-timeout and -query-deadline must be positive and -forward-retries must not be negative")
+		os.Exit(1)
+	}
+	server.mixCase = *forward0x20Ptr
+	if *groundTruthPtr {
+		server.groundTruth, server.truthSlots = true, make(chan struct{}, groundTruthMaxLookups)
+	}
+	server.limits = forwardLimits{timeout: *forwardTimeoutPtr, retries: *forwardRetriesPtr, deadline: *queryDeadlinePtr}
+	if server.flatten, err = parseFlattenMode(*flattenPtr); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *dns64Ptr != "" {
+		if server.dns64, err = parseDNS64Prefix(*dns64Ptr); err != nil {
+			fmt.Println("Invalid -dns64:", err)
+			os.Exit(1)
+		}
+	}
+	if *mastersPtr != "" {
+		var list []string
+		for _, m := range strings.Split(*mastersPtr, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				list = append(list, m)
+			}
+		}
+		if server.masters, err = parsePrefixes(list); err != nil {
+			fmt.Println("Invalid -masters:", err)
+			os.Exit(1)
+		}
+	}
+	if server.monitor {
+		slog.Warn("Monitor mode: rule matches are logged but not answered", "forward", *forwardPtr)
+	}
+	if server.sinks, err = newConfiguredSinks(cfg.Events, alerts); err != nil {
+		fmt.Println("Invalid event sink configuration:", err)
+		os.Exit(1)
+	}
+	rep, err := newReporter(cfg.Alerts.Reports, alerts, rules)
+	if err != nil {
+		fmt.Println("Invalid report configuration:", err)
+		os.Exit(1)
+	}
+	if rep != nil {
+		server.sinks = append(server.sinks, rep)
+	}
+	if *queryLogPtr != "" {
+		ql, err := newQueryLog(*queryLogPtr)
+		if err != nil {
+			fmt.Println("Failed to open query log:", err)
+			os.Exit(1)
+		}
+		server.sinks = append(server.sinks, ql)
+		// Every alert, unlike the notifiers' default of 60 a minute
+		alerts.add(queryLogAlerts{ql}, notifyOptions{RateLimit: math.MaxInt32})
+	}
+	if *pdnsPtr != "" {
+		if server.pdns, err = newPassiveDNS(*pdnsPtr); err != nil {
+			fmt.Println("Failed to open passive DNS database:", err)
+			os.Exit(1)
+		}
+		server.sinks = append(server.sinks, server.pdns)
+		server.keepWire = true
+	}
+	if *dnstapPtr != "" {
+		dt, err := newDnstapSink(*dnstapPtr, *dnstapIdentityPtr)
+		if err != nil {
+			fmt.Println("Invalid dnstap option:", err)
+			os.Exit(1)
+		}
+		server.sinks = append(server.sinks, dt)
+		server.keepWire = true
+	}
+	if *pcapPtr != "" {
+		pc, err := newPCAPSink(*pcapPtr, *pcapMaxSizePtr, *pcapKeepPtr, net.ParseIP(ip))
+		if err != nil {
+			fmt.Println("Failed to open pcap file:", err)
+			os.Exit(1)
+		}
+		server.sinks = append(server.sinks, pc)
+		server.keepWire = true
+	}
+	if *mirrorPtr != "" {
+		m, err := newMirrorSink(*mirrorPtr, *mirrorFormatPtr)
+		if err != nil {
+			fmt.Println("Invalid mirror option:", err)
+			os.Exit(1)
+		}
+		server.sinks = append(server.sinks, m)
+		server.keepWire = true
+	}
+	if slog.Default().Enabled(context.Background(), levelTrace) {
+		server.sinks = append(server.sinks, dumpSink{})
+		server.keepWire = true
+	}
+	if *honeytokensPtr != "" {
+		if server.honeytokens, err = loadHoneytokens(*honeytokensPtr); err != nil {
+			fmt.Println("Failed to load honeytokens:", err)
+			os.Exit(1)
+		}
+		slog.Info("Watching for honeytokens", "path", *honeytokensPtr, "tokens", server.honeytokens.len())
+	}
+	if *replayPtr != "" {
+		if server.replay, err = loadSnapshot(*replayPtr, false); err != nil {
+			fmt.Println("Failed to load snapshot:", err)
+			os.Exit(1)
+		}
+		slog.Info("Replaying snapshot", "path", *replayPtr, "answers", len(server.replay.entries))
+	}
+	if *recordPtr != "" {
+		if *recordPtr == *replayPtr {
+			server.record = server.replay // fill in what the snapshot lacks
+		} else if server.record, err = loadSnapshot(*recordPtr, true); err != nil {
+			fmt.Println("Failed to load snapshot:", err)
+			os.Exit(1)
+		}
+		server.record.startSaving()
+	}
+	var sinkhole *sinkholeServer
+	if *httpAddrPtr != "" || *httpsAddrPtr != "" {
+		page := []byte(sinkholePage)
+		if *httpPagePtr != "" {
+			if page, err = os.ReadFile(*httpPagePtr); err != nil {
+				fmt.Println("Failed to read HTTP page:", err)
+				os.Exit(1)
+			}
+		}
+		sinkhole = newSinkholeServer(server, page)
+		server.trackAnswers = true
+	}
+	var wpad *wpadServer
+	if *wpadPtr {
+		proxy := *wpadProxyPtr
+		if proxy == "" {
+			proxy = net.JoinHostPort(ip, "3128")
+		}
+		pac, err := wpadPAC(*wpadPACPtr, proxy)
+		if err != nil {
+			fmt.Println("Invalid WPAD option:", err)
+			os.Exit(1)
+		}
+		if sinkhole != nil && *wpadAddrPtr == *httpAddrPtr {
+			// One server for both, as they can't share the port
+			registerWPAD(sinkhole.mux, pac)
+		} else if wpad, err = startWPADServer(*wpadAddrPtr, pac); err != nil {
+			fmt.Println("Failed to start WPAD server:", err)
+			os.Exit(1)
+		}
+		server.wpad = true
+	}
+	if *httpAddrPtr != "" {
+		if err := sinkhole.start(*httpAddrPtr); err != nil {
+			fmt.Println("Failed to start HTTP sinkhole:", err)
+			os.Exit(1)
+		}
+	}
+	if *httpsAddrPtr != "" {
+		if (*httpsCACertPtr == "") != (*httpsCAKeyPtr == "") {
+			fmt.Println("-https-ca-cert and -https-ca-key must be given together")
+			os.Exit(1)
+		}
+		certs, err := newCertMinter(*httpsCACertPtr, *httpsCAKeyPtr)
+		if err != nil {
+			fmt.Println("Failed to load HTTPS CA:", err)
+			os.Exit(1)
+		}
+		if err := sinkhole.startTLS(*httpsAddrPtr, certs); err != nil {
+			fmt.Println("Failed to start HTTPS sinkhole:", err)
+			os.Exit(1)
+		}
+	}
+	var health *healthServer
+	if *healthAddrPtr != "" {
+		if health, err = startHealthServer(*healthAddrPtr, server); err != nil {
+			fmt.Println("Failed to start health checks:", err)
+			os.Exit(1)
+		}
+	}
+	var api *apiServer
+	var grpcSrv *grpc.Server
+	if *apiAddrPtr != "" || *grpcAddrPtr != "" {
+		broker := newEventBroker()
+		server.sinks = append(server.sinks, broker)
+		if *apiAddrPtr != "" {
+			api = newAPIServer(server, broker, cfg.API)
+			if err := api.start(*apiAddrPtr); err != nil {
+				fmt.Println("Failed to start API:", err)
+				os.Exit(1)
+			}
+		}
+		if *grpcAddrPtr != "" {
+			if grpcSrv, err = startGRPCServer(*grpcAddrPtr, server, broker, cfg.API); err != nil {
+				fmt.Println("Failed to start gRPC API:", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if *controlPtr != "" {
+		var reload func() error
+		if *configPtr != "" {
+			reload = func() error {
+				c, err := loadConfig(*configPtr, *profilePtr)
+				if err != nil {
+					return err
+				}
+				if *domainPtr != "" {
+					c.Rules = append(c.Rules, &rule{Domain: *domainPtr})
+				}
+				services, err := newServiceSet(c.Services)
+				if err != nil {
+					return err
+				}
+				if err := server.rules.replace(c.Rules); err != nil {
+					return err
+				}
+				server.services.Store(services)
+				slog.Info("Rules reloaded", "rules", server.rules.len(), "services", len(c.Services))
+				return nil
+			}
+		}
+		ctl, err := startControlServer(*controlPtr, server, reload)
+		if err != nil {
+			fmt.Println("Failed to open control socket:", err)
+			os.Exit(1)
+		}
+		defer ctl.Close()
+	}
+	if n := server.listenActivated(); n > 0 {
+		slog.Info("Using sockets passed by systemd; ignoring -listen", "sockets", n)
+		if *tcpPtr || axfr != nil {
+			slog.Warn("Not listening on TCP; systemd only passes UDP sockets")
+		}
+	} else {
+		for _, addr := range listenAddrs {
+			if err := server.listen(addr); err != nil {
+				fmt.Println("Failed to listen:", err)
+				os.Exit(1)
+			}
+			if *tcpPtr || axfr != nil {
+				if err := server.listenTCP(addr); err != nil {
+					fmt.Println("Failed to listen on TCP:", err)
+					os.Exit(1)
+				}
+			}
+		}
+	}
+	if *dotPtr != "" {
+		if (*dotCertPtr == "") != (*dotKeyPtr == "") {
+			fmt.Println("-dot-cert and -dot-key must be given together")
+			os.Exit(1)
+		}
+		var certs *certMinter
+		if *dotCertPtr == "" {
+			if (*httpsCACertPtr == "") != (*httpsCAKeyPtr == "") {
+				fmt.Println("-https-ca-cert and -https-ca-key must be given together")
+				os.Exit(1)
+			}
+			if certs, err = newCertMinter(*httpsCACertPtr, *httpsCAKeyPtr); err != nil {
+				fmt.Println("Failed to load DoT CA:", err)
+				os.Exit(1)
+			}
+		}
+		tc, err := dotTLSConfig(*dotCertPtr, *dotKeyPtr, certs)
+		if err != nil {
+			fmt.Println("Failed to load DoT certificate:", err)
+			os.Exit(1)
+		}
+		for _, addr := range strings.Split(*dotPtr, ",") {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+			if err := server.listenDoT(withDefaultPort(addr, "853"), tc); err != nil {
+				fmt.Println("Failed to listen for DNS over TLS:", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if *mdnsPtr {
+		if err := server.listenMDNS(); err != nil {
+			fmt.Println("Failed to join the mDNS group:", err)
+			os.Exit(1)
+		}
+	}
+	if *llmnrPtr || *llmnrAllPtr {
+		server.llmnrAll = *llmnrAllPtr
+		if err := server.listenLLMNR(); err != nil {
+			fmt.Println("Failed to join the LLMNR group:", err)
+			os.Exit(1)
+		}
+	}
+	if *nbnsPtr || *nbnsAllPtr {
+		server.nbnsAll = *nbnsAllPtr
+		if err := server.listenNBNS(); err != nil {
+			fmt.Println("Failed to listen for NetBIOS name queries:", err)
+			os.Exit(1)
+		}
+	}
+	if *dhcpRangePtr != "" {
+		dcfg := dhcpConfig{lease: *dhcpLeasePtr, domain: *dhcpDomainPtr}
+		var err error
+		if dcfg.first, dcfg.last, err = parseDHCPRange(*dhcpRangePtr); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if dcfg.netmask = net.ParseIP(*dhcpNetmaskPtr).To4(); dcfg.netmask == nil {
+			fmt.Println("Invalid DHCP netmask:", *dhcpNetmaskPtr)
+			os.Exit(1)
+		}
+		if *dhcpRouterPtr != "" {
+			if dcfg.router = net.ParseIP(*dhcpRouterPtr).To4(); dcfg.router == nil {
+				fmt.Println("Invalid DHCP router:", *dhcpRouterPtr)
+				os.Exit(1)
+			}
+		}
+		if dcfg.lease < time.Minute {
+			fmt.Println("-dhcp-lease must be at least a minute")
+			os.Exit(1)
+		}
+		if server.wpad {
+			// Option 252 saves clients the DNS lookup, and works for them
+			// even without a search domain
+			host := ip
+			if _, port, _ := net.SplitHostPort(*wpadAddrPtr); port != "80" {
+				host = net.JoinHostPort(ip, port)
+			}
+			dcfg.wpadURL = "http://" + host + "/wpad.dat"
+		}
+		server.dhcp = newDHCPServer(dcfg, net.ParseIP(ip))
+		if err := server.listenDHCP(); err != nil {
+			fmt.Println("Failed to start DHCP server:", err)
+			os.Exit(1)
+		}
+	}
+	if *userPtr != "" || *chrootPtr != "" {
+		if *userPtr == "" {
+			slog.Warn("Chrooting without -user; root can leave a chroot")
+		}
+		if err := dropPrivileges(*userPtr, *chrootPtr); err != nil {
+			fmt.Println("Failed to drop privileges:", err)
+			os.Exit(1)
+		}
+		slog.Info("Dropped privileges", "user", *userPtr, "chroot", *chrootPtr, "uid", os.Getuid(), "gid", os.Getgid())
+	}
+	var state *stateKeeper
+	if *statePtr != "" {
+		if err := server.restoreState(*statePtr); err != nil {
+			fmt.Println("Failed to restore state:", err)
+			os.Exit(1)
+		}
+		state = server.startStateKeeper(*statePtr)
+	}
+	// Before the listeners serve, so an instance of a pair stands by
+	// until it knows whether its peer is active
+	if err := server.repl.start(); err != nil {
+		fmt.Println("Failed to start replication:", err)
+		os.Exit(1)
+	}
+	server.startWorkers(*workersPtr, *queuePtr)
+	for _, l := range server.listeners {
+		server.readers.Add(1)
+		go server.serve(l)
+	}
+	for _, ln := range server.tcpListeners {
+		server.readers.Add(1)
+		go server.serveTCP(ln)
+	}
+	if *selfTestPtr {
+		if server.monitor {
+			slog.Warn("Skipping self-test in monitor mode, which sends no spoofed answers")
+		} else if server.repl != nil {
+			slog.Warn("Skipping self-test with replication, as the instance starts standing by")
+		} else {
+			tested := make(map[string]bool)
+			for _, l := range server.listeners {
+				if tested[l.addr] || l.proto != "" {
+					continue // another SO_REUSEPORT socket on the same address, or not unicast DNS
+				}
+				tested[l.addr] = true
+				if err := server.selfTest(l.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+					fmt.Println("Self-test failed:", err)
+					os.Exit(1)
+				}
+			}
+		}
 	}
-	go server.start()
 
-	// Wait for interruption (Ctrl+C) to close the server
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	<-interrupt
+	feeds.start()
+	server.upstream.start(server)
+	if server.steer != nil {
+		server.steer.start(server.rules)
+	}
+	var tracker *addrTracker
+	if (trackIP || *ip6Ptr == "auto") && *ipRefreshPtr > 0 {
+		tracker = server.startAddrTracker(*ifacePtr, trackIP, *ip6Ptr == "auto", *ipRefreshPtr)
+	}
+	if server.axfr != nil {
+		server.startZoneWatch()
+	}
+	server.ready.Store(true)
+	sdNotify("READY=1")
 
-	fmt.Println("DNS server stopped.")
+	// kill -USR1 logs a snapshot of the counters
+	usr1 := make(chan os.Signal, 1)
+	notifyStatsSignal(usr1)
+	go func() {
+		for range usr1 {
+			server.logStats()
+		}
+	}()
+
+	if isWindowsService() {
+		// Run until the service control manager stops us
+		if err := runWindowsService(); err != nil {
+			slog.Error("Windows service failed", "err", err)
+		}
+	} else {
+		// Wait for interruption (Ctrl+C) to close the server. A second
+		// signal kills the process if shutdown hangs.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		<-ctx.Done()
+		stop()
+	}
+
+	// Stop taking queries and let the ones in flight finish before the
+	// sinks they write to are flushed and closed
+	sdNotify("STOPPING=1")
+	slog.Info("Shutting down", "timeout", *shutdownTimeoutPtr)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutPtr)
+	defer cancel()
+	if err := server.shutdown(ctx); err != nil {
+		slog.Warn("Abandoning queries still in flight", "err", err)
+	}
+	feeds.close()
+	server.upstream.close()
+	server.steer.close()
+	tracker.close()
+	server.axfr.close()
+	server.closeSinks()
+	for _, d := range server.deciders {
+		d.close()
+	}
+	if server.honeytokens != nil {
+		server.honeytokens.close()
+	}
+	if server.record != nil {
+		if err := server.record.close(); err != nil {
+			slog.Error("Failed to save snapshot", "path", *recordPtr, "err", err)
+		}
+	}
+	if state != nil {
+		if err := state.close(); err != nil {
+			slog.Error("Failed to save state", "path", *statePtr, "err", err)
+		}
+	}
+	if err := server.repl.close(ctx); err != nil {
+		slog.Warn("Replication did not shut down cleanly", "err", err)
+	}
+	if err := health.shutdown(ctx); err != nil {
+		slog.Warn("Health checks did not shut down cleanly", "err", err)
+	}
+	if api != nil {
+		if err := api.shutdown(ctx); err != nil {
+			slog.Warn("API did not shut down cleanly", "err", err)
+		}
+	}
+	if wpad != nil {
+		if err := wpad.shutdown(ctx); err != nil {
+			slog.Warn("WPAD server did not shut down cleanly", "err", err)
+		}
+	}
+	if sinkhole != nil {
+		if err := sinkhole.shutdown(ctx); err != nil {
+			slog.Warn("HTTP sinkhole did not shut down cleanly", "err", err)
+		}
+	}
+	if grpcSrv != nil {
+		stopGRPC(ctx, grpcSrv)
+	}
+	server.alerts.close()
+	slog.Info("DNS server stopped")
+	return 0
 }
 
 type dnsServer struct {
-	domain string
-	ip     string
-}
+	rules    *ruleSet
+	services atomic.Pointer[serviceSet]  // DNS-SD records to advertise
+	addrs    atomic.Pointer[answerAddrs] // answers for rules without their own IP
+	steer    *steerer                    // probes the addresses of rules with several, if configured
+	dns64    netip.Prefix                // NAT64 prefix to synthesize AAAA answers under, if valid
+	flatten  string                      // which forwarded answers have their CNAMEs flattened: "", "apex" or "all"
+	iface    string                      // interface listeners are bound to, if any
+	sockets  int                         // sockets per listen address
+	sinks    []eventSink
+	alerts   *alerter
+	detect   *detectors
+	top      *topStats     // rolling per-rule, name and client counts
+	dhcp     *dhcpServer   // leases for the DHCP listener, if any
+	neigh    neighborTable // client MACs, for rules scoped by MAC
 
-func (s *dnsServer) start() {
-	addr := ":53" // Default DNS port
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		log.Fatal(err)
-	}
+	fingerprints *fingerprinter // client software guesses, with -fingerprint
+	honeytokens  *honeytokenSet // planted names to alert on, with -honeytokens
+	deciders     []queryDecider // -script and -hook, asked in turn before the rules
+	updates      *labZone       // names registered by DNS UPDATE, with -updates accept
+	updateTSIG   bool           // refuse unsigned updates
+	tsig         *tsigKeyring   // keys signed messages are checked with, if any
+	axfr         *axfrServer    // zones served by zone transfer, if any
 
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
+	listeners    []*listener
+	tcpListeners []net.Listener
+	tcpConns     sync.WaitGroup    // connections being served
+	tcpOpen      sync.Map          // net.Conn -> struct{}, to wake on shutdown
+	conns        connectionsConfig // limits on the connections of each TCP and DoT listener
+	connLimiters sync.Map          // listener stats name -> *connLimiter
+	readers      sync.WaitGroup    // serve loops
+	queue        chan packet       // received queries waiting for a worker
+	inflight     sync.WaitGroup    // workers
+	stopping     atomic.Bool
+	ready        atomic.Bool // set once every listener is serving, for /readyz
+	listenErrors sync.Map    // listener -> listenError, while its reads or accepts fail
 
-	fmt.Printf("DNS server listening on %s...\n", addr)
+	monitor  bool           // log rule matches without answering them
+	upstream *upstreamPool  // resolvers for queries no rule answers, if any
+	forwards forwardGroup   // lookups in flight upstream
+	limits   forwardLimits  // upstream timeouts and the per-query deadline
+	mixCase  bool           // forwarded queries use 0x20 encoding
+	masters  []netip.Prefix // where NOTIFYs are accepted from
+	replay   *snapshot      // recorded answers to serve instead of asking upstream
 
-	for {
-		buf := make([]byte, 1024)
-		n, addr, err := conn.ReadFromUDP(buf)
-		if err != nil {
-			log.Println("Error reading from UDP connection:", err)
-			continue
+	groundTruth bool           // ask upstream what spoofed queries would have got
+	truthSlots  chan struct{}  // ground truth lookups in flight
+	truths      sync.WaitGroup // likewise, for shutdown to wait on
+	truthMu     sync.RWMutex   // held to emit a ground truth event, and by shutdown to stop them
+	truthsDone  bool           // shutdown gave up on the lookups in flight, whose events are dropped
+
+	qtypes qtypePolicy  // what rules that answer do with each query type, from the config file
+	notice *noticeBoard // where sinkholed clients are sent to be told so, if anywhere
+
+	repl *replicator // the pair the instance is half of, if any
+
+	record   *snapshot   // where to record upstream answers
+	pdns     *passiveDNS // passive DNS database, if collecting
+	keepWire bool        // some sink needs the raw messages in events
+	llmnrAll bool        // answer every LLMNR name, not just rule matches
+	nbnsAll  bool        // likewise for NetBIOS names
+	wpad     bool        // answer WPAD names with wpadRule
+
+	trackAnswers bool     // record answers in answered, for the HTTP sinkhole
+	answered     sync.Map // client IP and query name -> time last answered
+
+	firstSeen   bool     // raise an alert for every new client
+	seenClients sync.Map // client IP -> time first seen
+	ruleHits    sync.Map // rule domain -> *atomic.Int64
+
+	selfTestAddr atomic.Pointer[net.UDPAddr] // source of self-test queries while one runs
+}
+
+// emit logs ev and hands it to every event sink.
+func (s *dnsServer) emit(ev *queryEvent) {
+	if s.isSelfTest(ev) {
+		return
+	}
+	if ev.Rule != "" {
+		if r := s.rules.get(ev.Rule); r != nil {
+			ev.Feed = r.Feed
 		}
+	}
+	ev.Session = sessionName()
+	logEvent(ev)
+	s.top.add(ev)
+	for _, sink := range s.sinks {
+		sink.Write(ev)
+	}
+	if ev.Rule != "" {
+		n, ok := s.ruleHits.Load(ev.Rule)
+		if !ok {
+			n, _ = s.ruleHits.LoadOrStore(ev.Rule, new(atomic.Int64))
+		}
+		n.(*atomic.Int64).Add(1)
+	}
+	if s.trackAnswers && ev.Action == "answered" {
+		s.answered.Store(ev.Client+" "+normalizeName(ev.QName), ev.Time)
+	}
+	if _, seen := s.seenClients.LoadOrStore(ev.Client, ev.Time); !seen && s.firstSeen {
+		s.alerts.raise(firstSeenAlert(ev))
+	}
+	s.detect.check(ev, s.alerts)
+	if s.honeytokens != nil {
+		if al := s.honeytokens.check(ev); al != nil {
+			s.alerts.raise(al)
+		}
+	}
+}
 
-		req := buf[:n]
-		go s.handleRequest(conn, addr, req)
+func (s *dnsServer) closeSinks() {
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			slog.Error("Error closing event sink", "err", err)
+		}
 	}
 }
 
-func (s *dnsServer) handleRequest(conn *net.UDPConn, addr *net.UDPAddr, req []byte) {
+// handleRequest answers one query. Parsing and building the response use
+// stack buffers, so apart from the event the query path doesn't allocate;
+// req is only copied into the event when a sink wants the raw messages.
+func (s *dnsServer) handleRequest(l *listener, addr netip.AddrPort, req []byte) {
+	start := time.Now()
+	handlersInFlight.Add(1)
+	defer handlersInFlight.Add(-1)
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("Recovered in handleRequest:", r)
+			queryErrors.Add(1)
+			slog.Error("Recovered in handleRequest", "client", addr.String(), "panic", r)
 		}
 	}()
+	queriesReceived.Add(1)
+	l.stats.Add("received", 1)
+	if s.detect.ban != nil && !s.monitor && s.detect.banned(addr.Addr().Unmap().String(), start) {
+		queriesBanned.Add(1)
+		l.stats.Add("banned", 1)
+		return
+	}
 
 	// Parse DNS request
 	var msg dnsMsg
-	if err := msg.unpack(req); err != nil {
-		log.Println("Error unpacking DNS message:", err)
+	if err := msg.unpack(req); err != nil && (opcodeImplemented(msg.Flags) || err != errNoQuestion && err != errMultipleQuestions) {
+		// Messages with other opcodes needn't have one question, IQUERY
+		// for one has none, and are answered NOTIMP below regardless
+		queriesMalformed.Add(1)
+		l.stats.Add("malformed", 1)
+		slog.Warn("Error unpacking DNS message", "client", addr.String(), "err", err)
+		s.detect.offense(addr.Addr().Unmap().String(), "malformed", start, s.alerts)
+		s.refuseQuestionCount(l, addr, &msg, req, err)
 		return
 	}
-
-	// Check if the request is for the domain we're listening to
-	if strings.EqualFold(msg.Question.Name, s.domain) {
-		// Send DNS response
-		resp := dnsMsg{
-			ID:       msg.ID,
-			Flags:    dnsFlagsResponse,
-			Question: msg.Question,
-			Answers: []dnsResourceRecord{
-				{
-					Name:  s.domain,
-					Type:  dnsTypeA,
-					Class: dnsClassIN,
-					TTL:   3600, // TTL in seconds
-					Data:  net.ParseIP(s.ip),
-				},
-			},
-		}
-
-		respBytes, err := resp.pack()
-		if err != nil {
-			log.Println("Error packing DNS response:", err)
+	q := msg.Question
+	ev := &queryEvent{
+		Time:     start,
+		Client:   addr.Addr().Unmap().String(),
+		Port:     int(addr.Port()),
+		Listener: l.addr,
+		QName:    q.Name,
+		QType:    typeString(q.Type),
+		Opcode:   opcodeString(msg.Flags),
+	}
+	if s.keepWire {
+		ev.Query = bytes.Clone(req) // req's buffer is reused once we return
+	}
+	switch msg.Flags >> 11 & 0xF {
+	case dnsOpcodeQuery:
+	case dnsOpcodeUpdate:
+		s.handleUpdate(l, addr, &msg, req, ev)
+		return
+	case dnsOpcodeNotify:
+		s.handleNotify(l, addr, &msg, req, ev)
+		return
+	default:
+		s.answerNotImp(l, addr, &msg, req, ev)
+		return
+	}
+	var tc *tsigCheck
+	if s.tsig != nil && binary.BigEndian.Uint16(req[10:12]) > 0 {
+		// Signed queries, as from a resolver forwarding to the honeypot
+		// with TSIG, get signed answers
+		var err error
+		if tc, err = s.tsig.check(req, start); err != nil {
+			queriesMalformed.Add(1)
+			l.stats.Add("malformed", 1)
+			slog.Warn("Error unpacking DNS message", "client", addr.String(), "err", err)
+			s.detect.offense(ev.Client, "malformed", start, s.alerts)
+			return
+		}
+		ev.TSIG = tc.verified()
+		if tc.err != nil {
+			s.refuseSigned(l, addr, &msg, tc, ev)
 			return
 		}
+	}
+	if s.fingerprints != nil {
+		ev.Fingerprint, ev.Software = s.fingerprints.observe(addr, &msg, req, start)
+	}
 
-		if _, err := conn.WriteToUDP(respBytes, addr); err != nil {
-			log.Println("Error sending DNS response:", err)
+	// Check if the request is for a domain we're listening to, or a service
+	// we advertise
+	r := s.matchClient(q.Name, addr.Addr(), ev)
+	if r == nil && s.honeytokens != nil {
+		// Answer planted names even without a rule, so a token keeps
+		// looking live to whoever found it
+		if t := s.honeytokens.lookup(q.Name); t != nil {
+			r = &rule{Domain: t.Name()}
+		}
+	}
+	var verdict *queryVerdict
+	if !s.isSelfTest(ev) {
+		for _, d := range s.deciders {
+			if verdict = d.decide(ev, r); verdict != nil {
+				break
+			}
+		}
+	}
+	if verdict == nil && r != nil {
+		// Rules that drop, refuse or forward their names, or the query's
+		// type, act like a decider that chose to
+		verdict = r.verdict(q.Type, s.qtypes)
+	}
+	var records []dnsResourceRecord
+	var isService bool
+	if verdict != nil {
+		r = verdict.rule
+	} else {
+		records, isService = s.serviceRecords(q.Name, q.Type, l.local, addr.Addr().Unmap())
+		if !isService && s.updates != nil {
+			// Names registered by dynamic update are answered like
+			// service hosts, with what was registered
+			records, isService = s.updates.answers(q.Name, q.Type)
+		}
+		if !isService {
+			records, isService = s.axfr.apexRecords(q.Name, q.Type)
+		}
+	}
+	if verdict != nil && verdict.drop && !s.monitor {
+		queriesIgnored.Add(1)
+		ev.Action = "ignored"
+		ev.Rule = r.Domain
+		ev.Latency = time.Since(start)
+		l.stats.Add(ev.Action, 1)
+		s.emit(ev)
+		return
+	}
+	if !s.monitor {
+		switch s.detect.enforce(ev.Client, start) {
+		case "drop":
+			queriesLimited.Add(1)
+			s.detect.offense(ev.Client, "limited", start, s.alerts)
+			ev.Action = "limited"
+			ev.Latency = time.Since(start)
+			l.stats.Add(ev.Action, 1)
+			s.emit(ev)
 			return
+		case "sinkhole":
+			queriesSinkholed.Add(1)
+			r, verdict = s.notice.redirect(tunnelSinkholeRule)
+			isService = false
+		case "quota":
+			queriesSinkholed.Add(1)
+			r, verdict = s.notice.redirect(quotaSinkholeRule)
+			isService = false
+		}
+	}
+	var nxdomain bool
+	var referral string // child zone served elsewhere that q.Name is delegated to
+	if r == nil && !isService && !s.monitor {
+		// Names in a zone the server is authoritative for are answered
+		// here rather than passed through: NODATA if the name exists and
+		// NXDOMAIN if not, except for the zone's name servers, and
+		// referrals for names delegated to zones served elsewhere
+		if zone := s.authority(q.Name); zone != "" {
+			if referral = s.axfr.delegation(q.Name); referral != "" {
+				isService = true
+			} else if ns := s.axfr.nameServerRule(q.Name); ns != nil {
+				r = ns
+			} else {
+				isService, nxdomain = true, !s.nameExists(q.Name, zone)
+			}
 		}
+	}
+	if (r == nil && !isService) || s.monitor {
+		s.passThrough(l, addr, &msg, req, r, ev)
+		return
+	}
 
-		// Log the request
-		log.Printf("[%s] Request for %s from %s\n", time.Now().Format("2006-01-02 15:04:05"), s.domain, addr)
+	// Send DNS response, answering A or AAAA depending on the configured address
+	var answers [1]dnsResourceRecord
+	resp := dnsMsg{
+		ID:       msg.ID,
+		Flags:    dnsFlagsResponse,
+		Question: q,
+	}
+	ttl := uint32(3600) // TTL in seconds
+	if verdict != nil {
+		resp.Flags |= verdict.rcode
+		if verdict.ttl > 0 {
+			ttl = verdict.ttl
+		}
+	}
+	if isService {
+		resp.Answers = records
+	} else if ip := s.answerFor(r, q.Type, l.local, addr.Addr().Unmap()); ip != nil && resp.Flags&0xF == 0 {
+		answers[0] = dnsResourceRecord{
+			Name:  q.Name,
+			Type:  q.Type,
+			Class: dnsClassIN,
+			TTL:   ttl,
+			Data:  ip,
+		}
+		resp.Answers = answers[:]
+	}
+	if nxdomain {
+		resp.Flags |= dnsRcodeNXDomain
+	}
+	if referral != "" {
+		resp.Authority = s.axfr.nsRecords(referral, axfrTTL)
+		resp.Additional = s.glue(referral, l.local, addr.Addr().Unmap())
+	} else if rc := resp.Flags & 0xF; len(resp.Answers) == 0 && (rc == 0 || rc == dnsRcodeNXDomain) {
+		// Negative answers carry the zone's SOA, which tells resolvers how
+		// long to cache them, and which some clients won't trust them without
+		soa := s.negativeSOA(q.Name, r)
+		if q.Type == dnsTypeSOA && rc == 0 && soa.Name == normalizeName(q.Name) {
+			soa.TTL = ttl
+			resp.Answers = []dnsResourceRecord{soa}
+		} else {
+			resp.Authority = []dnsResourceRecord{soa}
+		}
 	}
-}
 
-func getLocalIP() (string, error) {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return "", err
+	if opt, ede := r.edeRecord(req); opt != nil {
+		resp.Additional = append(resp.Additional, *opt)
+		ev.EDE = ede
 	}
 
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-			return ipnet.IP.String(), nil
+	// Over UDP, responses too large for the client, such as referrals with
+	// their glue or DNS-SD answers, are truncated
+	limit := 65535
+	if l.tcp == nil {
+		limit = maxUDPResponse(req)
+	}
+	var scratch [512]byte
+	respBytes, err := resp.appendPackLimit(scratch[:0], limit)
+	if err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error packing DNS response", "client", addr.String(), "qname", q.Name, "err", err)
+		return
+	}
+	if tc != nil {
+		signed := tc.sign(respBytes, time.Now())
+		if len(signed) > limit {
+			// Leave room for the signature
+			respBytes, _ = resp.appendPackLimit(scratch[:0], limit-(len(signed)-len(respBytes)))
+			signed = tc.sign(respBytes, time.Now())
 		}
+		respBytes = signed
 	}
 
-	return "", fmt.Errorf("no local IP address found")
-}
+	if err := l.reply(respBytes, addr); err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending DNS response", "client", addr.String(), "qname", q.Name, "err", err)
+		return
+	}
+	queriesAnswered.Add(1)
 
-type dnsMsg struct {
-	ID       uint16
-	Flags    uint16
-	Question dnsQuestion
-	Answers  []dnsResourceRecord
+	// Log the request
+	ev.Action = "answered"
+	if !isService {
+		ev.Rule = r.Domain
+	}
+	ev.RCode = rcodeString(resp.Flags)
+	if s.keepWire {
+		ev.Response = bytes.Clone(respBytes)
+	}
+	for i := range resp.Answers {
+		ev.Answer = append(ev.Answer, resp.Answers[i].dataString())
+	}
+	if referral != "" {
+		for i := range resp.Authority {
+			ev.Answer = append(ev.Answer, "referral "+resp.Authority[i].dataString())
+		}
+	}
+	ev.Latency = time.Since(start)
+	l.stats.Add(ev.Action, 1)
+	if !isService && r.Canary && !s.isSelfTest(ev) {
+		// Before the event is emitted, which with -ground-truth happens
+		// on another goroutine
+		ev.Feed = r.Feed
+		s.alerts.raise(canaryAlert(ev))
+	}
+	if s.groundTruth && !isService && tc == nil && !s.isSelfTest(ev) {
+		// Signed queries are left out, as upstream doesn't have the key
+		s.emitWithGroundTruth(ev, req)
+	} else {
+		s.emit(ev)
+	}
 }
 
-type dnsQuestion struct {
-	Name  string
-	Type  uint16
-	Class uint16
+// refuseQuestionCount answers a query with no question or several, as
+// scanners send, with FORMERR. Other malformed messages, responses, and
+// anything in monitor mode go unanswered.
+func (s *dnsServer) refuseQuestionCount(l *listener, addr netip.AddrPort, msg *dnsMsg, req []byte, err error) {
+	if (err != errNoQuestion && err != errMultipleQuestions) || msg.Flags&0x8000 != 0 || s.monitor {
+		return
+	}
+	if err := l.reply(formErr(req), addr); err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending DNS response", "client", addr.String(), "err", err)
+	}
 }
 
-type dnsResourceRecord struct {
-	Name  string
-	Type  uint16
-	Class uint16
-	TTL   uint32
-	Data  net.IP
+// opcodeImplemented reports whether messages with the opcode in flags are
+// handled; those with others, such as IQUERY and STATUS, get NOTIMP.
+func opcodeImplemented(flags uint16) bool {
+	switch flags >> 11 & 0xF {
+	case dnsOpcodeQuery, dnsOpcodeNotify, dnsOpcodeUpdate:
+		return true
+	}
+	return false
 }
 
-func (msg *dnsMsg) unpack(data []byte) error {
-	// Ensure data is at least 12 bytes long (DNS header)
-	if len(data) < 12 {
-		return fmt.Errorf("invalid DNS message: message too short")
+// answerNotImp answers a message whose opcode isn't implemented with a
+// header-only NOTIMP, rather than treating it as a query. Responses with such
+// opcodes are ignored.
+func (s *dnsServer) answerNotImp(l *listener, addr netip.AddrPort, msg *dnsMsg, req []byte, ev *queryEvent) {
+	queriesNotImp.Add(1)
+	ev.QType = ev.Opcode
+	ev.Action = "unsupported"
+	defer func() {
+		ev.Latency = time.Since(ev.Time)
+		l.stats.Add(ev.Action, 1)
+		s.emit(ev)
+	}()
+	switch {
+	case msg.Flags&0x8000 != 0:
+		queriesIgnored.Add(1)
+		ev.Action = "ignored"
+		return
+	case s.monitor:
+		queriesMonitored.Add(1)
+		ev.Action = "monitored"
+		return
 	}
+	resp := headerResponse(req, dnsRcodeNotImp)
+	if err := l.reply(resp, addr); err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending DNS response", "client", addr.String(), "opcode", ev.Opcode, "err", err)
+		return
+	}
+	ev.RCode = rcodeString(dnsRcodeNotImp)
+	if s.keepWire {
+		ev.Response = resp
+	}
+}
 
-	// Unpack DNS header
-	msg.ID = binary.BigEndian.Uint16(data[:2])
-	msg.Flags = binary.BigEndian.Uint16(data[2:4])
-
-	// Unpack DNS question section
-	qStart := 12
-	for qStart < len(data) && data[qStart] != 0 {
-		qStart++
+// passThrough handles a query without a spoofed answer: one no rule matches,
+// or any query in monitor mode, where r is the rule that would have answered
+// it. With an upstream resolver the query is forwarded and the real response
+// relayed; otherwise it goes unanswered.
+func (s *dnsServer) passThrough(l *listener, addr netip.AddrPort, msg *dnsMsg, req []byte, r *rule, ev *queryEvent) {
+	var respBytes []byte
+	if s.replay != nil {
+		respBytes = s.replay.lookup(msg, req)
 	}
-	if qStart+4 > len(data) {
-		return fmt.Errorf("invalid DNS message: malformed question section")
+	switch {
+	case r != nil:
+		queriesMonitored.Add(1)
+		ev.Action = "monitored"
+		ev.Rule = r.Domain
+	case respBytes != nil:
+		queriesReplayed.Add(1)
+		ev.Action = "replayed"
+	case s.upstream != nil:
+		ev.Action = "forwarded"
+	default:
+		queriesIgnored.Add(1)
+		ev.Action = "ignored"
 	}
-	msg.Question.Name = string(data[12:qStart])
-	msg.Question.Type = binary.BigEndian.Uint16(data[qStart+1 : qStart+3])
-	msg.Question.Class = binary.BigEndian.Uint16(data[qStart+3 : qStart+5])
 
-	// Other sections are not supported in this example
+	if respBytes == nil && s.upstream != nil {
+		var err error
+		deadline := ev.Time.Add(s.limits.deadline)
+		respBytes, err = s.forward(req, deadline)
+		if err != nil {
+			forwardErrors.Add(1)
+			if errors.Is(err, errQueryDeadline) {
+				queriesDeadline.Add(1)
+			}
+			slog.Warn("Error forwarding query", "client", addr.String(), "qname", msg.Question.Name, "err", err)
+			fail := dnsMsg{ID: msg.ID, Flags: dnsFlagsResponse | dnsRcodeServFail, Question: msg.Question}
+			if _, ok := findOPT(req); ok {
+				fail.Additional = []dnsResourceRecord{ednsOPTRecord(edeNoReachableAuthority, "")}
+				ev.EDE = edeString(edeNoReachableAuthority)
+			}
+			respBytes, _ = fail.pack()
+		} else {
+			queriesForwarded.Add(1)
+			if s.dns64.IsValid() && msg.Question.Type == dnsTypeAAAA {
+				if synth := s.dns64Answer(msg, req, respBytes, deadline); synth != nil {
+					respBytes = synth
+				}
+			}
+			if flat := s.flattenAnswer(msg, respBytes); flat != nil {
+				respBytes = flat
+			}
+			if s.record != nil {
+				s.record.record(msg, respBytes)
+			}
+		}
+	}
+	if respBytes != nil {
+		if l.tcp == nil {
+			respBytes = truncateResponse(respBytes, maxUDPResponse(req))
+		}
+		if err := l.reply(respBytes, addr); err != nil {
+			queryErrors.Add(1)
+			slog.Error("Error sending DNS response", "client", addr.String(), "qname", msg.Question.Name, "err", err)
+		}
+		var resp dnsMsg
+		if resp.unpack(respBytes) == nil {
+			ev.RCode = rcodeString(resp.Flags)
+			for _, rr := range resp.Answers {
+				ev.Answer = append(ev.Answer, rr.Data.String())
+			}
+		}
+		if s.keepWire {
+			ev.Response = respBytes
+		}
+	}
+	ev.Latency = time.Since(ev.Time)
+	l.stats.Add(ev.Action, 1)
+	s.emit(ev)
+}
 
+// answerFor returns the address to answer a qtype query for r from client,
+// arriving on local, with, or nil if the rule has no address of that
+// family. Rules with their own IP or answer template answer only with it;
+// the others use the server defaults. With -dns64, AAAA queries an IPv4
+// address would answer get it under the NAT64 prefix. Rules whose action
+// for qtype isn't to answer have no address.
+func (s *dnsServer) answerFor(r *rule, qtype uint16, local, client netip.Addr) net.IP {
+	if r.actionFor(qtype, s.qtypes) != "answer" {
+		return nil
+	}
+	defaults := s.addrs.Load()
+	ip := defaults.ip
+	switch {
+	case r.addr != nil:
+		ip = r.addr
+	case len(r.pool) > 0:
+		ip = s.steer.pick(r.pool, qtype, client)
+	case r.IP != "":
+		if ip = expandAnswer(r.IP, local, client); ip == nil {
+			return nil
+		}
+	case qtype == dnsTypeAAAA && defaults.ip6 != nil:
+		ip = defaults.ip6
+	}
+	if (qtype == dnsTypeA && ip.To4() != nil) || (qtype == dnsTypeAAAA && ip.To4() == nil) {
+		return ip
+	}
+	if qtype == dnsTypeAAAA && s.dns64.IsValid() {
+		return synthesizeAAAA(s.dns64, ip)
+	}
 	return nil
 }
 
-func (msg *dnsMsg) pack() ([]byte, error) {
-	// Pack DNS header
-	header := make([]byte, 12)
-	binary.BigEndian.PutUint16(header[:2], msg.ID)
-	binary.BigEndian.PutUint16(header[2:4], msg.Flags)
-
-	// Pack DNS question section
-	qName := strings.Split(msg.Question.Name, ".")
-	qNameBytes := make([]byte, 0)
-	for _, label := range qName {
-		qNameBytes = append(qNameBytes, byte(len(label)))
-		qNameBytes = append(qNameBytes, []byte(label)...)
-	}
-	qNameBytes = append(qNameBytes, 0) // Null-terminate domain name
-	qType := make([]byte, 2)
-	binary.BigEndian.PutUint16(qType, msg.Question.Type)
-	qClass := make([]byte, 2)
-	binary.BigEndian.PutUint16(qClass, msg.Question.Class)
-
-	return append(header, append(qNameBytes, append(qType, qClass...)...)...), nil
+func getLocalIP() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no local IP address found")
 }
 
-const (
-	dnsTypeA         = 1
-	dnsClassIN       = 1
-	dnsFlagsResponse = 0x8180 // Response flag
-)
+func getLocalIP6() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no global IPv6 address found")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsGroup is the IPv4 multicast group and port of multicast DNS
+// (RFC 6762).
+var mdnsGroup = netip.MustParseAddrPort("224.0.0.251:5353")
+
+const (
+	mdnsFlagsResponse = 0x8400 // response, authoritative
+	mdnsUnicast       = 0x8000 // top bit of a question's class: unicast response wanted
+	mdnsCacheFlush    = 0x8000 // top bit of a record's class: replaces cached records
+	mdnsTTL           = 120    // RFC 6762 section 10 for host address records
+	mdnsLegacyTTL     = 10     // for one-shot queries from ordinary resolvers
+)
+
+// listenMDNS joins the mDNS group and adds a listener that answers .local
+// rules. Another responder such as Avahi can keep running; both receive
+// every query.
+func (s *dnsServer) listenMDNS() error {
+	l, err := s.listenMulticast(mdnsGroup, "mdns")
+	if err != nil {
+		return err
+	}
+	// Responses go to the group with the TTL RFC 6762 requires, so receivers
+	// can tell they were not forwarded by a router
+	return ipv4.NewPacketConn(l.conn).SetMulticastTTL(255)
+}
+
+// handleMDNS answers an mDNS query for rules and DNS-SD services under
+// .local. Answers go to the
+// group unless every question asked for a unicast response, and queries
+// from a port other than 5353 get an ordinary unicast DNS response, as
+// RFC 6762 section 6.7 describes. mDNS answers are never negative, so names
+// without a rule get no response at all.
+func (s *dnsServer) handleMDNS(l *listener, addr netip.AddrPort, req []byte) {
+	start := time.Now()
+	handlersInFlight.Add(1)
+	defer handlersInFlight.Add(-1)
+	defer func() {
+		if r := recover(); r != nil {
+			queryErrors.Add(1)
+			slog.Error("Recovered in handleMDNS", "client", addr.String(), "panic", r)
+		}
+	}()
+
+	id, flags, questions, err := unpackQuestions(req)
+	if err != nil {
+		queriesReceived.Add(1)
+		l.stats.Add("received", 1)
+		queriesMalformed.Add(1)
+		l.stats.Add("malformed", 1)
+		slog.Debug("Error unpacking mDNS message", "client", addr.String(), "err", err)
+		return
+	}
+	if flags&0x8000 != 0 || flags&0x7800 != 0 {
+		return // other responders' answers, and opcodes other than QUERY
+	}
+	legacy := addr.Port() != mdnsGroup.Port()
+
+	var answers []dnsResourceRecord
+	var answered []dnsQuestion
+	var events []*queryEvent
+	var canaries []*queryEvent
+	unicast := true
+	for _, q := range questions {
+		queriesReceived.Add(1)
+		l.stats.Add("received", 1)
+		ev := &queryEvent{
+			Time:     start,
+			Client:   addr.Addr().Unmap().String(),
+			Port:     int(addr.Port()),
+			Listener: l.addr,
+			QName:    q.Name,
+			QType:    typeString(q.Type),
+			Opcode:   "QUERY",
+			Action:   "ignored",
+		}
+		if s.keepWire {
+			ev.Query = bytes.Clone(req)
+		}
+		events = append(events, ev)
+
+		name := normalizeName(q.Name)
+		r := s.matchClient(name, addr.Addr(), ev)
+		records, isService := s.serviceRecords(name, q.Type, l.local, addr.Addr().Unmap())
+		class := q.Class &^ mdnsUnicast
+		if (r == nil && !isService) || !strings.HasSuffix(name, ".local") || (class != dnsClassIN && class != dnsClassANY) {
+			queriesIgnored.Add(1)
+			continue
+		}
+		if !isService {
+			ev.Rule = r.Domain
+		}
+		if s.monitor {
+			queriesMonitored.Add(1)
+			ev.Action = "monitored"
+			continue
+		}
+
+		if !isService {
+			for _, t := range []uint16{dnsTypeA, dnsTypeAAAA} {
+				if q.Type != t && q.Type != dnsTypeANY {
+					continue
+				}
+				if ip := s.answerFor(r, t, l.local, addr.Addr().Unmap()); ip != nil {
+					records = append(records, dnsResourceRecord{Name: q.Name, Type: t, Class: dnsClassIN, TTL: mdnsTTL, Data: ip})
+				}
+			}
+		}
+		n := len(answers)
+		for _, rr := range records {
+			switch {
+			case legacy:
+				rr.TTL = mdnsLegacyTTL
+			case rr.Type != dnsTypePTR:
+				// PTR records are shared by every instance of a service;
+				// the rest are ours alone
+				rr.Class |= mdnsCacheFlush
+			}
+			answers = append(answers, rr)
+			ev.Answer = append(ev.Answer, rr.dataString())
+		}
+		if len(answers) == n {
+			// A rule without an address of the asked family; an mDNS
+			// responder stays quiet rather than denying the name
+			queriesIgnored.Add(1)
+			continue
+		}
+		ev.Action = "answered"
+		ev.RCode = rcodeString(mdnsFlagsResponse)
+		answered = append(answered, dnsQuestion{Name: q.Name, Type: q.Type, Class: class})
+		unicast = unicast && q.Class&mdnsUnicast != 0
+		if !isService && r.Canary {
+			canaries = append(canaries, ev)
+		}
+	}
+
+	if len(answers) > 0 {
+		to := mdnsGroup
+		if legacy || unicast {
+			to = addr
+		}
+		if !legacy {
+			// Multicast responses carry no ID or questions
+			id, answered = 0, nil
+		}
+		resp, err := packMDNSResponse(id, answered, answers)
+		if err == nil {
+			_, err = l.conn.WriteToUDPAddrPort(resp, to)
+		}
+		if err != nil {
+			queryErrors.Add(1)
+			slog.Error("Error sending mDNS response", "client", addr.String(), "to", to.String(), "err", err)
+			return
+		}
+		for _, ev := range events {
+			if ev.Action == "answered" && s.keepWire {
+				ev.Response = resp
+			}
+		}
+	}
+
+	for _, ev := range events {
+		if ev.Action == "answered" {
+			queriesAnswered.Add(1)
+		}
+		ev.Latency = time.Since(start)
+		l.stats.Add(ev.Action, 1)
+		s.emit(ev)
+	}
+	for _, ev := range canaries {
+		s.alerts.raise(canaryAlert(ev))
+	}
+}
+
+// unpackQuestions decodes the header and every question of a message.
+// Unlike unicast DNS, mDNS clients routinely ask several questions at once.
+func unpackQuestions(data []byte) (id, flags uint16, questions []dnsQuestion, err error) {
+	if len(data) < 12 {
+		return 0, 0, nil, fmt.Errorf("invalid DNS message: message too short")
+	}
+	id = binary.BigEndian.Uint16(data[:2])
+	flags = binary.BigEndian.Uint16(data[2:4])
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(data[4:6])); i++ {
+		var q dnsQuestion
+		if q.Name, off, err = readName(data, off); err != nil {
+			return 0, 0, nil, err
+		}
+		if off+4 > len(data) {
+			return 0, 0, nil, fmt.Errorf("invalid DNS message: malformed question section")
+		}
+		q.Type = binary.BigEndian.Uint16(data[off : off+2])
+		q.Class = binary.BigEndian.Uint16(data[off+2 : off+4])
+		off += 4
+		questions = append(questions, q)
+	}
+	return id, flags, questions, nil
+}
+
+// packMDNSResponse builds a response holding answers, and questions when
+// replying to a legacy resolver.
+func packMDNSResponse(id uint16, questions []dnsQuestion, answers []dnsResourceRecord) ([]byte, error) {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 512), id)
+	buf = binary.BigEndian.AppendUint16(buf, mdnsFlagsResponse)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(questions)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(answers)))
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	var c nameCompressor
+	var err error
+	for _, q := range questions {
+		if buf, err = c.appendName(buf, q.Name); err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, q.Type)
+		buf = binary.BigEndian.AppendUint16(buf, q.Class)
+	}
+	for i := range answers {
+		if buf, err = c.appendRR(buf, &answers[i]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"time"
+)
+
+// Query counters, published through expvar so they show up on /debug/vars.
+var (
+	queriesReceived  = expvar.NewInt("queries_received")
+	queriesAnswered  = expvar.NewInt("queries_answered")
+	queriesIgnored   = expvar.NewInt("queries_ignored")
+	queriesMonitored = expvar.NewInt("queries_monitored")
+	queriesForwarded = expvar.NewInt("queries_forwarded")
+	forwardErrors    = expvar.NewInt("forward_errors")
+	queriesMalformed = expvar.NewInt("queries_malformed")
+	queriesNotImp    = expvar.NewInt("queries_notimp") // opcodes not implemented
+	queriesDropped   = expvar.NewInt("queries_dropped")
+	queryErrors      = expvar.NewInt("query_errors")
+	handlersInFlight = expvar.NewInt("handlers_in_flight")
+)
+
+var startTime = time.Now()
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("uptime_seconds", expvar.Func(func() any {
+		return int64(time.Since(startTime).Seconds())
+	}))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	mirrorSent    = expvar.NewInt("mirror_sent")
+	mirrorDropped = expvar.NewInt("mirror_dropped")
+)
+
+// mirrorSink copies every query, with what the server did about it, to a
+// collector over UDP as it happens, for an IDS or analysis pipeline to see
+// the same traffic as the honeypot. Datagrams are sent from a goroutine of
+// their own and dropped when it falls behind or the collector is down, so
+// mirroring never holds up an answer.
+//
+// In the raw format each query is sent as the client sent it, followed by
+// the response it got, as if the collector were the server. In the json
+// format each is one datagram holding the query's event, with the two
+// messages base64-encoded, so the collector also learns the client's
+// address, the rule and the action.
+type mirrorSink struct {
+	conn   net.Conn
+	format string
+	msgs   chan []byte
+	wg     sync.WaitGroup
+}
+
+// mirrorRecord is a datagram of the json format.
+type mirrorRecord struct {
+	*queryEvent
+	Query    []byte `json:"query"`
+	Response []byte `json:"response,omitempty"`
+}
+
+// newMirrorSink mirrors queries to addr, a host:port, in format, raw or
+// json.
+func newMirrorSink(addr, format string) (*mirrorSink, error) {
+	if format != "raw" && format != "json" {
+		return nil, fmt.Errorf("unknown mirror format %q (want raw or json)", format)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid mirror address %q: %v", addr, err)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &mirrorSink{conn: conn, format: format, msgs: make(chan []byte, 4096)}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *mirrorSink) Write(ev *queryEvent) {
+	if ev.Query == nil {
+		return
+	}
+	if s.format == "json" {
+		b, err := json.Marshal(mirrorRecord{queryEvent: ev, Query: ev.Query, Response: ev.Response})
+		if err != nil {
+			return
+		}
+		s.enqueue(b)
+		return
+	}
+	s.enqueue(ev.Query)
+	if ev.Response != nil {
+		s.enqueue(ev.Response)
+	}
+}
+
+func (s *mirrorSink) enqueue(b []byte) {
+	select {
+	case s.msgs <- b:
+	default:
+		mirrorDropped.Add(1)
+	}
+}
+
+// Close stops the sender after sending what is already queued.
+func (s *mirrorSink) Close() error {
+	close(s.msgs)
+	s.wg.Wait()
+	return s.conn.Close()
+}
+
+func (s *mirrorSink) run() {
+	defer s.wg.Done()
+	var warned time.Time
+	for b := range s.msgs {
+		if _, err := s.conn.Write(b); err != nil {
+			// An unreachable collector fails every write; say so once a minute
+			mirrorDropped.Add(1)
+			if time.Since(warned) > time.Minute {
+				slog.Warn("Mirroring failed", "addr", s.conn.RemoteAddr().String(), "err", err)
+				warned = time.Now()
+			}
+			continue
+		}
+		mirrorSent.Add(1)
+	}
+}
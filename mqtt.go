@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var mqttDropped = expvar.NewInt("mqtt_dropped")
+
+// mqttConfig configures publishing of query events to an MQTT broker.
+// Topic is a text/template over the query event, so events can be split by
+// action or client, e.g. "deceptivedns/{{.Action}}/{{.Client}}".
+type mqttConfig struct {
+	Broker   string `yaml:"broker"` // mqtt://host:1883 or mqtts://host:8883
+	Topic    string `yaml:"topic"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	QoS      int    `yaml:"qos"` // 0 or 1
+	Retain   bool   `yaml:"retain"`
+}
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+
+	mqttKeepalive = 30 * time.Second
+)
+
+// mqttSink publishes one JSON message per query event. It speaks just
+// enough MQTT 3.1.1 to connect, publish at QoS 0 or 1 and keep the session
+// alive, reconnecting with backoff if the broker goes away. QoS 1 messages
+// are not redelivered across reconnects.
+type mqttSink struct {
+	cfg    mqttConfig
+	addr   string
+	tls    *tls.Config
+	topic  *template.Template
+	events chan *queryEvent
+	done   chan struct{}
+	wg     sync.WaitGroup
+	nextID uint16
+}
+
+func newMQTTSink(cfg mqttConfig) (*mqttSink, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid mqtt broker %q", cfg.Broker)
+	}
+	s := &mqttSink{cfg: cfg, addr: u.Host, events: make(chan *queryEvent, 4096), done: make(chan struct{})}
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		if u.Port() == "" {
+			s.addr = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "mqtts", "ssl", "tls":
+		if u.Port() == "" {
+			s.addr = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("unsupported mqtt scheme %q (want mqtt or mqtts)", u.Scheme)
+	}
+	if cfg.QoS != 0 && cfg.QoS != 1 {
+		return nil, fmt.Errorf("unsupported mqtt qos %d (want 0 or 1)", cfg.QoS)
+	}
+	if s.cfg.Topic == "" {
+		s.cfg.Topic = "deceptivedns/queries"
+	}
+	if s.topic, err = template.New("topic").Parse(s.cfg.Topic); err != nil {
+		return nil, fmt.Errorf("invalid mqtt topic template: %v", err)
+	}
+	if s.cfg.ClientID == "" {
+		id := make([]byte, 4)
+		rand.Read(id)
+		s.cfg.ClientID = "deceptivedns-" + hex.EncodeToString(id)
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *mqttSink) Write(ev *queryEvent) {
+	select {
+	case s.events <- ev:
+	default:
+		mqttDropped.Add(1)
+	}
+}
+
+func (s *mqttSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *mqttSink) run() {
+	defer s.wg.Done()
+	backoff := time.Second
+	for {
+		conn, err := s.connect()
+		if err != nil {
+			slog.Warn("MQTT broker unavailable", "broker", s.cfg.Broker, "err", err)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		stopped := s.publishLoop(conn)
+		conn.Close()
+		if stopped {
+			return
+		}
+	}
+}
+
+func (s *mqttSink) connect() (net.Conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if s.tls != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", s.addr, s.tls)
+	} else {
+		conn, err = d.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var vh []byte
+	vh = mqttAppendString(vh, "MQTT")
+	vh = append(vh, 4)  // protocol level 3.1.1
+	flags := byte(0x02) // clean session
+	if s.cfg.Username != "" {
+		flags |= 0x80
+		if s.cfg.Password != "" {
+			flags |= 0x40
+		}
+	}
+	vh = append(vh, flags)
+	vh = binary.BigEndian.AppendUint16(vh, uint16(mqttKeepalive/time.Second))
+	vh = mqttAppendString(vh, s.cfg.ClientID)
+	if s.cfg.Username != "" {
+		vh = mqttAppendString(vh, s.cfg.Username)
+		if s.cfg.Password != "" {
+			vh = mqttAppendString(vh, s.cfg.Password)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttPacket(mqttConnect<<4, vh)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, body, err := readMQTTPacket(bufio.NewReader(conn))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ>>4 != mqttConnack || len(body) < 2 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected packet type %d instead of CONNACK", typ>>4)
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("broker refused connection (return code %d)", body[1])
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("MQTT connected", "broker", s.cfg.Broker)
+	return conn, nil
+}
+
+// publishLoop sends events until the connection breaks (false) or the sink
+// is closed (true). A reader goroutine consumes PUBACK/PINGRESP packets.
+func (s *mqttSink) publishLoop(conn net.Conn) bool {
+	broken := make(chan struct{})
+	go func() {
+		defer close(broken)
+		r := bufio.NewReader(conn)
+		for {
+			if _, _, err := readMQTTPacket(r); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(mqttKeepalive / 2)
+	defer ping.Stop()
+	for {
+		select {
+		case ev := <-s.events:
+			if err := s.publish(conn, ev); err != nil {
+				mqttDropped.Add(1)
+				slog.Warn("MQTT publish failed", "broker", s.cfg.Broker, "err", err)
+				return false
+			}
+		case <-ping.C:
+			if _, err := conn.Write([]byte{mqttPingreq << 4, 0}); err != nil {
+				return false
+			}
+		case <-broken:
+			slog.Warn("MQTT connection lost", "broker", s.cfg.Broker)
+			return false
+		case <-s.done:
+			for drained := false; !drained; {
+				select {
+				case ev := <-s.events:
+					if s.publish(conn, ev) != nil {
+						return true
+					}
+				default:
+					drained = true
+				}
+			}
+			conn.Write([]byte{mqttDisconnect << 4, 0})
+			return true
+		}
+	}
+}
+
+// mqttTopicEscaper replaces the characters that separate topic levels or
+// are wildcards, so a value from a query, such as a name with a "/" in it,
+// fills one level of the topic.
+var mqttTopicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_", "\x00", "_")
+
+// topicEvent returns a copy of ev with its values escaped for a topic.
+func topicEvent(ev *queryEvent) *queryEvent {
+	e := *ev
+	for _, f := range []*string{&e.Client, &e.Listener, &e.QName, &e.QType, &e.Opcode, &e.Action, &e.Rule, &e.Feed, &e.RCode,
+		&e.EDE, &e.TSIG, &e.MAC, &e.Session, &e.TrueRCode, &e.Fingerprint, &e.Software} {
+		*f = mqttTopicEscaper.Replace(*f)
+	}
+	e.Answer = make([]string, len(ev.Answer))
+	for i, a := range ev.Answer {
+		e.Answer[i] = mqttTopicEscaper.Replace(a)
+	}
+	e.TrueAnswer = make([]string, len(ev.TrueAnswer))
+	for i, a := range ev.TrueAnswer {
+		e.TrueAnswer[i] = mqttTopicEscaper.Replace(a)
+	}
+	return &e
+}
+
+func (s *mqttSink) publish(conn net.Conn, ev *queryEvent) error {
+	var topic bytes.Buffer
+	if err := s.topic.Execute(&topic, topicEvent(ev)); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	header := byte(mqttPublish << 4)
+	if s.cfg.Retain {
+		header |= 0x01
+	}
+	body := mqttAppendString(nil, topic.String())
+	if s.cfg.QoS == 1 {
+		header |= 0x02
+		if s.nextID++; s.nextID == 0 {
+			s.nextID = 1
+		}
+		body = binary.BigEndian.AppendUint16(body, s.nextID)
+	}
+	body = append(body, payload...)
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(mqttPacket(header, body))
+	return err
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket prefixes body with the fixed header and variable-length
+// remaining length.
+func mqttPacket(header byte, body []byte) []byte {
+	p := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7F) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if mult *= 128; i >= 3 {
+			return 0, nil, fmt.Errorf("malformed mqtt remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
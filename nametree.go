@@ -0,0 +1,226 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// ruleTable holds rules by key: a nameTree for names and wildcard suffixes,
+// a ruleMap for regular expressions.
+type ruleTable interface {
+	get(key string) *rule
+	set(key string, r *rule)
+	delete(key string)
+	each(fn func(key string, r *rule))
+	len() int
+}
+
+// ruleMap is a ruleTable of the rules with keys that aren't names.
+type ruleMap map[string]*rule
+
+func (m ruleMap) get(key string) *rule    { return m[key] }
+func (m ruleMap) set(key string, r *rule) { m[key] = r }
+func (m ruleMap) delete(key string)       { delete(m, key) }
+func (m ruleMap) len() int                { return len(m) }
+
+func (m ruleMap) each(fn func(key string, r *rule)) {
+	for key, r := range m {
+		fn(key, r)
+	}
+}
+
+// nameTree is a ruleTable keyed by names, normalized, held as a radix tree
+// of their labels from the last down: names sharing a suffix share the
+// path to it, and runs of labels with nothing between them share one
+// node. Finding every entry for a name and its suffixes, as wildcard
+// matching does, is then one walk down the tree, whatever the number of
+// entries. The root holds the entry for "".
+type nameTree struct {
+	root nameNode
+	n    int
+}
+
+type nameNode struct {
+	edge     []string // labels from the parent down to the node, outermost first
+	rule     *rule
+	children map[string]*nameNode // by the first label of their edge
+}
+
+// reverseLabels returns the labels of name, a normalized name, from the
+// last, or none for "".
+func reverseLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	slices.Reverse(labels)
+	return labels
+}
+
+// prevLabel returns the label of name ending at end, the index of a dot or
+// of name's end, and the index it starts at.
+func prevLabel(name string, end int) (string, int) {
+	start := strings.LastIndexByte(name[:end], '.') + 1
+	return name[start:end], start
+}
+
+// walk calls fn, if not nil, with the entry for each of name's suffixes
+// the tree has one for, name itself included, the shortest first, with its
+// key. It returns the entry for name, if any.
+func (t *nameTree) walk(name string, fn func(key string, r *rule)) *rule {
+	n := &t.root
+	if n.rule != nil && fn != nil {
+		fn("", n.rule)
+	}
+	for end := len(name); end > 0; {
+		label, start := prevLabel(name, end)
+		child := n.children[label]
+		if child == nil {
+			return nil
+		}
+		for _, l := range child.edge[1:] {
+			if start == 0 {
+				return nil
+			}
+			if label, start = prevLabel(name, start-1); label != l {
+				return nil
+			}
+		}
+		n = child
+		if n.rule != nil && fn != nil {
+			fn(name[start:], n.rule)
+		}
+		if start == 0 {
+			break
+		}
+		end = start - 1
+	}
+	return n.rule
+}
+
+func (t *nameTree) get(key string) *rule {
+	return t.walk(key, nil)
+}
+
+func (t *nameTree) set(key string, r *rule) {
+	labels := reverseLabels(key)
+	n := &t.root
+	for len(labels) > 0 {
+		child := n.children[labels[0]]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[string]*nameNode)
+			}
+			child = &nameNode{edge: labels}
+			n.children[labels[0]] = child
+			n, labels = child, nil
+			break
+		}
+		common := 0
+		for common < len(child.edge) && common < len(labels) && child.edge[common] == labels[common] {
+			common++
+		}
+		if common < len(child.edge) {
+			// The key ends or turns off partway along the edge, which
+			// splits there
+			mid := &nameNode{edge: child.edge[:common], children: map[string]*nameNode{child.edge[common]: child}}
+			child.edge = child.edge[common:]
+			n.children[labels[0]] = mid
+			child = mid
+		}
+		n, labels = child, labels[common:]
+	}
+	if n.rule == nil {
+		t.n++
+	}
+	n.rule = r
+}
+
+func (t *nameTree) delete(key string) {
+	if t.root.remove(reverseLabels(key)) {
+		t.n--
+	}
+}
+
+// remove deletes the entry for labels below n, reporting whether it had
+// one, and merges away the nodes left with no entry and one child or none.
+func (n *nameNode) remove(labels []string) bool {
+	if len(labels) == 0 {
+		had := n.rule != nil
+		n.rule = nil
+		return had
+	}
+	child := n.children[labels[0]]
+	if child == nil || len(child.edge) > len(labels) || !slices.Equal(child.edge, labels[:len(child.edge)]) {
+		return false
+	}
+	if !child.remove(labels[len(child.edge):]) {
+		return false
+	}
+	if child.rule == nil {
+		switch len(child.children) {
+		case 0:
+			delete(n.children, labels[0])
+		case 1:
+			for _, grandchild := range child.children {
+				grandchild.edge = append(slices.Clip(child.edge), grandchild.edge...)
+				n.children[labels[0]] = grandchild
+			}
+		}
+	}
+	return true
+}
+
+func (t *nameTree) each(fn func(key string, r *rule)) {
+	t.root.until(nil, func(key string, r *rule) bool {
+		fn(key, r)
+		return false
+	})
+}
+
+// below calls fn with the entries for name and the names below it, until
+// fn returns true, and reports whether it did. Only the subtree under name
+// is visited.
+func (t *nameTree) below(name string, fn func(key string, r *rule) bool) bool {
+	labels := reverseLabels(name)
+	var path []string // labels leading to n, but for its own edge
+	n := &t.root
+	for len(labels) > 0 {
+		child := n.children[labels[0]]
+		if child == nil {
+			return false
+		}
+		// name may end partway along the edge, everything past which is
+		// below it
+		k := min(len(child.edge), len(labels))
+		if !slices.Equal(child.edge[:k], labels[:k]) {
+			return false
+		}
+		path = append(path, n.edge...)
+		n, labels = child, labels[k:]
+	}
+	return n.until(path, fn)
+}
+
+// until calls fn with every entry at or below n, whose labels, last first,
+// lead to n, until fn returns true, and reports whether it did.
+func (n *nameNode) until(labels []string, fn func(key string, r *rule) bool) bool {
+	labels = append(labels, n.edge...)
+	if n.rule != nil {
+		name := slices.Clone(labels)
+		slices.Reverse(name)
+		if fn(strings.Join(name, "."), n.rule) {
+			return true
+		}
+	}
+	for _, child := range n.children {
+		if child.until(labels, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *nameTree) len() int {
+	return t.n
+}
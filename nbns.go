@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// NetBIOS name service (RFC 1002 section 4.2), the broadcast name lookup
+// Windows tries after DNS and LLMNR.
+const (
+	nbnsAddr           = "0.0.0.0:137"
+	nbnsTypeNB         = 0x20
+	nbnsFlagsResponse  = 0x8500 // response, authoritative, recursion desired
+	nbnsTTL            = 165    // what Windows uses for its own names
+	nbnsEncodedNameLen = 32
+)
+
+// listenNBNS opens UDP port 137 on every IPv4 address, where broadcast name
+// queries arrive, and adds a listener for it.
+func (s *dnsServer) listenNBNS() error {
+	lc := net.ListenConfig{Control: s.socketOptions}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", nbnsAddr)
+	if err != nil {
+		return err
+	}
+	conn := pc.(*net.UDPConn)
+	l := &listener{conn: conn, addr: conn.LocalAddr().String(), stats: new(expvar.Map), proto: "nbns"}
+	listenerStats.Set(l.addr, l.stats)
+	s.listeners = append(s.listeners, l)
+	return nil
+}
+
+// handleNBNS answers a NetBIOS name query whose name, without its suffix
+// byte, matches a rule, or any name with s.nbnsAll. Like LLMNR, names we
+// don't answer get no response.
+func (s *dnsServer) handleNBNS(l *listener, addr netip.AddrPort, req []byte) {
+	start := time.Now()
+	handlersInFlight.Add(1)
+	defer handlersInFlight.Add(-1)
+	defer func() {
+		if r := recover(); r != nil {
+			queryErrors.Add(1)
+			slog.Error("Recovered in handleNBNS", "client", addr.String(), "panic", r)
+		}
+	}()
+
+	var msg dnsMsg
+	err := msg.unpack(req)
+	var name string
+	var suffix byte
+	if err == nil {
+		name, suffix, err = decodeNetBIOSName(msg.Question.Name)
+	}
+	if err != nil {
+		queriesReceived.Add(1)
+		l.stats.Add("received", 1)
+		queriesMalformed.Add(1)
+		l.stats.Add("malformed", 1)
+		slog.Debug("Error unpacking NetBIOS name query", "client", addr.String(), "err", err)
+		return
+	}
+	// Only name queries; registrations, releases and other hosts' responses
+	// are broadcast too
+	if msg.Flags&0xF800 != 0 || msg.Question.Type != nbnsTypeNB {
+		return
+	}
+	queriesReceived.Add(1)
+	l.stats.Add("received", 1)
+
+	ev := &queryEvent{
+		Time:     start,
+		Client:   addr.Addr().Unmap().String(),
+		Port:     int(addr.Port()),
+		Listener: l.addr,
+		QName:    fmt.Sprintf("%s<%02x>", name, suffix),
+		QType:    "NB",
+		Action:   "ignored",
+	}
+	if s.keepWire {
+		ev.Query = bytes.Clone(req)
+	}
+	var canary bool
+	defer func() {
+		ev.Latency = time.Since(start)
+		l.stats.Add(ev.Action, 1)
+		s.emit(ev)
+		if canary {
+			s.alerts.raise(canaryAlert(ev))
+		}
+	}()
+
+	r := s.matchClient(name, addr.Addr(), ev)
+	if r == nil && s.nbnsAll {
+		r = &rule{} // server defaults
+	}
+	var ip net.IP
+	if r != nil {
+		ip = s.answerFor(r, dnsTypeA, l.local, addr.Addr().Unmap()).To4()
+	}
+	if ip == nil {
+		queriesIgnored.Add(1)
+		return
+	}
+	ev.Rule = r.Domain
+	if s.monitor {
+		queriesMonitored.Add(1)
+		ev.Action = "monitored"
+		return
+	}
+
+	// Positive name query response: no question, one NB record whose data
+	// is the name flags (unique, B-node) and the address
+	resp := binary.BigEndian.AppendUint16(make([]byte, 0, 64), msg.ID)
+	resp = binary.BigEndian.AppendUint16(resp, nbnsFlagsResponse)
+	resp = binary.BigEndian.AppendUint16(resp, 0)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint32(resp, 0)
+	if resp, err = appendName(resp, msg.Question.Name); err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error packing NetBIOS response", "client", addr.String(), "name", ev.QName, "err", err)
+		return
+	}
+	resp = binary.BigEndian.AppendUint16(resp, nbnsTypeNB)
+	resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+	resp = binary.BigEndian.AppendUint32(resp, nbnsTTL)
+	resp = binary.BigEndian.AppendUint16(resp, 6)
+	resp = binary.BigEndian.AppendUint16(resp, 0)
+	resp = append(resp, ip...)
+
+	if _, err := l.conn.WriteToUDPAddrPort(resp, addr); err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending NetBIOS response", "client", addr.String(), "name", ev.QName, "err", err)
+		return
+	}
+	queriesAnswered.Add(1)
+	ev.Action = "answered"
+	ev.RCode = rcodeString(nbnsFlagsResponse)
+	ev.Answer = []string{ip.String()}
+	if s.keepWire {
+		ev.Response = resp
+	}
+	canary = r.Canary
+}
+
+// decodeNetBIOSName undoes the first-level encoding of a NetBIOS name, where
+// each nibble of the 16-byte name is a letter from A to P. It returns the
+// name, lower-cased and without padding, and its suffix byte, which says
+// what kind of service registered it (0x20 for file servers, for example).
+func decodeNetBIOSName(encoded string) (string, byte, error) {
+	label, _, _ := strings.Cut(encoded, ".") // any NetBIOS scope is ignored
+	if len(label) != nbnsEncodedNameLen {
+		return "", 0, fmt.Errorf("invalid NetBIOS name: encoded length %d", len(label))
+	}
+	var raw [nbnsEncodedNameLen / 2]byte
+	for i := range raw {
+		hi, lo := label[2*i]-'A', label[2*i+1]-'A'
+		if hi > 15 || lo > 15 {
+			return "", 0, fmt.Errorf("invalid NetBIOS name: bad character in %q", label)
+		}
+		raw[i] = hi<<4 | lo
+	}
+	name := strings.ToLower(strings.TrimRight(string(raw[:15]), " "))
+	if name == "" {
+		return "", 0, fmt.Errorf("invalid NetBIOS name: empty")
+	}
+	return name, raw[15], nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	neighborMaxAge       = 10 * time.Second // how long the kernel's table is cached
+	neighborMissInterval = time.Second      // how often an unknown address may cause a reread
+)
+
+// neighborTable caches the kernel's ARP and NDP neighbor table, mapping
+// the addresses of clients on the local segments to their link-layer
+// addresses, for rules scoped to devices by MAC.
+type neighborTable struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]net.HardwareAddr
+	loaded  time.Time
+	warned  bool // reading the table failed, and was logged
+}
+
+func (t *neighborTable) lookup(addr netip.Addr) net.HardwareAddr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	hw, ok := t.entries[addr]
+	if age := now.Sub(t.loaded); age > neighborMaxAge || (!ok && age > neighborMissInterval) {
+		entries, err := readNeighbors()
+		if err != nil && !t.warned {
+			slog.Warn("Cannot read the neighbor table; MAC rules only match DHCP clients", "err", err)
+			t.warned = true
+		}
+		t.entries, t.loaded = entries, now
+		hw = t.entries[addr]
+	}
+	return hw
+}
+
+// clientMAC returns the link-layer address of client, from its DHCP lease
+// or else the neighbor table, or nil for clients beyond a router.
+func (s *dnsServer) clientMAC(client netip.Addr) net.HardwareAddr {
+	client = client.Unmap()
+	if hw := s.dhcp.owner(client); hw != nil {
+		return hw
+	}
+	return s.neigh.lookup(client)
+}
+
+// matchClient returns the rule for name that applies to client, as match
+// does: rules listing MACs or OUIs only answer the devices they list, and
+// for others the rule next in precedence stands in. A MAC that had to be
+// looked up is recorded in ev, when given.
+func (s *dnsServer) matchClient(name string, client netip.Addr, ev *queryEvent) *rule {
+	var hw net.HardwareAddr
+	r := s.rules.matchFor(name, func(r *rule) bool {
+		if len(r.macs) == 0 {
+			return true
+		}
+		if hw == nil {
+			if hw = s.clientMAC(client); hw == nil {
+				hw = net.HardwareAddr{} // not known; don't look again
+			} else if ev != nil {
+				ev.MAC = hw.String()
+			}
+		}
+		return macListed(r.macs, hw)
+	})
+	if r == nil && s.wpad && isWPADName(name) {
+		return wpadRule
+	}
+	return r
+}
+
+// scoped reports whether r applies to client, which it does unless r lists
+// MACs or OUIs and client's isn't one of them.
+func (s *dnsServer) scoped(r *rule, client netip.Addr) bool {
+	return len(r.macs) == 0 || macListed(r.macs, s.clientMAC(client))
+}
+
+// macListed reports whether hw is one of macs, or has one of them as its
+// OUI.
+func macListed(macs []net.HardwareAddr, hw net.HardwareAddr) bool {
+	for _, m := range macs {
+		if len(hw) >= len(m) && string(hw[:len(m)]) == string(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMACPrefix parses a rule's MAC entry: a full address, or an OUI of
+// its first three octets, with colons or hyphens between the octets.
+func parseMACPrefix(s string) (net.HardwareAddr, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), "-", ":")
+	if strings.Count(s, ":") == 2 {
+		hw, err := net.ParseMAC(s + ":00:00:00")
+		if err != nil {
+			return nil, fmt.Errorf("invalid OUI %q", s)
+		}
+		return hw[:3], nil
+	}
+	hw, err := net.ParseMAC(s)
+	if err != nil || len(hw) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q", s)
+	}
+	return hw, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// readNeighbors dumps the kernel's neighbor table over netlink, both the
+// IPv4 (ARP) and IPv6 (NDP) entries.
+func readNeighbors() (map[netip.Addr]net.HardwareAddr, error) {
+	b, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[netip.Addr]net.HardwareAddr)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		if state := binary.NativeEndian.Uint16(m.Data[8:10]); state&(unix.NUD_INCOMPLETE|unix.NUD_FAILED|unix.NUD_NOARP) != 0 {
+			continue
+		}
+		var addr netip.Addr
+		var hw net.HardwareAddr
+		for attrs := m.Data[unix.SizeofNdMsg:]; len(attrs) >= 4; {
+			n := int(binary.NativeEndian.Uint16(attrs[:2]))
+			if n < 4 || n > len(attrs) {
+				break
+			}
+			switch binary.NativeEndian.Uint16(attrs[2:4]) {
+			case unix.NDA_DST:
+				addr, _ = netip.AddrFromSlice(attrs[4:n])
+			case unix.NDA_LLADDR:
+				hw = net.HardwareAddr(slices.Clone(attrs[4:n]))
+			}
+			attrs = attrs[min((n+3)&^3, len(attrs)):]
+		}
+		if addr.IsValid() && len(hw) == 6 {
+			out[addr.Unmap()] = hw
+		}
+	}
+	return out, nil
+}
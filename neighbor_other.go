@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"runtime"
+)
+
+// readNeighbors is only implemented on Linux, where netlink exposes the
+// neighbor table; elsewhere MAC rules match DHCP clients only.
+func readNeighbors() (map[netip.Addr]net.HardwareAddr, error) {
+	return nil, errors.New("reading the neighbor table is not supported on " + runtime.GOOS)
+}
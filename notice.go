@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	noticesServed   = expvar.NewInt("notices_served")
+	noticesIssued   = expvar.NewInt("notices_issued")
+	noticesResolved = expvar.NewInt("notices_resolved")
+)
+
+const (
+	noticeMaxTickets = 10000
+	noticeTTL        = 60                 // seconds redirected clients may cache their answers for
+	noticeKeep       = 7 * 24 * time.Hour // tickets are kept after their redirect ends, for the help desk to look up
+)
+
+// noticeAlphabet makes up tokens, without 0, 1, I, L or O, which are easily
+// misread over the phone.
+const noticeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// noticePage is the notification page when the notice section names none.
+const noticePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Your device was redirected</title></head>
+<body>
+<h1>Your device was redirected</h1>
+<p>This device ({{.Client}}) {{.Reason}}, so the network is sending its web traffic here until {{.Until.Format "15:04 on Jan 2"}}.</p>
+<p>You were trying to reach <b>{{.Host}}</b>.</p>
+<p>Please contact {{if .Contact}}{{.Contact}}{{else}}IT{{end}} and give them this reference: <b>{{.Token}}</b></p>
+</body>
+</html>
+`
+
+// noticeReasons says why a client was redirected, by the enforcement that
+// redirected it, for the page.
+var noticeReasons = map[string]string{
+	"sinkhole": "looked like it was tunneling data over DNS",
+	"quota":    "sent more DNS queries than it is allowed",
+}
+
+// noticeConfig is the "notice" section of the config file: telling the
+// people behind sinkholed clients what happened, rather than leaving them
+// with a network that mysteriously stopped working.
+type noticeConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	IP      string `yaml:"ip"`      // of the HTTP sinkhole, to answer redirected clients with, default the -ip answers
+	Page    string `yaml:"page"`    // HTML template file of the page, default a built-in one
+	Contact string `yaml:"contact"` // who to contact, for the page, e.g. "the IT service desk on ext. 4357"
+}
+
+// noticeBoard redirects the clients detection sinkholes, tunneling or over
+// their quota, to the HTTP sinkhole, which serves them a page saying so
+// instead of its usual one, with a reference to quote to the help desk.
+// The help desk looks the reference up in the API, and once the device is
+// seen to, lifts the redirect there.
+type noticeBoard struct {
+	cfg   noticeConfig
+	page  *template.Template
+	rules map[string]*rule // sinkhole rules answering with cfg.IP, by the domain of the one they stand in for
+
+	mu      sync.Mutex
+	tickets map[string]*noticeTicket // by token
+	clients map[string]*noticeTicket // the current ticket of each client, by client
+}
+
+// noticeTicket is a client's redirect as the help desk sees it.
+type noticeTicket struct {
+	Token    string     `json:"token"`
+	Client   string     `json:"client"`
+	Reason   string     `json:"reason"`             // "tunneling" or "quota"
+	Issued   time.Time  `json:"issued"`             // when the page was first shown
+	Until    time.Time  `json:"until"`              // when the redirect ends by itself
+	Views    int        `json:"views"`              // pages shown
+	LastHost string     `json:"last_host"`          // host of the last page request
+	Resolved *time.Time `json:"resolved,omitempty"` // when the redirect was lifted through the API
+}
+
+// noticeData is what the page template is executed with.
+type noticeData struct {
+	Client  string
+	Reason  string // as prose, such as "sent more DNS queries than it is allowed"
+	Host    string // the site the client asked for
+	Until   time.Time
+	Token   string
+	Contact string
+}
+
+// newNoticeBoard returns the board cfg describes, or nil if it isn't
+// enabled. It needs detection that sinkholes clients, which det has.
+func newNoticeBoard(cfg noticeConfig, det detectionConfig) (*noticeBoard, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if !(det.Tunneling.Enabled && det.Tunneling.Action == "sinkhole") && !(det.Quota.Enabled && det.Quota.Action != "alert") {
+		return nil, errors.New("notice: needs detection.tunneling or detection.quota with the sinkhole action")
+	}
+	b := &noticeBoard{
+		cfg:     cfg,
+		rules:   make(map[string]*rule),
+		tickets: make(map[string]*noticeTicket),
+		clients: make(map[string]*noticeTicket),
+	}
+	src := noticePage
+	if cfg.Page != "" {
+		data, err := os.ReadFile(cfg.Page)
+		if err != nil {
+			return nil, fmt.Errorf("notice: %v", err)
+		}
+		src = string(data)
+	}
+	var err error
+	if b.page, err = template.New("notice").Parse(src); err != nil {
+		return nil, fmt.Errorf("notice: page: %v", err)
+	}
+	if err := b.page.Execute(&bytes.Buffer{}, noticeData{}); err != nil {
+		return nil, fmt.Errorf("notice: page: %v", err)
+	}
+	for _, r := range []*rule{tunnelSinkholeRule, quotaSinkholeRule} {
+		c := *r
+		if cfg.IP != "" {
+			if c.addr = net.ParseIP(cfg.IP); c.addr == nil {
+				return nil, fmt.Errorf("notice: invalid ip %q", cfg.IP)
+			}
+			c.IP = cfg.IP
+		}
+		b.rules[r.Domain] = &c
+	}
+	return b, nil
+}
+
+// redirect returns the rule and verdict to answer a sinkholed client's
+// queries with in place of the sinkhole rule r: one answering with the
+// HTTP sinkhole's address, for a short time so the client's cache lets go
+// of it soon after the redirect ends, or r as it is without a board. It
+// is safe on a nil board.
+func (b *noticeBoard) redirect(r *rule) (*rule, *queryVerdict) {
+	if b == nil {
+		return r, nil
+	}
+	r = b.rules[r.Domain]
+	return r, &queryVerdict{rule: r, ttl: noticeTTL}
+}
+
+// view counts a page shown to client for host, returning its ticket for
+// the redirect detection gave reason and until for, issued if it has none
+// yet.
+func (b *noticeBoard) view(client, host, reason string, until, now time.Time) noticeTicket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.clients[client]
+	if t == nil || t.Resolved != nil || !now.Before(t.Until) {
+		if len(b.tickets) >= noticeMaxTickets {
+			b.prune(now)
+		}
+		t = &noticeTicket{Token: b.newToken(), Client: client, Issued: now}
+		b.tickets[t.Token] = t
+		b.clients[client] = t
+		noticesIssued.Add(1)
+	}
+	if reason == "sinkhole" {
+		reason = "tunneling"
+	}
+	t.Reason, t.Until = reason, until
+	t.Views++
+	t.LastHost = host
+	return *t
+}
+
+// newToken returns a token no ticket has, such as "K7QX-2M9P". The caller
+// holds b.mu.
+func (b *noticeBoard) newToken() string {
+	for {
+		var buf [8]byte
+		rand.Read(buf[:])
+		for i := range buf {
+			buf[i] = noticeAlphabet[int(buf[i])%len(noticeAlphabet)]
+		}
+		token := string(buf[:4]) + "-" + string(buf[4:])
+		if _, taken := b.tickets[token]; !taken {
+			return token
+		}
+	}
+}
+
+// prune forgets the tickets kept long enough after their redirect ended,
+// or every ticket whose redirect ended if that isn't enough. The caller
+// holds b.mu.
+func (b *noticeBoard) prune(now time.Time) {
+	for _, keep := range []time.Duration{noticeKeep, 0} {
+		for token, t := range b.tickets {
+			if now.Sub(t.Until) > keep {
+				delete(b.tickets, token)
+				if b.clients[t.Client] == t {
+					delete(b.clients, t.Client)
+				}
+			}
+		}
+		if len(b.tickets) < noticeMaxTickets {
+			return
+		}
+	}
+}
+
+// serve answers a web request from a redirected client with the page,
+// counting the view on its ticket.
+func (b *noticeBoard) serve(w http.ResponseWriter, client, host, reason string, until time.Time) {
+	t := b.view(client, host, reason, until, time.Now())
+	noticesServed.Add(1)
+	slog.Info("Client notice served", "client", client, "host", host, "reason", t.Reason, "token", t.Token, "until", until.Format(time.DateTime))
+
+	var buf bytes.Buffer
+	err := b.page.Execute(&buf, noticeData{
+		Client:  client,
+		Reason:  noticeReasons[reason],
+		Host:    host,
+		Until:   until,
+		Token:   t.Token,
+		Contact: b.cfg.Contact,
+	})
+	if err != nil {
+		slog.Error("Failed to render notice page", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// list returns every ticket kept, the latest first.
+func (b *noticeBoard) list() []noticeTicket {
+	b.mu.Lock()
+	out := make([]noticeTicket, 0, len(b.tickets))
+	for _, t := range b.tickets {
+		out = append(out, *t)
+	}
+	b.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Issued.After(out[j].Issued) })
+	return out
+}
+
+// lookup returns the ticket with token, if kept.
+func (b *noticeBoard) lookup(token string) (noticeTicket, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.tickets[token]
+	if !ok {
+		return noticeTicket{}, false
+	}
+	return *t, true
+}
+
+// resolve marks the ticket with token resolved, returning it, or false if
+// there's no such ticket.
+func (b *noticeBoard) resolve(token string, now time.Time) (noticeTicket, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.tickets[token]
+	if !ok {
+		return noticeTicket{}, false
+	}
+	if t.Resolved == nil {
+		t.Resolved = &now
+		noticesResolved.Add(1)
+	}
+	return *t, true
+}
+
+// redirected returns why client is being sinkholed now, as enforce would
+// say, and until when, or "" if it isn't. Unlike enforce it changes
+// nothing.
+func (d *detectors) redirected(client string, now time.Time) (string, time.Time) {
+	if d.tunnel != nil {
+		if until, ok := d.tunnel.sinkholedUntil(client, now); ok {
+			return "sinkhole", until
+		}
+	}
+	if d.quota != nil {
+		if until, ok := d.quota.sinkholedUntil(client, now); ok {
+			return "quota", until
+		}
+	}
+	return "", time.Time{}
+}
+
+// release ends client's sinkholing, reporting whether it was sinkholed.
+func (d *detectors) release(client string) bool {
+	var released bool
+	if d.tunnel != nil && d.tunnel.release(client) {
+		released = true
+	}
+	if d.quota != nil && d.quota.release(client) {
+		released = true
+	}
+	return released
+}
+
+func (a *apiServer) listNotices(w http.ResponseWriter, r *http.Request) {
+	if a.dns.notice == nil {
+		writeError(w, http.StatusNotFound, "notices are not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.dns.notice.list())
+}
+
+func (a *apiServer) getNotice(w http.ResponseWriter, r *http.Request) {
+	if a.dns.notice == nil {
+		writeError(w, http.StatusNotFound, "notices are not enabled")
+		return
+	}
+	t, ok := a.dns.notice.lookup(r.PathValue("token"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no notice %s", r.PathValue("token"))
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// deleteNotice lifts the redirect of the client the notice in the path
+// was shown to, once the help desk has seen to it, and marks the notice
+// resolved.
+func (a *apiServer) deleteNotice(w http.ResponseWriter, r *http.Request) {
+	if a.dns.notice == nil {
+		writeError(w, http.StatusNotFound, "notices are not enabled")
+		return
+	}
+	t, ok := a.dns.notice.resolve(r.PathValue("token"), time.Now())
+	if !ok {
+		writeError(w, http.StatusNotFound, "no notice %s", r.PathValue("token"))
+		return
+	}
+	released := a.dns.detect.release(t.Client)
+	slog.Info("Notice resolved", "token", t.Token, "client", t.Client, "released", released, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, t)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/netip"
+	"time"
+)
+
+var (
+	notifiesSent     = expvar.NewInt("notifies_sent")
+	notifiesFailed   = expvar.NewInt("notifies_failed")
+	notifiesReceived = expvar.NewInt("notifies_received")
+)
+
+// RFC 1996 constants
+const (
+	dnsOpcodeNotify     = 4
+	notifyCheckInterval = 2 * time.Second // how often the zones are checked for changes
+	notifyTimeout       = 2 * time.Second // per attempt
+	notifyAttempts      = 5
+)
+
+// zoneState is what the zone watcher compares to notice changes cheaply,
+// before hashing the zones themselves.
+type zoneState struct {
+	rules    uint64
+	updates  uint64
+	services *serviceSet
+}
+
+func (s *dnsServer) zoneState() zoneState {
+	return zoneState{s.rules.generation(), s.updates.generation(), s.services.Load()}
+}
+
+// zoneSum hashes the records of zone as every client would see them,
+// leaving out answer templates.
+func (s *dnsServer) zoneSum(zone string) [32]byte {
+	var b []byte
+	for _, rr := range s.zoneRecords(zone, netip.Addr{}, netip.Addr{}) {
+		b, _ = appendRR(b, &rr)
+	}
+	return sha256.Sum256(b)
+}
+
+// startZoneWatch keeps the SOA serials of the zones served by AXFR current:
+// when the rules, services or dynamic updates change what a zone holds, its
+// serial is bumped and its secondaries are sent a NOTIFY.
+func (s *dnsServer) startZoneWatch() {
+	a := s.axfr
+	state := s.zoneState()
+	for _, zone := range a.zones {
+		a.sums[zone] = s.zoneSum(zone)
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		ticker := time.NewTicker(notifyCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-a.stop:
+				return
+			}
+			if next := s.zoneState(); next != state {
+				state = next
+				for _, zone := range a.zones {
+					if serial, changed := a.update(zone, s.zoneSum(zone)); changed {
+						slog.Info("Zone changed", "zone", zone, "serial", serial, "notify", a.notify)
+						for _, target := range a.notify {
+							a.wg.Add(1)
+							go a.sendNotify(zone, target, s.tsig.peerKey(target))
+						}
+					}
+				}
+			}
+		}
+	}()
+}
+
+// update records sum as zone's contents, bumping its serial if they
+// changed. Serials stay at least the current time, as they would be after a
+// restart.
+func (a *axfrServer) update(zone string, sum [32]byte) (uint32, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sums[zone] == sum {
+		return a.serials[zone], false
+	}
+	a.sums[zone] = sum
+	a.serials[zone] = max(a.serials[zone]+1, uint32(time.Now().Unix()))
+	return a.serials[zone], true
+}
+
+// close stops the zone watcher and waits for NOTIFYs being sent.
+func (a *axfrServer) close() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	a.wg.Wait()
+}
+
+// sendNotify tells target that zone has changed, retrying until it
+// acknowledges or the attempts run out. With a key, the NOTIFY is signed
+// and so must the acknowledgement be.
+func (a *axfrServer) sendNotify(zone, target string, key *tsigKey) {
+	defer a.wg.Done()
+	for attempt := 1; ; attempt++ {
+		err := a.notifyOnce(zone, target, key)
+		if err == nil {
+			notifiesSent.Add(1)
+			slog.Info("NOTIFY acknowledged", "zone", zone, "secondary", target)
+			return
+		}
+		if attempt == notifyAttempts {
+			notifiesFailed.Add(1)
+			slog.Warn("NOTIFY failed", "zone", zone, "secondary", target, "attempts", attempt, "err", err)
+			return
+		}
+		select {
+		case <-time.After(notifyTimeout):
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+func (a *axfrServer) notifyOnce(zone, target string, key *tsigKey) error {
+	msg := dnsMsg{
+		ID:       uint16(rand.Uint32()),
+		Flags:    dnsOpcodeNotify<<11 | 0x0400, // authoritative
+		Question: dnsQuestion{Name: zone, Type: dnsTypeSOA, Class: dnsClassIN},
+		Answers:  []dnsResourceRecord{a.soa(zone)},
+	}
+	req, err := msg.pack()
+	if err != nil {
+		return err
+	}
+	var signer *tsigSigner
+	if key != nil {
+		signer = newTSIGSigner(key, nil)
+		req = signer.sign(req, time.Now())
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n < 12 || binary.BigEndian.Uint16(buf[:2]) != msg.ID {
+			continue
+		}
+		flags := binary.BigEndian.Uint16(buf[2:4])
+		if flags&0x8000 == 0 || flags>>11&0xF != dnsOpcodeNotify {
+			continue
+		}
+		if flags&0xF != 0 {
+			return errors.New("answered " + rcodeString(flags))
+		}
+		if signer == nil {
+			return nil
+		}
+		unsigned, sig, err := splitTSIG(buf[:n])
+		switch {
+		case err != nil:
+			return err
+		case sig == nil:
+			return errors.New("acknowledgement not signed")
+		case sig.key != key.name:
+			return errTSIGBadKey
+		}
+		return key.verify(unsigned, sig, signer.prior, time.Now())
+	}
+}
+
+// handleNotify answers a NOTIFY message. In forward and replay modes,
+// NOTIFYs from the masters (-masters, or else the -forward resolver) are
+// acknowledged, and the answers recorded for the zone are dropped, so
+// queries for it are asked upstream again; other senders are refused, and
+// outside those modes the server is nobody's secondary. All are logged.
+func (s *dnsServer) handleNotify(l *listener, addr netip.AddrPort, msg *dnsMsg, req []byte, ev *queryEvent) {
+	notifiesReceived.Add(1)
+	ev.QType = "NOTIFY"
+	ev.Action = "notify"
+	defer func() {
+		ev.Latency = time.Since(ev.Time)
+		l.stats.Add(ev.Action, 1)
+		s.emit(ev)
+	}()
+	if s.monitor {
+		queriesMonitored.Add(1)
+		ev.Action = "monitored"
+		return
+	}
+
+	tc, err := s.tsig.check(req, ev.Time)
+	if err != nil {
+		queriesMalformed.Add(1)
+		slog.Warn("Error unpacking NOTIFY", "client", addr.String(), "err", err)
+		ev.Action = "ignored"
+		return
+	}
+	ev.TSIG = tc.verified()
+	var rcode uint16
+	switch {
+	case tc.err != nil:
+		rcode = dnsRcodeNotAuth
+	case s.upstream == nil && s.replay == nil:
+		rcode = dnsRcodeNotAuth
+	case !prefixesContain(s.masters, addr.Addr().Unmap()):
+		rcode = dnsRcodeRefused
+	default:
+		zone := normalizeName(msg.Question.Name)
+		snaps := []*snapshot{s.replay}
+		if s.record != s.replay {
+			snaps = append(snaps, s.record)
+		}
+		forgotten := 0
+		for _, snap := range snaps {
+			if snap != nil {
+				forgotten += snap.forget(zone)
+			}
+		}
+		ev.Answer = []string{fmt.Sprintf("%d recorded answers dropped", forgotten)}
+		slog.Info("Zone changed upstream", "zone", zone, "master", addr.Addr().Unmap().String(), "answers_dropped", forgotten)
+	}
+
+	resp := dnsMsg{ID: msg.ID, Flags: 0x8000 | dnsOpcodeNotify<<11 | 0x0400 | rcode, Question: msg.Question}
+	var scratch [512]byte
+	respBytes, err := resp.appendPack(scratch[:0])
+	if err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error packing NOTIFY response", "client", addr.String(), "zone", msg.Question.Name, "err", err)
+		return
+	}
+	respBytes = tc.sign(respBytes, time.Now())
+	if err := l.reply(respBytes, addr); err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending NOTIFY response", "client", addr.String(), "zone", msg.Question.Name, "err", err)
+		return
+	}
+	ev.RCode = rcodeString(resp.Flags)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// levelTrace is below debug: -log-level trace also logs an annotated hex
+// dump of every query received and response sent.
+const levelTrace = slog.LevelDebug - 4
+
+// dumpSink logs the wire messages of each event at levelTrace, one record
+// per dump line so that every log handler keeps them readable.
+type dumpSink struct{}
+
+func (dumpSink) Write(ev *queryEvent) {
+	if ev.Query != nil {
+		logDump(ev, "query", ev.Query)
+	}
+	if ev.Response != nil {
+		logDump(ev, "response", ev.Response)
+	}
+}
+
+func (dumpSink) Close() error { return nil }
+
+func logDump(ev *queryEvent, dir string, msg []byte) {
+	var id string
+	if len(msg) >= 2 {
+		id = fmt.Sprintf("%#04x", binary.BigEndian.Uint16(msg))
+	}
+	for _, line := range dumpMessage(msg) {
+		slog.Log(context.Background(), levelTrace, "packet", "dir", dir, "client", ev.Client, "port", ev.Port, "id", id, "line", line)
+	}
+}
+
+// dumpMessage returns an annotated hex dump of a DNS message: the decoded
+// header, then each question and record, each followed by its bytes. A
+// message that fails to decode has its remaining bytes dumped after the
+// error.
+func dumpMessage(msg []byte) []string {
+	lines := []string{fmt.Sprintf("%d bytes", len(msg))}
+	if len(msg) < 12 {
+		lines = append(lines, "malformed: message shorter than a header")
+		return appendHexLines(lines, msg, 0, len(msg))
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	bit := func(mask uint16) int {
+		if flags&mask != 0 {
+			return 1
+		}
+		return 0
+	}
+	var counts [4]int // question, answer, authority, additional
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+	lines = append(lines, fmt.Sprintf("header id=%d qr=%d opcode=%s aa=%d tc=%d rd=%d ra=%d z=%d ad=%d cd=%d rcode=%s qdcount=%d ancount=%d nscount=%d arcount=%d",
+		binary.BigEndian.Uint16(msg), bit(0x8000), opcodeString(flags), bit(0x0400), bit(0x0200), bit(0x0100), bit(0x0080), bit(0x0040),
+		bit(0x0020), bit(0x0010), rcodeString(flags), counts[0], counts[1], counts[2], counts[3]))
+	lines = appendHexLines(lines, msg, 0, 12)
+
+	off := 12
+	malformed := func(err string) []string {
+		lines = append(lines, "malformed: "+err)
+		return appendHexLines(lines, msg, off, len(msg))
+	}
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return malformed(err.Error())
+		}
+		if next+4 > len(msg) {
+			return malformed("truncated question")
+		}
+		lines = append(lines, fmt.Sprintf(";; question %s. %s %s", name,
+			classString(binary.BigEndian.Uint16(msg[next+2:])), typeString(binary.BigEndian.Uint16(msg[next:]))))
+		lines = appendHexLines(lines, msg, off, next+4)
+		off = next + 4
+	}
+	for s, section := range []string{"answer", "authority", "additional"} {
+		for i := 0; i < counts[1+s]; i++ {
+			name, next, err := readName(msg, off)
+			if err != nil {
+				return malformed(err.Error())
+			}
+			if next+10 > len(msg) {
+				return malformed("truncated resource record")
+			}
+			typ := binary.BigEndian.Uint16(msg[next:])
+			class := binary.BigEndian.Uint16(msg[next+2:])
+			ttl := binary.BigEndian.Uint32(msg[next+4:])
+			rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+			if next+10+rdlen > len(msg) {
+				return malformed("record data runs past end of message")
+			}
+			data := rdataString(msg, next+10, rdlen, typ)
+			if typ == 41 { // OPT: the class is the sender's UDP payload size
+				lines = append(lines, fmt.Sprintf(";; %s OPT udp=%d ttl=%d data=%s", section, class, ttl, data))
+			} else {
+				lines = append(lines, fmt.Sprintf(";; %s %s. %d %s %s %s", section, name, ttl, classString(class), typeString(typ), data))
+			}
+			lines = appendHexLines(lines, msg, off, next+10+rdlen)
+			off = next + 10 + rdlen
+		}
+	}
+	if off < len(msg) {
+		lines = append(lines, fmt.Sprintf(";; trailing %d bytes", len(msg)-off))
+		lines = appendHexLines(lines, msg, off, len(msg))
+	}
+	return lines
+}
+
+// appendHexLines appends msg[from:to] to lines as hexdump -C does, sixteen
+// bytes a line with their offset in the message and their ASCII.
+func appendHexLines(lines []string, msg []byte, from, to int) []string {
+	for start := from; start < to; start += 16 {
+		end := min(start+16, to)
+		var hex, ascii strings.Builder
+		for i := start; i < start+16; i++ {
+			if i == start+8 {
+				hex.WriteByte(' ')
+			}
+			if i >= end {
+				hex.WriteString("   ")
+				continue
+			}
+			fmt.Fprintf(&hex, "%02x ", msg[i])
+			if c := msg[i]; c >= 0x20 && c <= 0x7e {
+				ascii.WriteByte(c)
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%04x  %s |%s|", start, hex.String(), ascii.String()))
+	}
+	return lines
+}
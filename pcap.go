@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+var pcapDropped = expvar.NewInt("pcap_dropped")
+
+// linktypeRaw marks packets as bare IPv4/IPv6 datagrams with no link layer.
+const linktypeRaw = 101
+
+// pcapSink writes every query and response to a rotating pcap file. The
+// server never sees the packets' IP and UDP headers, so they are synthesized
+// from the client and listener addresses; Wireshark decodes the result as
+// ordinary DNS over UDP.
+type pcapSink struct {
+	file     *rotatingFile
+	serverIP net.IP
+	packets  chan []byte
+	wg       sync.WaitGroup
+}
+
+// newPCAPSink opens path for capture. serverIP is used as the source of
+// responses when the listener is bound to the unspecified address.
+func newPCAPSink(path string, maxSizeMB, keep int, serverIP net.IP) (*pcapSink, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4) // microsecond timestamps
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535) // snaplen
+	binary.LittleEndian.PutUint32(hdr[20:24], linktypeRaw)
+
+	f := &rotatingFile{path: path, maxSize: int64(maxSizeMB) << 20, keep: keep, header: hdr}
+	if err := f.start(); err != nil {
+		return nil, err
+	}
+	s := &pcapSink{file: f, serverIP: serverIP, packets: make(chan []byte, 4096)}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *pcapSink) Write(ev *queryEvent) {
+	client := net.ParseIP(ev.Client)
+	server, serverPort := s.serverIP, 53
+	if host, port, err := net.SplitHostPort(ev.Listener); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			server = ip
+		}
+		if p, err := net.LookupPort("udp", port); err == nil {
+			serverPort = p
+		}
+	}
+	// Keep both ends in the same address family
+	if (client.To4() == nil) != (server.To4() == nil) {
+		if client.To4() == nil {
+			server = net.IPv6loopback
+		} else {
+			server = net.IPv4(127, 0, 0, 1)
+		}
+	}
+
+	if ev.Query != nil {
+		s.enqueue(pcapRecord(ev.Time, client, server, ev.Port, serverPort, ev.Query))
+	}
+	if ev.Response != nil {
+		s.enqueue(pcapRecord(ev.Time.Add(ev.Latency), server, client, serverPort, ev.Port, ev.Response))
+	}
+}
+
+func (s *pcapSink) enqueue(rec []byte) {
+	select {
+	case s.packets <- rec:
+	default:
+		pcapDropped.Add(1)
+	}
+}
+
+func (s *pcapSink) run() {
+	defer s.wg.Done()
+	for rec := range s.packets {
+		if _, err := s.file.Write(rec); err != nil {
+			pcapDropped.Add(1)
+			slog.Error("Failed to write pcap record", "err", err)
+		}
+	}
+}
+
+func (s *pcapSink) Close() error {
+	close(s.packets)
+	s.wg.Wait()
+	return s.file.Close()
+}
+
+// pcapRecord returns a pcap record header followed by an IP/UDP packet
+// carrying payload.
+func pcapRecord(ts time.Time, src, dst net.IP, srcPort, dstPort int, payload []byte) []byte {
+	udpLen := 8 + len(payload)
+	var pkt []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45 // version 4, 20-byte header
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+udpLen))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip, 0))
+		pkt = append(ip, udpHeader(srcPort, dstPort, payload, nil)...)
+	} else {
+		ip := make([]byte, 40)
+		ip[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(ip[4:6], uint16(udpLen))
+		ip[6] = 17 // next header: UDP
+		ip[7] = 64 // hop limit
+		copy(ip[8:24], src.To16())
+		copy(ip[24:40], dst.To16())
+		pkt = append(ip, udpHeader(srcPort, dstPort, payload, ip[8:40])...)
+	}
+	pkt = append(pkt, payload...)
+
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(pkt)))
+	return append(rec, pkt...)
+}
+
+// udpHeader builds a UDP header. The checksum is optional over IPv4 and left
+// zero there; over IPv6 it is mandatory, so addrs carries the IPv6 source
+// and destination for the pseudo-header.
+func udpHeader(srcPort, dstPort int, payload, addrs []byte) []byte {
+	h := make([]byte, 8)
+	binary.BigEndian.PutUint16(h[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(h[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(h[4:6], uint16(8+len(payload)))
+	if addrs != nil {
+		pseudo := make([]byte, 0, 40)
+		pseudo = append(pseudo, addrs...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(8+len(payload)))
+		pseudo = append(pseudo, 0, 0, 0, 17)
+		sum := ipChecksum(h, ipChecksum(pseudo, 0)^0xffff)
+		sum = ipChecksum(payload, sum^0xffff)
+		if sum == 0 {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(h[6:8], sum)
+	}
+	return h
+}
+
+// ipChecksum computes the Internet checksum of b, continuing from the
+// partial (non-complemented) sum initial.
+func ipChecksum(b []byte, initial uint16) uint16 {
+	sum := uint32(initial)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pdnsDropped = expvar.NewInt("pdns_dropped")
+
+const pdnsSchema = `
+CREATE TABLE IF NOT EXISTS pdns (
+	rrname     TEXT NOT NULL,
+	rrtype     TEXT NOT NULL,
+	rdata      TEXT NOT NULL,
+	time_first INTEGER NOT NULL, -- unix seconds
+	time_last  INTEGER NOT NULL,
+	count      INTEGER NOT NULL,
+	PRIMARY KEY (rrname, rrtype, rdata)
+);
+CREATE INDEX IF NOT EXISTS pdns_rdata ON pdns(rdata);
+CREATE INDEX IF NOT EXISTS pdns_time_last ON pdns(time_last);
+`
+
+// pdnsRecord is one observed record with when it was first and last seen,
+// in the passive DNS Common Output Format (draft-dulaunoy-dnsop-passive-dns-cof).
+type pdnsRecord struct {
+	RRName    string `json:"rrname"`
+	RRType    string `json:"rrtype"`
+	RData     string `json:"rdata"`
+	TimeFirst int64  `json:"time_first"`
+	TimeLast  int64  `json:"time_last"`
+	Count     int64  `json:"count"`
+}
+
+// passiveDNS is an event sink that keeps every record seen in forwarded
+// upstream answers, with first and last seen times and a count. Like the
+// query log, events are queued and written in batches.
+type passiveDNS struct {
+	db     *sql.DB
+	events chan *queryEvent
+	wg     sync.WaitGroup
+}
+
+func openPDNSDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", sqliteDSN(path, "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(pdnsSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func newPassiveDNS(path string) (*passiveDNS, error) {
+	db, err := openPDNSDB(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &passiveDNS{db: db, events: make(chan *queryEvent, 8192)}
+	p.wg.Add(1)
+	go p.run()
+	return p, nil
+}
+
+// Write queues ev if it carries an upstream response. Our own answers,
+// and replayed ones, say nothing about the real namespace.
+func (p *passiveDNS) Write(ev *queryEvent) {
+	if ev.Response == nil || (ev.Action != "forwarded" && ev.Action != "monitored") {
+		return
+	}
+	select {
+	case p.events <- ev:
+	default:
+		pdnsDropped.Add(1)
+	}
+}
+
+// Close flushes queued events and closes the database.
+func (p *passiveDNS) Close() error {
+	close(p.events)
+	p.wg.Wait()
+	return p.db.Close()
+}
+
+func (p *passiveDNS) run() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(queryLogFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*queryEvent, 0, queryLogBatchSize)
+	for {
+		select {
+		case ev, ok := <-p.events:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			if batch = append(batch, ev); len(batch) >= queryLogBatchSize {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			p.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (p *passiveDNS) flush(batch []*queryEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := p.upsert(pdnsObservations(batch)); err != nil {
+		pdnsDropped.Add(int64(len(batch)))
+		slog.Error("Failed to write passive DNS batch", "events", len(batch), "err", err)
+	}
+}
+
+// pdnsObservations collects the answer records of the responses in batch,
+// merging repeats so each tuple is written once.
+func pdnsObservations(batch []*queryEvent) map[[3]string]*pdnsRecord {
+	seen := make(map[[3]string]*pdnsRecord)
+	for _, ev := range batch {
+		resp, err := parseResponse(ev.Response)
+		if err != nil {
+			continue
+		}
+		ts := ev.Time.Unix()
+		for _, rr := range resp.sections[0] {
+			key := [3]string{normalizeName(rr.name), typeString(rr.typ), rr.data}
+			if r, ok := seen[key]; ok {
+				r.TimeLast = max(r.TimeLast, ts)
+				r.Count++
+				continue
+			}
+			seen[key] = &pdnsRecord{RRName: key[0], RRType: key[1], RData: key[2], TimeFirst: ts, TimeLast: ts, Count: 1}
+		}
+	}
+	return seen
+}
+
+func (p *passiveDNS) upsert(records map[[3]string]*pdnsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO pdns (rrname, rrtype, rdata, time_first, time_last, count)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (rrname, rrtype, rdata) DO UPDATE SET
+			time_first = min(time_first, excluded.time_first),
+			time_last = max(time_last, excluded.time_last),
+			count = count + excluded.count`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		if _, err := stmt.Exec(r.RRName, r.RRType, r.RData, r.TimeFirst, r.TimeLast, r.Count); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// pdnsFilter selects passive DNS records. Name and RData may contain * to
+// match any characters.
+type pdnsFilter struct {
+	Name  string
+	Type  string
+	RData string
+	Since time.Time
+	Limit int
+}
+
+// queryPDNS returns the records matching f, most recently seen first.
+func queryPDNS(db *sql.DB, f pdnsFilter) ([]pdnsRecord, error) {
+	where := []string{"1=1"}
+	var params []any
+	if f.Name != "" {
+		where = append(where, `rrname LIKE ? ESCAPE '\'`)
+		params = append(params, globToLike(normalizeName(f.Name)))
+	}
+	if f.Type != "" {
+		where = append(where, "rrtype = ?")
+		params = append(params, strings.ToUpper(f.Type))
+	}
+	if f.RData != "" {
+		where = append(where, `rdata LIKE ? ESCAPE '\'`)
+		params = append(params, globToLike(f.RData))
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "time_last >= ?")
+		params = append(params, f.Since.Unix())
+	}
+	query := `SELECT rrname, rrtype, rdata, time_first, time_last, count
+		FROM pdns WHERE ` + strings.Join(where, " AND ") + ` ORDER BY time_last DESC`
+	if f.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", f.Limit)
+	}
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []pdnsRecord{}
+	for rows.Next() {
+		var r pdnsRecord
+		if err := rows.Scan(&r.RRName, &r.RRType, &r.RData, &r.TimeFirst, &r.TimeLast, &r.Count); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// passiveDNSRecords serves GET /api/pdns?name=&type=&rdata=&since=&limit=.
+func (a *apiServer) passiveDNSRecords(w http.ResponseWriter, r *http.Request) {
+	if a.dns.pdns == nil {
+		writeError(w, http.StatusNotFound, "passive DNS collection is not enabled; start the server with -pdns")
+		return
+	}
+	q := r.URL.Query()
+	f := pdnsFilter{Name: q.Get("name"), Type: q.Get("type"), RData: q.Get("rdata"), Limit: 1000}
+	if f.Name == "" && f.RData == "" {
+		writeError(w, http.StatusBadRequest, "name or rdata is required")
+		return
+	}
+	if s := q.Get("since"); s != "" {
+		t, err := parseTimeBound(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		f.Since = t
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid limit %q", s)
+			return
+		}
+		f.Limit = n
+	}
+	records, err := queryPDNS(a.dns.pdns.db, f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// pdnsCommand implements "pdns", which looks up names or addresses in the
+// passive DNS database written by -pdns, e.g.
+//
+//	DeceptiveDNS pdns -db pdns.db -name '*.example.com'
+//	DeceptiveDNS pdns -db pdns.db -rdata 203.0.113.7
+func pdnsCommand(args []string) int {
+	fs := flag.NewFlagSet("pdns", flag.ContinueOnError)
+	dbPath := fs.String("db", "pdns.db", "Passive DNS database to search")
+	name := fs.String("name", "", "Only show records owned by this name; * matches any characters")
+	rtype := fs.String("type", "", "Only show records of this type, e.g. A or CNAME")
+	rdata := fs.String("rdata", "", "Only show records with this data, e.g. an address; * matches any characters")
+	since := fs.String("since", "", "Only show records seen since this duration (e.g. 24h) or RFC 3339 time")
+	limit := fs.Int("limit", 100, "Maximum number of rows to print (0 for no limit)")
+	format := fs.String("format", "table", "Output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	f := pdnsFilter{Name: *name, Type: *rtype, RData: *rdata, Limit: *limit}
+	if *since != "" {
+		t, err := parseTimeBound(*since)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		f.Since = t
+	}
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		fmt.Println("Cannot open passive DNS database:", err)
+		return 1
+	}
+	db, err := openPDNSDB(*dbPath)
+	if err != nil {
+		fmt.Println("Cannot open passive DNS database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	records, err := queryPDNS(db, f)
+	if err != nil {
+		fmt.Println("Query failed:", err)
+		return 1
+	}
+
+	switch *format {
+	case "json":
+		// One COF object per line, as passive DNS services return them
+		enc := json.NewEncoder(os.Stdout)
+		for i := range records {
+			enc.Encode(&records[i])
+		}
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "RRNAME\tRRTYPE\tRDATA\tFIRST SEEN\tLAST SEEN\tCOUNT")
+		for _, r := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", r.RRName, r.RRType, r.RData,
+				time.Unix(r.TimeFirst, 0).Format("2006-01-02 15:04:05"),
+				time.Unix(r.TimeLast, 0).Format("2006-01-02 15:04:05"), r.Count)
+		}
+		tw.Flush()
+	default:
+		fmt.Println("Unknown output format:", *format)
+		return 2
+	}
+	return 0
+}
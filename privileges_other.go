@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+func dropPrivileges(username, dir string) error {
+	return errors.New("-user and -chroot are not supported on " + runtime.GOOS)
+}
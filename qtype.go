@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// qtypeActions are what a query type policy can do with the queries of a
+// type: what rule actions do, or answer NOERROR with no records, or pass
+// the query through to the -forward resolvers as if no rule matched.
+var qtypeActions = []string{"answer", "nodata", "nxdomain", "refused", "servfail", "drop", "forward"}
+
+// qtypeAny keys the policy for the types a qtypePolicy doesn't name. No
+// query asks for type 0, which is reserved.
+const qtypeAny = 0
+
+// qtypePolicy is what to do with the queries of each type for a name a
+// rule matches, from the top-level "qtypes" section of the config file or
+// a rule's own, such as {AAAA: nodata, ANY: refused, TXT: forward}. "*"
+// covers the types not named.
+type qtypePolicy map[uint16]string
+
+// parseQTypePolicy parses the qtypes of the config file or a rule, keyed by
+// type name, TYPEnnn, number or "*".
+func parseQTypePolicy(m map[string]string) (qtypePolicy, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	p := make(qtypePolicy, len(m))
+	for name, action := range m {
+		t, ok := uint16(qtypeAny), name == "*"
+		if !ok {
+			if t, ok = parseType(name); !ok || t == qtypeAny {
+				return nil, fmt.Errorf("qtypes: unknown query type %q", name)
+			}
+		}
+		action = strings.ToLower(action)
+		if !slices.Contains(qtypeActions, action) {
+			return nil, fmt.Errorf("qtypes: %s: unknown action %q (want %s)", name, action, strings.Join(qtypeActions, ", "))
+		}
+		if _, dup := p[t]; dup {
+			return nil, fmt.Errorf("qtypes: %s is given twice", typeString(t))
+		}
+		p[t] = action
+	}
+	return p, nil
+}
+
+// String formats p as "AAAA nodata, ANY refused", with "*" last.
+func (p qtypePolicy) String() string {
+	var parts []string
+	for t, a := range p {
+		if t != qtypeAny {
+			parts = append(parts, typeString(t)+" "+a)
+		}
+	}
+	slices.Sort(parts)
+	if a, ok := p[qtypeAny]; ok {
+		parts = append(parts, "* "+a)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// lookup returns the action for qtype, or "" if p says nothing about it.
+func (p qtypePolicy) lookup(qtype uint16) string {
+	if a, ok := p[qtype]; ok {
+		return a
+	}
+	return p[qtypeAny]
+}
+
+// actionFor returns what r does with a qtype query: what its own qtypes
+// say, or if nothing, its action, or for rules that answer, what the
+// server's qtypes say, answering by default. Answering a type other than
+// A and AAAA, which rules have no records of, is answering with none.
+func (r *rule) actionFor(qtype uint16, global qtypePolicy) string {
+	if a := r.policy.lookup(qtype); a != "" {
+		return a
+	}
+	if !r.answers() {
+		return r.Action
+	}
+	if a := global.lookup(qtype); a != "" {
+		return a
+	}
+	return "answer"
+}
+
+// verdict returns what r does to a qtype query, as a decider would choose
+// it, or nil if r answers it, with its address or with no records.
+func (r *rule) verdict(qtype uint16, global qtypePolicy) *queryVerdict {
+	switch a := r.actionFor(qtype, global); a {
+	case "answer", "nodata":
+		return nil
+	case "forward":
+		return &queryVerdict{} // passed through
+	default:
+		return &queryVerdict{rule: r, rcode: ruleActions[a], drop: a == "drop"}
+	}
+}
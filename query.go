@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryCommand implements "query", a small dig replacement for checking
+// rules on hosts without DNS tools installed, e.g.
+//
+//	DeceptiveDNS query -server 127.0.0.1 example.com MX
+func queryCommand(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	server := fs.String("server", "127.0.0.1:53", "Server to query, host or host:port")
+	qtype := fs.String("type", "A", "Record type, by name (MX) or number (TYPE65 or 65)")
+	qclass := fs.String("class", "IN", "Query class: IN, CH, HS or ANY")
+	reverse := fs.Bool("x", false, "Treat the name as an IP address and look up its PTR record")
+	useTCP := fs.Bool("tcp", false, "Query over TCP instead of UDP")
+	noRecurse := fs.Bool("norecurse", false, "Clear the recursion desired flag")
+	edns := fs.Bool("edns", false, "Send an EDNS OPT record, as resolvers do, so responses can carry extended errors")
+	short := fs.Bool("short", false, "Print only the answer data")
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for an answer")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "usage: DeceptiveDNS query [flags] name [type]")
+		return 2
+	}
+	name := fs.Arg(0)
+	if fs.NArg() == 2 {
+		*qtype = fs.Arg(1)
+	}
+	if *reverse {
+		ptr, err := reverseName(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		name, *qtype = ptr, "PTR"
+	}
+	t, ok := parseType(*qtype)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown record type %q\n", *qtype)
+		return 2
+	}
+	c, ok := parseClass(*qclass)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown class %q\n", *qclass)
+		return 2
+	}
+	addr := withDefaultPort(*server, "53")
+
+	var id [2]byte
+	rand.Read(id[:])
+	q := dnsMsg{
+		ID:       binary.BigEndian.Uint16(id[:]),
+		Question: dnsQuestion{Name: strings.TrimSuffix(name, "."), Type: t, Class: c},
+	}
+	if !*noRecurse {
+		q.Flags = 0x0100 // recursion desired
+	}
+	if *edns {
+		q.Additional = []dnsResourceRecord{{Type: dnsTypeOPT, Class: ednsUDPSize, RData: []byte{}}}
+	}
+	req, err := q.pack()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	network := "udp"
+	if *useTCP {
+		network = "tcp"
+	}
+	start := time.Now()
+	data, err := exchange(network, addr, req, *timeout)
+	if err == nil && network == "udp" && len(data) >= 4 && data[2]&0x02 != 0 {
+		// Truncated; retry over TCP as resolvers do
+		fmt.Fprintln(os.Stderr, ";; Truncated, retrying in TCP mode.")
+		network = "tcp"
+		data, err = exchange(network, addr, req, *timeout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, ";; no answer:", err)
+		return 1
+	}
+	rtt := time.Since(start)
+	resp, err := parseResponse(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, ";; bad response:", err)
+		return 1
+	}
+
+	if *short {
+		for _, rr := range resp.sections[0] {
+			fmt.Println(rr.data)
+		}
+		return 0
+	}
+	resp.print(os.Stdout)
+	fmt.Printf(";; Query time: %v\n", rtt.Round(time.Microsecond))
+	fmt.Printf(";; SERVER: %s (%s)\n", addr, network)
+	fmt.Printf(";; MSG SIZE  rcvd: %d\n", len(data))
+	return 0
+}
+
+// exchange sends one query and waits for the response with the same ID.
+// Over TCP messages carry a two-byte length prefix.
+func exchange(network, addr string, req []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if network == "tcp" {
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(req)))
+		if _, err := conn.Write(append(msg, req...)); err != nil {
+			return nil, err
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 12 && buf[0] == req[0] && buf[1] == req[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// queryResponse is a fully decoded response, for display. Unlike dnsMsg it
+// keeps every section and renders record data of any type as text.
+type queryResponse struct {
+	id, flags uint16
+	questions []dnsQuestion
+	sections  [3][]queryRecord // answer, authority, additional
+}
+
+type queryRecord struct {
+	name  string
+	typ   uint16
+	class uint16
+	ttl   uint32
+	data  string
+	ede   string // of an OPT record carrying an Extended DNS Error
+}
+
+func parseResponse(data []byte) (*queryResponse, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("message too short")
+	}
+	r := &queryResponse{
+		id:    binary.BigEndian.Uint16(data[0:2]),
+		flags: binary.BigEndian.Uint16(data[2:4]),
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(data[4:6])); i++ {
+		name, next, err := readName(data, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(data) {
+			return nil, fmt.Errorf("truncated question")
+		}
+		r.questions = append(r.questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(data[next : next+2]),
+			Class: binary.BigEndian.Uint16(data[next+2 : next+4]),
+		})
+		off = next + 4
+	}
+	for s := range r.sections {
+		count := int(binary.BigEndian.Uint16(data[6+2*s : 8+2*s]))
+		for i := 0; i < count; i++ {
+			var rr queryRecord
+			var err error
+			if rr.name, off, err = readName(data, off); err != nil {
+				return nil, err
+			}
+			if off+10 > len(data) {
+				return nil, fmt.Errorf("truncated resource record")
+			}
+			rr.typ = binary.BigEndian.Uint16(data[off : off+2])
+			rr.class = binary.BigEndian.Uint16(data[off+2 : off+4])
+			rr.ttl = binary.BigEndian.Uint32(data[off+4 : off+8])
+			rdlen := int(binary.BigEndian.Uint16(data[off+8 : off+10]))
+			off += 10
+			if off+rdlen > len(data) {
+				return nil, fmt.Errorf("record data runs past end of message")
+			}
+			rr.data = rdataString(data, off, rdlen, rr.typ)
+			if rr.typ == dnsTypeOPT {
+				rr.ede = edeOptionString(data[off : off+rdlen])
+			}
+			off += rdlen
+			r.sections[s] = append(r.sections[s], rr)
+		}
+	}
+	return r, nil
+}
+
+// rdataString renders record data in zone file presentation format. Types
+// it doesn't know, and records that fail to decode, use the RFC 3597 generic
+// \# form.
+func rdataString(msg []byte, off, n int, typ uint16) string {
+	rd := msg[off : off+n]
+	name := func(at int) (string, int, bool) {
+		s, next, err := readName(msg, at)
+		return s + ".", next, err == nil && next <= off+n
+	}
+	switch typ {
+	case dnsTypeA, dnsTypeAAAA:
+		if n == 4 || n == 16 {
+			return net.IP(rd).String()
+		}
+	case 2, 5, 12, 39: // NS, CNAME, PTR, DNAME
+		if s, _, ok := name(off); ok {
+			return s
+		}
+	case 15: // MX
+		if n > 2 {
+			if s, _, ok := name(off + 2); ok {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rd), s)
+			}
+		}
+	case 33: // SRV
+		if n > 6 {
+			if s, _, ok := name(off + 6); ok {
+				return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rd), binary.BigEndian.Uint16(rd[2:]), binary.BigEndian.Uint16(rd[4:]), s)
+			}
+		}
+	case 6: // SOA
+		mname, next, ok := name(off)
+		if !ok {
+			break
+		}
+		rname, next, ok := name(next)
+		if !ok || next+20 > off+n {
+			break
+		}
+		v := msg[next : next+20]
+		return fmt.Sprintf("%s %s %d %d %d %d %d", mname, rname,
+			binary.BigEndian.Uint32(v), binary.BigEndian.Uint32(v[4:]), binary.BigEndian.Uint32(v[8:]),
+			binary.BigEndian.Uint32(v[12:]), binary.BigEndian.Uint32(v[16:]))
+	case 16: // TXT
+		var parts []string
+		for i := 0; i < n; {
+			l := int(rd[i])
+			if i+1+l > n {
+				parts = nil
+				break
+			}
+			parts = append(parts, quoteCharString(rd[i+1:i+1+l]))
+			i += 1 + l
+		}
+		if parts != nil {
+			return strings.Join(parts, " ")
+		}
+	}
+	if n == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, n, hex.EncodeToString(rd))
+}
+
+// quoteCharString quotes a TXT character-string, escaping quotes,
+// backslashes and unprintable bytes as dig does.
+func quoteCharString(b []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&sb, `\%03d`, c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func (r *queryResponse) print(w io.Writer) {
+	var flags []string
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{{0x8000, "qr"}, {0x0400, "aa"}, {0x0200, "tc"}, {0x0100, "rd"}, {0x0080, "ra"}, {0x0020, "ad"}, {0x0010, "cd"}} {
+		if r.flags&f.bit != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcodeString(r.flags), rcodeString(r.flags), r.id)
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(r.questions), len(r.sections[0]), len(r.sections[1]), len(r.sections[2]))
+
+	if len(r.questions) > 0 {
+		fmt.Fprintln(w, "\n;; QUESTION SECTION:")
+		for _, q := range r.questions {
+			fmt.Fprintf(w, ";%s.\t\t%s\t%s\n", q.Name, classString(q.Class), typeString(q.Type))
+		}
+	}
+	for i, title := range []string{"ANSWER", "AUTHORITY", "ADDITIONAL"} {
+		if len(r.sections[i]) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", title)
+		for _, rr := range r.sections[i] {
+			if rr.typ == 41 { // OPT: the class is the sender's UDP payload size
+				fmt.Fprintf(w, "; EDNS: udp: %d, ttl: %d, data: %s\n", rr.class, rr.ttl, rr.data)
+				if rr.ede != "" {
+					fmt.Fprintf(w, "; EDE: %s\n", rr.ede)
+				}
+				continue
+			}
+			fmt.Fprintf(w, "%s.\t%d\t%s\t%s\t%s\n", rr.name, rr.ttl, classString(rr.class), typeString(rr.typ), rr.data)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// parseType accepts a record type name, TYPEnnn or a plain number.
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range dnsTypeNames {
+		if name == s {
+			return t, true
+		}
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16)
+	return uint16(n), err == nil
+}
+
+var dnsClassNames = map[uint16]string{1: "IN", 3: "CH", 4: "HS", 255: "ANY"}
+
+func classString(c uint16) string {
+	if name, ok := dnsClassNames[c]; ok {
+		return name
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+func parseClass(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for c, name := range dnsClassNames {
+		if name == s {
+			return c, true
+		}
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "CLASS"), 10, 16)
+	return uint16(n), err == nil
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name for an address.
+func reverseName(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", addr)
+	}
+	var labels []string
+	if v4 := ip.To4(); v4 != nil {
+		for i := 3; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(v4[i])))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa", nil
+	}
+	h := hex.EncodeToString(ip.To16())
+	for i := len(h) - 1; i >= 0; i-- {
+		labels = append(labels, h[i:i+1])
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa", nil
+}
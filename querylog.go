@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var queryLogDropped = expvar.NewInt("querylog_dropped")
+
+const queryLogSchema = `
+CREATE TABLE IF NOT EXISTS queries (
+	id         INTEGER PRIMARY KEY,
+	ts         INTEGER NOT NULL, -- unix milliseconds
+	client     TEXT NOT NULL,
+	port       INTEGER NOT NULL,
+	qname      TEXT NOT NULL,
+	qtype      TEXT NOT NULL,
+	opcode     TEXT NOT NULL DEFAULT 'QUERY',
+	action     TEXT NOT NULL,
+	answer     TEXT NOT NULL,
+	rule       TEXT NOT NULL,
+	rcode      TEXT NOT NULL,
+	latency_us INTEGER NOT NULL,
+	session    TEXT NOT NULL DEFAULT '',
+	true_answer TEXT NOT NULL DEFAULT '', -- with -ground-truth
+	true_rcode  TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS queries_ts ON queries(ts);
+CREATE INDEX IF NOT EXISTS queries_client ON queries(client, ts);
+CREATE INDEX IF NOT EXISTS queries_qname ON queries(qname, ts);
+CREATE TABLE IF NOT EXISTS alerts (
+	id      INTEGER PRIMARY KEY,
+	ts      INTEGER NOT NULL, -- unix milliseconds
+	kind    TEXT NOT NULL,
+	client  TEXT NOT NULL,
+	qname   TEXT NOT NULL,
+	qtype   TEXT NOT NULL,
+	rule    TEXT NOT NULL,
+	source  TEXT NOT NULL,
+	message TEXT NOT NULL,
+	session TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS alerts_ts ON alerts(ts);
+CREATE INDEX IF NOT EXISTS alerts_session ON alerts(session, ts);
+`
+
+// queryLogColumns are the columns added to the queries table since it was
+// first released, with their definitions, in the order they were added.
+var queryLogColumns = []struct{ name, def string }{
+	{"opcode", "TEXT NOT NULL DEFAULT 'QUERY'"},
+	{"session", "TEXT NOT NULL DEFAULT ''"},
+	{"true_answer", "TEXT NOT NULL DEFAULT ''"},
+	{"true_rcode", "TEXT NOT NULL DEFAULT ''"},
+}
+
+const (
+	queryLogBatchSize     = 500
+	queryLogFlushInterval = time.Second
+)
+
+// queryLog persists query events to SQLite. Events are queued and written
+// in batches inside a single transaction, so a burst of queries costs one
+// fsync rather than one per query. Alerts, which are far fewer, are written
+// one at a time as queryLogAlerts delivers them.
+type queryLog struct {
+	db     *sql.DB
+	events chan *queryEvent
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// sqliteDSN returns the DSN for the SQLite database at path with the given
+// query parameters. The path is escaped, so a "?", "#" or "%" in it stays
+// part of the file name.
+func sqliteDSN(path, query string) string {
+	u := url.URL{Scheme: "file", Opaque: (&url.URL{Path: path}).EscapedPath(), RawQuery: query}
+	return u.String()
+}
+
+func openQueryLogDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", sqliteDSN(path, "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(queryLogSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateQueryLog(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openQueryLogReadOnly opens the query log database at path for reading,
+// such as while a server writes to it, or a copy from an older version,
+// which is read as it is.
+func openQueryLogReadOnly(path string) (*sql.DB, error) {
+	return sql.Open("sqlite", sqliteDSN(path, "mode=ro&_pragma=busy_timeout(5000)"))
+}
+
+// queryLogFrom returns the table to select queries from in db, opened with
+// openQueryLogReadOnly: the queries table, with the columns a database from
+// an older version doesn't have yet filled in with their defaults.
+func queryLogFrom(db *sql.DB) (string, error) {
+	var missing []string
+	for _, col := range queryLogColumns {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('queries') WHERE name = ?`, col.name).Scan(&n); err != nil {
+			return "", err
+		}
+		if n == 0 {
+			_, def, _ := strings.Cut(col.def, "DEFAULT ")
+			missing = append(missing, def+" AS "+col.name)
+		}
+	}
+	if len(missing) == 0 {
+		return "queries", nil
+	}
+	return "(SELECT *, " + strings.Join(missing, ", ") + " FROM queries)", nil
+}
+
+// migrateQueryLog adds the columns newer versions record to a database
+// written by an older one, and the indexes on them.
+func migrateQueryLog(db *sql.DB) error {
+	for _, col := range queryLogColumns {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('queries') WHERE name = ?`, col.name).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE queries ADD COLUMN ` + col.name + ` ` + col.def); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS queries_session ON queries(session, ts)`)
+	return err
+}
+
+func newQueryLog(path string) (*queryLog, error) {
+	db, err := openQueryLogDB(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &queryLog{db: db, events: make(chan *queryEvent, 8192)}
+	l.wg.Add(1)
+	go l.run()
+	return l, nil
+}
+
+func (l *queryLog) Write(ev *queryEvent) {
+	select {
+	case l.events <- ev:
+	default:
+		queryLogDropped.Add(1)
+	}
+}
+
+// Close flushes queued events and closes the database. Alerts delivered
+// after it are dropped.
+func (l *queryLog) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	close(l.events)
+	l.wg.Wait()
+	return l.db.Close()
+}
+
+func (l *queryLog) run() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(queryLogFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*queryEvent, 0, queryLogBatchSize)
+	for {
+		select {
+		case ev, ok := <-l.events:
+			if !ok {
+				l.flush(batch)
+				return
+			}
+			if batch = append(batch, ev); len(batch) >= queryLogBatchSize {
+				l.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			l.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (l *queryLog) flush(batch []*queryEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := l.insert(batch); err != nil {
+		queryLogDropped.Add(int64(len(batch)))
+		slog.Error("Failed to write query log batch", "events", len(batch), "err", err)
+	}
+}
+
+func (l *queryLog) insert(batch []*queryEvent) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO queries
+		(ts, client, port, qname, qtype, opcode, action, answer, rule, rcode, latency_us, session, true_answer, true_rcode)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, ev := range batch {
+		opcode := ev.Opcode
+		if opcode == "" {
+			opcode = "QUERY"
+		}
+		if _, err := stmt.Exec(ev.Time.UnixMilli(), ev.Client, ev.Port, ev.QName, ev.QType, opcode, ev.Action,
+			strings.Join(ev.Answer, ","), ev.Rule, ev.RCode, ev.Latency.Microseconds(), ev.Session,
+			strings.Join(ev.TrueAnswer, ","), ev.TrueRCode); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// queryLogAlerts records alerts in a queryLog's alerts table, so they can
+// be searched and exported along with the queries that raised them. It is
+// a separate type so the alerter does not close the query log a second
+// time.
+type queryLogAlerts struct{ l *queryLog }
+
+func (a queryLogAlerts) String() string { return "query log" }
+
+func (a queryLogAlerts) Notify(ctx context.Context, al *alert) error {
+	a.l.mu.Lock()
+	defer a.l.mu.Unlock()
+	if a.l.closed {
+		return nil
+	}
+	_, err := a.l.db.ExecContext(ctx, `INSERT INTO alerts (ts, kind, client, qname, qtype, rule, source, message, session)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		al.Time.UnixMilli(), al.Kind, al.Client, al.QName, al.QType, al.Rule, al.Source, al.Message, al.Session)
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// querylogCommand implements "querylog", which searches the SQLite query
+// log written by -querylog, e.g.
+//
+//	DeceptiveDNS querylog -db queries.db -client 10.0.0.5 -since 1h -qname '*.corp'
+func querylogCommand(args []string) int {
+	fs := flag.NewFlagSet("querylog", flag.ContinueOnError)
+	dbPath := fs.String("db", "queries.db", "Query log database to search")
+	client := fs.String("client", "", "Only show queries from this client IP")
+	qname := fs.String("qname", "", "Only show queries for this name; * matches any characters")
+	qtype := fs.String("qtype", "", "Only show queries of this type, e.g. A or AAAA")
+	opcode := fs.String("opcode", "", "Only show messages with this opcode, e.g. QUERY or IQUERY")
+	action := fs.String("action", "", "Only show queries with this action, e.g. answered or ignored")
+	session := fs.String("session", "", "Only show queries made during this session")
+	since := fs.String("since", "", "Only show queries newer than this duration (e.g. 1h) or RFC 3339 time")
+	until := fs.String("until", "", "Only show queries older than this duration or RFC 3339 time")
+	limit := fs.Int("limit", 100, "Maximum number of rows to print (0 for no limit)")
+	format := fs.String("format", "table", "Output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	where := []string{"1=1"}
+	var params []any
+	if *client != "" {
+		where = append(where, "client = ?")
+		params = append(params, *client)
+	}
+	if *qname != "" {
+		where = append(where, `qname LIKE ? ESCAPE '\'`)
+		params = append(params, globToLike(strings.TrimSuffix(*qname, ".")))
+	}
+	if *qtype != "" {
+		where = append(where, "qtype = ?")
+		params = append(params, strings.ToUpper(*qtype))
+	}
+	if *opcode != "" {
+		where = append(where, "opcode = ?")
+		params = append(params, strings.ToUpper(*opcode))
+	}
+	if *action != "" {
+		where = append(where, "action = ?")
+		params = append(params, *action)
+	}
+	if *session != "" {
+		where = append(where, "session = ?")
+		params = append(params, *session)
+	}
+	for _, bound := range []struct {
+		value, op string
+	}{{*since, ">="}, {*until, "<"}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := parseTimeBound(bound.value)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		where = append(where, "ts "+bound.op+" ?")
+		params = append(params, t.UnixMilli())
+	}
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		fmt.Println("Cannot open query log:", err)
+		return 1
+	}
+	db, err := openQueryLogReadOnly(*dbPath)
+	if err != nil {
+		fmt.Println("Cannot open query log:", err)
+		return 1
+	}
+	defer db.Close()
+	from, err := queryLogFrom(db)
+	if err != nil {
+		fmt.Println("Cannot open query log:", err)
+		return 1
+	}
+
+	query := queryLogSelect + from + ` WHERE ` + strings.Join(where, " AND ") + ` ORDER BY ts DESC`
+	if *limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", *limit)
+	}
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		fmt.Println("Query failed:", err)
+		return 1
+	}
+	defer rows.Close()
+
+	var events []queryEvent
+	for rows.Next() {
+		ev, err := scanQueryLog(rows)
+		if err != nil {
+			fmt.Println("Query failed:", err)
+			return 1
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println("Query failed:", err)
+		return 1
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		for i := range events {
+			enc.Encode(&events[i])
+		}
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tCLIENT\tQNAME\tQTYPE\tACTION\tRCODE\tANSWER\tRULE\tLATENCY")
+		for _, ev := range events {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				ev.Time.Format("2006-01-02 15:04:05"), ev.Client, ev.QName, ev.QType, ev.Action,
+				ev.RCode, strings.Join(ev.Answer, ","), ev.Rule, ev.Latency)
+		}
+		tw.Flush()
+	default:
+		fmt.Println("Unknown output format:", *format)
+		return 2
+	}
+	return 0
+}
+
+// queryLogSelect selects the queries table's columns as scanQueryLog
+// reads them, from the table that follows.
+const queryLogSelect = `SELECT ts, client, port, qname, qtype, opcode, action, answer, rule, rcode, latency_us, session,
+	true_answer, true_rcode FROM `
+
+// scanQueryLog reads a row selected by queryLogSelect.
+func scanQueryLog(rows *sql.Rows) (queryEvent, error) {
+	var ev queryEvent
+	var ts, latency int64
+	var answer, trueAnswer string
+	if err := rows.Scan(&ts, &ev.Client, &ev.Port, &ev.QName, &ev.QType, &ev.Opcode, &ev.Action, &answer, &ev.Rule, &ev.RCode, &latency, &ev.Session,
+		&trueAnswer, &ev.TrueRCode); err != nil {
+		return ev, err
+	}
+	ev.Time = time.UnixMilli(ts)
+	ev.Latency = time.Duration(latency) * time.Microsecond
+	if answer != "" {
+		ev.Answer = strings.Split(answer, ",")
+	}
+	if trueAnswer != "" {
+		ev.TrueAnswer = strings.Split(trueAnswer, ",")
+	} else if ev.TrueRCode != "" && ev.TrueRCode != "error" {
+		ev.TrueAnswer = []string{}
+	}
+	return ev, nil
+}
+
+// globToLike converts a shell-style pattern where * matches anything into
+// a SQL LIKE pattern, escaping LIKE's own wildcards.
+func globToLike(pattern string) string {
+	var b strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteByte('%')
+		case '%', '_', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// parseTimeBound accepts either a duration relative to now ("1h", "30m") or
+// an absolute RFC 3339 timestamp.
+func parseTimeBound(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: want a duration like 1h or an RFC 3339 time", s)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	quotaExceeded = expvar.NewInt("quota_exceeded")
+	// quotaSinkholeRule answers every query of a client over its quota
+	quotaSinkholeRule = &rule{Domain: "quota-sinkhole"}
+)
+
+const quotaMaxClients = 10000
+
+// quotaConfig is the "quota" part of the "detection" section: capping how
+// many queries a client may send per hour and per day, and containing the
+// noisy or malicious hosts that go over.
+type quotaConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Hourly  int      `yaml:"hourly"` // queries per clock hour, 0 for no limit
+	Daily   int      `yaml:"daily"`  // queries per day, from local midnight, 0 for no limit
+	Action  string   `yaml:"action"` // what to do with clients over quota: sinkhole (default) or alert
+	Allow   []string `yaml:"allow"`  // client addresses and prefixes without a quota
+
+	allow []netip.Prefix // Allow parsed
+}
+
+// quotaDetector counts each client's queries in the current hour and day.
+// The query that takes a client over either quota raises a "quota" alert
+// and, with the sinkhole action, every later query from it is answered
+// with the default address until the period it went over in ends.
+type quotaDetector struct {
+	cfg quotaConfig
+
+	mu      sync.Mutex
+	clients map[string]*quotaClient
+}
+
+type quotaClient struct {
+	hour, day     time.Time // start of the periods counted
+	hourly, daily int
+	until         time.Time // end of the current sinkholing
+}
+
+func newQuotaDetector(cfg quotaConfig) (*quotaDetector, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Action == "" {
+		cfg.Action = "sinkhole"
+	}
+	switch {
+	case cfg.Hourly < 0 || cfg.Daily < 0:
+		return nil, fmt.Errorf("quota: hourly and daily must not be negative")
+	case cfg.Hourly == 0 && cfg.Daily == 0:
+		return nil, fmt.Errorf("quota: set hourly, daily or both")
+	case cfg.Action != "alert" && cfg.Action != "sinkhole":
+		return nil, fmt.Errorf("quota: unknown action %q (want sinkhole or alert)", cfg.Action)
+	}
+	allow, err := parsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("quota: allow: %v", err)
+	}
+	cfg.allow = allow
+	return &quotaDetector{cfg: cfg, clients: make(map[string]*quotaClient)}, nil
+}
+
+// check counts ev against its client's quotas and returns an alert when
+// it's the query that goes over one.
+func (d *quotaDetector) check(ev *queryEvent) *alert {
+	if addr, err := netip.ParseAddr(ev.Client); err == nil && prefixesContain(d.cfg.allow, addr) {
+		return nil
+	}
+	hour := ev.Time.Truncate(time.Hour)
+	y, m, dd := ev.Time.Date()
+	day := time.Date(y, m, dd, 0, 0, 0, 0, ev.Time.Location())
+
+	d.mu.Lock()
+	c, ok := d.clients[ev.Client]
+	if !ok {
+		if len(d.clients) >= quotaMaxClients {
+			d.prune(ev.Time)
+		}
+		c = &quotaClient{}
+		d.clients[ev.Client] = c
+	}
+	if !c.hour.Equal(hour) {
+		c.hour, c.hourly = hour, 0
+	}
+	if !c.day.Equal(day) {
+		c.day, c.daily = day, 0
+	}
+	c.hourly++
+	c.daily++
+	var period string
+	var quota int
+	switch {
+	case d.cfg.Daily > 0 && c.daily == d.cfg.Daily+1:
+		period, quota = "a day", d.cfg.Daily
+		c.until = day.AddDate(0, 0, 1)
+	case d.cfg.Hourly > 0 && c.hourly == d.cfg.Hourly+1:
+		period, quota = "an hour", d.cfg.Hourly
+		if end := hour.Add(time.Hour); end.After(c.until) {
+			c.until = end
+		}
+	}
+	until := c.until
+	d.mu.Unlock()
+	if period == "" {
+		return nil
+	}
+
+	quotaExceeded.Add(1)
+	msg := fmt.Sprintf("%s went over its quota of %d queries %s (last query %s %s)", ev.Client, quota, period, ev.QType, ev.QName)
+	if d.cfg.Action == "sinkhole" {
+		msg += fmt.Sprintf("; sinkholing its queries until %s", until.Format(time.DateTime))
+	}
+	return &alert{Time: ev.Time, Kind: "quota", Client: ev.Client, QName: ev.QName, QType: ev.QType, Message: msg}
+}
+
+// sinkholed reports whether queries from client should be answered from
+// the sinkhole now.
+func (d *quotaDetector) sinkholed(client string, now time.Time) bool {
+	_, ok := d.sinkholedUntil(client, now)
+	return ok
+}
+
+// sinkholedUntil returns when client's sinkholing ends, if it is
+// sinkholed now.
+func (d *quotaDetector) sinkholedUntil(client string, now time.Time) (time.Time, bool) {
+	if d.cfg.Action != "sinkhole" {
+		return time.Time{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[client]
+	if !ok || !now.Before(c.until) {
+		return time.Time{}, false
+	}
+	return c.until, true
+}
+
+// release ends client's sinkholing, reporting whether it was sinkholed.
+// The queries it sent this period still count, but it doesn't go over the
+// quota again until the next.
+func (d *quotaDetector) release(client string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[client]
+	if !ok || !time.Now().Before(c.until) {
+		return false
+	}
+	c.until = time.Time{}
+	return true
+}
+
+// usage returns the clients over quota, with when their sinkholing ends,
+// sorted by client.
+func (d *quotaDetector) usage() []quotaStatus {
+	now := time.Now()
+	var out []quotaStatus
+	d.mu.Lock()
+	for client, c := range d.clients {
+		if now.Before(c.until) {
+			out = append(out, quotaStatus{Client: client, Hourly: c.hourly, Daily: c.daily, Until: c.until})
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Client < out[j].Client })
+	return out
+}
+
+// quotaStatus is a client over quota, as the stats API shows it.
+type quotaStatus struct {
+	Client string    `json:"client"`
+	Hourly int       `json:"hourly"` // queries this hour
+	Daily  int       `json:"daily"`  // queries today
+	Until  time.Time `json:"until"`  // when the quota it went over resets
+}
+
+// prune forgets clients not heard from today and not sinkholed, or
+// everyone if that isn't enough.
+func (d *quotaDetector) prune(now time.Time) {
+	for client, c := range d.clients {
+		if now.Sub(c.day) > 24*time.Hour && !now.Before(c.until) {
+			delete(d.clients, client)
+		}
+	}
+	if len(d.clients) >= quotaMaxClients {
+		clear(d.clients)
+	}
+}
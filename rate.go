@@ -0,0 +1,172 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var rateAnomalies = expvar.NewInt("rate_anomalies")
+
+const (
+	rateDefaultWindow     = time.Minute
+	rateDefaultBaseline   = time.Hour
+	rateDefaultFactor     = 10
+	rateDefaultMinQueries = 100
+	rateDefaultCooldown   = 10 * time.Minute
+	rateMaxClients        = 10000
+)
+
+// rateConfig is the "rate" part of the "detection" section: alerting when
+// a client, or the network as a whole, suddenly queries far more than it
+// usually does, as beaconing bursts and scans do.
+type rateConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Window     time.Duration `yaml:"window"`      // period queries are counted over, default 1m
+	Baseline   time.Duration `yaml:"baseline"`    // how far back the usual rate looks, default 1h
+	Factor     float64       `yaml:"factor"`      // multiple of the usual rate that raises an alert, default 10
+	MinQueries int           `yaml:"min_queries"` // queries per window below which a client never alerts, default 100
+	Cooldown   time.Duration `yaml:"cooldown"`    // least time between alerts about the same client, default 10m
+}
+
+// rateDetector counts each client's queries, and everyone's, per window.
+// Each completed window is folded into a moving average that forgets
+// windows older than the baseline period; a window whose count reaches
+// factor times that average raises a "rate_anomaly" alert. Clients not yet
+// seen for a whole window have no average, and alert on min_queries alone,
+// which catches scans from new hosts; the global rate only alerts once it
+// has one.
+type rateDetector struct {
+	cfg   rateConfig
+	alpha float64 // weight of a completed window in the moving average
+
+	mu      sync.Mutex
+	global  rateCounter
+	clients map[string]*rateCounter
+}
+
+type rateCounter struct {
+	start    time.Time // of the current window
+	count    int       // queries in the current window
+	baseline float64   // moving average of queries per window
+	windows  int       // windows completed
+	alerted  time.Time
+}
+
+func newRateDetector(cfg rateConfig) (*rateDetector, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Window == 0 {
+		cfg.Window = rateDefaultWindow
+	}
+	if cfg.Baseline == 0 {
+		cfg.Baseline = rateDefaultBaseline
+	}
+	if cfg.Factor == 0 {
+		cfg.Factor = rateDefaultFactor
+	}
+	if cfg.MinQueries == 0 {
+		cfg.MinQueries = rateDefaultMinQueries
+	}
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = rateDefaultCooldown
+	}
+	switch {
+	case cfg.Window < 0 || cfg.Baseline < 0 || cfg.MinQueries < 0 || cfg.Cooldown < 0:
+		return nil, fmt.Errorf("rate: window, baseline, min_queries and cooldown must not be negative")
+	case cfg.Baseline < cfg.Window:
+		return nil, fmt.Errorf("rate: baseline %s is shorter than the window %s", cfg.Baseline, cfg.Window)
+	case cfg.Factor <= 1:
+		return nil, fmt.Errorf("rate: factor %g must be greater than 1", cfg.Factor)
+	}
+	return &rateDetector{
+		cfg:     cfg,
+		alpha:   1 - math.Exp(-cfg.Window.Seconds()/cfg.Baseline.Seconds()),
+		clients: make(map[string]*rateCounter),
+	}, nil
+}
+
+// check counts ev and returns an alert when its client's rate, or failing
+// that the global rate, crosses the threshold outside a cooldown.
+func (d *rateDetector) check(ev *queryEvent) *alert {
+	d.mu.Lock()
+	c, ok := d.clients[ev.Client]
+	if !ok {
+		if len(d.clients) >= rateMaxClients {
+			d.prune(ev.Time)
+		}
+		c = &rateCounter{}
+		d.clients[ev.Client] = c
+	}
+	clientAlert := d.count(c, ev.Time, float64(d.cfg.MinQueries))
+	globalAlert := d.count(&d.global, ev.Time, math.Inf(1))
+	count, baseline, windows := c.count, c.baseline, c.windows
+	if !clientAlert && globalAlert {
+		count, baseline = d.global.count, d.global.baseline
+	}
+	d.mu.Unlock()
+
+	var msg string
+	switch {
+	case clientAlert && windows == 0:
+		msg = fmt.Sprintf("%s sent %d queries within %s of its first, with no usual rate yet", ev.Client, count, d.cfg.Window)
+	case clientAlert:
+		msg = fmt.Sprintf("%s sent %d queries in %s, against its usual %.1f", ev.Client, count, d.cfg.Window, baseline)
+	case globalAlert:
+		msg = fmt.Sprintf("clients sent %d queries in %s, against the usual %.1f (the last from %s)", count, d.cfg.Window, baseline, ev.Client)
+	default:
+		return nil
+	}
+	rateAnomalies.Add(1)
+	al := &alert{Time: ev.Time, Kind: "rate_anomaly", Client: ev.Client, QName: ev.QName, QType: ev.QType, Message: msg}
+	if !clientAlert {
+		al.Client = ""
+	}
+	return al
+}
+
+// count adds a query at now to c, and reports whether that takes c's
+// current window to the threshold: factor times its moving average, or
+// floor while it has none.
+func (d *rateDetector) count(c *rateCounter, now time.Time, floor float64) bool {
+	if c.start.IsZero() {
+		c.start = now
+	}
+	if n := int(now.Sub(c.start) / d.cfg.Window); n > 0 {
+		if c.windows == 0 {
+			c.baseline = float64(c.count)
+		} else {
+			c.baseline += d.alpha * (float64(c.count) - c.baseline)
+		}
+		c.baseline *= math.Pow(1-d.alpha, float64(n-1)) // windows without a query
+		c.windows += n
+		c.count = 0
+		c.start = c.start.Add(time.Duration(n) * d.cfg.Window)
+	}
+	c.count++
+	threshold := floor
+	if c.windows > 0 {
+		threshold = max(d.cfg.Factor*c.baseline, float64(d.cfg.MinQueries))
+	}
+	if float64(c.count) < threshold || now.Sub(c.alerted) < d.cfg.Cooldown {
+		return false
+	}
+	c.alerted = now
+	return true
+}
+
+// prune forgets clients quiet for the baseline period, or everyone if
+// that isn't enough.
+func (d *rateDetector) prune(now time.Time) {
+	for client, c := range d.clients {
+		if now.Sub(c.start) > d.cfg.Baseline {
+			delete(d.clients, client)
+		}
+	}
+	if len(d.clients) >= rateMaxClients {
+		clear(d.clients)
+	}
+}
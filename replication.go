@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	replicationSent      = expvar.NewInt("replication_sent")
+	replicationFailed    = expvar.NewInt("replication_failed")
+	replicationApplied   = expvar.NewInt("replication_applied")
+	replicationRejected  = expvar.NewInt("replication_rejected") // updates that failed authentication
+	replicationTakeovers = expvar.NewInt("replication_takeovers")
+	queriesStandby       = expvar.NewInt("queries_standby")
+)
+
+const (
+	replicationDefaultInterval = 2 * time.Second
+	replicationMaxSkew         = 30 * time.Second // between the peers' clocks
+	replicationMaxBody         = 64 << 20         // bytes of state in one update
+	replicationPath            = "/replication"
+	replicationTimeHeader      = "X-Replication-Time"
+	replicationSigHeader       = "X-Replication-Signature"
+)
+
+// replicationConfig is the "replication" section of the config file: the
+// instance's half of an active/standby pair. Both run with the same rules
+// and settings; the active one answers queries and sends its runtime
+// state to the standby every interval, and the standby takes over when it
+// hears nothing for failover.
+type replicationConfig struct {
+	Role     string        `yaml:"role"`     // "primary" or "secondary", or empty to run alone
+	Listen   string        `yaml:"listen"`   // address updates from the peer arrive on, e.g. 0.0.0.0:8055
+	Peer     string        `yaml:"peer"`     // the peer's listen address
+	Key      string        `yaml:"key"`      // shared secret, of at least 16 characters, updates are signed with
+	Interval time.Duration `yaml:"interval"` // between updates, default 2s
+	Failover time.Duration `yaml:"failover"` // silence from the active peer after which the standby takes over, default 5 intervals
+}
+
+// replicationState is the runtime state the active instance sends: what
+// changes while it runs rather than coming from the config file.
+type replicationState struct {
+	Rules       []rule        `json:"rules"`                 // added or changed through the APIs, control socket or reloads; not the feeds'
+	Bans        []banStatus   `json:"bans,omitempty"`        // with detection.ban
+	Honeytokens []*honeytoken `json:"honeytokens,omitempty"` // with -honeytokens
+	Session     *session      `json:"session,omitempty"`
+}
+
+// replicationUpdate is what the peers send each other every interval: the
+// sender's role and whether it is active, with its state if the receiver
+// hasn't applied it yet.
+type replicationUpdate struct {
+	Role   string            `json:"role"`
+	Active bool              `json:"active"`
+	Digest string            `json:"digest,omitempty"` // of State, or of the state the receiver already has
+	State  *replicationState `json:"state,omitempty"`
+}
+
+// replicationReply answers an update with the receiver's side.
+type replicationReply struct {
+	Role   string `json:"role"`
+	Active bool   `json:"active"`
+	Digest string `json:"digest"` // of the state it last applied
+}
+
+// replicationStatus is the pair as the stats API shows it.
+type replicationStatus struct {
+	Role       string     `json:"role"`
+	Active     bool       `json:"active"`
+	Peer       string     `json:"peer"`
+	PeerActive bool       `json:"peer_active"`
+	LastHeard  *time.Time `json:"last_heard,omitempty"` // last authenticated update or reply from the peer
+	LastError  string     `json:"last_error,omitempty"` // of the last update sent, if it failed
+}
+
+// replicator keeps one instance of a pair in step with the other. The
+// primary is active whenever it runs, but first waits up to failover to
+// take over the state of a secondary that stood in for it. The secondary
+// stands by while the primary is heard from, takes over when it falls
+// silent for failover, and stands by again when it comes back. A standby
+// reads queries but neither answers nor acts on them.
+type replicator struct {
+	cfg     replicationConfig
+	s       *dnsServer
+	client  *http.Client
+	srv     *http.Server
+	started time.Time
+
+	active atomic.Bool
+
+	mu         sync.Mutex
+	synced     bool      // the primary has taken over the secondary's state, or given up waiting for it
+	heard      time.Time // last authenticated message from the peer
+	heardFrom  time.Time // last update from the peer while it was active
+	peerActive bool
+	peerDigest string // of the state the peer last said it has
+	applied    string // digest of the state last applied here
+	lastStamp  int64  // of the last update accepted, so none is accepted twice
+	lastErr    string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// validate fills in the defaults of the settings not set. Replication is
+// off without a role.
+func (c *replicationConfig) validate() error {
+	switch c.Role {
+	case "":
+		return nil
+	case "primary", "secondary":
+	default:
+		return fmt.Errorf("replication: unknown role %q (want primary or secondary)", c.Role)
+	}
+	switch {
+	case c.Listen == "" || c.Peer == "":
+		return errors.New("replication: listen and peer are required")
+	case len(c.Key) < 16:
+		return errors.New("replication: key must be at least 16 characters")
+	case c.Interval < 0 || c.Failover < 0:
+		return errors.New("replication: interval and failover must not be negative")
+	}
+	for _, addr := range []string{c.Listen, c.Peer} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("replication: %v", err)
+		}
+	}
+	if c.Interval == 0 {
+		c.Interval = replicationDefaultInterval
+	}
+	if c.Failover == 0 {
+		c.Failover = 5 * c.Interval
+	}
+	if c.Failover <= c.Interval {
+		return errors.New("replication: failover must be longer than interval")
+	}
+	return nil
+}
+
+// newReplicator returns s's half of the pair cfg, valid, describes, standing
+// by until started, or nil if cfg has no role.
+func newReplicator(cfg replicationConfig, s *dnsServer) *replicator {
+	if cfg.Role == "" {
+		return nil
+	}
+	return &replicator{
+		cfg:    cfg,
+		s:      s,
+		client: &http.Client{Timeout: cfg.Interval},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// start listens for the peer's updates and starts sending it updates, once
+// the state they replace is restored. It is safe on a nil replicator.
+func (rp *replicator) start() error {
+	if rp == nil {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+replicationPath, rp.receive)
+	ln, err := net.Listen("tcp", rp.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	rp.started = time.Now()
+	rp.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := rp.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Replication listener stopped", "err", err)
+		}
+	}()
+	slog.Info("Replication started, standing by", "role", rp.cfg.Role, "listen", ln.Addr().String(), "peer", rp.cfg.Peer)
+	go rp.run()
+	return nil
+}
+
+// close stops replicating. It is safe on a nil replicator.
+func (rp *replicator) close(ctx context.Context) error {
+	if rp == nil {
+		return nil
+	}
+	close(rp.stop)
+	<-rp.done
+	return rp.srv.Shutdown(ctx)
+}
+
+// standby reports whether the instance is the standby of a pair, and so
+// mustn't answer queries. It is safe on a nil replicator.
+func (rp *replicator) standby() bool {
+	return rp != nil && !rp.active.Load()
+}
+
+func (rp *replicator) run() {
+	defer close(rp.done)
+	tick := time.NewTicker(rp.cfg.Interval)
+	defer tick.Stop()
+	for {
+		rp.decide(time.Now())
+		rp.send()
+		select {
+		case <-tick.C:
+		case <-rp.stop:
+			return
+		}
+	}
+}
+
+// decide makes the instance active or standby, as its role and what it
+// last heard from the peer call for.
+func (rp *replicator) decide(now time.Time) {
+	rp.mu.Lock()
+	silent := now.Sub(rp.heardFrom) > rp.cfg.Failover && now.Sub(rp.started) > rp.cfg.Failover
+	var active bool
+	var why string
+	if rp.cfg.Role == "primary" {
+		if !rp.synced && now.Sub(rp.started) > rp.cfg.Failover {
+			rp.synced, why = true, "no active secondary to take state over from"
+		}
+		active = rp.synced
+	} else {
+		active = silent
+		why = "primary not heard from within failover"
+	}
+	rp.mu.Unlock()
+	rp.setActive(active, why)
+}
+
+func (rp *replicator) setActive(active bool, why string) {
+	if rp.active.Swap(active) == active {
+		return
+	}
+	if active {
+		replicationTakeovers.Add(1)
+		slog.Warn("Replication: now active, answering queries", "role", rp.cfg.Role, "why", why)
+	} else {
+		slog.Warn("Replication: now standing by", "role", rp.cfg.Role, "why", why)
+	}
+}
+
+// state collects the state to send, with its digest.
+func (rp *replicator) state() (*replicationState, string) {
+	st := &replicationState{Session: activeSession.Load()}
+	for _, r := range rp.s.rules.list() {
+		if r.Feed == "" {
+			st.Rules = append(st.Rules, r)
+		}
+	}
+	// Regular expressions are tried in the order they were added
+	slices.SortStableFunc(st.Rules, func(a, b rule) int { return cmp.Compare(a.seq, b.seq) })
+	if rp.s.detect.ban != nil {
+		st.Bans = rp.s.detect.ban.snapshot()
+		slices.SortFunc(st.Bans, func(a, b banStatus) int { return cmp.Compare(a.Client, b.Client) })
+	}
+	if rp.s.honeytokens != nil {
+		st.Honeytokens = rp.s.honeytokens.list()
+	}
+	data, _ := json.Marshal(st)
+	sum := sha256.Sum256(data)
+	return st, hex.EncodeToString(sum[:])
+}
+
+// send sends the peer an update, with the state if the instance is active
+// and the peer doesn't have it yet.
+func (rp *replicator) send() {
+	up := replicationUpdate{Role: rp.cfg.Role, Active: rp.active.Load()}
+	if up.Active {
+		st, digest := rp.state()
+		up.Digest = digest
+		rp.mu.Lock()
+		if digest != rp.peerDigest {
+			up.State = st
+		}
+		rp.mu.Unlock()
+	}
+	body, err := json.Marshal(&up)
+	if err == nil {
+		err = rp.post(body)
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if err != nil {
+		replicationFailed.Add(1)
+		if rp.lastErr == "" {
+			slog.Warn("Replication: peer unreachable", "peer", rp.cfg.Peer, "err", err)
+		}
+		rp.lastErr = err.Error()
+		return
+	}
+	replicationSent.Add(1)
+	if rp.lastErr != "" {
+		slog.Info("Replication: peer reachable again", "peer", rp.cfg.Peer)
+	}
+	rp.lastErr = ""
+}
+
+// post sends body to the peer, signed, and takes in its signed reply.
+func (rp *replicator) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, "http://"+rp.cfg.Peer+replicationPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rp.sign(req.Header, body)
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	if _, err := rp.verify(resp.Header, data); err != nil {
+		replicationRejected.Add(1)
+		return fmt.Errorf("reply: %v", err)
+	}
+	var reply replicationReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return fmt.Errorf("reply: %v", err)
+	}
+	rp.mu.Lock()
+	rp.heard = time.Now()
+	rp.peerActive = reply.Active
+	rp.peerDigest = reply.Digest
+	rp.mu.Unlock()
+	return nil
+}
+
+// receive takes an update from the peer.
+func (rp *replicator) receive(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, replicationMaxBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "%v", err)
+		return
+	}
+	stamp, err := rp.verify(r.Header, body)
+	if err == nil {
+		rp.mu.Lock()
+		if stamp <= rp.lastStamp {
+			err = errors.New("replayed update")
+		} else {
+			rp.lastStamp = stamp
+		}
+		rp.mu.Unlock()
+	}
+	if err != nil {
+		replicationRejected.Add(1)
+		slog.Warn("Replication: rejected update", "from", r.RemoteAddr, "err", err)
+		writeError(w, http.StatusUnauthorized, "%v", err)
+		return
+	}
+	var up replicationUpdate
+	if err := json.Unmarshal(body, &up); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if up.Role == rp.cfg.Role {
+		slog.Error("Replication: peer has the same role; give one primary and the other secondary", "role", up.Role)
+		writeError(w, http.StatusConflict, "both peers are %s", up.Role)
+		return
+	}
+	rp.handle(&up, time.Now())
+
+	rp.mu.Lock()
+	reply := replicationReply{Role: rp.cfg.Role, Active: rp.active.Load(), Digest: rp.applied}
+	rp.mu.Unlock()
+	data, _ := json.Marshal(&reply)
+	rp.sign(w.Header(), data)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// handle acts on an authenticated update from the peer: a standby applies
+// the state of an active peer, a primary that has applied it takes over,
+// and an active secondary steps down for an active primary.
+func (rp *replicator) handle(up *replicationUpdate, now time.Time) {
+	rp.mu.Lock()
+	rp.heard = now
+	rp.peerActive = up.Active
+	if up.Active {
+		rp.heardFrom = now
+	}
+	rp.mu.Unlock()
+	if !up.Active {
+		if rp.cfg.Role == "primary" {
+			// Nothing to take over from a secondary standing by
+			rp.mu.Lock()
+			rp.synced = true
+			rp.mu.Unlock()
+			rp.setActive(true, "secondary is standing by")
+		}
+		return
+	}
+	if rp.cfg.Role == "secondary" {
+		rp.setActive(false, "primary is active")
+	} else if rp.active.Load() {
+		return // the secondary steps down once it hears from us
+	}
+	if up.State != nil {
+		if err := rp.apply(up.State); err != nil {
+			slog.Error("Replication: failed to apply the peer's state", "err", err)
+			return
+		}
+		rp.mu.Lock()
+		rp.applied = up.Digest
+		rp.mu.Unlock()
+	}
+	if rp.cfg.Role == "primary" {
+		rp.mu.Lock()
+		synced := rp.applied == up.Digest
+		rp.synced = rp.synced || synced
+		rp.mu.Unlock()
+		if synced {
+			rp.setActive(true, "took over the secondary's state")
+		}
+	}
+}
+
+// apply replaces the instance's state with st.
+func (rp *replicator) apply(st *replicationState) error {
+	rules := make([]*rule, len(st.Rules))
+	for i := range st.Rules {
+		rules[i] = &st.Rules[i]
+	}
+	if err := rp.s.rules.replace(rules); err != nil {
+		return err
+	}
+	if rp.s.detect.ban != nil {
+		rp.s.detect.ban.replace(st.Bans)
+	}
+	if rp.s.honeytokens != nil {
+		if err := rp.s.honeytokens.replace(st.Honeytokens); err != nil {
+			return err
+		}
+	}
+	if st.Session == nil {
+		activeSession.Store(nil)
+	} else if cur := activeSession.Load(); cur == nil || cur.Name != st.Session.Name || !cur.Started.Equal(st.Session.Started) {
+		activeSession.Store(st.Session)
+	}
+	replicationApplied.Add(1)
+	slog.Info("Replication: applied the peer's state", "rules", len(st.Rules), "bans", len(st.Bans), "honeytokens", len(st.Honeytokens))
+	return nil
+}
+
+// sign sets the headers that authenticate body: the time it was sent, in
+// Unix nanoseconds, and an HMAC-SHA256 of that time and body under the
+// shared key.
+func (rp *replicator) sign(h http.Header, body []byte) {
+	stamp := strconv.FormatInt(time.Now().UnixNano(), 10)
+	h.Set(replicationTimeHeader, stamp)
+	h.Set(replicationSigHeader, hex.EncodeToString(rp.mac(stamp, body)))
+}
+
+// verify checks the headers sign set for body, returning the time it was
+// sent.
+func (rp *replicator) verify(h http.Header, body []byte) (int64, error) {
+	stamp := h.Get(replicationTimeHeader)
+	ns, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return 0, errors.New("missing or invalid time")
+	}
+	sig, err := hex.DecodeString(h.Get(replicationSigHeader))
+	if err != nil || !hmac.Equal(sig, rp.mac(stamp, body)) {
+		return 0, errors.New("bad signature")
+	}
+	if skew := time.Since(time.Unix(0, ns)); skew > replicationMaxSkew || skew < -replicationMaxSkew {
+		return 0, fmt.Errorf("sent %v away from this clock", skew.Round(time.Second))
+	}
+	return ns, nil
+}
+
+func (rp *replicator) mac(stamp string, body []byte) []byte {
+	m := hmac.New(sha256.New, []byte(rp.cfg.Key))
+	m.Write([]byte(stamp))
+	m.Write([]byte{'\n'})
+	m.Write(body)
+	return m.Sum(nil)
+}
+
+// status returns the pair's state for the stats API. It is safe on a nil
+// replicator.
+func (rp *replicator) status() *replicationStatus {
+	if rp == nil {
+		return nil
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	st := &replicationStatus{
+		Role:       rp.cfg.Role,
+		Active:     rp.active.Load(),
+		Peer:       rp.cfg.Peer,
+		PeerActive: rp.peerActive,
+		LastError:  rp.lastErr,
+	}
+	if !rp.heard.IsZero() {
+		heard := rp.heard
+		st.LastHeard = &heard
+	}
+	return st
+}
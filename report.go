@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	reportsSent   = expvar.NewInt("reports_sent")
+	reportsFailed = expvar.NewInt("reports_failed")
+)
+
+const (
+	reportDefaultTop  = 10
+	reportMaxKeys     = 50000  // distinct names or clients counted per period, the rest go under topOther
+	reportMaxKnown    = 100000 // names remembered to tell new domains from old ones
+	reportMaxNewShown = 100    // new domains listed by name in a report
+)
+
+// reportConfig is one entry of the "reports" list in the "alerts" section:
+// a summary of the traffic since the last report, sent on a schedule to
+// every email and webhook notifier that accepts the "report" kind.
+type reportConfig struct {
+	Schedule string `yaml:"schedule"` // daily or weekly
+	At       string `yaml:"at"`       // local time of day to send it, default 00:00
+	Weekday  string `yaml:"weekday"`  // day weekly reports are sent, default monday
+	Format   string `yaml:"format"`   // markdown (default) or html
+	Top      int    `yaml:"top"`      // rows in each top-N table, default 10
+}
+
+// report is a rendered summary, as handed to notifiers.
+type report struct {
+	Title   string         `json:"title"`
+	Format  string         `json:"format"`
+	Content string         `json:"content"`
+	Summary *reportSummary `json:"summary"`
+}
+
+// reportSummary is what a report says about one period.
+type reportSummary struct {
+	Host       string           `json:"host"`
+	Schedule   string           `json:"schedule"`
+	From       time.Time        `json:"from"`
+	To         time.Time        `json:"to"`
+	Queries    int64            `json:"queries"`
+	Clients    int              `json:"unique_clients"`
+	NewDomains int64            `json:"new_domains"`
+	CanaryHits int64            `json:"canary_hits"`
+	Blocked    int64            `json:"blocked"` // answered with a spoofed address or rate limited
+	Actions    map[string]int64 `json:"actions"`
+	TopRules   []topEntry       `json:"top_rules"`
+	TopNames   []topEntry       `json:"top_names"`
+	TopClients []topEntry       `json:"top_clients"`
+	NewNames   []string         `json:"new_names"` // the first new domains seen
+}
+
+// reportSender is implemented by notifiers that can deliver reports.
+type reportSender interface {
+	SendReport(ctx context.Context, r *report) error
+}
+
+// reporter is an event sink that tallies traffic for each configured
+// report and sends the report when its time comes. A domain counts as new
+// the first time any client asks for it since the server started.
+type reporter struct {
+	alerts *alerter
+	rules  *ruleSet
+	host   string
+
+	mu        sync.Mutex
+	schedules []*reportSchedule
+	known     map[string]bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type reportSchedule struct {
+	cfg     reportConfig
+	at      time.Duration // time of day
+	weekday time.Weekday
+	period  *reportPeriod
+}
+
+// reportPeriod is the tally since a schedule's last report.
+type reportPeriod struct {
+	from       time.Time
+	queries    int64
+	canary     int64
+	blocked    int64
+	newDomains int64
+	newNames   []string
+	actions    map[string]int64
+	rules      map[string]int64
+	names      map[string]int64
+	clients    map[string]int64
+}
+
+func newReportPeriod(from time.Time) *reportPeriod {
+	return &reportPeriod{
+		from:    from,
+		actions: make(map[string]int64),
+		rules:   make(map[string]int64),
+		names:   make(map[string]int64),
+		clients: make(map[string]int64),
+	}
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// newReporter starts the reports in cfgs, or returns nil if there are none.
+func newReporter(cfgs []reportConfig, alerts *alerter, rules *ruleSet) (*reporter, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	host, _ := os.Hostname()
+	r := &reporter{alerts: alerts, rules: rules, host: host, known: make(map[string]bool), done: make(chan struct{})}
+	now := time.Now()
+	for i, cfg := range cfgs {
+		s := &reportSchedule{cfg: cfg, weekday: time.Monday, period: newReportPeriod(now)}
+		switch cfg.Schedule {
+		case "daily", "weekly":
+		default:
+			return nil, fmt.Errorf("report %d: unknown schedule %q (want daily or weekly)", i+1, cfg.Schedule)
+		}
+		if cfg.At != "" {
+			t, err := time.Parse("15:04", cfg.At)
+			if err != nil {
+				return nil, fmt.Errorf("report %d: invalid time of day %q (want HH:MM)", i+1, cfg.At)
+			}
+			s.at = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		}
+		if cfg.Weekday != "" {
+			d, ok := weekdays[strings.ToLower(cfg.Weekday)]
+			if !ok {
+				return nil, fmt.Errorf("report %d: unknown weekday %q", i+1, cfg.Weekday)
+			}
+			s.weekday = d
+		}
+		switch cfg.Format {
+		case "":
+			s.cfg.Format = "markdown"
+		case "markdown", "html":
+		default:
+			return nil, fmt.Errorf("report %d: unknown format %q (want markdown or html)", i+1, cfg.Format)
+		}
+		if cfg.Top < 0 {
+			return nil, fmt.Errorf("report %d: top must not be negative", i+1)
+		}
+		if cfg.Top == 0 {
+			s.cfg.Top = reportDefaultTop
+		}
+		r.schedules = append(r.schedules, s)
+	}
+	for _, s := range r.schedules {
+		r.wg.Add(1)
+		go r.run(s)
+	}
+	return r, nil
+}
+
+// Write adds ev to the tally of every report.
+func (r *reporter) Write(ev *queryEvent) {
+	name := normalizeName(ev.QName)
+	canary := false
+	if ev.Rule != "" && (ev.Action == "answered" || ev.Action == "monitored") {
+		rl := r.rules.get(ev.Rule)
+		canary = rl != nil && rl.Canary
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	isNew := false
+	if !r.known[name] && len(r.known) < reportMaxKnown {
+		r.known[name] = true
+		isNew = true
+	}
+	for _, s := range r.schedules {
+		p := s.period
+		p.queries++
+		p.actions[ev.Action]++
+		if ev.Action == "answered" || ev.Action == "limited" {
+			p.blocked++
+		}
+		if canary {
+			p.canary++
+		}
+		if isNew {
+			p.newDomains++
+			if len(p.newNames) < reportMaxNewShown {
+				p.newNames = append(p.newNames, name)
+			}
+		}
+		if ev.Rule != "" {
+			countKey(p.rules, ev.Rule, reportMaxKeys)
+		}
+		countKey(p.names, name, reportMaxKeys)
+		countKey(p.clients, ev.Client, reportMaxKeys)
+	}
+}
+
+// Close stops the schedules. The current period is not reported.
+func (r *reporter) Close() error {
+	close(r.done)
+	r.wg.Wait()
+	return nil
+}
+
+func (r *reporter) run(s *reportSchedule) {
+	defer r.wg.Done()
+	for {
+		timer := time.NewTimer(time.Until(s.next(time.Now())))
+		select {
+		case <-timer.C:
+			r.send(r.summarize(s, time.Now()), s.cfg.Format)
+		case <-r.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// next returns when s is next due after t, in local time.
+func (s *reportSchedule) next(t time.Time) time.Time {
+	y, m, d := t.Date()
+	due := time.Date(y, m, d, 0, 0, 0, 0, t.Location()).Add(s.at)
+	for !due.After(t) || (s.cfg.Schedule == "weekly" && due.Weekday() != s.weekday) {
+		y, m, d = due.Date()
+		due = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location()).Add(s.at)
+	}
+	return due
+}
+
+// summarize ends s's current period at now and starts the next one.
+func (r *reporter) summarize(s *reportSchedule, now time.Time) *reportSummary {
+	r.mu.Lock()
+	p := s.period
+	s.period = newReportPeriod(now)
+	r.mu.Unlock()
+
+	sum := &reportSummary{
+		Host:       r.host,
+		Schedule:   s.cfg.Schedule,
+		From:       p.from,
+		To:         now,
+		Queries:    p.queries,
+		Clients:    len(p.clients),
+		NewDomains: p.newDomains,
+		CanaryHits: p.canary,
+		Blocked:    p.blocked,
+		Actions:    p.actions,
+		TopRules:   topEntries(p.rules, s.cfg.Top),
+		TopNames:   topEntries(p.names, s.cfg.Top),
+		TopClients: topEntries(p.clients, s.cfg.Top),
+		NewNames:   p.newNames,
+	}
+	if sum.NewNames == nil {
+		sum.NewNames = []string{}
+	}
+	return sum
+}
+
+// send renders sum and delivers it to every notifier that takes reports,
+// retrying each as alerts are.
+func (r *reporter) send(sum *reportSummary, format string) {
+	rep := &report{
+		Title:   fmt.Sprintf("DeceptiveDNS %s report for %s, %s", sum.Schedule, sum.Host, sum.To.Format("2006-01-02")),
+		Format:  format,
+		Summary: sum,
+	}
+	var b bytes.Buffer
+	var err error
+	if format == "html" {
+		err = htmlReportTemplate.Execute(&b, rep)
+	} else {
+		err = markdownReportTemplate.Execute(&b, rep)
+	}
+	if err != nil {
+		slog.Error("Failed to render report", "err", err)
+		return
+	}
+	rep.Content = b.String()
+
+	slog.Info("Sending report", "schedule", sum.Schedule, "queries", sum.Queries, "clients", sum.Clients)
+	for _, t := range r.alerts.targets {
+		rs, ok := t.n.(reportSender)
+		if !ok || !t.opts.wants("report") {
+			continue
+		}
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := rs.SendReport(ctx, rep)
+			cancel()
+			if err == nil {
+				reportsSent.Add(1)
+				break
+			}
+			if attempt >= t.opts.Retries {
+				reportsFailed.Add(1)
+				slog.Error("Report delivery failed", "notifier", t.n.String(), "attempts", attempt+1, "err", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+const markdownReport = `# {{.Title}}
+
+{{with .Summary}}{{.From.Format "2006-01-02 15:04"}} to {{.To.Format "2006-01-02 15:04 MST"}}
+
+| | |
+| --- | ---: |
+| Queries | {{.Queries}} |
+| Unique clients | {{.Clients}} |
+| New domains | {{.NewDomains}} |
+| Canary hits | {{.CanaryHits}} |
+| Blocked | {{.Blocked}} |
+{{if .Actions}}
+## Queries by action
+
+| Action | Queries |
+| --- | ---: |
+{{range $k, $v := .Actions}}| {{$k}} | {{$v}} |
+{{end}}{{end}}{{if .TopRules}}
+## Top rules
+
+| Rule | Queries |
+| --- | ---: |
+{{range .TopRules}}| {{.Key}} | {{.Count}} |
+{{end}}{{end}}{{if .TopNames}}
+## Top names
+
+| Name | Queries |
+| --- | ---: |
+{{range .TopNames}}| {{.Key}} | {{.Count}} |
+{{end}}{{end}}{{if .TopClients}}
+## Top clients
+
+| Client | Queries |
+| --- | ---: |
+{{range .TopClients}}| {{.Key}} | {{.Count}} |
+{{end}}{{end}}{{if .NewNames}}
+## New domains
+
+{{range .NewNames}}- {{.}}
+{{end}}{{if gt .NewDomains (len .NewNames | int64)}}- ... and {{sub .NewDomains (len .NewNames | int64)}} more
+{{end}}{{end}}{{end}}`
+
+const htmlReport = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse;margin-bottom:1em}td,th{border:1px solid #ccc;padding:2px 8px;text-align:left}td.n{text-align:right}</style>
+</head><body>
+<h1>{{.Title}}</h1>
+{{with .Summary}}<p>{{.From.Format "2006-01-02 15:04"}} to {{.To.Format "2006-01-02 15:04 MST"}}</p>
+<table>
+<tr><th>Queries</th><td class="n">{{.Queries}}</td></tr>
+<tr><th>Unique clients</th><td class="n">{{.Clients}}</td></tr>
+<tr><th>New domains</th><td class="n">{{.NewDomains}}</td></tr>
+<tr><th>Canary hits</th><td class="n">{{.CanaryHits}}</td></tr>
+<tr><th>Blocked</th><td class="n">{{.Blocked}}</td></tr>
+</table>
+{{if .Actions}}<h2>Queries by action</h2>
+<table><tr><th>Action</th><th>Queries</th></tr>
+{{range $k, $v := .Actions}}<tr><td>{{$k}}</td><td class="n">{{$v}}</td></tr>
+{{end}}</table>
+{{end}}{{template "table" (table "Top rules" "Rule" .TopRules)}}{{template "table" (table "Top names" "Name" .TopNames)}}{{template "table" (table "Top clients" "Client" .TopClients)}}{{if .NewNames}}<h2>New domains</h2>
+<ul>
+{{range .NewNames}}<li>{{.}}</li>
+{{end}}{{if gt .NewDomains (len .NewNames | int64)}}<li>... and {{sub .NewDomains (len .NewNames | int64)}} more</li>
+{{end}}</ul>
+{{end}}{{end}}</body></html>
+{{define "table"}}{{if .Entries}}<h2>{{.Title}}</h2>
+<table><tr><th>{{.Column}}</th><th>Queries</th></tr>
+{{range .Entries}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}`
+
+var reportFuncs = map[string]any{
+	"int64": func(n int) int64 { return int64(n) },
+	"sub":   func(a, b int64) int64 { return a - b },
+	"table": func(title, column string, entries []topEntry) any {
+		return struct {
+			Title, Column string
+			Entries       []topEntry
+		}{title, column, entries}
+	},
+}
+
+var (
+	markdownReportTemplate = template.Must(template.New("report").Funcs(reportFuncs).Parse(markdownReport))
+	htmlReportTemplate     = htmltemplate.Must(htmltemplate.New("report").Funcs(reportFuncs).Parse(htmlReport))
+)
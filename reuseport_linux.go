@@ -0,0 +1,11 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const reusePortSupported = true
+
+// setReusePort lets several sockets bind the same address, with the kernel
+// spreading incoming datagrams across them by flow hash.
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
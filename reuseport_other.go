@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Other systems either lack SO_REUSEPORT or deliver every datagram to one
+// of the sockets, which defeats the point.
+const reusePortSupported = false
+
+func setReusePort(fd uintptr) error {
+	return errors.New("load-balanced SO_REUSEPORT is not supported on " + runtime.GOOS)
+}
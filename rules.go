@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// rule tells the server to answer queries for Domain. A domain of the form
+// *.example.com matches every name below example.com (but not example.com
+// itself), one starting with "~" is a regular expression matched against
+// the whole name, lower case and without the final dot, and "*" matches
+// every name. Typos names generators of lookalike domains the rule answers
+// too, such as "omission" or "idn" (see typoGenerators), or "all". Action
+// answers with something other than an address (see ruleActions).
+type rule struct {
+	Domain   string   `yaml:"domain" json:"domain"`
+	IP       string   `yaml:"ip,omitempty" json:"ip,omitempty"`   // an address or answer template, defaults to the server's -ip
+	IPs      []string `yaml:"ips,omitempty" json:"ips,omitempty"` // addresses to share answers out between instead, such as several sensors
+	Action   string   `yaml:"action,omitempty" json:"action,omitempty"`
+	EDE      string   `yaml:"ede,omitempty" json:"ede,omitempty"`           // Extended DNS Error to attach to responses, by name or code
+	EDEText  string   `yaml:"ede_text,omitempty" json:"ede_text,omitempty"` // its extra text
+	Priority int      `yaml:"priority,omitempty" json:"priority,omitempty"` // outranks every lower priority, whatever the kind of rule
+	Canary   bool     `yaml:"canary,omitempty" json:"canary,omitempty"`
+	Typos    []string `yaml:"typos,omitempty" json:"typos,omitempty"`
+	MAC      []string `yaml:"mac,omitempty" json:"mac,omitempty"` // client MACs or OUIs the rule answers, or any client if empty
+	Feed     string   `yaml:"-" json:"feed,omitempty"`            // threat feed the rule came from, if any
+
+	QTypes map[string]string `yaml:"qtypes,omitempty" json:"qtypes,omitempty"` // action by query type, over Action and the server's (see qtypePolicy)
+
+	addr   net.IP             // IP parsed, set by ruleSet.add
+	policy qtypePolicy        // QTypes parsed, set by ruleSet.add
+	pool   []net.IP           // IPs parsed, set by ruleSet.add
+	macs   []net.HardwareAddr // MAC parsed, set by ruleSet.add
+	re     *regexp.Regexp     // a "~" domain compiled, set by ruleSet.add
+	seq    uint64             // when the rule was added, for ordering regular expressions
+}
+
+// The kinds of rule, from the one that wins a name by default down
+const (
+	ruleExact = iota
+	ruleWildcard
+	ruleRegex
+	ruleCatchAll
+)
+
+var ruleKindNames = []string{"exact", "wildcard", "regex", "catch-all"}
+
+// kind returns which of the kinds of rule r is.
+func (r *rule) kind() int {
+	switch {
+	case r.Domain == "*":
+		return ruleCatchAll
+	case strings.HasPrefix(r.Domain, "~"):
+		return ruleRegex
+	case strings.HasPrefix(r.Domain, "*."):
+		return ruleWildcard
+	}
+	return ruleExact
+}
+
+// normalizeRuleDomain normalizes a rule's domain like a name, leaving
+// regular expressions as they are.
+func normalizeRuleDomain(domain string) string {
+	if strings.HasPrefix(domain, "~") {
+		return domain
+	}
+	return normalizeName(domain)
+}
+
+func (r *rule) validate() error {
+	switch r.kind() {
+	case ruleCatchAll:
+		if len(r.Typos) > 0 {
+			return fmt.Errorf("rule *: typos need a domain")
+		}
+	case ruleRegex:
+		if _, err := regexp.Compile(r.Domain[1:]); err != nil {
+			return fmt.Errorf("invalid rule domain %q: %v", r.Domain, err)
+		}
+		if len(r.Typos) > 0 {
+			return fmt.Errorf("rule %s: typos need a domain, not a regular expression", r.Domain)
+		}
+	default:
+		d := strings.TrimPrefix(r.Domain, "*.")
+		if d == "" || strings.Contains(d, "*") || len(d) > 253 {
+			return fmt.Errorf("invalid rule domain %q", r.Domain)
+		}
+		for _, label := range strings.Split(d, ".") {
+			if label == "" || len(label) > 63 {
+				return fmt.Errorf("invalid rule domain %q: bad label %q", r.Domain, label)
+			}
+		}
+	}
+	if r.IP != "" && net.ParseIP(r.IP) == nil && !answerTemplates[r.IP] {
+		return fmt.Errorf("rule %s: invalid IP address or answer template %q", r.Domain, r.IP)
+	}
+	if _, ok := ruleActions[r.Action]; !ok {
+		return fmt.Errorf("rule %s: unknown action %q (want answer, drop, servfail, refused or nxdomain)", r.Domain, r.Action)
+	}
+	if err := checkEDE(r.EDE, r.EDEText); err != nil {
+		return fmt.Errorf("rule %s: %v", r.Domain, err)
+	}
+	if _, err := parseQTypePolicy(r.QTypes); err != nil {
+		return fmt.Errorf("rule %s: %v", r.Domain, err)
+	}
+	if r.IP != "" && !r.answersSome() {
+		return fmt.Errorf("rule %s: ip is only used with the answer action", r.Domain)
+	}
+	if len(r.IPs) > 0 {
+		switch {
+		case r.IP != "":
+			return fmt.Errorf("rule %s: ip and ips don't go together", r.Domain)
+		case !r.answersSome():
+			return fmt.Errorf("rule %s: ips is only used with the answer action", r.Domain)
+		}
+		for _, ip := range r.IPs {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("rule %s: invalid IP address %q in ips", r.Domain, ip)
+			}
+		}
+	}
+	for _, m := range r.MAC {
+		if _, err := parseMACPrefix(m); err != nil {
+			return fmt.Errorf("rule %s: %v", r.Domain, err)
+		}
+	}
+	if err := checkTypoKinds(r.Typos); err != nil {
+		return fmt.Errorf("rule %s: %v", r.Domain, err)
+	}
+	return nil
+}
+
+// ruleActions maps the actions a rule can take to the response code it
+// answers with. Rules that drop queries send nothing at all, and the ones
+// that answer send their address.
+var ruleActions = map[string]uint16{
+	"":         0,
+	"answer":   0,
+	"drop":     0,
+	"servfail": dnsRcodeServFail,
+	"refused":  dnsRcodeRefused,
+	"nxdomain": dnsRcodeNXDomain,
+}
+
+// answers reports whether r answers with an address, rather than dropping
+// queries or refusing them with an error code.
+func (r *rule) answers() bool {
+	return r.Action == "" || r.Action == "answer"
+}
+
+// answersSome reports whether r answers queries of some type with an
+// address, with its action or its own qtypes.
+func (r *rule) answersSome() bool {
+	for _, a := range r.QTypes {
+		if strings.EqualFold(a, "answer") {
+			return true
+		}
+	}
+	return r.answers()
+}
+
+// ruleSet holds the active rules. For a name several rules match, the one
+// with the highest priority wins; among equals an exact match beats the
+// most specific wildcard, then the wildcards above it, then the regular
+// expressions in the order they were added, then the catch-all. The typo
+// variants of a rule are entries for their own names pointing at it, behind
+// any rule of that name.
+type ruleSet struct {
+	mu       sync.RWMutex
+	exact    *nameTree
+	wildcard *nameTree // keyed by the suffix after "*.", and "" for the catch-all
+	regex    ruleMap   // keyed by domain
+	gen      uint64    // bumped on every change
+	seq      uint64    // rules added
+}
+
+func newRuleSet(rules []*rule) (*ruleSet, error) {
+	rs := &ruleSet{exact: new(nameTree), wildcard: new(nameTree), regex: make(ruleMap)}
+	for _, r := range rules {
+		if err := rs.add(r); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// table returns the table holding the rule for domain, which is
+// normalized, and its key there.
+func (rs *ruleSet) table(domain string) (ruleTable, string) {
+	switch {
+	case domain == "*":
+		return rs.wildcard, ""
+	case strings.HasPrefix(domain, "~"):
+		return rs.regex, domain
+	}
+	if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+		return rs.wildcard, suffix
+	}
+	return rs.exact, domain
+}
+
+// tables returns every table of rules.
+func (rs *ruleSet) tables() []ruleTable {
+	return []ruleTable{rs.exact, rs.wildcard, rs.regex}
+}
+
+func (rs *ruleSet) add(r *rule) error {
+	r.Domain = normalizeRuleDomain(r.Domain)
+	if err := r.validate(); err != nil {
+		return err
+	}
+	r.addr = net.ParseIP(r.IP)
+	r.policy, _ = parseQTypePolicy(r.QTypes)
+	r.pool = nil
+	for _, ip := range r.IPs {
+		r.pool = append(r.pool, net.ParseIP(ip))
+	}
+	r.macs = nil
+	for _, m := range r.MAC {
+		hw, _ := parseMACPrefix(m)
+		r.macs = append(r.macs, hw)
+	}
+	r.re = nil
+	if r.kind() == ruleRegex {
+		r.re = regexp.MustCompile(r.Domain[1:])
+	}
+	variants := typoVariants(r.Domain, r.Typos)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.gen++
+	rs.seq++
+	r.seq = rs.seq
+	m, key := rs.table(r.Domain)
+	if old := m.get(key); old != nil && !old.isVariant(key) {
+		rs.dropVariants(old)
+	}
+	m.set(key, r)
+	for _, v := range variants {
+		key := strings.TrimPrefix(v, "*.")
+		if old := m.get(key); old == nil || old.key() != key {
+			m.set(key, r)
+		}
+	}
+	return nil
+}
+
+// key returns the table key of r's own entry: its domain, less any "*.", or
+// "" for the catch-all.
+func (r *rule) key() string {
+	if r.Domain == "*" {
+		return ""
+	}
+	return strings.TrimPrefix(r.Domain, "*.")
+}
+
+// isVariant reports whether the entry under key is a typo variant of r
+// rather than r itself.
+func (r *rule) isVariant(key string) bool {
+	return r.key() != key
+}
+
+// dropVariants deletes the typo variant entries pointing at r. The caller
+// holds rs.mu.
+func (rs *ruleSet) dropVariants(r *rule) {
+	if len(r.Typos) == 0 {
+		return
+	}
+	m, _ := rs.table(r.Domain)
+	for _, v := range typoVariants(r.Domain, r.Typos) {
+		if key := strings.TrimPrefix(v, "*."); m.get(key) == r {
+			m.delete(key)
+		}
+	}
+}
+
+// generation returns a number that changes whenever the rules do.
+func (rs *ruleSet) generation() uint64 {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.gen
+}
+
+// ruleMatch is a rule that matches a name, and how.
+type ruleMatch struct {
+	rule    *rule
+	kind    int  // of the entry matched, which for typo variants is their own
+	depth   int  // labels in a wildcard's suffix, more being more specific
+	variant bool // the entry is a typo variant of the rule
+}
+
+// outranks reports whether m takes precedence over o for a name both match.
+func (m ruleMatch) outranks(o ruleMatch) bool {
+	switch {
+	case m.rule.Priority != o.rule.Priority:
+		return m.rule.Priority > o.rule.Priority
+	case m.kind != o.kind:
+		return m.kind < o.kind
+	case m.depth != o.depth:
+		return m.depth > o.depth
+	}
+	return m.rule.seq < o.rule.seq
+}
+
+// eachMatch calls fn with every rule that matches name, which is
+// normalized. The caller holds rs.mu.
+func (rs *ruleSet) eachMatch(name string, fn func(ruleMatch)) {
+	if r := rs.exact.get(name); r != nil {
+		fn(ruleMatch{rule: r, kind: ruleExact, variant: r.isVariant(name)})
+	}
+	// A wildcard matches the names below its suffix, not the suffix itself
+	rs.wildcard.walk(name, func(suffix string, r *rule) {
+		switch {
+		case suffix == "":
+			fn(ruleMatch{rule: r, kind: ruleCatchAll})
+		case len(suffix) < len(name):
+			fn(ruleMatch{rule: r, kind: ruleWildcard, depth: strings.Count(suffix, ".") + 1, variant: r.isVariant(suffix)})
+		}
+	})
+	for _, r := range rs.regex {
+		if r.re.MatchString(name) {
+			fn(ruleMatch{rule: r, kind: ruleRegex})
+		}
+	}
+}
+
+// match returns the rule for qname, or nil if no rule applies.
+func (rs *ruleSet) match(qname string) *rule {
+	return rs.matchFor(qname, nil)
+}
+
+// matchFor returns the highest-ranked rule for qname that accept allows,
+// or any if accept is nil, or nil if there is none.
+func (rs *ruleSet) matchFor(qname string, accept func(*rule) bool) *rule {
+	name := normalizeName(qname)
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	var best ruleMatch
+	rs.eachMatch(name, func(m ruleMatch) {
+		if (best.rule == nil || m.outranks(best)) && (accept == nil || accept(m.rule)) {
+			best = m
+		}
+	})
+	return best.rule
+}
+
+// matches returns every rule that matches qname, the winner first.
+func (rs *ruleSet) matches(qname string) []ruleMatch {
+	name := normalizeName(qname)
+	var out []ruleMatch
+	rs.mu.RLock()
+	rs.eachMatch(name, func(m ruleMatch) { out = append(out, m) })
+	rs.mu.RUnlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].outranks(out[j]) })
+	return out
+}
+
+func (rs *ruleSet) len() int {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	n := 0
+	for _, m := range rs.tables() {
+		m.each(func(key string, r *rule) {
+			if !r.isVariant(key) {
+				n++
+			}
+		})
+	}
+	return n
+}
+
+// get returns the rule with exactly the given domain (including any "*."
+// prefix), or nil.
+func (rs *ruleSet) get(domain string) *rule {
+	domain = normalizeRuleDomain(domain)
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	m, key := rs.table(domain)
+	if r := m.get(key); r != nil && !r.isVariant(key) {
+		return r
+	}
+	return nil
+}
+
+// hasBelow reports whether a rule names name, normalized, or a name below
+// it, exactly or by wildcard. Typo variants and the catch-all don't count.
+func (rs *ruleSet) hasBelow(name string) bool {
+	named := func(key string, r *rule) bool {
+		return key != "" && !r.isVariant(key)
+	}
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.exact.below(name, named) || rs.wildcard.below(name, named)
+}
+
+// remove deletes the rule for domain and reports whether there was one.
+func (rs *ruleSet) remove(domain string) bool {
+	domain = normalizeRuleDomain(domain)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	m, key := rs.table(domain)
+	r := m.get(key)
+	if r == nil || r.isVariant(key) {
+		return false
+	}
+	m.delete(key)
+	rs.dropVariants(r)
+	rs.gen++
+	return true
+}
+
+// list returns a copy of every rule, sorted by domain.
+func (rs *ruleSet) list() []rule {
+	rs.mu.RLock()
+	out := make([]rule, 0, rs.exact.len()+rs.wildcard.len()+rs.regex.len())
+	for _, m := range rs.tables() {
+		m.each(func(key string, r *rule) {
+			if !r.isVariant(key) {
+				out = append(out, *r)
+			}
+		})
+	}
+	rs.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Domain < out[j].Domain })
+	return out
+}
+
+// pooled returns the addresses of the rules with several to answer with,
+// each once.
+func (rs *ruleSet) pooled() []net.IP {
+	seen := make(map[string]bool)
+	var out []net.IP
+	rs.mu.RLock()
+	for _, m := range rs.tables() {
+		m.each(func(_ string, r *rule) {
+			for _, ip := range r.pool {
+				if !seen[ip.String()] {
+					seen[ip.String()] = true
+					out = append(out, ip)
+				}
+			}
+		})
+	}
+	rs.mu.RUnlock()
+	return out
+}
+
+// replace swaps in a new set of rules in one step, so queries never see a
+// half-loaded rule set. On error the current rules are left untouched.
+// Rules from threat feeds are kept, unless a new rule has the same domain.
+func (rs *ruleSet) replace(rules []*rule) error {
+	next, err := newRuleSet(rules)
+	if err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, pair := range [][2]ruleTable{{rs.exact, next.exact}, {rs.wildcard, next.wildcard}} {
+		pair[0].each(func(key string, r *rule) {
+			if old := pair[1].get(key); r.Feed != "" && (old == nil || old.isVariant(key)) {
+				pair[1].set(key, r)
+			}
+		})
+	}
+	rs.exact, rs.wildcard, rs.regex = next.exact, next.wildcard, next.regex
+	rs.seq = max(rs.seq, next.seq)
+	rs.gen++
+	return nil
+}
+
+// replaceFeed swaps the rules from the named feed for rules, which must be
+// valid. Domains that already have a rule of their own or from another
+// feed keep it. It returns how many rules were added and how many were
+// shadowed by existing ones.
+func (rs *ruleSet) replaceFeed(feed string, rules []*rule) (added, shadowed int) {
+	for _, r := range rules {
+		r.addr = net.ParseIP(r.IP)
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.gen++
+	for _, m := range []ruleTable{rs.exact, rs.wildcard} {
+		var stale []string
+		m.each(func(key string, r *rule) {
+			if r.Feed == feed {
+				stale = append(stale, key)
+			}
+		})
+		for _, key := range stale {
+			m.delete(key)
+		}
+	}
+	for _, r := range rules {
+		m, key := rs.table(r.Domain)
+		if old := m.get(key); old != nil && !old.isVariant(key) {
+			shadowed++
+			continue
+		}
+		rs.seq++
+		r.seq = rs.seq
+		m.set(key, r)
+		added++
+	}
+	return added, shadowed
+}
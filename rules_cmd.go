@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// rulesCommand implements "rules", whose one subcommand so far, explain,
+// shows which of a config file's rules would answer a name and why, e.g.
+//
+//	DeceptiveDNS rules explain -config config.yaml www.corp.local
+func rulesCommand(args []string) int {
+	if len(args) == 0 || args[0] != "explain" {
+		fmt.Fprintln(os.Stderr, "usage: DeceptiveDNS rules explain [-profile name] -config file.yaml name")
+		return 2
+	}
+	fs := flag.NewFlagSet("rules explain", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Config file whose rules to check")
+	profile := fs.String("profile", "", "Profile of the config file to apply")
+	domain := fs.String("domain", "", "Also add a rule for this domain, as serve -domain does")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *configPath == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: DeceptiveDNS rules explain [-profile name] -config file.yaml name")
+		return 2
+	}
+	cfg, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *domain != "" {
+		cfg.Rules = append(cfg.Rules, &rule{Domain: *domain})
+	}
+	rs, err := newRuleSet(cfg.Rules)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	name := normalizeName(fs.Arg(0))
+	ms := rs.matches(name)
+	if len(ms) == 0 {
+		fmt.Printf("No rule matches %s; it would be forwarded, replayed or ignored.\n", name)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tRULE\tKIND\tPRIORITY\tANSWER")
+	for i, m := range ms {
+		mark := ""
+		if i == 0 {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", mark, m.rule.Domain, m.describe(), m.rule.Priority, m.rule.answerString())
+	}
+	tw.Flush()
+	fmt.Println()
+	fmt.Println(explainWinner(name, ms))
+	for _, m := range ms {
+		if len(m.rule.MAC) > 0 {
+			fmt.Printf("%s only answers clients with MAC %s; for the others the next rule down answers.\n", m.rule.Domain, strings.Join(m.rule.MAC, ", "))
+		}
+		if len(m.rule.QTypes) > 0 {
+			fmt.Printf("%s handles some query types its own way: %s.\n", m.rule.Domain, m.rule.policy.String())
+		}
+	}
+	return 0
+}
+
+// describe names the kind of match m is.
+func (m ruleMatch) describe() string {
+	if m.variant {
+		return ruleKindNames[m.kind] + " (typo variant)"
+	}
+	return ruleKindNames[m.kind]
+}
+
+// answerString describes what r answers with.
+func (r *rule) answerString() string {
+	switch {
+	case !r.answers():
+		return r.Action
+	case r.IP != "":
+		return r.IP
+	case len(r.IPs) > 0:
+		return strings.Join(r.IPs, ",")
+	}
+	return "default address"
+}
+
+// explainWinner says why the first of ms, which are sorted, wins name.
+func explainWinner(name string, ms []ruleMatch) string {
+	w := ms[0]
+	if len(ms) == 1 {
+		return fmt.Sprintf("%s answers %s, the only rule that matches it.", w.rule.Domain, name)
+	}
+	o := ms[1]
+	var why string
+	switch {
+	case w.rule.Priority != o.rule.Priority:
+		why = fmt.Sprintf("its priority %d is above %s's %d", w.rule.Priority, o.rule.Domain, o.rule.Priority)
+	case w.kind != o.kind:
+		why = fmt.Sprintf("at equal priority, %s rules come before %s rules such as %s", ruleKindNames[w.kind], ruleKindNames[o.kind], o.rule.Domain)
+	case w.depth != o.depth:
+		why = fmt.Sprintf("it is a more specific wildcard than %s", o.rule.Domain)
+	default:
+		why = fmt.Sprintf("it was listed before %s, and regular expressions are tried in order", o.rule.Domain)
+	}
+	return fmt.Sprintf("%s answers %s: %s.", w.rule.Domain, name, why)
+}
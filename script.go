@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var (
+	scriptCalls  = expvar.NewInt("script_calls")
+	scriptErrors = expvar.NewInt("script_errors")
+)
+
+// scriptLoadTimeout bounds the script's top-level code, which may load data
+// before the first query.
+const scriptLoadTimeout = 10 * time.Second
+
+// queryScript runs the query function of a Lua script for each unicast DNS
+// query, letting it choose the answer. Lua states can't be shared between
+// goroutines, so queries handled at once each get their own; every state
+// runs the same script but keeps its own globals.
+type queryScript struct {
+	path    string
+	proto   *lua.FunctionProto
+	timeout time.Duration // per call
+	idle    chan *lua.LState
+}
+
+// loadQueryScript compiles the script at path and runs it once to check
+// that it defines a query function. Up to states Lua states are kept
+// between queries.
+func loadQueryScript(path string, timeout time.Duration, states int) (*queryScript, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(src), path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+	qs := &queryScript{path: path, proto: proto, timeout: timeout, idle: make(chan *lua.LState, states)}
+	L, err := qs.newState()
+	if err != nil {
+		return nil, err
+	}
+	qs.put(L)
+	return qs, nil
+}
+
+func (qs *queryScript) newState() (*lua.LState, error) {
+	L := lua.NewState()
+	L.SetGlobal("log", L.NewFunction(scriptLog))
+	ctx, cancel := context.WithTimeout(context.Background(), scriptLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	L.Push(L.NewFunctionFromProto(qs.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	L.SetTop(0)
+	if L.GetGlobal("query").Type() != lua.LTFunction {
+		L.Close()
+		return nil, errors.New("script defines no query function")
+	}
+	return L, nil
+}
+
+// scriptLog is the script's log(message) function.
+func scriptLog(L *lua.LState) int {
+	slog.Info("Script log", "where", strings.TrimSuffix(L.Where(1), ":"), "message", L.CheckString(1))
+	return 0
+}
+
+func (qs *queryScript) get() (*lua.LState, error) {
+	select {
+	case L := <-qs.idle:
+		return L, nil
+	default:
+		return qs.newState()
+	}
+}
+
+func (qs *queryScript) put(L *lua.LState) {
+	select {
+	case qs.idle <- L:
+	default:
+		L.Close()
+	}
+}
+
+func (qs *queryScript) close() {
+	for {
+		select {
+		case L := <-qs.idle:
+			L.Close()
+		default:
+			return
+		}
+	}
+}
+
+// decide calls the script's query function for ev, where matched is the
+// rule the query would be answered by otherwise. It returns nil to leave
+// the query to the rules, as it does when the script fails.
+func (qs *queryScript) decide(ev *queryEvent, matched *rule) *queryVerdict {
+	scriptCalls.Add(1)
+	v, err := qs.call(ev, matched)
+	if err != nil {
+		scriptErrors.Add(1)
+		slog.Warn("Query script failed", "path", qs.path, "client", ev.Client, "qname", ev.QName, "err", err)
+		return nil
+	}
+	return v
+}
+
+func (qs *queryScript) call(ev *queryEvent, matched *rule) (*queryVerdict, error) {
+	L, err := qs.get()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), qs.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	q := L.NewTable()
+	q.RawSetString("name", lua.LString(normalizeName(ev.QName)))
+	q.RawSetString("type", lua.LString(ev.QType))
+	q.RawSetString("client", lua.LString(ev.Client))
+	q.RawSetString("port", lua.LNumber(ev.Port))
+	q.RawSetString("listener", lua.LString(ev.Listener))
+	q.RawSetString("time", lua.LNumber(float64(ev.Time.UnixNano())/1e9))
+	if ev.Fingerprint != "" {
+		q.RawSetString("fingerprint", lua.LString(ev.Fingerprint))
+		q.RawSetString("software", lua.LString(ev.Software))
+	}
+	if matched != nil {
+		q.RawSetString("rule", lua.LString(matched.Domain))
+	}
+	err = L.CallByParam(lua.P{Fn: L.GetGlobal("query"), NRet: 1, Protect: true}, q)
+	if err != nil {
+		// A state interrupted mid-call may be left inconsistent
+		L.Close()
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.SetTop(0)
+	L.RemoveContext()
+	qs.put(L)
+	return scriptResult(ret, matched)
+}
+
+// scriptResult turns the query function's return value into a verdict:
+// nothing or "default" for the rules' answer, an action name, or a table
+// with an action (default "answer") and the ip, ttl, canary, rule and
+// extended error to answer with.
+func scriptResult(ret lua.LValue, matched *rule) (*queryVerdict, error) {
+	a := hookAnswer{Action: "answer"}
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LString:
+		a.Action = string(ret)
+	case *lua.LTable:
+		if action, ok := ret.RawGetString("action").(lua.LString); ok {
+			a.Action = string(action)
+		}
+		if name, ok := ret.RawGetString("rule").(lua.LString); ok {
+			a.Rule = string(name)
+		}
+		if ip, ok := ret.RawGetString("ip").(lua.LString); ok {
+			a.IP = string(ip)
+		}
+		switch ede := ret.RawGetString("ede").(type) {
+		case lua.LString:
+			a.EDE = string(ede)
+		case lua.LNumber:
+			a.EDE = ede.String()
+		}
+		if text, ok := ret.RawGetString("ede_text").(lua.LString); ok {
+			a.EDEText = string(text)
+		}
+		if canary, ok := ret.RawGetString("canary").(lua.LBool); ok {
+			c := bool(canary)
+			a.Canary = &c
+		}
+		if ttl, ok := ret.RawGetString("ttl").(lua.LNumber); ok {
+			if ttl < 1 || ttl > 1<<31-1 {
+				return nil, fmt.Errorf("query returned invalid ttl %v", ttl)
+			}
+			a.TTL = uint32(ttl)
+		}
+	default:
+		return nil, fmt.Errorf("query returned a %s, want nothing, an action or a table", ret.Type())
+	}
+	return a.verdict(matched)
+}
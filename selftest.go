@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// selfTestLabel stands in for the "*" of wildcard rules in self-test queries.
+const selfTestLabel = "deceptivedns-selftest"
+
+// selfTest queries every rule through the socket at addr and checks that
+// our own answer comes back. It catches setups where another resolver, such
+// as systemd-resolved on 127.0.0.53, receives the traffic instead. Self-test
+// queries are answered normally but produce no events or alerts.
+func (s *dnsServer) selfTest(addr *net.UDPAddr) error {
+	target := *addr
+	if target.IP == nil || target.IP.IsUnspecified() {
+		target.IP = net.IPv4(127, 0, 0, 1)
+		if addr.IP.To4() == nil {
+			target.IP = net.IPv6loopback
+		}
+	}
+	conn, err := net.DialUDP("udp", nil, &target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s.selfTestAddr.Store(conn.LocalAddr().(*net.UDPAddr))
+	defer s.selfTestAddr.Store(nil)
+	local := target.AddrPort().Addr().Unmap()
+	client := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+
+	rules := s.rules.list()
+	buf := make([]byte, 65535)
+	for i, r := range rules {
+		if k := r.kind(); k == ruleRegex || k == ruleCatchAll || !r.answers() || len(r.macs) > 0 {
+			continue // no name to ask for, or no answer to expect for this host
+		}
+		name := r.Domain
+		if suffix, ok := strings.CutPrefix(name, "*."); ok {
+			name = selfTestLabel + "." + suffix
+		}
+		if w := s.rules.match(name); w == nil || w.Domain != r.Domain {
+			continue // another rule outranks it for that name
+		}
+		q := dnsMsg{ID: uint16(i), Question: dnsQuestion{Name: name, Type: dnsTypeA, Class: dnsClassIN}}
+		want := s.answerFor(&r, dnsTypeA, local, client)
+		if want == nil {
+			q.Question.Type = dnsTypeAAAA
+			want = s.answerFor(&r, dnsTypeAAAA, local, client)
+		}
+		req, err := q.pack()
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(req); err != nil {
+			return fmt.Errorf("sending query for %s to %s: %w", name, &target, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		var resp dnsMsg
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					return fmt.Errorf("no answer for %s from %s; is another resolver (such as systemd-resolved) bound to this port?", name, &target)
+				}
+				return fmt.Errorf("query for %s to %s: %w", name, &target, err)
+			}
+			if n >= 2 && binary.BigEndian.Uint16(buf[:2]) == q.ID && resp.unpack(buf[:n]) == nil {
+				break
+			}
+		}
+		if len(resp.Answers) != 1 || !resp.Answers[0].Data.Equal(want) {
+			var got []string
+			for _, rr := range resp.Answers {
+				got = append(got, rr.Data.String())
+			}
+			return fmt.Errorf("%s %s answered [%s] (%s), want %s; another resolver may be answering on %s",
+				typeString(q.Question.Type), name, strings.Join(got, " "), rcodeString(resp.Flags), want, &target)
+		}
+	}
+	slog.Info("Self-test passed", "rules", len(rules), "addr", target.String())
+	return nil
+}
+
+// isSelfTest reports whether ev is a query sent by a running self-test.
+func (s *dnsServer) isSelfTest(ev *queryEvent) bool {
+	addr := s.selfTestAddr.Load()
+	if addr == nil || addr.Port != ev.Port {
+		return false
+	}
+	client, err := netip.ParseAddr(ev.Client)
+	return err == nil && addr.AddrPort().Addr().Unmap() == client
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+func isWindowsService() bool { return false }
+
+func serviceCommand([]string) int {
+	fmt.Println("The service command is only available on Windows; use a systemd unit elsewhere.")
+	return 1
+}
+
+func runWindowsService() error {
+	return errors.New("not running on Windows")
+}
+
+// eventLogHandler is never constructed outside Windows; it exists so main
+// compiles on every platform.
+type eventLogHandler struct{ slog.Handler }
+
+func newEventLogHandler(slog.Leveler) (*eventLogHandler, error) {
+	return nil, errors.New("the Windows Event Log is not available on this platform")
+}
+
+func (h *eventLogHandler) Close() error { return nil }
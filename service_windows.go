@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "DeceptiveDNS"
+
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// serviceCommand implements "service install|uninstall|start|stop". Any
+// arguments after "install" are stored as the service's command line, e.g.
+// "service install -domain example.com -ip 10.0.0.5".
+func serviceCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Usage: DeceptiveDNS service install|uninstall|start|stop [server flags...]")
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = controlService(func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = controlService(func(s *mgr.Service) error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+	default:
+		fmt.Println("Unknown service command:", args[0])
+		return 2
+	}
+	if err != nil {
+		fmt.Printf("service %s failed: %v\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("service %s: ok\n", args[0])
+	return 0
+}
+
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "DeceptiveDNS",
+		Description: "Deceptive DNS responder (" + strings.Join(args, " ") + ")",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"serve"}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source: %v", err)
+	}
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+func controlService(fn func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+type windowsService struct{}
+
+func (windowsService) Execute(_ []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// runWindowsService reports the server as running to the service control
+// manager and blocks until it asks us to stop.
+func runWindowsService() error {
+	return svc.Run(serviceName, windowsService{})
+}
+
+// eventLogHandler writes records to the Windows Event Log. Only the message
+// is used for the event text; attributes are appended as key=value pairs.
+type eventLogHandler struct {
+	level slog.Leveler
+	log   *eventlog.Log
+	attrs []slog.Attr
+}
+
+func newEventLogHandler(level slog.Leveler) (*eventLogHandler, error) {
+	l, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogHandler{level: level, log: l}, nil
+}
+
+func (h *eventLogHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *eventLogHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	fmt.Fprintf(&b, " time=%s", r.Time.Format(time.RFC3339))
+
+	// Event IDs: 1 informational, 2 warning, 3 error
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.log.Error(3, b.String())
+	case r.Level >= slog.LevelWarn:
+		return h.log.Warning(2, b.String())
+	default:
+		return h.log.Info(1, b.String())
+	}
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return &n
+}
+
+// WithGroup is a no-op; event text is flat.
+func (h *eventLogHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func (h *eventLogHandler) Close() error {
+	return h.log.Close()
+}
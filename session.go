@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// session is a named period of work, such as one engagement or exercise,
+// whose queries and alerts are tagged with its name so "export" can bundle
+// them afterwards. At most one is active at a time.
+type session struct {
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+}
+
+var activeSession atomic.Pointer[session]
+
+// sessionName returns the name of the active session, or "".
+func sessionName() string {
+	if s := activeSession.Load(); s != nil {
+		return s.Name
+	}
+	return ""
+}
+
+// validSessionName reports whether name can name a session: up to 64
+// letters, digits, dots, dashes and underscores, so it is safe to use in
+// file names.
+func validSessionName(name string) error {
+	if name == "" || len(name) > 64 {
+		return fmt.Errorf("invalid session name %q: want 1 to 64 characters", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid session name %q: only letters, digits, '.', '-' and '_' are allowed", name)
+		}
+	}
+	return nil
+}
+
+// startSession makes name the active session, ending any other.
+func startSession(name, via string) error {
+	if err := validSessionName(name); err != nil {
+		return err
+	}
+	prev := activeSession.Swap(&session{Name: name, Started: time.Now()})
+	if prev != nil {
+		slog.Info("Session ended", "session", prev.Name, "via", via)
+	}
+	slog.Info("Session started", "session", name, "via", via)
+	return nil
+}
+
+// endSession ends the active session, returning it, or nil if there was
+// none.
+func endSession(via string) *session {
+	prev := activeSession.Swap(nil)
+	if prev != nil {
+		slog.Info("Session ended", "session", prev.Name, "via", via)
+	}
+	return prev
+}
+
+func (a *apiServer) getSession(w http.ResponseWriter, r *http.Request) {
+	s := activeSession.Load()
+	if s == nil {
+		writeError(w, http.StatusNotFound, "no session is active")
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// putSession starts the session named in the path.
+func (a *apiServer) putSession(w http.ResponseWriter, r *http.Request) {
+	if err := startSession(r.PathValue("name"), "api"); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, activeSession.Load())
+}
+
+func (a *apiServer) deleteSession(w http.ResponseWriter, r *http.Request) {
+	if endSession("api") == nil {
+		writeError(w, http.StatusNotFound, "no session is active")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
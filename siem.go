@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var siemDropped = expvar.NewInt("siem_dropped")
+
+// siemConfig configures an ArcSight CEF or QRadar LEEF feed of query events
+// and alerts.
+type siemConfig struct {
+	Format        string `yaml:"format"`   // cef or leef
+	Target        string `yaml:"target"`   // udp://, tcp:// or unix:// syslog target, or a file path
+	Facility      string `yaml:"facility"` // syslog facility, default local4
+	Queries       string `yaml:"queries"`  // all (default), answered or none
+	notifyOptions `yaml:",inline"`
+}
+
+// siemRecord is one CEF/LEEF line with its severity on the CEF 0-10 scale.
+type siemRecord struct {
+	severity int
+	line     string
+}
+
+// siemSink formats events as CEF or LEEF and writes one line per event to
+// a syslog receiver or a file. Query events are queued; alerts arrive via
+// siemAlerts on the alerter's delivery goroutine and are written directly.
+type siemSink struct {
+	format  string
+	queries string
+
+	mu     sync.Mutex
+	closed bool
+	syslog *syslogWriter
+	file   *os.File
+
+	records chan siemRecord
+	wg      sync.WaitGroup
+}
+
+func newSIEMSink(cfg siemConfig) (*siemSink, error) {
+	s := &siemSink{format: cfg.Format, queries: cfg.Queries, records: make(chan siemRecord, 4096)}
+	if s.format != "cef" && s.format != "leef" {
+		return nil, fmt.Errorf("invalid siem format %q (want cef or leef)", cfg.Format)
+	}
+	switch s.queries {
+	case "":
+		s.queries = "all"
+	case "all", "answered", "none":
+	default:
+		return nil, fmt.Errorf("invalid siem queries option %q (want all, answered or none)", cfg.Queries)
+	}
+	if cfg.Target == "" {
+		return nil, errors.New("siem output needs a target")
+	}
+
+	var err error
+	if strings.Contains(cfg.Target, "://") {
+		if cfg.Facility == "" {
+			cfg.Facility = "local4"
+		}
+		s.syslog, err = newSyslogWriter(cfg.Target, cfg.Facility)
+	} else {
+		s.file, err = os.OpenFile(cfg.Target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *siemSink) Write(ev *queryEvent) {
+	if s.queries == "none" || (s.queries == "answered" && ev.Action != "answered") {
+		return
+	}
+	var rec siemRecord
+	if s.format == "cef" {
+		rec = cefQuery(ev)
+	} else {
+		rec = leefQuery(ev)
+	}
+	select {
+	case s.records <- rec:
+	default:
+		siemDropped.Add(1)
+	}
+}
+
+func (s *siemSink) run() {
+	defer s.wg.Done()
+	for rec := range s.records {
+		if err := s.writeRecord(rec); err != nil {
+			siemDropped.Add(1)
+			slog.Warn("SIEM write failed", "err", err)
+		}
+	}
+}
+
+func (s *siemSink) writeRecord(rec siemRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("siem output closed")
+	}
+	if s.file != nil {
+		_, err := s.file.WriteString(rec.line + "\n")
+		return err
+	}
+	s.syslog.mu.Lock()
+	defer s.syslog.mu.Unlock()
+	s.syslog.severity = 6 // info
+	if rec.severity >= 7 {
+		s.syslog.severity = 4 // warning
+	}
+	_, err := s.syslog.Write([]byte(rec.line))
+	return err
+}
+
+func (s *siemSink) Close() error {
+	close(s.records)
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return s.syslog.Close()
+}
+
+// siemAlerts delivers alerts to a siemSink. It is a separate type so the
+// alerter does not close the sink a second time.
+type siemAlerts struct{ s *siemSink }
+
+func (a siemAlerts) String() string { return a.s.format + " output" }
+
+func (a siemAlerts) Notify(ctx context.Context, al *alert) error {
+	if a.s.format == "cef" {
+		return a.s.writeRecord(cefAlert(al))
+	}
+	return a.s.writeRecord(leefAlert(al))
+}
+
+func querySeverity(ev *queryEvent) int {
+	if ev.Action == "answered" {
+		return 3
+	}
+	return 1
+}
+
+func alertSeverity(al *alert) int {
+	switch al.Kind {
+	case "canary":
+		return 9
+	case "first_seen":
+		return 5
+	}
+	return 7
+}
+
+// listenerPort returns the local IP and port a query arrived on, leaving the
+// IP empty for wildcard listeners.
+func listenerPort(listener string) (string, string) {
+	host, port, err := net.SplitHostPort(listener)
+	if err != nil {
+		return "", ""
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = ""
+	}
+	return host, port
+}
+
+// cefLine builds a CEF:0 line. Header fields escape backslash, pipe and
+// newlines; extension values escape backslash, equals and newlines. Names
+// from queries belong in the extension, not the header.
+func cefLine(sigID, name string, severity int, ext [][2]string) string {
+	hdr := strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", `\n`, "\r", `\r`)
+	val := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|SarahRoseLives|DeceptiveDNS|%s|%s|%s|%d|", hdr.Replace(version), hdr.Replace(sigID), hdr.Replace(name), severity)
+	first := true
+	for i, kv := range ext {
+		// Skip empty values, and custom labels whose value is empty
+		if kv[1] == "" || (strings.HasSuffix(kv[0], "Label") && i+1 < len(ext) && ext[i+1][1] == "") {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(kv[0] + "=" + val.Replace(kv[1]))
+	}
+	return b.String()
+}
+
+func cefQuery(ev *queryEvent) siemRecord {
+	dst, dpt := listenerPort(ev.Listener)
+	sev := querySeverity(ev)
+	return siemRecord{sev, cefLine("query:"+ev.Action, "DNS query "+ev.Action, sev, [][2]string{
+		{"rt", strconv.FormatInt(ev.Time.UnixMilli(), 10)},
+		{"src", ev.Client},
+		{"spt", strconv.Itoa(ev.Port)},
+		{"dst", dst},
+		{"dpt", dpt},
+		{"proto", "UDP"},
+		{"app", "DNS"},
+		{"act", ev.Action},
+		{"outcome", ev.RCode},
+		{"cs1Label", "qname"}, {"cs1", ev.QName},
+		{"cs2Label", "qtype"}, {"cs2", ev.QType},
+		{"cs3Label", "rule"}, {"cs3", ev.Rule},
+		{"cs4Label", "answer"}, {"cs4", strings.Join(ev.Answer, ",")},
+		{"cn1Label", "latencyMicros"}, {"cn1", strconv.FormatInt(ev.Latency.Microseconds(), 10)},
+	})}
+}
+
+func cefAlert(al *alert) siemRecord {
+	sev := alertSeverity(al)
+	return siemRecord{sev, cefLine("alert:"+al.Kind, "DNS alert "+al.Kind, sev, [][2]string{
+		{"rt", strconv.FormatInt(al.Time.UnixMilli(), 10)},
+		{"src", al.Client},
+		{"app", "DNS"},
+		{"msg", al.Message},
+		{"cs1Label", "qname"}, {"cs1", al.QName},
+		{"cs2Label", "qtype"}, {"cs2", al.QType},
+		{"cs3Label", "rule"}, {"cs3", al.Rule},
+	})}
+}
+
+// leefLine builds a tab-delimited LEEF:1.0 line. Tabs and newlines are not
+// allowed inside values, nor newlines in the header, so they are replaced
+// with spaces.
+func leefLine(eventID string, attrs [][2]string) string {
+	hdr := strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	val := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|SarahRoseLives|DeceptiveDNS|%s|%s|", hdr.Replace(version), hdr.Replace(eventID))
+	first := true
+	for _, kv := range attrs {
+		if kv[1] == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte('\t')
+		}
+		first = false
+		b.WriteString(kv[0] + "=" + val.Replace(kv[1]))
+	}
+	return b.String()
+}
+
+const leefTimeFormat = "Jan 02 2006 15:04:05.000 MST"
+
+func leefQuery(ev *queryEvent) siemRecord {
+	dst, dpt := listenerPort(ev.Listener)
+	sev := querySeverity(ev)
+	return siemRecord{sev, leefLine("query:"+ev.Action, [][2]string{
+		{"cat", "DNS query"},
+		{"devTime", ev.Time.UTC().Format(leefTimeFormat)},
+		{"devTimeFormat", "MMM dd yyyy HH:mm:ss.SSS z"},
+		{"sev", strconv.Itoa(sev)},
+		{"src", ev.Client},
+		{"srcPort", strconv.Itoa(ev.Port)},
+		{"dst", dst},
+		{"dstPort", dpt},
+		{"proto", "UDP"},
+		{"action", ev.Action},
+		{"qname", ev.QName},
+		{"qtype", ev.QType},
+		{"rcode", ev.RCode},
+		{"rule", ev.Rule},
+		{"answer", strings.Join(ev.Answer, ",")},
+		{"latencyMicros", strconv.FormatInt(ev.Latency.Microseconds(), 10)},
+	})}
+}
+
+func leefAlert(al *alert) siemRecord {
+	sev := alertSeverity(al)
+	return siemRecord{sev, leefLine("alert:"+al.Kind, [][2]string{
+		{"cat", "DNS alert"},
+		{"devTime", al.Time.UTC().Format(leefTimeFormat)},
+		{"devTimeFormat", "MMM dd yyyy HH:mm:ss.SSS z"},
+		{"sev", strconv.Itoa(sev)},
+		{"src", al.Client},
+		{"qname", al.QName},
+		{"qtype", al.QType},
+		{"rule", al.Rule},
+		{"msg", al.Message},
+	})}
+}
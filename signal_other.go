@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyStatsSignal does nothing: there is no SIGUSR1 on this platform.
+func notifyStatsSignal(c chan<- os.Signal) {}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStatsSignal relays SIGUSR1, which asks for a stats dump, to c.
+func notifyStatsSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
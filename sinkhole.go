@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	httpHits        = expvar.NewInt("http_hits")
+	tlsClientHellos = expvar.NewInt("https_client_hellos")
+)
+
+// sinkholePage is served when -http-page isn't given.
+const sinkholePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Site unavailable</title></head>
+<body>
+<h1>This site is unavailable</h1>
+<p>The page you requested can't be reached from this network.</p>
+</body>
+</html>
+`
+
+// sinkholeServer answers every HTTP and HTTPS request that our DNS answers
+// steer clients to with a landing page, logging who asked for what.
+type sinkholeServer struct {
+	dns    *dnsServer
+	page   []byte
+	mux    *http.ServeMux
+	srv    *http.Server
+	tlsSrv *http.Server
+}
+
+// newSinkholeServer returns a sinkhole serving page on every path. More
+// specific handlers, such as the WPAD file, can be added to its mux before
+// it starts.
+func newSinkholeServer(dns *dnsServer, page []byte) *sinkholeServer {
+	h := &sinkholeServer{dns: dns, page: page, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/", h.serve)
+	return h
+}
+
+func (h *sinkholeServer) start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("HTTP sinkhole listening", "addr", ln.Addr().String())
+
+	h.srv = &http.Server{Handler: h.mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := h.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP sinkhole stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// startTLS serves the sinkhole over HTTPS on addr with certificates from
+// certs, minted for whatever name each client sends in SNI, or for the
+// address it connected to. The SNI is logged as soon as the client hello
+// arrives, so it's recorded even when the client then rejects the
+// certificate.
+func (h *sinkholeServer) startTLS(addr string, certs *certMinter) error {
+	tc := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tlsClientHellos.Add(1)
+			client, _, _ := net.SplitHostPort(hello.Conn.RemoteAddr().String())
+			name := hello.ServerName
+			slog.Info("HTTPS sinkhole client hello", "client", client, "sni", name)
+			if name == "" {
+				name, _, _ = net.SplitHostPort(hello.Conn.LocalAddr().String())
+			}
+			return certs.certificate(name)
+		},
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("HTTPS sinkhole listening", "addr", ln.Addr().String(), "ca", certs.ca.Subject.CommonName, "ca_sha256", certs.fingerprint())
+
+	h.tlsSrv = &http.Server{Handler: h.mux, ReadHeaderTimeout: 10 * time.Second, ErrorLog: log.New(io.Discard, "", 0)}
+	go func() {
+		if err := h.tlsSrv.Serve(tls.NewListener(ln, tc)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTPS sinkhole stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// serve logs the request along with the DNS answer that led to it, if the
+// client was answered for the requested host, and sends the landing page.
+func (h *sinkholeServer) serve(w http.ResponseWriter, r *http.Request) {
+	httpHits.Add(1)
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	host := r.Host
+	if hp, _, err := net.SplitHostPort(host); err == nil {
+		host = hp
+	}
+	attrs := []any{"client", client, "method", r.Method, "host", r.Host, "url", r.RequestURI, "user_agent", r.UserAgent()}
+	if rl := h.dns.match(host); rl != nil {
+		attrs = append(attrs, "rule", rl.Domain)
+	}
+	if t, ok := h.dns.answeredAt(client, host); ok {
+		attrs = append(attrs, "answered_ago", time.Since(t).Round(time.Millisecond))
+	}
+	if r.TLS != nil {
+		attrs = append(attrs, "sni", r.TLS.ServerName)
+	}
+	slog.Info("HTTP sinkhole hit", attrs...)
+
+	if h.dns.notice != nil {
+		if reason, until := h.dns.detect.redirected(client, time.Now()); reason != "" {
+			h.dns.notice.serve(w, client, host, reason, until)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(h.page)
+}
+
+// shutdown stops the servers once open requests finish, or ctx expires.
+func (h *sinkholeServer) shutdown(ctx context.Context) error {
+	var errs []error
+	for _, srv := range []*http.Server{h.srv, h.tlsSrv} {
+		if srv != nil {
+			errs = append(errs, srv.Shutdown(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// answeredAt returns when client was last answered for name, tracked while
+// the HTTP sinkhole runs.
+func (s *dnsServer) answeredAt(client, name string) (time.Time, bool) {
+	t, ok := s.answered.Load(client + " " + normalizeName(name))
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.(time.Time), true
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	queriesReplayed  = expvar.NewInt("queries_replayed")
+	snapshotRecorded = expvar.NewInt("snapshot_recorded")
+)
+
+// snapshotSaveInterval is how often a recording snapshot with new answers
+// is written out, so a crash loses little.
+const snapshotSaveInterval = time.Minute
+
+// snapshotEntry is one recorded upstream answer. Answer is only there for
+// people reading the file; replay sends Response as it was received.
+type snapshotEntry struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Class    string    `json:"class"`
+	RCode    string    `json:"rcode"`
+	Answer   []string  `json:"answer,omitempty"`
+	Response []byte    `json:"response"` // wire format, base64 in the file
+	Recorded time.Time `json:"recorded"`
+}
+
+type snapshotFile struct {
+	Saved   time.Time        `json:"saved"`
+	Answers []*snapshotEntry `json:"answers"`
+}
+
+// snapshot holds upstream answers by question, recorded with -record and
+// served again with -replay.
+type snapshot struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*snapshotEntry
+	dirty   bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func snapshotKey(name string, qtype, qclass uint16) string {
+	return normalizeName(name) + " " + typeString(qtype) + " " + classString(qclass)
+}
+
+// loadSnapshot reads the snapshot at path. A missing file is an empty
+// snapshot when recording to it, and an error otherwise.
+func loadSnapshot(path string, mayNotExist bool) (*snapshot, error) {
+	s := &snapshot{path: path, entries: make(map[string]*snapshotEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && mayNotExist {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f snapshotFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for _, e := range f.Answers {
+		qtype, ok := parseType(e.Type)
+		qclass, ok2 := parseClass(e.Class)
+		if !ok || !ok2 || len(e.Response) < 12 {
+			continue
+		}
+		s.entries[snapshotKey(e.Name, qtype, qclass)] = e
+	}
+	return s, nil
+}
+
+// lookup returns the recorded response to msg, with the query's ID and the
+// spelling of its name, for clients that randomise the case.
+func (s *snapshot) lookup(msg *dnsMsg, req []byte) []byte {
+	s.mu.Lock()
+	e, ok := s.entries[snapshotKey(msg.Question.Name, msg.Question.Type, msg.Question.Class)]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return respondAs(e.Response, req)
+}
+
+// record stores resp as the answer to msg, replacing any earlier one.
+// Truncated responses and server failures aren't worth replaying.
+func (s *snapshot) record(msg *dnsMsg, resp []byte) {
+	r, err := parseResponse(resp)
+	if err != nil || r.flags&0x0200 != 0 || r.flags&0xF == 2 {
+		return
+	}
+	e := &snapshotEntry{
+		Name:     normalizeName(msg.Question.Name),
+		Type:     typeString(msg.Question.Type),
+		Class:    classString(msg.Question.Class),
+		RCode:    rcodeString(r.flags),
+		Response: append([]byte(nil), resp...),
+		Recorded: time.Now().UTC(),
+	}
+	for _, rr := range r.sections[0] {
+		e.Answer = append(e.Answer, typeString(rr.typ)+" "+rr.data)
+	}
+	s.mu.Lock()
+	s.entries[snapshotKey(msg.Question.Name, msg.Question.Type, msg.Question.Class)] = e
+	s.dirty = true
+	s.mu.Unlock()
+	snapshotRecorded.Add(1)
+}
+
+// forget drops the answers for names in zone and returns how many there
+// were.
+func (s *snapshot) forget(zone string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, e := range s.entries {
+		if inZone(e.Name, zone) {
+			delete(s.entries, key)
+			n++
+		}
+	}
+	if n > 0 {
+		s.dirty = true
+	}
+	return n
+}
+
+// startSaving writes the snapshot out periodically until close.
+func (s *snapshot) startSaving() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		t := time.NewTicker(snapshotSaveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := s.save(); err != nil {
+					slog.Error("Failed to save snapshot", "path", s.path, "err", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops periodic saving and saves the snapshot a last time.
+func (s *snapshot) close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+	return s.save()
+}
+
+// save writes the snapshot if it has changed, replacing the file in one
+// rename so a reader never sees half of it.
+func (s *snapshot) save() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	f := snapshotFile{Saved: time.Now().UTC(), Answers: make([]*snapshotEntry, 0, len(s.entries))}
+	for _, e := range s.entries {
+		f.Answers = append(f.Answers, e)
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	sortSnapshot(f.Answers)
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(data, '\n'))
+}
+
+// writeFileAtomic replaces path with data by way of a temporary file, so
+// readers never see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sortSnapshot orders entries by name and type, so successive recordings
+// of the same lab diff cleanly.
+func sortSnapshot(entries []*snapshotEntry) {
+	key := func(e *snapshotEntry) string { return e.Name + " " + e.Type + " " + e.Class }
+	slices.SortFunc(entries, func(a, b *snapshotEntry) int { return strings.Compare(key(a), key(b)) })
+}
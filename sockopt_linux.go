@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// bindToInterface restricts a socket to traffic on the named interface with
+// SO_BINDTODEVICE, which keeps working when the interface's addresses change.
+func bindToInterface(fd uintptr, network, iface string) error {
+	return unix.BindToDevice(int(fd), iface)
+}
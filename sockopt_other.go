@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+func bindToInterface(fd uintptr, network, iface string) error {
+	return errors.New("binding to an interface is not supported on " + runtime.GOOS)
+}
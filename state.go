@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// stateSaveInterval is how often -state is checkpointed, so a crash or
+// power cut loses little.
+const stateSaveInterval = time.Minute
+
+// stateGauges are the expvar integers that measure the moment rather than
+// count up, which a restart starts over rather than adding to.
+var stateGauges = map[string]bool{
+	"handlers_in_flight": true,
+}
+
+// stateFile is what -state keeps across restarts: the counters, the
+// clients seen and the caches a restart would otherwise empty.
+type stateFile struct {
+	Saved     time.Time                   `json:"saved"`
+	Counters  map[string]int64            `json:"counters"`            // expvar counters
+	Listeners map[string]map[string]int64 `json:"listeners,omitempty"` // local address -> counter -> value
+	RuleHits  map[string]int64            `json:"rule_hits,omitempty"`
+	Clients   map[string]time.Time        `json:"clients,omitempty"`  // client IP -> first seen
+	Answered  map[string]time.Time        `json:"answered,omitempty"` // client IP and name -> last answered, for the HTTP sinkhole
+	Leases    []stateLease                `json:"dhcp_leases,omitempty"`
+	Bans      []banStatus                 `json:"bans,omitempty"` // bans in force and clients with strikes
+}
+
+type stateLease struct {
+	MAC     string     `json:"mac"`
+	Addr    netip.Addr `json:"addr"`
+	Expires time.Time  `json:"expires"`
+}
+
+// stateKeeper saves the server's state to path periodically until close.
+type stateKeeper struct {
+	path string
+	dns  *dnsServer
+	stop chan struct{}
+	done chan struct{}
+}
+
+// restoreState loads the state saved at path into s, adding the saved
+// counters to the current ones. It runs once the listeners are open, so
+// their counters can be restored too. A missing file is a first start.
+func (s *dnsServer) restoreState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st stateFile
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+
+	for name, v := range st.Counters {
+		if c, ok := expvar.Get(name).(*expvar.Int); ok && !stateGauges[name] {
+			c.Add(v)
+		}
+	}
+	for addr, counters := range st.Listeners {
+		stats, ok := listenerStats.Get(addr).(*expvar.Map)
+		if !ok {
+			continue // no longer listening there
+		}
+		for name, v := range counters {
+			stats.Add(name, v)
+		}
+	}
+	for domain, v := range st.RuleHits {
+		n, _ := s.ruleHits.LoadOrStore(domain, new(atomic.Int64))
+		n.(*atomic.Int64).Add(v)
+	}
+	for client, t := range st.Clients {
+		s.seenClients.LoadOrStore(client, t)
+	}
+	if s.trackAnswers {
+		for key, t := range st.Answered {
+			s.answered.LoadOrStore(key, t)
+		}
+	}
+	restored := s.dhcp.restore(st.Leases)
+	bans := 0
+	if s.detect.ban != nil {
+		bans = s.detect.ban.restore(st.Bans)
+	}
+	slog.Info("Restored state", "path", path, "saved", st.Saved, "clients", len(st.Clients), "rules", len(st.RuleHits), "dhcp_leases", restored, "bans", bans)
+	return nil
+}
+
+// snapshotState collects what restoreState brings back.
+func (s *dnsServer) snapshotState() stateFile {
+	st := stateFile{
+		Saved:     time.Now().UTC(),
+		Counters:  make(map[string]int64),
+		Listeners: make(map[string]map[string]int64),
+		RuleHits:  make(map[string]int64),
+		Clients:   make(map[string]time.Time),
+		Answered:  make(map[string]time.Time),
+		Leases:    s.dhcp.leaseList(),
+	}
+	if s.detect.ban != nil {
+		st.Bans = s.detect.ban.snapshot()
+	}
+	expvar.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok && !stateGauges[kv.Key] {
+			st.Counters[kv.Key] = v.Value()
+		}
+	})
+	listenerStats.Do(func(l expvar.KeyValue) {
+		counters := make(map[string]int64)
+		l.Value.(*expvar.Map).Do(func(kv expvar.KeyValue) {
+			counters[kv.Key] = kv.Value.(*expvar.Int).Value()
+		})
+		st.Listeners[l.Key] = counters
+	})
+	s.ruleHits.Range(func(k, v any) bool {
+		st.RuleHits[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	s.seenClients.Range(func(k, v any) bool {
+		st.Clients[k.(string)] = v.(time.Time)
+		return true
+	})
+	s.answered.Range(func(k, v any) bool {
+		st.Answered[k.(string)] = v.(time.Time)
+		return true
+	})
+	return st
+}
+
+func (s *dnsServer) startStateKeeper(path string) *stateKeeper {
+	k := &stateKeeper{path: path, dns: s, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(k.done)
+		t := time.NewTicker(stateSaveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := k.save(); err != nil {
+					slog.Error("Failed to save state", "path", k.path, "err", err)
+				}
+			case <-k.stop:
+				return
+			}
+		}
+	}()
+	return k
+}
+
+// close stops periodic saving and saves the state a last time.
+func (k *stateKeeper) close() error {
+	close(k.stop)
+	<-k.done
+	return k.save()
+}
+
+func (k *stateKeeper) save() error {
+	data, err := json.MarshalIndent(k.dns.snapshotState(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(k.path, append(data, '\n'))
+}
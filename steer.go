@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	steerProbes   = expvar.NewInt("steering_probes")
+	steerFailures = expvar.NewInt("steering_probe_failures")
+)
+
+const (
+	steerFall = 2 // consecutive failed probes that mark an address down
+	steerRise = 2 // consecutive answered probes that bring it back
+
+	steerDefaultPort     = 80
+	steerDefaultInterval = 10 * time.Second
+	steerDefaultTimeout  = time.Second
+)
+
+// steeringConfig is the "steering" section of the config file: probing the
+// addresses of rules with several, so their answers avoid the ones that
+// are down and favour the fastest.
+type steeringConfig struct {
+	Probe     string        `yaml:"probe"`     // "tcp" or "icmp", or empty to share answers out without probing
+	Port      int           `yaml:"port"`      // port tcp probes connect to, default 80
+	Interval  time.Duration `yaml:"interval"`  // time between probes of each address, default 10s
+	Timeout   time.Duration `yaml:"timeout"`   // time a probe may take, default 1s
+	Tolerance time.Duration `yaml:"tolerance"` // how much slower than the fastest address others may be and still be answered with, default 0
+}
+
+// steerer keeps track of whether the addresses of rules with several are
+// reachable and how quickly, probing each every interval. An address that
+// fails steerFall probes in a row is down until it answers steerRise in a
+// row; one that fails its first probe is down from the start, until it
+// answers once. Answers go to the up addresses within tolerance of the fastest,
+// shared out by client so each keeps getting the same one; when all are
+// down, to any of them, as answering with a dead address is no worse than
+// not answering.
+type steerer struct {
+	cfg  steeringConfig
+	stop chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	targets map[string]*steerTarget // by address
+}
+
+type steerTarget struct {
+	up        bool
+	probed    bool          // at least once
+	answered  bool          // at least once
+	rtt       time.Duration // smoothed over recent probes
+	failures  int           // in a row
+	successes int           // in a row, while down
+	changed   time.Time
+	err       string // of the last failed probe
+}
+
+// steerStatus is an address's health as the stats API shows it.
+type steerStatus struct {
+	Address  string    `json:"address"`
+	Up       bool      `json:"up"`
+	RTTms    float64   `json:"rtt_ms"`
+	Failures int       `json:"consecutive_failures"`
+	Error    string    `json:"error,omitempty"`
+	Since    time.Time `json:"since"` // when it last went up or down
+}
+
+// newSteerer returns nil if cfg configures no probing.
+func newSteerer(cfg steeringConfig) (*steerer, error) {
+	switch cfg.Probe {
+	case "":
+		return nil, nil
+	case "tcp", "icmp":
+	default:
+		return nil, fmt.Errorf("steering: unknown probe %q (want tcp or icmp)", cfg.Probe)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = steerDefaultPort
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = steerDefaultInterval
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = steerDefaultTimeout
+	}
+	switch {
+	case cfg.Port < 0 || cfg.Port > 65535:
+		return nil, fmt.Errorf("steering: invalid port %d", cfg.Port)
+	case cfg.Interval < 0 || cfg.Timeout < 0 || cfg.Tolerance < 0:
+		return nil, errors.New("steering: interval, timeout and tolerance must not be negative")
+	case cfg.Timeout >= cfg.Interval:
+		return nil, errors.New("steering: timeout must be below interval")
+	}
+	return &steerer{cfg: cfg, targets: make(map[string]*steerTarget)}, nil
+}
+
+// start probes the addresses of rs's rules until close, picking up rules
+// added or changed since the last round on each.
+func (st *steerer) start(rs *ruleSet) {
+	st.stop, st.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(st.done)
+		tick := time.NewTicker(st.cfg.Interval)
+		defer tick.Stop()
+		for {
+			st.probeAll(rs.pooled())
+			select {
+			case <-tick.C:
+			case <-st.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops probing. It is safe on a nil steerer.
+func (st *steerer) close() {
+	if st == nil || st.stop == nil {
+		return
+	}
+	close(st.stop)
+	<-st.done
+}
+
+// probeAll probes addrs at once and forgets addresses no rule has any more.
+func (st *steerer) probeAll(addrs []net.IP) {
+	keep := make(map[string]bool, len(addrs))
+	var wg sync.WaitGroup
+	for _, ip := range addrs {
+		keep[ip.String()] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtt, err := st.probe(ip)
+			st.report(ip.String(), rtt, err)
+		}()
+	}
+	wg.Wait()
+	st.mu.Lock()
+	for addr := range st.targets {
+		if !keep[addr] {
+			delete(st.targets, addr)
+		}
+	}
+	st.mu.Unlock()
+}
+
+// probe checks ip is reachable, returning how long it took to answer.
+func (st *steerer) probe(ip net.IP) (time.Duration, error) {
+	steerProbes.Add(1)
+	if st.cfg.Probe == "icmp" {
+		return pingProbe(ip, st.cfg.Timeout)
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(st.cfg.Port)), st.cfg.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+// pingSeq numbers echo requests, so replies to earlier ones are ignored.
+var pingSeq atomic.Uint32
+
+// pingProbe sends ip an ICMP echo request and waits for the reply. It uses
+// an unprivileged ping socket where the system allows one, which Linux only
+// does for the groups in net.ipv4.ping_group_range, and a raw socket, which
+// needs root or CAP_NET_RAW, where it doesn't.
+func pingProbe(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	network, raw, laddr, proto := "udp4", "ip4:icmp", "0.0.0.0", 1
+	var echo, reply icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, raw, laddr, proto = "udp6", "ip6:ipv6-icmp", "::", 58
+		echo, reply = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	c, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		if c, err = icmp.ListenPacket(raw, laddr); err != nil {
+			return 0, err
+		}
+		dst = &net.IPAddr{IP: ip}
+	}
+	defer c.Close()
+	id, seq := os.Getpid()&0xffff, int(pingSeq.Add(1)&0xffff)
+	req, err := (&icmp.Message{Type: echo, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("DeceptiveDNS")}}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	c.SetDeadline(start.Add(timeout))
+	if _, err := c.WriteTo(req, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		m, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || m.Type != reply {
+			continue
+		}
+		// The kernel sets the ID of echoes sent over ping sockets, and a
+		// raw socket sees the replies to every echo on the host
+		e, ok := m.Body.(*icmp.Echo)
+		if ok && e.Seq == seq && (e.ID == id || dst.Network() == "udp") && string(e.Data) == "DeceptiveDNS" {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// report records the outcome of a probe of addr.
+func (st *steerer) report(addr string, rtt time.Duration, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.targets[addr]
+	if !ok {
+		t = &steerTarget{up: true, changed: time.Now()}
+		st.targets[addr] = t
+	}
+	if err != nil {
+		steerFailures.Add(1)
+		t.failures++
+		t.successes = 0
+		t.err = err.Error()
+		if t.up && (t.failures >= steerFall || !t.probed) {
+			t.up, t.changed = false, time.Now()
+			slog.Warn("Answer address is down, steering answers away from it", "addr", addr, "err", err)
+		}
+		t.probed = true
+		return
+	}
+	first := !t.answered
+	if first {
+		t.rtt = rtt
+	} else {
+		t.rtt = (3*t.rtt + rtt) / 4
+	}
+	t.probed, t.answered = true, true
+	t.failures = 0
+	t.err = ""
+	if !t.up {
+		if t.successes++; t.successes >= steerRise || first {
+			t.up, t.changed, t.successes = true, time.Now(), 0
+			slog.Info("Answer address is back up", "addr", addr, "rtt", t.rtt)
+		}
+	}
+}
+
+// pick returns the address of pool, one of a rule's, to answer a query
+// of type qtype from client with: of the right family if pool has any, and
+// of those the ones steering favours. It is safe on a nil steerer, which
+// only shares them out.
+func (st *steerer) pick(pool []net.IP, qtype uint16, client netip.Addr) net.IP {
+	candidates := poolFamily(pool, qtype)
+	if st != nil {
+		candidates = st.favoured(candidates)
+	}
+	// The same client gets the same address while the candidates last
+	h := fnv.New32a()
+	b, _ := client.MarshalBinary()
+	h.Write(b)
+	return candidates[h.Sum32()%uint32(len(candidates))]
+}
+
+// poolFamily returns the IPv6 addresses of pool for AAAA queries and the
+// IPv4 ones otherwise, or all of them if it has none of that family.
+func poolFamily(pool []net.IP, qtype uint16) []net.IP {
+	var out []net.IP
+	for _, ip := range pool {
+		if (ip.To4() == nil) == (qtype == dnsTypeAAAA) {
+			out = append(out, ip)
+		}
+	}
+	if len(out) == 0 {
+		return pool
+	}
+	return out
+}
+
+// favoured returns the addresses of candidates that are up and within
+// tolerance of the fastest of them, or all candidates if none are up.
+// Addresses not probed yet count as up and as fast as the fastest.
+func (st *steerer) favoured(candidates []net.IP) []net.IP {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fastest := time.Duration(-1)
+	for _, ip := range candidates {
+		if t, ok := st.targets[ip.String()]; ok && t.up && (fastest < 0 || t.rtt < fastest) {
+			fastest = t.rtt
+		}
+	}
+	var out []net.IP
+	for _, ip := range candidates {
+		t, ok := st.targets[ip.String()]
+		if !ok || t.up && t.rtt <= fastest+st.cfg.Tolerance {
+			out = append(out, ip)
+		}
+	}
+	if len(out) == 0 {
+		return candidates
+	}
+	return out
+}
+
+// status returns the health of every address probed, sorted. It is safe on
+// a nil steerer.
+func (st *steerer) status() []steerStatus {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	out := make([]steerStatus, 0, len(st.targets))
+	for addr, t := range st.targets {
+		out = append(out, steerStatus{
+			Address:  addr,
+			Up:       t.up,
+			RTTms:    float64(t.rtt.Microseconds()) / 1000,
+			Failures: t.failures,
+			Error:    t.err,
+			Since:    t.changed,
+		})
+	}
+	st.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var streamDropped = expvar.NewInt("stream_dropped")
+
+// eventBroker is an event sink that fans query events out to live
+// subscribers (SSE and WebSocket clients). Slow subscribers miss events
+// rather than slowing down the query path.
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[chan *queryEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subs: make(map[chan *queryEvent]struct{})}
+}
+
+func (b *eventBroker) Write(ev *queryEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			streamDropped.Add(1)
+		}
+	}
+}
+
+func (b *eventBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		close(ch)
+		delete(b.subs, ch)
+	}
+	return nil
+}
+
+func (b *eventBroker) subscribe() chan *queryEvent {
+	ch := make(chan *queryEvent, 256)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan *queryEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// eventFilter selects events by the client, qname and action query
+// parameters. qname accepts shell-style patterns such as *.corp.
+type eventFilter struct {
+	client, qname, action string
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	q := r.URL.Query()
+	return eventFilter{client: q.Get("client"), qname: strings.ToLower(q.Get("qname")), action: q.Get("action")}
+}
+
+func (f eventFilter) match(ev *queryEvent) bool {
+	if f.client != "" && f.client != ev.Client {
+		return false
+	}
+	if f.action != "" && f.action != ev.Action {
+		return false
+	}
+	if f.qname != "" {
+		if ok, _ := path.Match(f.qname, strings.ToLower(ev.QName)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// handleEventStream serves /api/events. Clients sending a WebSocket upgrade
+// get one JSON text frame per event; everyone else gets Server-Sent Events.
+func (b *eventBroker) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	if isWebSocket(r) {
+		b.serveWebSocket(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	filter := newEventFilter(r)
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !filter.match(ev) {
+				continue
+			}
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: query\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455).
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// isWebSocket reports whether r asks for a WebSocket upgrade.
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// originAllowed reports whether the page that sent r, if a browser did,
+// may use the API: a page it serves itself, or from one of origins.
+func originAllowed(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // not a browser
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.ContainsFunc(origins, func(o string) bool { return strings.EqualFold(o, origin) })
+}
+
+// serveWebSocket performs the RFC 6455 handshake and pushes events until the
+// client disconnects. Incoming frames are only read to answer pings and
+// notice close requests.
+func (b *eventBroker) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "bad websocket handshake", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	filter := newEventFilter(r)
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	var wmu sync.Mutex
+	send := func(op byte, payload []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := conn.Write(wsFrame(op, payload))
+		return err
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, payload, err := readWSFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsOpPing:
+				send(wsOpPong, payload)
+			case wsOpClose:
+				send(wsOpClose, nil)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				send(wsOpClose, nil)
+				return
+			}
+			if !filter.match(ev) {
+				continue
+			}
+			data, _ := json.Marshal(ev)
+			if err := send(wsOpText, data); err != nil {
+				slog.Debug("WebSocket client went away", "remote", conn.RemoteAddr(), "err", err)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// wsFrame builds a single unmasked, final frame.
+func wsFrame(op byte, payload []byte) []byte {
+	f := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		f = append(f, byte(n))
+	case n <= 0xFFFF:
+		f = append(f, 126)
+		f = binary.BigEndian.AppendUint16(f, uint16(n))
+	default:
+		f = append(f, 127)
+		f = binary.BigEndian.AppendUint64(f, uint64(n))
+	}
+	return append(f, payload...)
+}
+
+// readWSFrame reads one client frame and unmasks its payload. Control frames
+// are small, and we never expect data frames, so large payloads are refused.
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	op := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 64<<10 {
+		return 0, nil, fmt.Errorf("websocket frame too large")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return op, payload, nil
+}
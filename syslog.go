@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogWriter sends RFC 5424 messages to a syslog receiver. Each Write is
+// one message; the severity of the message being written is set by
+// syslogHandler while it holds mu.
+type syslogWriter struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	facility int
+	severity int
+	hostname string
+	conn     net.Conn
+}
+
+// newSyslogWriter parses a target of the form udp://host:514, tcp://host:601
+// or unix:///dev/log and connects to it.
+func newSyslogWriter(target, facility string) (*syslogWriter, error) {
+	fac, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog target %q: %v", target, err)
+	}
+
+	w := &syslogWriter{facility: fac}
+	switch u.Scheme {
+	case "udp", "tcp":
+		w.network, w.addr = u.Scheme, u.Host
+		if u.Port() == "" {
+			w.addr = net.JoinHostPort(u.Hostname(), "514")
+		}
+	case "unix":
+		w.network, w.addr = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("unsupported syslog scheme %q (want udp, tcp or unix)", u.Scheme)
+	}
+	if w.hostname, err = os.Hostname(); err != nil || w.hostname == "" {
+		w.hostname = "-"
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write must be called with mu held.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	line := fmt.Sprintf("<%d>1 %s %s DeceptiveDNS %d - - %s",
+		w.facility*8+w.severity, time.Now().Format(time.RFC3339Nano), w.hostname, os.Getpid(), msg)
+	if w.network == "tcp" {
+		// RFC 6587 octet-counting framing
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+
+	if w.conn == nil {
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.conn.Write([]byte(line)); err != nil {
+		// Reconnect once, e.g. after the receiver restarted
+		w.conn.Close()
+		w.conn = nil
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+		if _, err := w.conn.Write([]byte(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
+
+// syslogSeverity maps slog levels onto syslog severities.
+func syslogSeverity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3 // err
+	case l >= slog.LevelWarn:
+		return 4 // warning
+	case l >= slog.LevelInfo:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
+
+// syslogHandler formats records with an ordinary slog handler and ships the
+// result to syslog with a severity matching the record level.
+type syslogHandler struct {
+	inner slog.Handler
+	w     *syslogWriter
+}
+
+func newSyslogHandler(w *syslogWriter, format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// The syslog header already carries the timestamp
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return nameTraceLevel(groups, a)
+		},
+	}
+	var inner slog.Handler = slog.NewTextHandler(w, opts)
+	if format == "json" {
+		inner = slog.NewJSONHandler(w, opts)
+	}
+	return &syslogHandler{inner: inner, w: w}
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.inner.Enabled(ctx, l)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.severity = syslogSeverity(r.Level)
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithAttrs(attrs), w: h.w}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithGroup(name), w: h.w}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes, after stdin,
+// stdout and stderr.
+const sdListenFDsStart = 3
+
+// listenActivated adopts the UDP sockets systemd passed under socket
+// activation, as sd_listen_fds(3) describes, and returns how many it found.
+// The environment variables are cleared so child processes don't see them.
+// -iface and -sockets don't apply to these sockets; the .socket unit's
+// BindToDevice= and ReusePort= settings do the same job.
+func (s *dnsServer) listenActivated() int {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return 0
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	found := 0
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(sdListenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(sdListenFDsStart+i), name)
+		pc, err := net.FilePacketConn(f)
+		f.Close() // FilePacketConn made its own copy
+		if err != nil {
+			slog.Warn("Ignoring inherited socket that isn't a datagram socket", "name", name, "err", err)
+			continue
+		}
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			slog.Warn("Ignoring inherited socket that isn't UDP", "name", name, "addr", pc.LocalAddr().String())
+			pc.Close()
+			continue
+		}
+		l := &listener{conn: conn, addr: conn.LocalAddr().String()}
+		if v, ok := listenerStats.Get(l.addr).(*expvar.Map); ok {
+			l.stats = v
+		} else {
+			l.stats = new(expvar.Map)
+			listenerStats.Set(l.addr, l.stats)
+		}
+		s.listeners = append(s.listeners, l)
+		found++
+	}
+	return found
+}
+
+// sdNotify sends a state change such as "READY=1" to systemd when the
+// service runs with Type=notify, and does nothing otherwise.
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Failed to notify systemd", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Failed to notify systemd", "err", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// listenTCP opens a TCP socket for queries and zone transfers on addr. Like
+// listen, an address without a host gets separate IPv4 and IPv6 sockets.
+func (s *dnsServer) listenTCP(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		if err := s.listenTCPNetwork("tcp4", net.JoinHostPort("0.0.0.0", port)); err != nil {
+			return err
+		}
+		if err := s.listenTCPNetwork("tcp6", net.JoinHostPort("::", port)); err != nil {
+			slog.Warn("Not listening on IPv6 TCP", "port", port, "err", err)
+		}
+		return nil
+	}
+	return s.listenTCPNetwork("tcp", addr)
+}
+
+func (s *dnsServer) listenTCPNetwork(network, addr string) error {
+	lc := net.ListenConfig{Control: s.socketOptions}
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return err
+	}
+	s.tcpListeners = append(s.tcpListeners, ln)
+	return nil
+}
+
+// serveTCP accepts connections on ln until shutdown, within the limits
+// of the connections section for its protocol. The caller adds to
+// s.readers first.
+func (s *dnsServer) serveTCP(ln net.Listener) {
+	defer s.readers.Done()
+	addr := ln.Addr().String()
+	stats := new(expvar.Map)
+	name, limits := addr+"/tcp", s.conns.TCP
+	if _, ok := ln.(dotListener); ok {
+		name, limits = addr+"/dot", s.conns.DoT
+		slog.Info("DNS server listening on TLS", "addr", addr, "max_conns", limits.MaxConns)
+	} else {
+		slog.Info("DNS server listening on TCP", "addr", addr, "max_conns", limits.MaxConns, "axfr_zones", s.axfr.zoneNames())
+	}
+	listenerStats.Set(name, stats)
+	cl := newConnLimiter(limits, stats)
+	s.connLimiters.Store(name, cl)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.stopping.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Error accepting TCP connection", "listener", addr, "err", err)
+			s.listenFailed(ln, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.listenErrors.Delete(ln)
+		if s.repl.standby() {
+			queriesStandby.Add(1)
+			stats.Add("standby", 1)
+			conn.Close()
+			continue
+		}
+		client := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+		if !cl.acquire(client) {
+			conn.Close()
+			continue
+		}
+		s.tcpConns.Add(1)
+		go func() {
+			idle := s.handleTCP(conn, addr, stats, limits.IdleTimeout)
+			cl.release(client, idle)
+		}()
+	}
+}
+
+// handleTCP answers the length-prefixed messages on one connection until
+// the client closes it, goes idle or the server stops, reporting whether
+// it went idle.
+func (s *dnsServer) handleTCP(conn net.Conn, addr string, stats *expvar.Map, idleTimeout time.Duration) (idle bool) {
+	defer s.tcpConns.Done()
+	defer conn.Close()
+	s.tcpOpen.Store(conn, struct{}{})
+	defer s.tcpOpen.Delete(conn)
+
+	remote := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	if !s.monitor && s.detect.banned(remote.Addr().Unmap().String(), time.Now()) {
+		// Zone transfers too are off limits to banned clients
+		queriesBanned.Add(1)
+		stats.Add("banned", 1)
+		return false
+	}
+	l := &listener{
+		addr:  addr,
+		local: conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr(),
+		stats: stats,
+		tcp:   conn,
+	}
+	_, l.tls = conn.(*tls.Conn)
+	buf := make([]byte, 65535)
+	for !s.stopping.Load() {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		var prefix [2]byte
+		if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+			return errors.Is(err, os.ErrDeadlineExceeded) && !s.stopping.Load()
+		}
+		msg := buf[:binary.BigEndian.Uint16(prefix[:])]
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return errors.Is(err, os.ErrDeadlineExceeded) && !s.stopping.Load()
+		}
+		conn.SetReadDeadline(time.Time{})
+		l.pad = l.tls && wantsPadding(msg)
+		if isAXFR(msg) {
+			s.handleAXFR(l, remote, msg)
+			continue
+		}
+		s.handleRequest(l, remote, msg)
+	}
+	return false
+}
+
+// reply sends a response to addr, over UDP or, on the listener of a TCP
+// connection, with its length prefix. Over TLS, responses to queries that
+// asked for it are padded; DoT is the only encrypted transport served.
+func (l *listener) reply(b []byte, addr netip.AddrPort) error {
+	if l.pad {
+		b = padMessage(b)
+	}
+	if l.tcp != nil {
+		if len(b) > 65535 {
+			return errors.New("message too long for TCP")
+		}
+		_, err := l.tcp.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+		return err
+	}
+	_, err := l.conn.WriteToUDPAddrPort(b, addr)
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxMintedCerts bounds the certificate cache, which clients fill with
+// whatever names they send.
+const maxMintedCerts = 10000
+
+// certMinter issues a certificate for every name TLS clients ask for, signed
+// by one CA. Leaf certificates share a key and are cached by name.
+type certMinter struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// newCertMinter loads the CA from PEM files, or creates a throwaway one for
+// this run when both paths are empty.
+func newCertMinter(certFile, keyFile string) (*certMinter, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	m := &certMinter{key: key, certs: make(map[string]*tls.Certificate)}
+	if certFile == "" && keyFile == "" {
+		m.caKey = key
+		tmpl := &x509.Certificate{
+			SerialNumber:          randomSerial(),
+			Subject:               pkix.Name{CommonName: "DeceptiveDNS CA", Organization: []string{"DeceptiveDNS"}},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().AddDate(1, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			return nil, err
+		}
+		m.ca, err = x509.ParseCertificate(der)
+		return m, err
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if m.ca, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if !m.ca.IsCA {
+		return nil, errors.New("certificate is not a CA certificate")
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key can't sign")
+	}
+	m.caKey = signer
+	return m, nil
+}
+
+// fingerprint is the SHA-256 fingerprint of the CA certificate, for
+// checking what a client was asked to trust.
+func (m *certMinter) fingerprint() string {
+	sum := sha256.Sum256(m.ca.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certificate returns the certificate for name, minting it on first use.
+func (m *certMinter) certificate(name string) (*tls.Certificate, error) {
+	name = normalizeName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.certs[name]; ok {
+		return c, nil
+	}
+	if len(m.certs) >= maxMintedCerts {
+		clear(m.certs)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, 397), // the most browsers accept
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &m.key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{Certificate: [][]byte{der, m.ca.Raw}, PrivateKey: m.key}
+	m.certs[name] = c
+	return c, nil
+}
+
+func randomSerial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return n
+}
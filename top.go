@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	topMaxWindow = 24 * time.Hour
+	topDefaultN  = 10
+	topMaxKeys   = 4096 // distinct keys a bucket counts per table, the rest go under topOther
+	topOther     = "(other)"
+)
+
+// topStats counts queries per rule, name and client in one-minute buckets
+// for the last hour and one-hour buckets for the last day, so the busiest
+// of each can be listed for any recent window without searching the logs.
+type topStats struct {
+	mu      sync.Mutex
+	minutes [60]topBucket
+	hours   [24]topBucket
+}
+
+type topBucket struct {
+	start   int64 // unix seconds, 0 if unused
+	queries int64
+	rules   map[string]int64
+	names   map[string]int64
+	clients map[string]int64
+}
+
+// topEntry is one row of a top-N table.
+type topEntry struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// topReport holds the busiest rules, names and clients over a window.
+type topReport struct {
+	Window  string     `json:"window"`
+	Since   time.Time  `json:"since"`
+	Queries int64      `json:"queries"`
+	Rules   []topEntry `json:"rules"`
+	Names   []topEntry `json:"names"`
+	Clients []topEntry `json:"clients"`
+}
+
+func newTopStats() *topStats {
+	return &topStats{}
+}
+
+// add counts ev in the buckets for its minute and hour.
+func (t *topStats) add(ev *queryEvent) {
+	ts := ev.Time.Unix()
+	name := normalizeName(ev.QName)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range []*topBucket{t.bucket(t.minutes[:], ts, 60), t.bucket(t.hours[:], ts, 3600)} {
+		b.queries++
+		if ev.Rule != "" {
+			countKey(b.rules, ev.Rule, topMaxKeys)
+		}
+		countKey(b.names, name, topMaxKeys)
+		countKey(b.clients, ev.Client, topMaxKeys)
+	}
+}
+
+// bucket returns the bucket in ring that ts falls in, emptying it first if
+// it still holds an older period.
+func (t *topStats) bucket(ring []topBucket, ts, width int64) *topBucket {
+	start := ts - ts%width
+	b := &ring[(ts/width)%int64(len(ring))]
+	if b.start != start {
+		*b = topBucket{
+			start:   start,
+			rules:   make(map[string]int64),
+			names:   make(map[string]int64),
+			clients: make(map[string]int64),
+		}
+	}
+	return b
+}
+
+// countKey counts key in m, or under topOther once m holds limit keys.
+func countKey(m map[string]int64, key string, limit int) {
+	if _, ok := m[key]; !ok && len(m) >= limit {
+		key = topOther
+	}
+	m[key]++
+}
+
+// report returns the n busiest rules, names and clients over the window
+// ending now, or all of them if n is 0. Windows up to an hour are rounded
+// up to whole minutes and longer ones to whole hours.
+func (t *topStats) report(window time.Duration, n int, now time.Time) (*topReport, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("window %s is not positive", window)
+	}
+	if window > topMaxWindow {
+		return nil, fmt.Errorf("window %s is longer than the %s kept", window, topMaxWindow)
+	}
+	ring, width := t.minutes[:], int64(60)
+	if window > time.Hour {
+		ring, width = t.hours[:], 3600
+	}
+	buckets := (int64(window/time.Second) + width - 1) / width
+	ts := now.Unix()
+	since := ts - ts%width - (buckets-1)*width
+
+	rules := make(map[string]int64)
+	names := make(map[string]int64)
+	clients := make(map[string]int64)
+	rep := &topReport{Window: window.String(), Since: time.Unix(since, 0)}
+	t.mu.Lock()
+	for i := range ring {
+		b := &ring[i]
+		if b.start < since || b.start > ts {
+			continue
+		}
+		rep.Queries += b.queries
+		for k, v := range b.rules {
+			rules[k] += v
+		}
+		for k, v := range b.names {
+			names[k] += v
+		}
+		for k, v := range b.clients {
+			clients[k] += v
+		}
+	}
+	t.mu.Unlock()
+	rep.Rules, rep.Names, rep.Clients = topEntries(rules, n), topEntries(names, n), topEntries(clients, n)
+	return rep, nil
+}
+
+// topEntries returns the n largest counts in m, most first.
+func topEntries(m map[string]int64, n int) []topEntry {
+	entries := make([]topEntry, 0, len(m))
+	for k, v := range m {
+		entries = append(entries, topEntry{k, v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// parseTopArgs reads the optional window and row count of a top-N request.
+func parseTopArgs(window, n string) (time.Duration, int, error) {
+	w, rows := time.Hour, topDefaultN
+	if window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid window %q", window)
+		}
+		w = d
+	}
+	if n != "" {
+		i, err := strconv.Atoi(n)
+		if err != nil || i < 0 {
+			return 0, 0, fmt.Errorf("invalid row count %q", n)
+		}
+		rows = i
+	}
+	return w, rows, nil
+}
+
+// topQueries serves GET /api/top?window=&n=.
+func (a *apiServer) topQueries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	window, n, err := parseTopArgs(q.Get("window"), q.Get("n"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	rep, err := a.dns.top.report(window, n, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// statsCommand implements "stats", which asks a running server over its
+// control socket for its busiest rules, query names and clients, e.g.
+//
+//	DeceptiveDNS stats -window 15m -n 20
+func statsCommand(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	socket := fs.String("socket", "/run/deceptivedns.sock", "Control socket of the running server")
+	window := fs.Duration("window", time.Hour, "How far back to count, up to 24h")
+	n := fs.Int("n", topDefaultN, "Rows per table (0 for all)")
+	by := fs.String("by", "", "Only show one table: rule, name or client")
+	format := fs.String("format", "table", "Output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch *by {
+	case "", "rule", "name", "client":
+	default:
+		fmt.Println("Unknown table:", *by)
+		return 2
+	}
+
+	lines, err := controlRequest(*socket, fmt.Sprintf("top %s %d", *window, *n))
+	if err != nil {
+		fmt.Println("Cannot get statistics:", err)
+		return 1
+	}
+	rep, err := parseTopReply(lines)
+	if err != nil {
+		fmt.Println("Unexpected reply from the server:", err)
+		return 1
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		tables := map[string][]topEntry{"rule": rep.Rules, "name": rep.Names, "client": rep.Clients}
+		if *by != "" {
+			enc.Encode(tables[*by])
+		} else {
+			enc.Encode(rep)
+		}
+	case "table":
+		fmt.Printf("%d queries in the last %s (since %s)\n", rep.Queries, rep.Window, rep.Since.Format("2006-01-02 15:04:05"))
+		for _, t := range []struct {
+			title   string
+			entries []topEntry
+		}{{"RULE", rep.Rules}, {"NAME", rep.Names}, {"CLIENT", rep.Clients}} {
+			if *by != "" && t.title != strings.ToUpper(*by) {
+				continue
+			}
+			fmt.Println()
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(tw, "%s\tQUERIES\tSHARE\n", t.title)
+			for _, e := range t.entries {
+				share := 0.0
+				if rep.Queries > 0 {
+					share = float64(e.Count) / float64(rep.Queries) * 100
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%.1f%%\n", e.Key, e.Count, share)
+			}
+			tw.Flush()
+		}
+	default:
+		fmt.Println("Unknown output format:", *format)
+		return 2
+	}
+	return 0
+}
+
+// parseTopReply turns the control socket's reply to "top" back into a
+// report.
+func parseTopReply(lines []string) (*topReport, error) {
+	rep := &topReport{Rules: []topEntry{}, Names: []topEntry{}, Clients: []topEntry{}}
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		var err error
+		switch f[0] {
+		case "window":
+			rep.Window = f[1]
+		case "since":
+			rep.Since, err = time.Parse(time.RFC3339, f[1])
+		case "queries":
+			rep.Queries, err = strconv.ParseInt(f[1], 10, 64)
+		case "rule", "name", "client":
+			if len(f) != 3 {
+				return nil, fmt.Errorf("malformed line %q", line)
+			}
+			e := topEntry{Key: f[1]}
+			if e.Count, err = strconv.ParseInt(f[2], 10, 64); err != nil {
+				break
+			}
+			switch f[0] {
+			case "rule":
+				rep.Rules = append(rep.Rules, e)
+			case "name":
+				rep.Names = append(rep.Names, e)
+			default:
+				rep.Clients = append(rep.Clients, e)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+	}
+	return rep, nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+const (
+	dnsTypeTSIG = 250
+	tsigFudge   = 300 // seconds of clock skew allowed, as dig and BIND use
+
+	// TSIG error codes (RFC 8945 section 3)
+	tsigBadSig  = 16
+	tsigBadKey  = 17
+	tsigBadTime = 18
+)
+
+var (
+	errTSIGBadKey  = errors.New("unknown TSIG key")
+	errTSIGBadSig  = errors.New("TSIG signature does not verify")
+	errTSIGBadTime = errors.New("TSIG time outside the allowed skew")
+)
+
+// tsigConfig is the "tsig" section of the config file: the keys signed
+// requests are checked with, and peers whose NOTIFYs are signed.
+type tsigConfig struct {
+	Keys  []tsigKeyConfig  `yaml:"keys"`
+	Peers []tsigPeerConfig `yaml:"peers"`
+}
+
+// tsigPeerConfig names the key NOTIFYs to a secondary are signed with.
+type tsigPeerConfig struct {
+	Address string `yaml:"address"` // as listed under axfr notify
+	Key     string `yaml:"key"`
+}
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// tsigKeyConfig is a shared secret zone transfers can be signed with, as
+// made by tsig-keygen or dnssec-keygen.
+type tsigKeyConfig struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm"` // hmac-sha256 (default), hmac-sha512 or hmac-sha1
+	Secret    string `yaml:"secret"`    // base64
+}
+
+type tsigKey struct {
+	name      string // lower case, without the trailing dot
+	algorithm string
+	hash      func() hash.Hash
+	secret    []byte
+}
+
+func newTSIGKey(cfg tsigKeyConfig) (*tsigKey, error) {
+	k := &tsigKey{name: normalizeName(cfg.Name), algorithm: normalizeName(cfg.Algorithm)}
+	if k.name == "" {
+		return nil, errors.New("TSIG key needs a name")
+	}
+	if k.algorithm == "" {
+		k.algorithm = "hmac-sha256"
+	}
+	if k.hash = tsigAlgorithms[k.algorithm]; k.hash == nil {
+		return nil, fmt.Errorf("TSIG key %s: unsupported algorithm %q (want hmac-sha256, hmac-sha512 or hmac-sha1)", k.name, cfg.Algorithm)
+	}
+	var err error
+	if k.secret, err = base64.StdEncoding.DecodeString(cfg.Secret); err != nil || len(k.secret) == 0 {
+		return nil, fmt.Errorf("TSIG key %s: secret must be base64", k.name)
+	}
+	return k, nil
+}
+
+// tsigKeyring holds the configured keys.
+type tsigKeyring struct {
+	keys  map[string]*tsigKey
+	peers map[string]*tsigKey // host:port -> key
+}
+
+// newTSIGKeyring returns nil if cfg has no keys.
+func newTSIGKeyring(cfg tsigConfig) (*tsigKeyring, error) {
+	if len(cfg.Keys) == 0 {
+		if len(cfg.Peers) > 0 {
+			return nil, errors.New("peers need keys")
+		}
+		return nil, nil
+	}
+	kr := &tsigKeyring{keys: make(map[string]*tsigKey), peers: make(map[string]*tsigKey)}
+	for _, kc := range cfg.Keys {
+		k, err := newTSIGKey(kc)
+		if err != nil {
+			return nil, err
+		}
+		if kr.keys[k.name] != nil {
+			return nil, fmt.Errorf("TSIG key %s is defined twice", k.name)
+		}
+		kr.keys[k.name] = k
+	}
+	for _, pc := range cfg.Peers {
+		k := kr.keys[normalizeName(pc.Key)]
+		if k == nil {
+			return nil, fmt.Errorf("peer %s: no key named %q", pc.Address, pc.Key)
+		}
+		kr.peers[withDefaultPort(pc.Address, "53")] = k
+	}
+	return kr, nil
+}
+
+// checkTSIGUse checks that the sections relying on TSIG keys have them.
+func checkTSIGUse(cfg *config) error {
+	if cfg.AXFR.RequireTSIG && len(cfg.TSIG.Keys) == 0 {
+		return errors.New("axfr: require_tsig needs keys in the tsig section")
+	}
+	for _, p := range cfg.TSIG.Peers {
+		if !slices.ContainsFunc(cfg.AXFR.Notify, func(n string) bool {
+			return withDefaultPort(n, "53") == withDefaultPort(p.Address, "53")
+		}) {
+			return fmt.Errorf("tsig: peer %s is not listed under axfr notify", p.Address)
+		}
+	}
+	return nil
+}
+
+// peerKey returns the key to sign messages to target with, if any.
+func (kr *tsigKeyring) peerKey(target string) *tsigKey {
+	if kr == nil {
+		return nil
+	}
+	return kr.peers[target]
+}
+
+// tsigCheck is what checking a request's signature found.
+type tsigCheck struct {
+	unsigned []byte      // the request without its TSIG record
+	sig      *tsigRecord // nil if the request isn't signed
+	key      *tsigKey    // the key sig names, if it is one of ours
+	err      error       // why the signature didn't verify
+}
+
+// check verifies the signature on msg, if it has one. The error is for
+// malformed messages; a signature that doesn't verify is reported in the
+// result.
+func (kr *tsigKeyring) check(msg []byte, now time.Time) (*tsigCheck, error) {
+	unsigned, sig, err := splitTSIG(msg)
+	if err != nil {
+		return nil, err
+	}
+	c := &tsigCheck{unsigned: unsigned, sig: sig}
+	if sig == nil {
+		return c, nil
+	}
+	if kr != nil {
+		c.key = kr.keys[sig.key]
+	}
+	if c.key == nil {
+		c.err = errTSIGBadKey
+	} else {
+		c.err = c.key.verify(unsigned, sig, nil, now)
+	}
+	return c, nil
+}
+
+// verified returns the name of the key the request was signed with, or ""
+// if it wasn't signed or didn't verify.
+func (c *tsigCheck) verified() string {
+	if c.sig == nil || c.err != nil {
+		return ""
+	}
+	return c.key.name
+}
+
+// sign signs resp, the response to the checked request. Responses to
+// unsigned requests are left alone; to requests that didn't verify, they
+// carry the TSIG error, signed only when the key is known and the
+// signature was merely late (RFC 8945 section 5.2).
+func (c *tsigCheck) sign(resp []byte, now time.Time) []byte {
+	switch {
+	case c.sig == nil:
+		return resp
+	case c.err == nil:
+		return newTSIGSigner(c.key, c.sig).sign(resp, now)
+	case c.err == errTSIGBadTime:
+		return newTSIGSigner(c.key, c.sig).signWith(resp, now, tsigBadTime, appendTime48(nil, uint64(now.Unix())))
+	}
+	code := uint16(tsigBadSig)
+	if c.err == errTSIGBadKey {
+		code = tsigBadKey
+	}
+	rdata, _ := appendName(nil, c.sig.algorithm)
+	rdata = appendTSIGTimers(rdata, c.sig.timeSigned, c.sig.fudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // no MAC
+	rdata = append(rdata, resp[0:2]...)
+	rdata = binary.BigEndian.AppendUint16(rdata, code)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	return appendTSIGRecord(resp, c.sig.key, rdata)
+}
+
+// appendTSIGRecord returns msg with a TSIG record appended.
+func appendTSIGRecord(msg []byte, key string, rdata []byte) []byte {
+	out, _ := appendRR(append([]byte(nil), msg...), &dnsResourceRecord{Name: key, Type: dnsTypeTSIG, Class: dnsClassANY, RData: rdata})
+	binary.BigEndian.PutUint16(out[10:12], binary.BigEndian.Uint16(out[10:12])+1)
+	return out
+}
+
+// tsigRecord is the TSIG record a signed message ends with.
+type tsigRecord struct {
+	key        string
+	algorithm  string
+	timeSigned uint64 // 48 bits on the wire
+	fudge      uint16
+	mac        []byte
+	origID     uint16
+	err        uint16
+	other      []byte
+}
+
+// splitTSIG returns msg as it was before it was signed, without its TSIG
+// record, and the record, which is nil if msg isn't signed.
+func splitTSIG(msg []byte) ([]byte, *tsigRecord, error) {
+	if len(msg) < 12 {
+		return nil, nil, errors.New("invalid DNS message: message too short")
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, nil, err
+		}
+		off = next + 4
+	}
+	records := 0
+	for _, c := range [][]byte{msg[6:8], msg[8:10], msg[10:12]} {
+		records += int(binary.BigEndian.Uint16(c))
+	}
+	for i := 0; i < records; i++ {
+		start := off
+		owner, next, err := readName(msg, off)
+		if err != nil {
+			return nil, nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, nil, errors.New("invalid DNS message: truncated resource record")
+		}
+		typ := binary.BigEndian.Uint16(msg[next : next+2])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8 : next+10]))
+		rdata := next + 10
+		if off = rdata + rdlen; off > len(msg) {
+			return nil, nil, errors.New("invalid DNS message: record data runs past end of message")
+		}
+		if typ != dnsTypeTSIG {
+			continue
+		}
+		if i != records-1 || binary.BigEndian.Uint16(msg[10:12]) == 0 {
+			return nil, nil, errors.New("TSIG record is not the last one")
+		}
+		t, err := parseTSIGData(msg, rdata, off)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.key = normalizeName(owner)
+		unsigned := append([]byte(nil), msg[:start]...)
+		binary.BigEndian.PutUint16(unsigned[0:2], t.origID)
+		binary.BigEndian.PutUint16(unsigned[10:12], binary.BigEndian.Uint16(msg[10:12])-1)
+		return unsigned, t, nil
+	}
+	return msg, nil, nil
+}
+
+func parseTSIGData(msg []byte, off, end int) (*tsigRecord, error) {
+	alg, off, err := readName(msg, off)
+	if err != nil {
+		return nil, err
+	}
+	t := &tsigRecord{algorithm: normalizeName(alg)}
+	if off+10 > end {
+		return nil, errors.New("invalid DNS message: truncated TSIG record")
+	}
+	t.timeSigned = uint64(binary.BigEndian.Uint16(msg[off:]))<<32 | uint64(binary.BigEndian.Uint32(msg[off+2:]))
+	t.fudge = binary.BigEndian.Uint16(msg[off+6:])
+	macLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+macLen+6 > end {
+		return nil, errors.New("invalid DNS message: truncated TSIG record")
+	}
+	t.mac = msg[off : off+macLen]
+	off += macLen
+	t.origID = binary.BigEndian.Uint16(msg[off:])
+	t.err = binary.BigEndian.Uint16(msg[off+2:])
+	otherLen := int(binary.BigEndian.Uint16(msg[off+4:]))
+	off += 6
+	if off+otherLen > end {
+		return nil, errors.New("invalid DNS message: truncated TSIG record")
+	}
+	t.other = msg[off : off+otherLen]
+	return t, nil
+}
+
+// appendTSIGVariables appends the fields of a TSIG record that are signed
+// along with the message (RFC 8945 section 4.3.3).
+func appendTSIGVariables(b []byte, key, algorithm string, timeSigned uint64, fudge, tsigErr uint16, other []byte) []byte {
+	b, _ = appendName(b, key)
+	b = binary.BigEndian.AppendUint16(b, dnsClassANY)
+	b = binary.BigEndian.AppendUint32(b, 0) // TTL
+	b, _ = appendName(b, algorithm)
+	b = appendTSIGTimers(b, timeSigned, fudge)
+	b = binary.BigEndian.AppendUint16(b, tsigErr)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(other)))
+	return append(b, other...)
+}
+
+func appendTSIGTimers(b []byte, timeSigned uint64, fudge uint16) []byte {
+	return binary.BigEndian.AppendUint16(appendTime48(b, timeSigned), fudge)
+}
+
+func appendTime48(b []byte, t uint64) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(t>>32))
+	return binary.BigEndian.AppendUint32(b, uint32(t))
+}
+
+// verify checks that a message was signed by k, where unsigned is the
+// message as splitTSIG returned it. For a response, prior is the MAC of the
+// request it answers.
+func (k *tsigKey) verify(unsigned []byte, t *tsigRecord, prior []byte, now time.Time) error {
+	if t.algorithm != k.algorithm {
+		return errTSIGBadKey
+	}
+	mac := hmac.New(k.hash, k.secret)
+	if prior != nil {
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(prior))))
+		mac.Write(prior)
+	}
+	mac.Write(unsigned)
+	mac.Write(appendTSIGVariables(nil, k.name, k.algorithm, t.timeSigned, t.fudge, t.err, t.other))
+	if !hmac.Equal(mac.Sum(nil), t.mac) {
+		return errTSIGBadSig
+	}
+	if skew := now.Unix() - int64(t.timeSigned); skew > int64(t.fudge) || -skew > int64(t.fudge) {
+		return errTSIGBadTime
+	}
+	return nil
+}
+
+// tsigSigner signs a sequence of messages with key, each MAC covering the
+// one before it: the messages of a response, starting with the request's
+// MAC, or a request, starting with none.
+type tsigSigner struct {
+	key   *tsigKey
+	prior []byte
+	first bool
+}
+
+func newTSIGSigner(key *tsigKey, request *tsigRecord) *tsigSigner {
+	sg := &tsigSigner{key: key, first: true}
+	if request != nil {
+		sg.prior = request.mac
+	}
+	return sg
+}
+
+// sign returns msg with a TSIG record appended.
+func (sg *tsigSigner) sign(msg []byte, now time.Time) []byte {
+	return sg.signWith(msg, now, 0, nil)
+}
+
+// signWith signs msg with a TSIG error and other data.
+func (sg *tsigSigner) signWith(msg []byte, now time.Time, tsigErr uint16, other []byte) []byte {
+	timeSigned := uint64(now.Unix())
+	mac := hmac.New(sg.key.hash, sg.key.secret)
+	if sg.prior != nil {
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(sg.prior))))
+		mac.Write(sg.prior)
+	}
+	mac.Write(msg)
+	if sg.first {
+		mac.Write(appendTSIGVariables(nil, sg.key.name, sg.key.algorithm, timeSigned, tsigFudge, tsigErr, other))
+	} else {
+		mac.Write(appendTSIGTimers(nil, timeSigned, tsigFudge))
+	}
+	sum := mac.Sum(nil)
+	sg.prior, sg.first = sum, false
+
+	var rdata []byte
+	rdata, _ = appendName(rdata, sg.key.algorithm)
+	rdata = appendTSIGTimers(rdata, timeSigned, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0:2]...) // original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigErr)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(other)))
+	rdata = append(rdata, other...)
+	return appendTSIGRecord(msg, sg.key.name, rdata)
+}
+
+// refuseSigned answers a signed query whose signature didn't verify with
+// NOTAUTH and the TSIG error.
+func (s *dnsServer) refuseSigned(l *listener, addr netip.AddrPort, msg *dnsMsg, tc *tsigCheck, ev *queryEvent) {
+	resp := dnsMsg{ID: msg.ID, Flags: dnsFlagsResponse | dnsRcodeNotAuth, Question: msg.Question}
+	respBytes, err := resp.pack()
+	if err == nil {
+		err = l.reply(tc.sign(respBytes, time.Now()), addr)
+	}
+	if err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending DNS response", "client", addr.String(), "qname", msg.Question.Name, "err", err)
+	}
+	slog.Warn("Signed query failed verification", "client", addr.String(), "qname", msg.Question.Name, "key", tc.sig.key, "err", tc.err)
+	ev.Action = "refused"
+	ev.RCode = rcodeString(resp.Flags)
+	ev.Latency = time.Since(ev.Time)
+	l.stats.Add(ev.Action, 1)
+	s.emit(ev)
+}
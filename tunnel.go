@@ -0,0 +1,260 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tunnelDetections = expvar.NewInt("tunnel_detections")
+	queriesLimited   = expvar.NewInt("queries_limited")
+	queriesSinkholed = expvar.NewInt("queries_sinkholed")
+	// tunnelSinkholeRule answers every query of a sinkholed client
+	tunnelSinkholeRule = &rule{Domain: "tunnel-sinkhole"}
+)
+
+const (
+	tunnelDefaultMaxLabel  = 50
+	tunnelDefaultEntropy   = 3.5
+	tunnelDefaultThreshold = 100
+	tunnelDefaultPenalty   = 10 * time.Minute
+	tunnelHalfLife         = time.Minute
+	tunnelMinSubdomain     = 24 // shorter subdomains are too short to judge by entropy
+	tunnelMaxClients       = 10000
+
+	// What each suspicious trait of a query adds to its client's score
+	tunnelLongLabelPoints = 20
+	tunnelEntropyPoints   = 10
+	tunnelTXTPoints       = 2
+)
+
+// tunnelConfig is the "tunneling" part of the "detection" section:
+// spotting clients that carry data over DNS, as tunnels such as iodine and
+// dnscat2 and exfiltration tools do.
+type tunnelConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	MaxLabel  int           `yaml:"max_label"`  // labels longer than this are suspicious, default 50
+	Entropy   float64       `yaml:"entropy"`    // bits per character at which a long subdomain is suspicious, default 3.5
+	Threshold float64       `yaml:"threshold"`  // client score that raises an alert, default 100
+	Action    string        `yaml:"action"`     // what to do with flagged clients: alert (default), rate_limit or sinkhole
+	RateLimit int           `yaml:"rate_limit"` // queries per second a rate-limited client gets, default 1
+	Penalty   time.Duration `yaml:"penalty"`    // how long the action lasts, default 10m
+	Allow     []string      `yaml:"allow"`      // domains whose queries never count, with their subdomains
+}
+
+// tunnelDetector keeps a score per client that every suspicious query adds
+// to and that halves each minute: very long labels, long high-entropy
+// subdomains, and TXT and NULL queries, which tunnels use to carry data
+// back. A client whose score reaches the threshold raises a "tunneling"
+// alert and, depending on the action, is rate limited or has every query
+// answered with the default address for the penalty period.
+type tunnelDetector struct {
+	cfg tunnelConfig
+
+	mu      sync.Mutex
+	clients map[string]*tunnelClient
+}
+
+type tunnelClient struct {
+	score   float64
+	updated time.Time
+	until   time.Time // end of the current penalty
+	limiter *rateLimiter
+}
+
+func newTunnelDetector(cfg tunnelConfig) (*tunnelDetector, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.MaxLabel == 0 {
+		cfg.MaxLabel = tunnelDefaultMaxLabel
+	}
+	if cfg.Entropy == 0 {
+		cfg.Entropy = tunnelDefaultEntropy
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = tunnelDefaultThreshold
+	}
+	if cfg.Action == "" {
+		cfg.Action = "alert"
+	}
+	if cfg.RateLimit == 0 {
+		cfg.RateLimit = 1
+	}
+	if cfg.Penalty == 0 {
+		cfg.Penalty = tunnelDefaultPenalty
+	}
+	switch {
+	case cfg.MaxLabel < 1 || cfg.MaxLabel > 63:
+		return nil, fmt.Errorf("tunneling: max_label %d is not between 1 and 63", cfg.MaxLabel)
+	case cfg.Threshold < 0 || cfg.RateLimit < 0 || cfg.Penalty < 0:
+		return nil, fmt.Errorf("tunneling: threshold, rate_limit and penalty must not be negative")
+	case cfg.Action != "alert" && cfg.Action != "rate_limit" && cfg.Action != "sinkhole":
+		return nil, fmt.Errorf("tunneling: unknown action %q (want alert, rate_limit or sinkhole)", cfg.Action)
+	}
+	for i, a := range cfg.Allow {
+		cfg.Allow[i] = normalizeName(strings.TrimPrefix(a, "*."))
+	}
+	return &tunnelDetector{cfg: cfg, clients: make(map[string]*tunnelClient)}, nil
+}
+
+// points is what ev's query adds to its client's score.
+func (d *tunnelDetector) points(ev *queryEvent) float64 {
+	name := normalizeName(ev.QName)
+	for _, a := range d.cfg.Allow {
+		if name == a || strings.HasSuffix(name, "."+a) {
+			return 0
+		}
+	}
+	var p float64
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > d.cfg.MaxLabel {
+			p += tunnelLongLabelPoints
+			break
+		}
+	}
+	if sub := subdomainOf(name); len(sub) >= tunnelMinSubdomain && charEntropy(sub) >= d.cfg.Entropy {
+		p += tunnelEntropyPoints
+	}
+	if ev.QType == "TXT" || ev.QType == "NULL" {
+		p += tunnelTXTPoints
+	}
+	return p
+}
+
+// check scores ev and returns an alert when its client crosses the
+// threshold outside a penalty it's already serving.
+func (d *tunnelDetector) check(ev *queryEvent) *alert {
+	p := d.points(ev)
+	d.mu.Lock()
+	c, ok := d.clients[ev.Client]
+	if !ok {
+		if p == 0 {
+			d.mu.Unlock()
+			return nil
+		}
+		if len(d.clients) >= tunnelMaxClients {
+			d.prune(ev.Time)
+		}
+		c = &tunnelClient{updated: ev.Time}
+		d.clients[ev.Client] = c
+	}
+	score := c.decayed(ev.Time) + p
+	c.score, c.updated = score, ev.Time
+	if score < d.cfg.Threshold || ev.Time.Before(c.until) {
+		d.mu.Unlock()
+		return nil
+	}
+	c.until = ev.Time.Add(d.cfg.Penalty)
+	if d.cfg.Action == "rate_limit" {
+		c.limiter = newRateLimiter(d.cfg.RateLimit, time.Second)
+	}
+	d.mu.Unlock()
+
+	tunnelDetections.Add(1)
+	msg := fmt.Sprintf("%s looks like it's tunneling over DNS (score %.0f, last query %s %s)", ev.Client, score, ev.QType, ev.QName)
+	switch d.cfg.Action {
+	case "rate_limit":
+		msg += fmt.Sprintf("; limiting it to %d queries per second for %s", d.cfg.RateLimit, d.cfg.Penalty)
+	case "sinkhole":
+		msg += fmt.Sprintf("; sinkholing its queries for %s", d.cfg.Penalty)
+	}
+	return &alert{Time: ev.Time, Kind: "tunneling", Client: ev.Client, QName: ev.QName, QType: ev.QType, Message: msg}
+}
+
+// enforce returns what to do with a query from client now: "drop" when a
+// rate-limited client is over its limit, "sinkhole" while a sinkholed
+// client's penalty lasts, or "".
+func (d *tunnelDetector) enforce(client string, now time.Time) string {
+	if d.cfg.Action == "alert" {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[client]
+	if !ok || !now.Before(c.until) {
+		return ""
+	}
+	if d.cfg.Action == "sinkhole" {
+		return "sinkhole"
+	}
+	if !c.limiter.allow() {
+		return "drop"
+	}
+	return ""
+}
+
+// sinkholedUntil returns when client's sinkholing ends, if it is
+// sinkholed now.
+func (d *tunnelDetector) sinkholedUntil(client string, now time.Time) (time.Time, bool) {
+	if d.cfg.Action != "sinkhole" {
+		return time.Time{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[client]
+	if !ok || !now.Before(c.until) {
+		return time.Time{}, false
+	}
+	return c.until, true
+}
+
+// release ends client's penalty and forgets its score, reporting whether
+// it had a penalty.
+func (d *tunnelDetector) release(client string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[client]
+	if !ok {
+		return false
+	}
+	delete(d.clients, client)
+	return time.Now().Before(c.until)
+}
+
+// scores returns the current score of every client that has one worth
+// mentioning.
+func (d *tunnelDetector) scores() map[string]float64 {
+	now := time.Now()
+	out := make(map[string]float64)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for client, c := range d.clients {
+		if s := c.decayed(now); s >= 1 {
+			out[client] = math.Round(s*10) / 10
+		}
+	}
+	return out
+}
+
+// prune forgets clients whose score has decayed away and that aren't
+// serving a penalty, or everyone if that isn't enough.
+func (d *tunnelDetector) prune(now time.Time) {
+	for client, c := range d.clients {
+		if c.decayed(now) < 1 && !now.Before(c.until) {
+			delete(d.clients, client)
+		}
+	}
+	if len(d.clients) >= tunnelMaxClients {
+		clear(d.clients)
+	}
+}
+
+func (c *tunnelClient) decayed(now time.Time) float64 {
+	return c.score * math.Exp2(-now.Sub(c.updated).Seconds()/tunnelHalfLife.Seconds())
+}
+
+// subdomainOf returns the labels of name left of its registrable domain,
+// where tunnels put their data, joined without dots.
+func subdomainOf(name string) string {
+	labels := strings.Split(name, ".")
+	i := registrableIndex(labels)
+	if i <= 0 {
+		return ""
+	}
+	return strings.Join(labels[:i], "")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// typoGenerators turn the registrable label of a domain, such as "example"
+// in mail.example.co.uk, into lookalikes people mistype or mistake it for.
+var typoGenerators = map[string]func(label string) []string{
+	"omission":      typoOmission,
+	"repetition":    typoRepetition,
+	"transposition": typoTransposition,
+	"replacement":   typoReplacement,
+	"insertion":     typoInsertion,
+	"hyphenation":   typoHyphenation,
+	"homoglyph":     typoHomoglyph,
+	"idn":           typoIDN,
+}
+
+// typoMaxVariants caps the variants of one rule, as idn and replacement on
+// a long label would otherwise run to thousands.
+const typoMaxVariants = 1000
+
+// qwertyNeighbors lists the keys around each key of a QWERTY keyboard.
+var qwertyNeighbors = map[byte]string{
+	'1': "2q", '2': "13wq", '3': "24ew", '4': "35re", '5': "46tr", '6': "57yt", '7': "68uy", '8': "79iu", '9': "80oi", '0': "9po",
+	'q': "12wa", 'w': "qe23sa", 'e': "wr34ds", 'r': "et45fd", 't': "ry56gf", 'y': "tu67hg", 'u': "yi78jh", 'i': "uo89kj", 'o': "ip90lk", 'p': "o0l",
+	'a': "qwsz", 's': "awedxz", 'd': "serfcx", 'f': "drtgvc", 'g': "ftyhbv", 'h': "gyujnb", 'j': "huikmn", 'k': "jiolm", 'l': "kop",
+	'z': "asx", 'x': "zsdc", 'c': "xdfv", 'v': "cfgb", 'b': "vghn", 'n': "bhjm", 'm': "njk",
+}
+
+// asciiHomoglyphs are letter groups that look alike in most fonts.
+var asciiHomoglyphs = [][2]string{
+	{"o", "0"}, {"0", "o"}, {"l", "1"}, {"1", "l"}, {"l", "i"}, {"i", "l"}, {"i", "1"},
+	{"m", "rn"}, {"rn", "m"}, {"w", "vv"}, {"vv", "w"}, {"d", "cl"}, {"cl", "d"}, {"g", "q"}, {"q", "g"},
+}
+
+// idnHomoglyphs are Cyrillic and Greek letters that are drawn like Latin
+// ones, for internationalized names that differ from the real one only in
+// script.
+var idnHomoglyphs = map[byte][]rune{
+	'a': {'а', 'α'}, 'c': {'с', 'ϲ'}, 'e': {'е'}, 'h': {'һ'}, 'i': {'і', 'ι'}, 'j': {'ј'}, 'k': {'κ'},
+	'o': {'о', 'ο'}, 'p': {'р', 'ρ'}, 's': {'ѕ'}, 'x': {'х', 'χ'}, 'y': {'у'}, 'n': {'ո'}, 'v': {'ν'},
+}
+
+// typoVariants returns the lookalikes of domain the generators named in
+// kinds produce ("all" for every one), keeping any "*." prefix and every
+// label but the registrable one. The domain itself is never among them.
+func typoVariants(domain string, kinds []string) []string {
+	wildcard, name := "", domain
+	if rest, ok := strings.CutPrefix(domain, "*."); ok {
+		wildcard, name = "*.", rest
+	}
+	labels := strings.Split(name, ".")
+	i := registrableIndex(labels)
+	if i < 0 {
+		return nil
+	}
+	if slices.Contains(kinds, "all") {
+		kinds = typoGeneratorNames()
+	}
+
+	seen := map[string]bool{labels[i]: true}
+	var out []string
+	for _, kind := range kinds {
+		for _, label := range typoGenerators[kind](labels[i]) {
+			if seen[label] || !validTypoLabel(label) {
+				continue
+			}
+			seen[label] = true
+			variant := slices.Clone(labels)
+			variant[i] = label
+			out = append(out, wildcard+strings.Join(variant, "."))
+			if len(out) == typoMaxVariants {
+				return out
+			}
+		}
+	}
+	return out
+}
+
+// checkTypoKinds reports an unknown generator name in kinds.
+func checkTypoKinds(kinds []string) error {
+	for _, k := range kinds {
+		if _, ok := typoGenerators[k]; !ok && k != "all" {
+			return fmt.Errorf("unknown variant generator %q (want all or %s)", k, strings.Join(typoGeneratorNames(), ", "))
+		}
+	}
+	return nil
+}
+
+func typoGeneratorNames() []string {
+	names := make([]string, 0, len(typoGenerators))
+	for name := range typoGenerators {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func validTypoLabel(label string) bool {
+	return label != "" && len(label) <= 63 && label[0] != '-' && label[len(label)-1] != '-'
+}
+
+func typoOmission(label string) []string {
+	var out []string
+	for i := 0; i < len(label); i++ {
+		out = append(out, label[:i]+label[i+1:])
+	}
+	return out
+}
+
+func typoRepetition(label string) []string {
+	var out []string
+	for i := 0; i < len(label); i++ {
+		out = append(out, label[:i+1]+label[i:])
+	}
+	return out
+}
+
+func typoTransposition(label string) []string {
+	var out []string
+	for i := 0; i+1 < len(label); i++ {
+		if label[i] != label[i+1] {
+			out = append(out, label[:i]+string(label[i+1])+string(label[i])+label[i+2:])
+		}
+	}
+	return out
+}
+
+func typoReplacement(label string) []string {
+	var out []string
+	for i := 0; i < len(label); i++ {
+		for _, k := range []byte(qwertyNeighbors[label[i]]) {
+			out = append(out, label[:i]+string(k)+label[i+1:])
+		}
+	}
+	return out
+}
+
+// typoInsertion adds a neighboring key next to each character, as a finger
+// catching two keys does.
+func typoInsertion(label string) []string {
+	var out []string
+	for i := 0; i < len(label); i++ {
+		for _, k := range []byte(qwertyNeighbors[label[i]]) {
+			out = append(out, label[:i]+string(k)+label[i:], label[:i+1]+string(k)+label[i+1:])
+		}
+	}
+	return out
+}
+
+func typoHyphenation(label string) []string {
+	var out []string
+	for i := 1; i < len(label); i++ {
+		out = append(out, label[:i]+"-"+label[i:])
+	}
+	return out
+}
+
+func typoHomoglyph(label string) []string {
+	var out []string
+	for _, g := range asciiHomoglyphs {
+		for i := 0; ; {
+			j := strings.Index(label[i:], g[0])
+			if j < 0 {
+				break
+			}
+			j += i
+			out = append(out, label[:j]+g[1]+label[j+len(g[0]):])
+			i = j + 1
+		}
+	}
+	return out
+}
+
+// typoIDN swaps one letter at a time for a lookalike from another script,
+// returning the punycode (xn--) form clients query.
+func typoIDN(label string) []string {
+	var out []string
+	for i := 0; i < len(label); i++ {
+		for _, r := range idnHomoglyphs[label[i]] {
+			a, err := idna.Punycode.ToASCII(label[:i] + string(r) + label[i+1:])
+			if err == nil {
+				out = append(out, a)
+			}
+		}
+	}
+	return out
+}
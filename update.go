@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	updatesReceived = expvar.NewInt("updates_received")
+	updatesApplied  = expvar.NewInt("updates_applied")
+	updatesRefused  = expvar.NewInt("updates_refused")
+)
+
+// RFC 2136 constants
+const (
+	dnsOpcodeUpdate  = 5
+	dnsClassNONE     = 254
+	dnsRcodeNotAuth  = 9
+	dnsRcodeNotZone  = 10
+	dnsFlagsUpdate   = 0x8000 | dnsOpcodeUpdate<<11 // response to an UPDATE
+	updateRecordsMax = 64                           // per name and type
+	updateNamesMax   = 10000                        // in the lab zone, so clients can't grow it without bound
+)
+
+// updateRR is one record of an UPDATE message's update section.
+type updateRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	RData []byte
+}
+
+// parseUpdate returns the update section of an UPDATE message, skipping
+// its zone and prerequisite sections.
+func parseUpdate(data []byte) ([]updateRR, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("invalid DNS message: message too short")
+	}
+	_, off, err := readName(data, 12)
+	if err != nil {
+		return nil, err
+	}
+	off += 4
+	prereqs := int(binary.BigEndian.Uint16(data[6:8]))
+	updates := int(binary.BigEndian.Uint16(data[8:10]))
+	var out []updateRR
+	for i := 0; i < prereqs+updates; i++ {
+		var rr updateRR
+		if rr.Name, off, err = readName(data, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(data) {
+			return nil, fmt.Errorf("invalid DNS message: truncated resource record")
+		}
+		rr.Type = binary.BigEndian.Uint16(data[off : off+2])
+		rr.Class = binary.BigEndian.Uint16(data[off+2 : off+4])
+		rr.TTL = binary.BigEndian.Uint32(data[off+4 : off+8])
+		rdlen := int(binary.BigEndian.Uint16(data[off+8 : off+10]))
+		off += 10
+		if off+rdlen > len(data) {
+			return nil, fmt.Errorf("invalid DNS message: record data runs past end of message")
+		}
+		rr.RData = data[off : off+rdlen]
+		off += rdlen
+		if i >= prereqs {
+			out = append(out, rr)
+		}
+	}
+	return out, nil
+}
+
+// String formats rr as the change it asks for, for events.
+func (rr *updateRR) String() string {
+	name := normalizeName(rr.Name)
+	switch {
+	case rr.Class == dnsClassANY && rr.Type == dnsTypeANY:
+		return "delete " + name
+	case rr.Class == dnsClassANY:
+		return "delete " + name + " " + typeString(rr.Type)
+	case rr.Class == dnsClassNONE:
+		return "delete " + name + " " + typeString(rr.Type) + " " + rdataString(rr.RData, 0, len(rr.RData), rr.Type)
+	}
+	return "add " + name + " " + typeString(rr.Type) + " " + rdataString(rr.RData, 0, len(rr.RData), rr.Type)
+}
+
+// updateRecord is an address registered by dynamic update.
+type updateRecord struct {
+	addr netip.Addr
+	ttl  uint32
+}
+
+// labZone holds the A and AAAA records clients have registered with DNS
+// UPDATE, in memory only. Names it has records for are answered from it.
+type labZone struct {
+	zones []string // zones updates may change, or nil for any
+
+	mu      sync.RWMutex
+	records map[string]map[uint16][]updateRecord // name -> type -> records
+	gen     uint64                               // bumped on every change
+}
+
+func newLabZone(zones []string) *labZone {
+	z := &labZone{records: make(map[string]map[uint16][]updateRecord)}
+	for _, zone := range zones {
+		z.zones = append(z.zones, normalizeName(zone))
+	}
+	return z
+}
+
+// allows reports whether updates to zone are accepted.
+func (z *labZone) allows(zone string) bool {
+	return z.zones == nil || slices.Contains(z.zones, normalizeName(zone))
+}
+
+// inZone reports whether name is zone or below it.
+func inZone(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// apply makes the changes in updates to zone. Like a real server it checks
+// every record before changing anything, returning the RCODE to answer
+// with. Records of types other than A and AAAA are accepted but not kept,
+// and updates that would add names to a full zone are refused.
+func (z *labZone) apply(zone string, updates []updateRR) uint16 {
+	zone = normalizeName(zone)
+	for _, rr := range updates {
+		if !inZone(normalizeName(rr.Name), zone) {
+			return dnsRcodeNotZone
+		}
+		switch rr.Class {
+		case dnsClassIN, dnsClassANY, dnsClassNONE:
+		default:
+			return dnsRcodeFormErr
+		}
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	added := make(map[string]bool)
+	for _, rr := range updates {
+		name := normalizeName(rr.Name)
+		if _, ok := z.records[name]; !ok && rr.Class == dnsClassIN && (rr.Type == dnsTypeA || rr.Type == dnsTypeAAAA) {
+			added[name] = true
+		}
+	}
+	if len(added) > 0 && len(z.records)+len(added) > updateNamesMax {
+		return dnsRcodeRefused
+	}
+	z.gen++
+	for _, rr := range updates {
+		name := normalizeName(rr.Name)
+		switch {
+		case rr.Class == dnsClassANY && rr.Type == dnsTypeANY:
+			delete(z.records, name)
+		case rr.Class == dnsClassANY:
+			delete(z.records[name], rr.Type)
+		default:
+			if (rr.Type != dnsTypeA || len(rr.RData) != 4) && (rr.Type != dnsTypeAAAA || len(rr.RData) != 16) {
+				continue
+			}
+			addr, _ := netip.AddrFromSlice(rr.RData)
+			types := z.records[name]
+			if types == nil {
+				types = make(map[uint16][]updateRecord)
+				z.records[name] = types
+			}
+			recs := slices.DeleteFunc(types[rr.Type], func(r updateRecord) bool { return r.addr == addr })
+			if rr.Class == dnsClassIN && len(recs) < updateRecordsMax {
+				recs = append(recs, updateRecord{addr: addr, ttl: rr.TTL})
+			}
+			types[rr.Type] = recs
+		}
+		if types := z.records[name]; len(types[dnsTypeA])+len(types[dnsTypeAAAA]) == 0 {
+			delete(z.records, name)
+		}
+	}
+	return 0
+}
+
+// answers returns the registered records of type qtype (or both types,
+// for ANY) for name, and whether the zone has any records for name at all.
+func (z *labZone) answers(name string, qtype uint16) ([]dnsResourceRecord, bool) {
+	key := normalizeName(name)
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	types, ok := z.records[key]
+	if !ok {
+		return nil, false
+	}
+	var out []dnsResourceRecord
+	for _, t := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		if qtype != t && qtype != dnsTypeANY {
+			continue
+		}
+		for _, r := range types[t] {
+			out = append(out, dnsResourceRecord{Name: name, Type: t, Class: dnsClassIN, TTL: r.ttl, Data: net.IP(r.addr.AsSlice())})
+		}
+	}
+	return out, true
+}
+
+// generation returns a number that changes whenever the records do.
+func (z *labZone) generation() uint64 {
+	if z == nil {
+		return 0
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.gen
+}
+
+// names returns the names the zone has records for.
+func (z *labZone) names() []string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	names := make([]string, 0, len(z.records))
+	for name := range z.records {
+		names = append(names, name)
+	}
+	return names
+}
+
+// handleUpdate answers a DNS UPDATE message. Without -updates accept it is
+// refused, as are unsigned ones with -update-tsig and those whose signature
+// doesn't verify; either way it is logged with the changes it asked for.
+func (s *dnsServer) handleUpdate(l *listener, addr netip.AddrPort, msg *dnsMsg, req []byte, ev *queryEvent) {
+	updatesReceived.Add(1)
+	ev.QType = "UPDATE"
+	ev.Action = "update"
+	defer func() {
+		ev.Latency = time.Since(ev.Time)
+		l.stats.Add(ev.Action, 1)
+		s.emit(ev)
+	}()
+
+	updates, err := parseUpdate(req)
+	if err != nil {
+		queriesMalformed.Add(1)
+		slog.Warn("Error unpacking DNS update", "client", addr.String(), "err", err)
+		ev.Action = "ignored"
+		return
+	}
+	tc, err := s.tsig.check(req, ev.Time)
+	if err != nil {
+		queriesMalformed.Add(1)
+		slog.Warn("Error unpacking DNS update", "client", addr.String(), "err", err)
+		ev.Action = "ignored"
+		return
+	}
+	ev.TSIG = tc.verified()
+	for i := range updates {
+		ev.Answer = append(ev.Answer, updates[i].String())
+	}
+	if s.monitor {
+		queriesMonitored.Add(1)
+		ev.Action = "monitored"
+		return
+	}
+
+	var rcode uint16 = dnsRcodeRefused
+	switch {
+	case tc.err != nil:
+		rcode = dnsRcodeNotAuth
+	case s.updates == nil:
+	case s.updateTSIG && tc.sig == nil:
+	case msg.Question.Class != dnsClassIN || msg.Question.Type != dnsTypeSOA:
+		rcode = dnsRcodeFormErr
+	case !s.updates.allows(msg.Question.Name):
+		rcode = dnsRcodeNotAuth
+	default:
+		rcode = s.updates.apply(msg.Question.Name, updates)
+	}
+	if rcode == 0 {
+		updatesApplied.Add(1)
+	} else {
+		updatesRefused.Add(1)
+	}
+
+	resp := dnsMsg{ID: msg.ID, Flags: dnsFlagsUpdate | rcode, Question: msg.Question}
+	var scratch [512]byte
+	respBytes, err := resp.appendPack(scratch[:0])
+	if err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error packing DNS update response", "client", addr.String(), "zone", msg.Question.Name, "err", err)
+		return
+	}
+	respBytes = tc.sign(respBytes, time.Now())
+	if err := l.reply(respBytes, addr); err != nil {
+		queryErrors.Add(1)
+		slog.Error("Error sending DNS update response", "client", addr.String(), "zone", msg.Question.Name, "err", err)
+		return
+	}
+	ev.RCode = rcodeString(resp.Flags)
+	if s.keepWire {
+		ev.Response = slices.Clone(respBytes)
+	}
+}
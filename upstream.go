@@ -0,0 +1,200 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	upstreamFall = 3 // consecutive failures that mark an upstream down
+	upstreamRise = 2 // consecutive successes that bring it back
+)
+
+// upstreamPool is the set of -forward resolvers, in order of preference.
+// Queries go to the first healthy one. An upstream that fails upstreamFall
+// times in a row, answering queries or probes, is marked down until it
+// answers upstreamRise times in a row; while it's down its queries fail
+// over to the next healthy one, and when it comes back they fail back.
+type upstreamPool struct {
+	list  []*upstream
+	probe time.Duration // how often every upstream is probed, 0 for never
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type upstream struct {
+	addr    string
+	queries atomic.Int64 // attempts sent, probes included
+	errors  atomic.Int64 // attempts that failed
+	spoofed atomic.Int64 // datagrams that weren't the response to an attempt
+
+	mu        sync.Mutex
+	healthy   bool
+	failures  int // in a row
+	successes int // in a row, while down
+	changed   time.Time
+	rtt       time.Duration // of the last answer
+
+	spoofAlerted time.Time // when a spoofing alert was last raised about it
+}
+
+// upstreamStatus is an upstream's health as the stats API shows it.
+type upstreamStatus struct {
+	Address   string    `json:"address"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"consecutive_failures"`
+	Queries   int64     `json:"queries"`
+	Errors    int64     `json:"errors"`
+	Spoofed   int64     `json:"spoofed"`
+	LastRTTms float64   `json:"last_rtt_ms"`
+	Since     time.Time `json:"since"` // when it last went up or down
+}
+
+func newUpstreamPool(addrs []string, probe time.Duration) *upstreamPool {
+	p := &upstreamPool{probe: probe}
+	for _, a := range addrs {
+		p.list = append(p.list, &upstream{addr: a, healthy: true, changed: time.Now()})
+	}
+	return p
+}
+
+// pick returns the upstream for the given attempt at a query: the first
+// healthy one, then on retries the healthy ones after it in turn. With none
+// healthy every upstream is tried in turn, in case one has recovered.
+func (p *upstreamPool) pick(attempt int) *upstream {
+	var healthy []*upstream
+	for _, u := range p.list {
+		u.mu.Lock()
+		if u.healthy {
+			healthy = append(healthy, u)
+		}
+		u.mu.Unlock()
+	}
+	if len(healthy) == 0 {
+		healthy = p.list
+	}
+	return healthy[attempt%len(healthy)]
+}
+
+// report records the outcome of an attempt sent to u.
+func (u *upstream) report(err error, rtt time.Duration) {
+	u.queries.Add(1)
+	if err != nil {
+		u.errors.Add(1)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err == nil {
+		u.failures, u.rtt = 0, rtt
+		if !u.healthy {
+			if u.successes++; u.successes >= upstreamRise {
+				u.healthy, u.successes, u.changed = true, 0, time.Now()
+				slog.Info("Upstream resolver is back up", "upstream", u.addr)
+			}
+		}
+		return
+	}
+	u.successes = 0
+	if u.failures++; u.healthy && u.failures >= upstreamFall {
+		u.healthy, u.changed = false, time.Now()
+		slog.Warn("Upstream resolver is down, failing over", "upstream", u.addr, "failures", u.failures, "err", err)
+	}
+}
+
+// start probes every upstream on the pool's interval until close. It is
+// safe on a nil pool.
+func (p *upstreamPool) start(s *dnsServer) {
+	if p == nil || p.probe <= 0 {
+		return
+	}
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(p.probe)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				var wg sync.WaitGroup
+				for _, u := range p.list {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						s.probeUpstream(u)
+					}()
+				}
+				wg.Wait()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *upstreamPool) close() {
+	if p != nil && p.stop != nil {
+		close(p.stop)
+		<-p.done
+	}
+}
+
+// probeUpstream asks u for the root NS records, which any working resolver
+// answers. Any response counts, even an error code: u is up.
+func (s *dnsServer) probeUpstream(u *upstream) {
+	msg := dnsMsg{
+		ID:       uint16(rand.Uint32()),
+		Flags:    0x0100, // RD
+		Question: dnsQuestion{Name: ".", Type: dnsTypeNS, Class: dnsClassIN},
+	}
+	req, err := msg.pack()
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	_, err = s.attempt(u, req, start.Add(s.limits.timeout))
+	u.report(err, time.Since(start))
+}
+
+// anyHealthy reports whether some upstream is healthy. It is safe on a
+// nil pool, which has none.
+func (p *upstreamPool) anyHealthy() bool {
+	if p == nil {
+		return false
+	}
+	for _, u := range p.list {
+		u.mu.Lock()
+		healthy := u.healthy
+		u.mu.Unlock()
+		if healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// status returns the health of every upstream, in order of preference. It
+// is safe on a nil pool.
+func (p *upstreamPool) status() []upstreamStatus {
+	if p == nil {
+		return nil
+	}
+	out := make([]upstreamStatus, 0, len(p.list))
+	for _, u := range p.list {
+		u.mu.Lock()
+		out = append(out, upstreamStatus{
+			Address:   u.addr,
+			Healthy:   u.healthy,
+			Failures:  u.failures,
+			Queries:   u.queries.Load(),
+			Errors:    u.errors.Load(),
+			Spoofed:   u.spoofed.Load(),
+			LastRTTms: float64(u.rtt.Microseconds()) / 1000,
+			Since:     u.changed,
+		})
+		u.mu.Unlock()
+	}
+	return out
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configProblem is something wrong with a config file, with the line it was
+// found on (0 if unknown). Warnings don't stop the server from starting.
+type configProblem struct {
+	line    int
+	warning bool
+	msg     string
+}
+
+func (p configProblem) format(path string) string {
+	kind := "error"
+	if p.warning {
+		kind = "warning"
+	}
+	if p.line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", path, p.line, kind, p.msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", path, kind, p.msg)
+}
+
+// checkConfig looks for mistakes that decoding alone doesn't catch: invalid
+// rules and targets, rules that are defined twice or can never make a
+// difference, and invalid alert and API settings. data is the raw file, used
+// to find line numbers.
+func checkConfig(data []byte, cfg *config) []configProblem {
+	var problems []configProblem
+	add := func(line int, warning bool, format string, args ...any) {
+		problems = append(problems, configProblem{line, warning, fmt.Sprintf(format, args...)})
+	}
+	lines := ruleLines(data, cfg.profile)
+	line := func(i int) int {
+		if i < len(lines) {
+			return lines[i]
+		}
+		return 0
+	}
+
+	type seenRule struct {
+		r    *rule
+		line int
+	}
+	exact := make(map[string]seenRule)
+	wildcard := make(map[string]seenRule)
+	others := make(map[string]seenRule) // regular expressions and the catch-all
+	regexes := 0
+	for i, r := range cfg.Rules {
+		r := *r // leave cfg untouched
+		r.Domain = normalizeRuleDomain(r.Domain)
+		if err := r.validate(); err != nil {
+			add(line(i), false, "%v", err)
+			continue
+		}
+		for _, addr := range append([]string{r.IP}, r.IPs...) {
+			ip := net.ParseIP(addr)
+			switch {
+			case ip == nil:
+			case ip.IsUnspecified(), ip.IsMulticast(), ip.Equal(net.IPv4bcast):
+				add(line(i), false, "rule %s: %s is not a usable answer address", r.Domain, addr)
+			case ip.IsLoopback():
+				add(line(i), true, "rule %s: loopback answer %s points clients at themselves", r.Domain, addr)
+			}
+		}
+
+		m, key := exact, r.Domain
+		switch r.kind() {
+		case ruleWildcard:
+			m, key = wildcard, strings.TrimPrefix(r.Domain, "*.")
+		case ruleRegex:
+			m = others
+			regexes++
+		case ruleCatchAll:
+			m = others
+		}
+		if prev, ok := m[key]; ok {
+			add(line(i), false, "rule %s is defined twice (first on line %d); only the last one would take effect", r.Domain, prev.line)
+		}
+		m[key] = seenRule{&r, line(i)}
+	}
+
+	// A rule is redundant when the closest wildcard above it gives the same
+	// answer with the same priority, since removing it wouldn't change any
+	// response. A regular expression could come between them.
+	parent := func(name string) (seenRule, bool) {
+		for {
+			i := strings.IndexByte(name, '.')
+			if i < 0 {
+				return seenRule{}, false
+			}
+			name = name[i+1:]
+			if w, ok := wildcard[name]; ok {
+				return w, true
+			}
+		}
+	}
+	check := func(s seenRule, name string) {
+		if regexes > 0 {
+			return
+		}
+		if w, ok := parent(name); ok && w.r.Priority == s.r.Priority && w.r.IP == s.r.IP && slices.Equal(w.r.IPs, s.r.IPs) && w.r.Action == s.r.Action && w.r.Canary == s.r.Canary && slices.Equal(w.r.MAC, s.r.MAC) {
+			add(s.line, true, "rule %s is redundant: %s (line %d) already gives the same answer", s.r.Domain, w.r.Domain, w.line)
+		}
+	}
+	for name, s := range exact {
+		check(s, name)
+	}
+	for suffix, s := range wildcard {
+		check(s, suffix)
+	}
+
+	if _, err := newServiceSet(cfg.Services); err != nil {
+		add(0, false, "services: %v", err)
+	}
+	if a, err := newAlerter(cfg.Alerts); err != nil {
+		add(0, false, "alerts: %v", err)
+	} else {
+		a.close()
+	}
+	if r, err := newReporter(cfg.Alerts.Reports, nil, nil); err != nil {
+		add(0, false, "alerts: reports: %v", err)
+	} else if r != nil {
+		r.Close()
+	}
+	if _, err := newFeeds(cfg.Feeds, nil); err != nil {
+		add(0, false, "feeds: %v", err)
+	}
+	if _, err := newFingerprinter(cfg.Fingerprints); err != nil {
+		add(0, false, "fingerprints: %v", err)
+	}
+	if _, err := newDetectors(cfg.Detection); err != nil {
+		add(0, false, "detection: %v", err)
+	}
+	if _, err := newAXFRServer(cfg.AXFR); err != nil {
+		add(0, false, "axfr: %v", err)
+	}
+	if _, err := newSteerer(cfg.Steering); err != nil {
+		add(0, false, "%v", err)
+	}
+	conns := cfg.Connections // validate fills in defaults
+	if err := conns.validate(); err != nil {
+		add(0, false, "%v", err)
+	}
+	repl := cfg.Replication // likewise
+	if err := repl.validate(); err != nil {
+		add(0, false, "%v", err)
+	}
+	if _, err := parseQTypePolicy(cfg.QTypes); err != nil {
+		add(0, false, "%v", err)
+	}
+	if _, err := newNoticeBoard(cfg.Notice, cfg.Detection); err != nil {
+		add(0, false, "%v", err)
+	}
+	if _, err := newTSIGKeyring(cfg.TSIG); err != nil {
+		add(0, false, "tsig: %v", err)
+	} else if err := checkTSIGUse(cfg); err != nil {
+		add(0, false, "%v", err)
+	}
+	if err := cfg.API.validate(); err != nil {
+		add(0, false, "%v", err)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+	return problems
+}
+
+// ruleLines returns the line number of each entry of the top-level "rules"
+// sequence in a YAML document, or of the profile's if it has its own.
+func ruleLines(data []byte, profile string) []int {
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	// Rules a profile sets replace the top-level ones
+	if p := mappingValue(mappingValue(root, "profiles"), profile); p != nil && mappingValue(p, "rules") != nil {
+		root = p
+	}
+	var lines []int
+	if rules := mappingValue(root, "rules"); rules != nil && rules.Kind == yaml.SequenceNode {
+		for _, item := range rules.Content {
+			lines = append(lines, item.Line)
+		}
+	}
+	return lines
+}
+
+// mappingValue returns the value of key in the mapping node m, or nil.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// hasErrors reports whether any problem is more than a warning.
+func hasErrors(problems []configProblem) bool {
+	for _, p := range problems {
+		if !p.warning {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCommand implements "validate", which checks a config file without
+// binding any ports, e.g.
+//
+//	DeceptiveDNS validate -config /etc/deceptivedns/config.yaml
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Config file to check")
+	profile := fs.String("profile", "", "Check only this profile (default: the top level and every profile)")
+	strict := fs.Bool("strict", false, "Treat warnings as errors")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: DeceptiveDNS validate [-strict] [-profile name] -config file.yaml")
+		return 2
+	}
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	problems := checkConfig(data, cfg)
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p.format(*configPath))
+	}
+	failed := hasErrors(problems) || (*strict && len(problems) > 0)
+
+	// Each profile is checked as serve -profile would see it, reporting
+	// only what the top level doesn't already have wrong
+	var profiles []string
+	if *profile == "" {
+		profiles = cfg.profileNames()
+	}
+	seen := make(map[string]bool)
+	for _, p := range problems {
+		seen[p.format(*configPath)] = true
+	}
+	for _, name := range profiles {
+		pcfg, err := loadConfig(*configPath, name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		for _, p := range checkConfig(data, pcfg) {
+			if seen[p.format(*configPath)] {
+				continue
+			}
+			p.msg = "profile " + name + ": " + p.msg
+			fmt.Fprintln(os.Stderr, p.format(*configPath))
+			failed = failed || !p.warning || *strict
+		}
+	}
+	if failed {
+		return 1
+	}
+	if *profile != "" {
+		fmt.Printf("%s: profile %s ok, %d rules\n", *configPath, *profile, len(cfg.Rules))
+		return 0
+	}
+	fmt.Printf("%s: ok, %d rules", *configPath, len(cfg.Rules))
+	if len(profiles) > 0 {
+		fmt.Printf(", %d profiles", len(profiles))
+	}
+	fmt.Println()
+	return 0
+}
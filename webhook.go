@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+type webhookConfig struct {
+	URL           string            `yaml:"url"`
+	Headers       map[string]string `yaml:"headers"`
+	notifyOptions `yaml:",inline"`
+}
+
+// webhookNotifier POSTs each alert as a JSON object.
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newWebhookNotifier(cfg webhookConfig) (*webhookNotifier, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q", cfg.URL)
+	}
+	return &webhookNotifier{url: cfg.URL, headers: cfg.Headers, client: &http.Client{}}, nil
+}
+
+func (w *webhookNotifier) String() string {
+	return "webhook " + w.url
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, a *alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, w.client, w.url, w.headers, body)
+}
+
+// SendReport POSTs r as a JSON object with kind "report", the rendered
+// content and the figures in it.
+func (w *webhookNotifier) SendReport(ctx context.Context, r *report) error {
+	body, err := json.Marshal(struct {
+		Kind string `json:"kind"`
+		*report
+	}{"report", r})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, w.client, w.url, w.headers, body)
+}
+
+// postJSON sends body and treats any non-2xx status as an error.
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "DeceptiveDNS")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var wpadRequests = expvar.NewInt("wpad_requests")
+
+// wpadRule answers WPAD lookups in -wpad mode. Browsers set to detect proxy
+// settings automatically look up wpad.<suffix> for each suffix of their DNS
+// search domain, and plain "wpad" over LLMNR and NetBIOS.
+var wpadRule = &rule{Domain: "wpad"}
+
+// isWPADName reports whether name is "wpad" or wpad.<suffix>.
+func isWPADName(name string) bool {
+	label, _, _ := strings.Cut(normalizeName(name), ".")
+	return label == "wpad"
+}
+
+// match returns the rule for name: a configured rule, or wpadRule for WPAD
+// names in -wpad mode.
+func (s *dnsServer) match(name string) *rule {
+	if r := s.rules.match(name); r != nil {
+		return r
+	}
+	if s.wpad && isWPADName(name) {
+		return wpadRule
+	}
+	return nil
+}
+
+// wpadPAC returns the PAC file to serve: the contents of path if given, or
+// one sending every request through proxy and going direct if it's down.
+func wpadPAC(path, proxy string) ([]byte, error) {
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	if _, _, err := net.SplitHostPort(proxy); err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %v", proxy, err)
+	}
+	return []byte(fmt.Sprintf("function FindProxyForURL(url, host) {\n\treturn \"PROXY %s; DIRECT\";\n}\n", proxy)), nil
+}
+
+// wpadServer serves the PAC file that WPAD lookups lead browsers to.
+type wpadServer struct {
+	srv *http.Server
+}
+
+// registerWPAD adds the PAC file handlers to mux.
+func registerWPAD(mux *http.ServeMux, pac []byte) {
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		wpadRequests.Add(1)
+		slog.Info("WPAD file requested", "client", r.RemoteAddr, "host", r.Host, "path", r.URL.Path, "user_agent", r.UserAgent())
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(pac)
+	}
+	// wpad.dat is what WPAD fetches; proxy.pac is the usual name when a
+	// PAC URL is set by hand
+	mux.HandleFunc("GET /wpad.dat", serve)
+	mux.HandleFunc("GET /proxy.pac", serve)
+}
+
+func startWPADServer(addr string, pac []byte) (*wpadServer, error) {
+	mux := http.NewServeMux()
+	registerWPAD(mux, pac)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("WPAD server listening", "url", "http://"+ln.Addr().String()+"/wpad.dat")
+
+	w := &wpadServer{srv: &http.Server{Handler: mux}}
+	go func() {
+		if err := w.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("WPAD server stopped", "err", err)
+		}
+	}()
+	return w, nil
+}
+
+// shutdown stops the server once open requests finish, or ctx expires.
+func (w *wpadServer) shutdown(ctx context.Context) error {
+	return w.srv.Shutdown(ctx)
+}